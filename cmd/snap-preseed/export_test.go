@@ -19,7 +19,12 @@
 
 package main
 
-import "github.com/snapcore/snapd/testutil"
+import (
+	"io"
+
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/testutil"
+)
 
 var (
 	Run = run
@@ -31,13 +36,13 @@ func MockOsGetuid(f func() int) (restore func()) {
 	return r
 }
 
-func MockPreseedCore20(f func(dir string) error) (restore func()) {
+func MockPreseedCore20(f func(dir string, opts *preseed.CoreOptions) error) (restore func()) {
 	r := testutil.Backup(&preseedCore20)
 	preseedCore20 = f
 	return r
 }
 
-func MockPreseedClassic(f func(dir string) error) (restore func()) {
+func MockPreseedClassic(f func(dir string, opts *preseed.ClassicOptions) error) (restore func()) {
 	r := testutil.Backup(&preseedClassic)
 	preseedClassic = f
 	return r
@@ -48,3 +53,39 @@ func MockResetPreseededChroot(f func(dir string) error) (restore func()) {
 	preseedResetPreseededChroot = f
 	return r
 }
+
+func MockResetPreseededChrootWithOptions(f func(dir string, opts *preseed.ResetOptions) error) (restore func()) {
+	r := testutil.Backup(&preseedResetWithOptions)
+	preseedResetWithOptions = f
+	return r
+}
+
+func MockResetIfPreseeded(f func(dir string) (bool, error)) (restore func()) {
+	r := testutil.Backup(&preseedResetIfPreseeded)
+	preseedResetIfPreseeded = f
+	return r
+}
+
+func MockDiskImage(f func(imagePath string, opts *preseed.DiskImageOptions) error) (restore func()) {
+	r := testutil.Backup(&preseedDiskImage)
+	preseedDiskImage = f
+	return r
+}
+
+func MockVerifyPreseedAssertion(f func(prepareImageDir, sysLabel string) error) (restore func()) {
+	r := testutil.Backup(&preseedVerifyAssertion)
+	preseedVerifyAssertion = f
+	return r
+}
+
+func MockStdout(w io.Writer) (restore func()) {
+	r := testutil.Backup(&Stdout)
+	Stdout = w
+	return r
+}
+
+func MockStderr(w io.Writer) (restore func()) {
+	r := testutil.Backup(&Stderr)
+	Stderr = w
+	return r
+}
@@ -24,6 +24,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/jessevdk/go-flags"
 
@@ -47,18 +48,32 @@ first-boot startup time`
 )
 
 type options struct {
-	Reset bool `long:"reset"`
+	Reset               bool     `long:"reset"`
+	ResetIfPreseeded    bool     `long:"reset-if-preseeded"`
+	SystemLabel         string   `long:"system-label"`
+	AppArmorFeaturesDir string   `long:"apparmor-features-dir"`
+	ProgressJSON        string   `long:"progress-json"`
+	Resume              bool     `long:"resume"`
+	DryRun              bool     `long:"dry-run"`
+	ResetOnly           []string `long:"reset-only"`
+	DiskImage           bool     `long:"disk-image"`
+	ImageFormat         string   `long:"image-format"`
+	NBDDevice           string   `long:"nbd-device"`
+	VerifyAssertion     bool     `long:"verify-assertion"`
 }
 
 var (
-	osGetuid = os.Getuid
-	// unused currently, left in place for consistency for when it is needed
-	// Stdout   io.Writer = os.Stdout
-	Stderr io.Writer = os.Stderr
+	osGetuid           = os.Getuid
+	Stdout   io.Writer = os.Stdout
+	Stderr   io.Writer = os.Stderr
 
 	preseedCore20               = preseed.Core20
 	preseedClassic              = preseed.Classic
 	preseedResetPreseededChroot = preseed.ResetPreseededChroot
+	preseedResetWithOptions     = preseed.ResetPreseededChrootWithOptions
+	preseedResetIfPreseeded     = preseed.ResetIfPreseeded
+	preseedDiskImage            = preseed.DiskImage
+	preseedVerifyAssertion      = preseed.VerifyPreseedAssertion
 
 	opts options
 )
@@ -117,8 +132,90 @@ func run(parser *flags.Parser, args []string) (err error) {
 		return preseedResetPreseededChroot(chrootDir)
 	}
 
-	if probeCore20ImageDir(chrootDir) {
-		return preseedCore20(chrootDir)
+	// the flag can be repeated or take a comma separated list of classes
+	if len(opts.ResetOnly) > 0 {
+		var classes []preseed.ArtifactClass
+		for _, value := range opts.ResetOnly {
+			for _, class := range strings.Split(value, ",") {
+				classes = append(classes, preseed.ArtifactClass(class))
+			}
+		}
+		return preseedResetWithOptions(chrootDir, &preseed.ResetOptions{Classes: classes})
 	}
-	return preseedClassic(chrootDir)
+
+	if opts.ResetIfPreseeded {
+		_, err := preseedResetIfPreseeded(chrootDir)
+		return err
+	}
+
+	// the image may hold a UC20+ system
+	core20 := !opts.DiskImage && probeCore20ImageDir(chrootDir)
+	if opts.VerifyAssertion {
+		if !core20 {
+			return fmt.Errorf("cannot use --verify-assertion with a classic system, only UC20+ images have a preseed assertion")
+		}
+		// the assertion is signed once preseeding is done, it is verified
+		// without preseeding again
+		return preseedVerifyAssertion(chrootDir, opts.SystemLabel)
+	}
+	if opts.DryRun {
+		if opts.DiskImage {
+			return fmt.Errorf("cannot use --dry-run with --disk-image")
+		}
+		if core20 {
+			return fmt.Errorf("cannot use --dry-run when preseeding UC20+ systems")
+		}
+	}
+	if opts.Resume && core20 {
+		return fmt.Errorf("cannot use --resume when preseeding UC20+ systems")
+	}
+
+	var events chan<- preseed.PreseedEvent
+	if opts.ProgressJSON != "" {
+		var finish func() error
+		var reportErr error
+		events, finish, reportErr = startProgressReport(opts.ProgressJSON)
+		if reportErr != nil {
+			return fmt.Errorf("cannot report progress: %v", reportErr)
+		}
+		defer func() {
+			if finishErr := finish(); finishErr != nil && err == nil {
+				err = fmt.Errorf("cannot report progress: %v", finishErr)
+			}
+		}()
+		if opts.ProgressJSON == "-" {
+			// keep the output of preseeding apart from the report
+			oldStdout := preseed.Stdout
+			preseed.Stdout = Stderr
+			defer func() { preseed.Stdout = oldStdout }()
+		}
+	}
+
+	coreOpts := &preseed.CoreOptions{
+		SysLabel:                  opts.SystemLabel,
+		AppArmorKernelFeaturesDir: opts.AppArmorFeaturesDir,
+		Events:                    events,
+	}
+	if core20 {
+		return preseedCore20(chrootDir, coreOpts)
+	}
+	var classicOpts *preseed.ClassicOptions
+	if opts.AppArmorFeaturesDir != "" || opts.ProgressJSON != "" || opts.Resume || opts.DryRun {
+		classicOpts = &preseed.ClassicOptions{
+			AppArmorFeaturesDir: opts.AppArmorFeaturesDir,
+			Resume:              opts.Resume,
+			DryRun:              opts.DryRun,
+			Events:              events,
+		}
+	}
+	if opts.DiskImage {
+		// the argument is the path of the disk image
+		return preseedDiskImage(chrootDir, &preseed.DiskImageOptions{
+			Format:         opts.ImageFormat,
+			NBDDevice:      opts.NBDDevice,
+			ClassicOptions: classicOpts,
+			CoreOptions:    coreOpts,
+		})
+	}
+	return preseedClassic(chrootDir, classicOpts)
 }
@@ -20,18 +20,22 @@
 package main_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	. "gopkg.in/check.v1"
 
 	"github.com/snapcore/snapd/cmd/snap-preseed"
 	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/osutil/squashfs"
 	"github.com/snapcore/snapd/snap"
@@ -119,7 +123,7 @@ func (s *startPreseedSuite) TestRunPreseedClassicHappy(c *C) {
 	defer restore()
 
 	var called bool
-	restorePreseed := main.MockPreseedClassic(func(dir string) error {
+	restorePreseed := main.MockPreseedClassic(func(dir string, opts *preseed.ClassicOptions) error {
 		c.Check(dir, Equals, "/a/dir")
 		called = true
 		return nil
@@ -131,6 +135,176 @@ func (s *startPreseedSuite) TestRunPreseedClassicHappy(c *C) {
 	c.Check(called, Equals, true)
 }
 
+func (s *startPreseedSuite) TestRunPreseedClassicAppArmorFeaturesDir(c *C) {
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	var called bool
+	restorePreseed := main.MockPreseedClassic(func(dir string, opts *preseed.ClassicOptions) error {
+		c.Check(opts, DeepEquals, &preseed.ClassicOptions{AppArmorFeaturesDir: "/features"})
+		called = true
+		return nil
+	})
+	defer restorePreseed()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--apparmor-features-dir", "/features", "/a/dir"}), IsNil)
+	c.Check(called, Equals, true)
+}
+
+func (s *startPreseedSuite) TestRunPreseedClassicProgressJSON(c *C) {
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	start := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	restorePreseed := main.MockPreseedClassic(func(dir string, opts *preseed.ClassicOptions) error {
+		c.Assert(opts, NotNil)
+		c.Assert(opts.Events, NotNil)
+		for _, ev := range []preseed.PreseedEvent{
+			{Stage: preseed.StageCheckChroot, Time: start, Detail: "/a/dir"},
+			{Stage: preseed.StageMountSnapd, Time: start.Add(time.Second)},
+			{Stage: preseed.StageRunSnapd, Time: start.Add(3 * time.Second)},
+			{Stage: preseed.StageWriteArtifacts, Time: start.Add(10 * time.Second)},
+			{Stage: preseed.StageCleanup, Time: start.Add(12 * time.Second)},
+			{Stage: preseed.StageDone, Time: start.Add(12500 * time.Millisecond)},
+		} {
+			opts.Events <- ev
+		}
+		return nil
+	})
+	defer restorePreseed()
+
+	report := filepath.Join(c.MkDir(), "progress.json")
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--progress-json", report, "/a/dir"}), IsNil)
+
+	data, err := ioutil.ReadFile(report)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(lines, HasLen, 7)
+	c.Check(lines[0], Equals, `{"stage":"check-chroot","time":"2022-01-02T03:04:05Z","detail":"/a/dir"}`)
+	c.Check(lines[5], Equals, `{"stage":"done","time":"2022-01-02T03:04:17.5Z"}`)
+
+	var timings struct {
+		Timings map[string]float64 `json:"timings"`
+		Total   float64            `json:"total"`
+	}
+	c.Assert(json.Unmarshal([]byte(lines[6]), &timings), IsNil)
+	c.Check(timings.Timings, DeepEquals, map[string]float64{
+		"check-chroot":    1,
+		"mount-snapd":     2,
+		"run-snapd":       7,
+		"write-artifacts": 2,
+		"cleanup":         0.5,
+	})
+	c.Check(timings.Total, Equals, 12.5)
+}
+
+func (s *startPreseedSuite) TestRunPreseedClassicProgressJSONStdout(c *C) {
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+	var stdout, stderr bytes.Buffer
+	defer main.MockStdout(&stdout)()
+	defer main.MockStderr(&stderr)()
+
+	restorePreseed := main.MockPreseedClassic(func(dir string, opts *preseed.ClassicOptions) error {
+		// the output of preseeding goes to stderr
+		fmt.Fprintf(preseed.Stdout, "starting to preseed root: %s\n", dir)
+		opts.Events <- preseed.PreseedEvent{Stage: preseed.StageCheckChroot, Time: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)}
+		opts.Events <- preseed.PreseedEvent{Stage: preseed.StageFailed, Time: time.Date(2022, 1, 2, 3, 4, 6, 0, time.UTC), Detail: "boom"}
+		return fmt.Errorf("boom")
+	})
+	defer restorePreseed()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--progress-json", "-", "/a/dir"}), ErrorMatches, "boom")
+	c.Check(stdout.String(), Equals, `{"stage":"check-chroot","time":"2022-01-02T03:04:05Z"}
+{"stage":"failed","time":"2022-01-02T03:04:06Z","detail":"boom"}
+{"timings":{"check-chroot":1},"total":1}
+`)
+	c.Check(stderr.String(), Equals, "starting to preseed root: /a/dir\n")
+}
+
+func (s *startPreseedSuite) TestRunPreseedClassicResume(c *C) {
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	var called bool
+	restorePreseed := main.MockPreseedClassic(func(dir string, opts *preseed.ClassicOptions) error {
+		c.Check(opts, DeepEquals, &preseed.ClassicOptions{Resume: true})
+		called = true
+		return nil
+	})
+	defer restorePreseed()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--resume", "/a/dir"}), IsNil)
+	c.Check(called, Equals, true)
+}
+
+func (s *startPreseedSuite) TestRunPreseedClassicDryRun(c *C) {
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	var called bool
+	restorePreseed := main.MockPreseedClassic(func(dir string, opts *preseed.ClassicOptions) error {
+		c.Check(opts, DeepEquals, &preseed.ClassicOptions{DryRun: true})
+		called = true
+		return nil
+	})
+	defer restorePreseed()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--dry-run", "/a/dir"}), IsNil)
+	c.Check(called, Equals, true)
+}
+
+func (s *startPreseedSuite) TestRunPreseedDiskImage(c *C) {
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	var called bool
+	restorePreseed := main.MockDiskImage(func(imagePath string, opts *preseed.DiskImageOptions) error {
+		c.Check(imagePath, Equals, "/a/disk.qcow2")
+		c.Check(opts, DeepEquals, &preseed.DiskImageOptions{
+			Format:         "qcow2",
+			NBDDevice:      "/dev/nbd2",
+			ClassicOptions: &preseed.ClassicOptions{Resume: true},
+			CoreOptions:    &preseed.CoreOptions{SysLabel: "20220203"},
+		})
+		called = true
+		return nil
+	})
+	defer restorePreseed()
+
+	parser := testParser(c)
+	args := []string{"--disk-image", "--image-format", "qcow2", "--nbd-device", "/dev/nbd2", "--resume", "--system-label", "20220203", "/a/disk.qcow2"}
+	c.Assert(main.Run(parser, args), IsNil)
+	c.Check(called, Equals, true)
+}
+
+func (s *startPreseedSuite) TestRunPreseedDiskImageDryRun(c *C) {
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--disk-image", "--dry-run", "/a/disk.img"}), ErrorMatches, "cannot use --dry-run with --disk-image")
+}
+
 func (s *startPreseedSuite) TestReset(c *C) {
 	restore := main.MockOsGetuid(func() int {
 		return 0
@@ -149,6 +323,47 @@ func (s *startPreseedSuite) TestReset(c *C) {
 	c.Check(called, Equals, true)
 }
 
+func (s *startPreseedSuite) TestResetOnly(c *C) {
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	var called bool
+	restoreReset := main.MockResetPreseededChrootWithOptions(func(dir string, opts *preseed.ResetOptions) error {
+		c.Check(dir, Equals, "/a/dir")
+		c.Check(opts, DeepEquals, &preseed.ResetOptions{
+			Classes: []preseed.ArtifactClass{preseed.ArtifactClassAppArmor, preseed.ArtifactClassSystemdUnits, preseed.ArtifactClassState},
+		})
+		called = true
+		return nil
+	})
+	defer restoreReset()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--reset-only", "apparmor,systemd-units", "--reset-only=state", "/a/dir"}), IsNil)
+	c.Check(called, Equals, true)
+}
+
+func (s *startPreseedSuite) TestResetIfPreseeded(c *C) {
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	var called bool
+	restoreReset := main.MockResetIfPreseeded(func(dir string) (bool, error) {
+		c.Check(dir, Equals, "/a/dir")
+		called = true
+		return false, nil
+	})
+	defer restoreReset()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--reset-if-preseeded", "/a/dir"}), IsNil)
+	c.Check(called, Equals, true)
+}
+
 func (s *startPreseedSuite) TestReadInfoValidity(c *C) {
 	var called bool
 	inf := &snap.Info{
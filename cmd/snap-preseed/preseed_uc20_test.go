@@ -20,13 +20,17 @@
 package main_test
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	. "gopkg.in/check.v1"
 
 	"github.com/snapcore/snapd/cmd/snap-preseed"
 	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
 )
 
 func (s *startPreseedSuite) TestRunPreseedUC20Happy(c *C) {
@@ -42,8 +46,9 @@ func (s *startPreseedSuite) TestRunPreseedUC20Happy(c *C) {
 	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
 
 	var called bool
-	restorePreseed := main.MockPreseedCore20(func(dir string) error {
+	restorePreseed := main.MockPreseedCore20(func(dir string, opts *preseed.CoreOptions) error {
 		c.Check(dir, Equals, tmpDir)
+		c.Check(opts, DeepEquals, &preseed.CoreOptions{})
 		called = true
 		return nil
 	})
@@ -53,3 +58,162 @@ func (s *startPreseedSuite) TestRunPreseedUC20Happy(c *C) {
 	c.Assert(main.Run(parser, []string{tmpDir}), IsNil)
 	c.Check(called, Equals, true)
 }
+
+func (s *startPreseedSuite) TestRunPreseedUC20AppArmorFeaturesDir(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	// for UC20 probing
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+
+	var called bool
+	restorePreseed := main.MockPreseedCore20(func(dir string, opts *preseed.CoreOptions) error {
+		c.Check(opts, DeepEquals, &preseed.CoreOptions{AppArmorKernelFeaturesDir: "/features"})
+		called = true
+		return nil
+	})
+	defer restorePreseed()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--apparmor-features-dir", "/features", tmpDir}), IsNil)
+	c.Check(called, Equals, true)
+}
+
+func (s *startPreseedSuite) TestRunPreseedUC20DryRunUnsupported(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	// for UC20 probing
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+
+	restorePreseed := main.MockPreseedCore20(func(dir string, opts *preseed.CoreOptions) error {
+		c.Fatalf("unexpected call")
+		return nil
+	})
+	defer restorePreseed()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--dry-run", tmpDir}), ErrorMatches, "cannot use --dry-run when preseeding UC20\\+ systems")
+}
+
+func (s *startPreseedSuite) TestRunPreseedUC20ResumeUnsupported(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	// for UC20 probing
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+
+	restorePreseed := main.MockPreseedCore20(func(dir string, opts *preseed.CoreOptions) error {
+		c.Fatalf("unexpected call")
+		return nil
+	})
+	defer restorePreseed()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--resume", tmpDir}), ErrorMatches, "cannot use --resume when preseeding UC20\\+ systems")
+}
+
+func (s *startPreseedSuite) TestRunPreseedUC20VerifyAssertion(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	// for UC20 probing
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+
+	restorePreseed := main.MockPreseedCore20(func(dir string, opts *preseed.CoreOptions) error {
+		c.Fatalf("unexpected call")
+		return nil
+	})
+	defer restorePreseed()
+
+	var verified []string
+	restoreVerify := main.MockVerifyPreseedAssertion(func(prepareImageDir, sysLabel string) error {
+		c.Check(prepareImageDir, Equals, tmpDir)
+		verified = append(verified, sysLabel)
+		return nil
+	})
+	defer restoreVerify()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--verify-assertion", tmpDir}), IsNil)
+	parser = testParser(c)
+	c.Assert(main.Run(parser, []string{"--verify-assertion", "--system-label", "20220203", tmpDir}), IsNil)
+	c.Check(verified, DeepEquals, []string{"", "20220203"})
+
+	// a mismatching assertion fails the build
+	restoreVerify = main.MockVerifyPreseedAssertion(func(prepareImageDir, sysLabel string) error {
+		return fmt.Errorf("preseed assertion of system 20220203 does not match")
+	})
+	defer restoreVerify()
+	parser = testParser(c)
+	c.Assert(main.Run(parser, []string{"--verify-assertion", tmpDir}), ErrorMatches, "preseed assertion of system 20220203 does not match")
+}
+
+func (s *startPreseedSuite) TestRunPreseedVerifyAssertionClassic(c *C) {
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	restoreVerify := main.MockVerifyPreseedAssertion(func(prepareImageDir, sysLabel string) error {
+		c.Fatalf("unexpected call")
+		return nil
+	})
+	defer restoreVerify()
+
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--verify-assertion", c.MkDir()}), ErrorMatches, "cannot use --verify-assertion with a classic system, only UC20\\+ images have a preseed assertion")
+}
+
+func (s *startPreseedSuite) TestRunPreseedUC20ProgressJSON(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+
+	restore := main.MockOsGetuid(func() int {
+		return 0
+	})
+	defer restore()
+
+	// for UC20 probing
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+
+	start := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	restorePreseed := main.MockPreseedCore20(func(dir string, opts *preseed.CoreOptions) error {
+		c.Assert(opts.Events, NotNil)
+		opts.Events <- preseed.PreseedEvent{Stage: preseed.StageCheckChroot, Time: start, Detail: dir}
+		opts.Events <- preseed.PreseedEvent{Stage: preseed.StageDone, Time: start.Add(2 * time.Second)}
+		return nil
+	})
+	defer restorePreseed()
+
+	report := filepath.Join(c.MkDir(), "progress.json")
+	parser := testParser(c)
+	c.Assert(main.Run(parser, []string{"--progress-json", report, tmpDir}), IsNil)
+
+	data, err := ioutil.ReadFile(report)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, fmt.Sprintf(`{"stage":"check-chroot","time":"2022-01-02T03:04:05Z","detail":%q}
+{"stage":"done","time":"2022-01-02T03:04:07Z"}
+{"timings":{"check-chroot":2},"total":2}
+`, tmpDir))
+}
@@ -0,0 +1,112 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/snapcore/snapd/image/preseed"
+)
+
+// progressEvent is a line of the progress report, written for every stage
+// preseeding enters.
+type progressEvent struct {
+	Stage  preseed.Stage `json:"stage"`
+	Time   time.Time     `json:"time"`
+	Detail string        `json:"detail,omitempty"`
+}
+
+// timingReport is the last line of the progress report, with the seconds
+// spent in each of the stages and in total.
+type timingReport struct {
+	Timings map[preseed.Stage]float64 `json:"timings"`
+	Total   float64                   `json:"total"`
+}
+
+// startProgressReport starts writing the progress of preseeding as JSON
+// lines to path, or to stdout if path is "-". The returned channel is meant
+// for ClassicOptions.Events. The returned function must be called once
+// preseeding returned, it writes the timing report.
+func startProgressReport(path string) (events chan<- preseed.PreseedEvent, finish func() error, err error) {
+	var w io.Writer = Stdout
+	closeOut := func() error { return nil }
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closeOut = f, f.Close
+	}
+
+	// events are dropped by preseeding if they cannot be sent right away,
+	// there are only a few of them
+	ch := make(chan preseed.PreseedEvent, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- writeProgress(w, ch)
+	}()
+
+	finish = func() error {
+		close(ch)
+		err := <-done
+		if closeErr := closeOut(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	return ch, finish, nil
+}
+
+// writeProgress writes a progress event for each of the events and, once
+// the channel is closed, the timing report.
+func writeProgress(w io.Writer, events <-chan preseed.PreseedEvent) error {
+	enc := json.NewEncoder(w)
+	report := timingReport{Timings: make(map[preseed.Stage]float64)}
+	var first, last preseed.PreseedEvent
+	var writeErr error
+	for ev := range events {
+		if writeErr != nil {
+			// keep draining the events
+			continue
+		}
+		writeErr = enc.Encode(progressEvent{
+			Stage:  ev.Stage,
+			Time:   ev.Time,
+			Detail: ev.Detail,
+		})
+		if first.Stage == "" {
+			first = ev
+		} else {
+			// the previous stage lasted until this one started
+			report.Timings[last.Stage] += ev.Time.Sub(last.Time).Seconds()
+		}
+		last = ev
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if first.Stage != "" {
+		report.Total = last.Time.Sub(first.Time).Seconds()
+	}
+	return enc.Encode(report)
+}
@@ -262,7 +262,7 @@ var helpCategories = []helpCategory{
 		Label:           i18n.G("Development"),
 		Description:     i18n.G("developer-oriented features"),
 		Commands:        []string{"download", "pack", "run", "try"},
-		AllOnlyCommands: []string{"prepare-image"},
+		AllOnlyCommands: []string{"prepare-image", "image-info"},
 	},
 }
 
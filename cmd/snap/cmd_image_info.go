@@ -0,0 +1,129 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/i18n"
+	"github.com/snapcore/snapd/image"
+)
+
+type cmdImageInfo struct {
+	JSON        bool   `long:"json"`
+	SystemLabel string `long:"system-label"`
+
+	Positional struct {
+		ImageDir flags.Filename `positional-arg-name:"<image-dir>"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func init() {
+	addCommand("image-info",
+		i18n.G("Inspect a built or preseeded image"),
+		i18n.G(`
+The image-info command reports the model and its assertion, the seeded snaps
+and whether the given image was preseeded, together with the version of snapd
+used for preseeding and the digest recorded by the preseed assertion, if any.
+
+The image is either the root filesystem of a classic image or the
+directory of a UC20+ image prepared with prepare-image.
+`),
+		func() flags.Commander { return &cmdImageInfo{} },
+		map[string]string{
+			// TRANSLATORS: This should not start with a lowercase letter.
+			"json": i18n.G("Output results in JSON format"),
+			// TRANSLATORS: This should not start with a lowercase letter.
+			"system-label": i18n.G("The recovery system of a UC20+ image to inspect"),
+		}, nil)
+}
+
+var imageReadInfo = image.ReadInfo
+
+func (x *cmdImageInfo) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+
+	info, err := imageReadInfo(string(x.Positional.ImageDir), x.SystemLabel)
+	if err != nil {
+		return err
+	}
+
+	var modelAssertion string
+	if info.ModelAssertion != nil {
+		modelAssertion = string(asserts.Encode(info.ModelAssertion))
+	}
+
+	if x.JSON {
+		obj, err := json.Marshal(struct {
+			*image.Info
+			ModelAssertion string `json:"model-assertion,omitempty"`
+		}{info, modelAssertion})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(Stdout, "%s\n", obj)
+		return nil
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	fmt.Fprintf(w, "model:\t%s/%s\n", info.Model.BrandID, info.Model.Model)
+	if info.Model.Grade != "" {
+		fmt.Fprintf(w, "grade:\t%s\n", info.Model.Grade)
+	}
+	if info.SystemLabel != "" {
+		fmt.Fprintf(w, "system-label:\t%s\n", info.SystemLabel)
+	}
+	fmt.Fprintf(w, "classic:\t%t\n", info.Classic)
+	fmt.Fprintf(w, "preseeded:\t%t\n", info.Preseeded)
+	if info.PreseedDigest != "" {
+		fmt.Fprintf(w, "preseed-digest:\t%s\n", info.PreseedDigest)
+	}
+	if info.SnapdVersion != "" {
+		fmt.Fprintf(w, "snapd-version:\t%s\n", info.SnapdVersion)
+	}
+	fmt.Fprintf(w, "snaps:\n")
+	for _, sn := range info.Snaps {
+		channel := sn.Channel
+		if channel == "" {
+			channel = "-"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", sn.Name, sn.Revision, channel)
+	}
+	if modelAssertion != "" {
+		fmt.Fprintf(w, "model-assertion: |\n")
+		for _, line := range strings.Split(strings.TrimRight(modelAssertion, "\n"), "\n") {
+			if line == "" {
+				fmt.Fprintln(w)
+				continue
+			}
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	return nil
+}
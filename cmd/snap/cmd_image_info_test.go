@@ -0,0 +1,124 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/asserts"
+	snap "github.com/snapcore/snapd/cmd/snap"
+	"github.com/snapcore/snapd/image"
+	snaplib "github.com/snapcore/snapd/snap"
+)
+
+type SnapImageInfoSuite struct {
+	BaseSnapSuite
+}
+
+var _ = Suite(&SnapImageInfoSuite{})
+
+const mockImageModelAssertion = `type: model
+authority-id: my-brand
+series: 16
+brand-id: my-brand
+model: my-model
+architecture: amd64
+gadget: pc
+kernel: pc-kernel
+timestamp: 2022-02-03T00:00:00.0Z
+sign-key-sha3-384: 9tydnLa6MTJ-jaQTFUXEwHl1yRx7ZS4K5cyFDhYDcPzhS7uyEkDxdUjg9g08BtNn
+
+AcLorsomethingthatlooksvaguelylikeasignature==`
+
+func mockImageModel() *asserts.Model {
+	a, err := asserts.Decode([]byte(mockImageModelAssertion))
+	if err != nil {
+		panic(err)
+	}
+	return a.(*asserts.Model)
+}
+
+var mockImageInfo = &image.Info{
+	SystemLabel: "20220203",
+	Model: image.ModelInfo{
+		BrandID: "my-brand",
+		Model:   "my-model",
+		Series:  "16",
+		Grade:   "signed",
+	},
+	ModelAssertion: mockImageModel(),
+	Snaps: []image.SeededSnapInfo{
+		{Name: "snapd", Revision: snaplib.R(1), Channel: "latest/stable"},
+		{Name: "pc-kernel", Revision: snaplib.R(22)},
+	},
+	Preseeded:     true,
+	PreseedDigest: "KPIl7M4vQ9d4AUjkoU41TGAwtOMLc_bWUCeW8AvdRWD4_xcP60Oo4ABs1No7BtXj",
+	SnapdVersion:  "2.56",
+}
+
+func (s *SnapImageInfoSuite) TestImageInfo(c *C) {
+	restore := snap.MockImageReadInfo(func(path, label string) (*image.Info, error) {
+		c.Check(path, Equals, "image-dir")
+		c.Check(label, Equals, "20220203")
+		return mockImageInfo, nil
+	})
+	defer restore()
+
+	rest, err := snap.Parser(snap.Client()).ParseArgs([]string{"image-info", "--system-label", "20220203", "image-dir"})
+	c.Assert(err, IsNil)
+	c.Assert(rest, DeepEquals, []string{})
+	c.Check(s.Stdout(), Equals, `model:           my-brand/my-model
+grade:           signed
+system-label:    20220203
+classic:         false
+preseeded:       true
+preseed-digest:  KPIl7M4vQ9d4AUjkoU41TGAwtOMLc_bWUCeW8AvdRWD4_xcP60Oo4ABs1No7BtXj
+snapd-version:   2.56
+snaps:
+  snapd      1    latest/stable
+  pc-kernel  22   -
+model-assertion: |
+  type: model
+  authority-id: my-brand
+  series: 16
+  brand-id: my-brand
+  model: my-model
+  architecture: amd64
+  gadget: pc
+  kernel: pc-kernel
+  timestamp: 2022-02-03T00:00:00.0Z
+  sign-key-sha3-384: 9tydnLa6MTJ-jaQTFUXEwHl1yRx7ZS4K5cyFDhYDcPzhS7uyEkDxdUjg9g08BtNn
+
+  AcLorsomethingthatlooksvaguelylikeasignature==
+`)
+	c.Check(s.Stderr(), Equals, "")
+}
+
+func (s *SnapImageInfoSuite) TestImageInfoJSON(c *C) {
+	restore := snap.MockImageReadInfo(func(path, label string) (*image.Info, error) {
+		c.Check(label, Equals, "")
+		return mockImageInfo, nil
+	})
+	defer restore()
+
+	_, err := snap.Parser(snap.Client()).ParseArgs([]string{"image-info", "--json", "image-dir"})
+	c.Assert(err, IsNil)
+	c.Check(s.Stdout(), Equals, `{"classic":false,"system-label":"20220203","model":{"brand-id":"my-brand","model":"my-model","series":"16","grade":"signed"},"snaps":[{"name":"snapd","revision":"1","channel":"latest/stable"},{"name":"pc-kernel","revision":"22"}],"preseeded":true,"preseed-digest":"KPIl7M4vQ9d4AUjkoU41TGAwtOMLc_bWUCeW8AvdRWD4_xcP60Oo4ABs1No7BtXj","snapd-version":"2.56","model-assertion":"type: model\nauthority-id: my-brand\nseries: 16\nbrand-id: my-brand\nmodel: my-model\narchitecture: amd64\ngadget: pc\nkernel: pc-kernel\ntimestamp: 2022-02-03T00:00:00.0Z\nsign-key-sha3-384: 9tydnLa6MTJ-jaQTFUXEwHl1yRx7ZS4K5cyFDhYDcPzhS7uyEkDxdUjg9g08BtNn\n\nAcLorsomethingthatlooksvaguelylikeasignature=="}`+"\n")
+}
@@ -311,6 +311,14 @@ func MockTermSize(newTermSize func() (int, int)) (restore func()) {
 	}
 }
 
+func MockImageReadInfo(f func(path, label string) (*image.Info, error)) (restore func()) {
+	old := imageReadInfo
+	imageReadInfo = f
+	return func() {
+		imageReadInfo = old
+	}
+}
+
 func MockImagePrepare(newImagePrepare func(*image.Options) error) (restore func()) {
 	old := imagePrepare
 	imagePrepare = newImagePrepare
@@ -22,11 +22,19 @@ package image
 import (
 	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/image/preseed"
 	"github.com/snapcore/snapd/overlord/auth"
+	"github.com/snapcore/snapd/seed"
 	"github.com/snapcore/snapd/store"
 	"github.com/snapcore/snapd/testutil"
 )
 
+func MockSeedOpen(f func(seedDir, label string) (seed.Seed, error)) (restore func()) {
+	r := testutil.Backup(&seedOpen)
+	seedOpen = f
+	return r
+}
+
 func MockToolingStore(sto Store) *ToolingStore {
 	return &ToolingStore{sto: sto}
 }
@@ -73,7 +81,7 @@ func MockNewToolingStoreFromModel(f func(model *asserts.Model, fallbackArchitect
 	}
 }
 
-func MockPreseedCore20(f func(dir string) error) (restore func()) {
+func MockPreseedCore20(f func(dir string, opts *preseed.CoreOptions) error) (restore func()) {
 	r := testutil.Backup(&preseedCore20)
 	preseedCore20 = f
 	return r
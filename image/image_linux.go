@@ -160,7 +160,7 @@ func Prepare(opts *Options) error {
 			return fmt.Errorf("cannot preseed the image for a model other than core20")
 		}
 		// TODO: support signing key
-		return preseedCore20(opts.PrepareDir)
+		return preseedCore20(opts.PrepareDir, nil)
 	}
 
 	return nil
@@ -43,6 +43,7 @@ import (
 	"github.com/snapcore/snapd/bootloader/ubootenv"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/image/preseed"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/overlord/auth"
 	"github.com/snapcore/snapd/progress"
@@ -3309,9 +3310,10 @@ func (s *imageSuite) TestPrepareWithUC20Preseed(c *C) {
 	defer restoreSetupSeed()
 
 	var preseedCalled bool
-	restorePreseedCore20 := image.MockPreseedCore20(func(dir string) error {
+	restorePreseedCore20 := image.MockPreseedCore20(func(dir string, opts *preseed.CoreOptions) error {
 		preseedCalled = true
 		c.Assert(dir, Equals, "/a/dir")
+		c.Assert(opts, IsNil)
 		return nil
 	})
 	defer restorePreseedCore20()
@@ -0,0 +1,214 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/timings"
+)
+
+var seedOpen = seed.Open
+
+// ModelInfo identifies the model of an image.
+type ModelInfo struct {
+	BrandID string `json:"brand-id"`
+	Model   string `json:"model"`
+	Series  string `json:"series"`
+	Grade   string `json:"grade,omitempty"`
+}
+
+// SeededSnapInfo describes a snap of the seed of an image.
+type SeededSnapInfo struct {
+	Name     string        `json:"name"`
+	Revision snap.Revision `json:"revision"`
+	Channel  string        `json:"channel,omitempty"`
+}
+
+// Info describes a built, and possibly preseeded, image.
+type Info struct {
+	// Classic is set for classic images, whose seed is in the root
+	// filesystem.
+	Classic bool `json:"classic"`
+	// SystemLabel is the label of the recovery system of UC20+ images.
+	SystemLabel string `json:"system-label,omitempty"`
+
+	Model ModelInfo `json:"model"`
+	// ModelAssertion is the model assertion of the seed.
+	ModelAssertion *asserts.Model `json:"-"`
+
+	Snaps []SeededSnapInfo `json:"snaps"`
+
+	Preseeded bool `json:"preseeded"`
+	// PreseedDigest is the SHA3-384 digest of the preseed artifact as
+	// recorded by the preseed assertion, if the image has one.
+	PreseedDigest string `json:"preseed-digest,omitempty"`
+	// SnapdVersion is the version of snapd used for preseeding, or
+	// which would be used, if known.
+	SnapdVersion string `json:"snapd-version,omitempty"`
+}
+
+// ReadInfo inspects the image at path, either a classic root filesystem or
+// a UC20+ image prepared by Prepare, which has a system-seed directory. For
+// UC20+ images the recovery system is identified by label, which may be
+// empty if there is only one. Nothing is mounted and snapd is not run.
+func ReadInfo(path, label string) (*Info, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{}
+	seedDir := filepath.Join(path, "system-seed")
+	if osutil.IsDirectory(filepath.Join(seedDir, "systems")) {
+		if label == "" {
+			label, err = singleSystemLabel(seedDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		info.SystemLabel = label
+	} else {
+		if label != "" {
+			return nil, fmt.Errorf("cannot use system label %q with classic image %s", label, path)
+		}
+		info.Classic = true
+		seedDir = dirs.SnapSeedDirUnder(path)
+	}
+
+	sd, err := seedOpen(seedDir, label)
+	if err != nil {
+		return nil, err
+	}
+	if err := sd.LoadAssertions(nil, nil); err != nil {
+		return nil, fmt.Errorf("cannot load assertions of the seed of %s: %v", path, err)
+	}
+	model := sd.Model()
+	info.ModelAssertion = model
+	info.Model = ModelInfo{
+		BrandID: model.BrandID(),
+		Model:   model.Model(),
+		Series:  model.Series(),
+	}
+	if model.Grade() != asserts.ModelGradeUnset {
+		info.Model.Grade = string(model.Grade())
+	}
+
+	if err := sd.LoadMeta(timings.New(nil)); err != nil {
+		return nil, fmt.Errorf("cannot load metadata of the seed of %s: %v", path, err)
+	}
+	var snapdSnap *seed.Snap
+	err = sd.Iter(func(sn *seed.Snap) error {
+		info.Snaps = append(info.Snaps, SeededSnapInfo{
+			Name:     sn.SnapName(),
+			Revision: sn.SideInfo.Revision,
+			Channel:  sn.Channel,
+		})
+		switch {
+		case sn.EssentialType == snap.TypeSnapd:
+			snapdSnap = sn
+		case sn.EssentialType == snap.TypeOS && snapdSnap == nil:
+			snapdSnap = sn
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Classic {
+		info.Preseeded = preseed.IsPreseeded(path)
+		if snapdSnap != nil {
+			// the version of the deb may be newer
+			if _, version, err := preseed.ResolveSnapd(path, snapdSnap.Path); err == nil {
+				info.SnapdVersion = version
+			}
+		}
+		return info, nil
+	}
+
+	systemDir := filepath.Join(seedDir, "systems", label)
+	info.Preseeded = osutil.FileExists(filepath.Join(systemDir, "preseed.tgz"))
+	if snapdSnap != nil {
+		if version, err := preseed.SnapdVersionFromSnap(snapdSnap.Path); err == nil {
+			info.SnapdVersion = version
+		}
+	}
+	digest, err := preseedAssertionDigest(filepath.Join(systemDir, "preseed"))
+	if err != nil {
+		return nil, err
+	}
+	info.PreseedDigest = digest
+	return info, nil
+}
+
+// singleSystemLabel returns the label of the only recovery system of the
+// seed at seedDir.
+func singleSystemLabel(seedDir string) (string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(seedDir, "systems"))
+	if err != nil {
+		return "", err
+	}
+	var labels []string
+	for _, ent := range entries {
+		if ent.IsDir() {
+			labels = append(labels, ent.Name())
+		}
+	}
+	switch len(labels) {
+	case 0:
+		return "", fmt.Errorf("cannot find a recovery system in %s", seedDir)
+	case 1:
+		return labels[0], nil
+	default:
+		return "", fmt.Errorf("cannot choose between %d recovery systems in %s, a system label is required", len(labels), seedDir)
+	}
+}
+
+// preseedAssertionDigest returns the digest of the preseed artifact as
+// recorded by the preseed assertion in the given file, or an empty string
+// if there is no such file.
+func preseedAssertionDigest(assertionFile string) (string, error) {
+	data, err := ioutil.ReadFile(assertionFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	a, err := asserts.Decode(data)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode preseed assertion %s: %v", assertionFile, err)
+	}
+	preseedAs, ok := a.(*asserts.Preseed)
+	if !ok {
+		return "", fmt.Errorf("cannot use %s as preseed assertion: unexpected assertion type %q", assertionFile, a.Type().Name)
+	}
+	return preseedAs.ArtifactSHA3_384(), nil
+}
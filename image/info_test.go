@@ -0,0 +1,219 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/timings"
+)
+
+type fakeSeed struct {
+	seed.Seed
+
+	model *asserts.Model
+	snaps []*seed.Snap
+}
+
+func (sd *fakeSeed) LoadAssertions(db asserts.RODatabase, commitTo func(*asserts.Batch) error) error {
+	return nil
+}
+
+func (sd *fakeSeed) Model() *asserts.Model {
+	return sd.model
+}
+
+func (sd *fakeSeed) LoadMeta(tm timings.Measurer) error {
+	return nil
+}
+
+func (sd *fakeSeed) Iter(f func(sn *seed.Snap) error) error {
+	for _, sn := range sd.snaps {
+		if err := f(sn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mockSnapdSnapDir(c *C, name, version string) string {
+	snapDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(snapDir, "meta"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(snapDir, "meta/snap.yaml"), []byte("name: "+name+"\nversion: 1\n"), 0644), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(snapDir, "usr/lib/snapd"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(snapDir, "usr/lib/snapd/info"), []byte("VERSION="+version), 0644), IsNil)
+	return snapDir
+}
+
+func seedSnap(name string, rev int, channel string, typ snap.Type, path string) *seed.Snap {
+	return &seed.Snap{
+		Path:          path,
+		SideInfo:      &snap.SideInfo{RealName: name, Revision: snap.R(rev)},
+		EssentialType: typ,
+		Essential:     typ != "",
+		Channel:       channel,
+	}
+}
+
+func (s *imageSuite) TestReadInfoClassic(c *C) {
+	rootDir := c.MkDir()
+	// snapd from the deb is older than the one of the core snap
+	c.Assert(os.MkdirAll(filepath.Join(rootDir, dirs.CoreLibExecDir), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(rootDir, dirs.CoreLibExecDir, "info"), []byte("VERSION=2.41"), 0644), IsNil)
+	// preseeded
+	c.Assert(os.MkdirAll(dirs.SnapdStateDir(rootDir), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(rootDir, dirs.SnapStateFile), []byte("{}"), 0644), IsNil)
+
+	coreSnap := mockSnapdSnapDir(c, "core", "2.55.3")
+	restore := image.MockSeedOpen(func(seedDir, label string) (seed.Seed, error) {
+		c.Check(seedDir, Equals, filepath.Join(rootDir, "var/lib/snapd/seed"))
+		c.Check(label, Equals, "")
+		return &fakeSeed{
+			model: s.model,
+			snaps: []*seed.Snap{
+				seedSnap("core", 12, "stable", snap.TypeOS, coreSnap),
+				seedSnap("foo", 3, "latest/edge", "", "/seed/snaps/foo_3.snap"),
+			},
+		}, nil
+	})
+	defer restore()
+
+	info, err := image.ReadInfo(rootDir, "")
+	c.Assert(err, IsNil)
+	c.Check(info, DeepEquals, &image.Info{
+		Classic: true,
+		Model: image.ModelInfo{
+			BrandID: "my-brand",
+			Model:   "my-model",
+			Series:  "16",
+		},
+		ModelAssertion: s.model,
+		Snaps: []image.SeededSnapInfo{
+			{Name: "core", Revision: snap.R(12), Channel: "stable"},
+			{Name: "foo", Revision: snap.R(3), Channel: "latest/edge"},
+		},
+		Preseeded:    true,
+		SnapdVersion: "2.55.3",
+	})
+}
+
+func (s *imageSuite) TestReadInfoUC20(c *C) {
+	model := s.Brands.Model("my-brand", "my-model", map[string]interface{}{
+		"display-name": "my model",
+		"architecture": "amd64",
+		"base":         "core20",
+		"grade":        "signed",
+		"snaps": []interface{}{
+			map[string]interface{}{
+				"name":            "pc-kernel",
+				"id":              s.AssertedSnapID("pc-kernel"),
+				"type":            "kernel",
+				"default-channel": "20",
+			},
+			map[string]interface{}{
+				"name":            "pc",
+				"id":              s.AssertedSnapID("pc"),
+				"type":            "gadget",
+				"default-channel": "20",
+			},
+		},
+	})
+
+	prepareDir := c.MkDir()
+	systemDir := filepath.Join(prepareDir, "system-seed/systems/20220203")
+	c.Assert(os.MkdirAll(systemDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(systemDir, "preseed.tgz"), nil, 0644), IsNil)
+
+	digest := "KPIl7M4vQ9d4AUjkoU41TGAwtOMLc_bWUCeW8AvdRWD4_xcP60Oo4ABs1No7BtXj"
+	preseedAs, err := s.Brands.Signing("my-brand").Sign(asserts.PreseedType, map[string]interface{}{
+		"type":              "preseed",
+		"authority-id":      "my-brand",
+		"series":            "16",
+		"brand-id":          "my-brand",
+		"model":             "my-model",
+		"system-label":      "20220203",
+		"artifact-sha3-384": digest,
+		"timestamp":         time.Now().UTC().Format(time.RFC3339),
+		"snaps": []interface{}{
+			map[string]interface{}{
+				"name":     "snapd",
+				"id":       s.AssertedSnapID("snapd"),
+				"revision": "1",
+			},
+		},
+	}, nil, "")
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(systemDir, "preseed"), asserts.Encode(preseedAs), 0644), IsNil)
+
+	snapdSnap := mockSnapdSnapDir(c, "snapd", "2.56")
+	restore := image.MockSeedOpen(func(seedDir, label string) (seed.Seed, error) {
+		c.Check(seedDir, Equals, filepath.Join(prepareDir, "system-seed"))
+		c.Check(label, Equals, "20220203")
+		return &fakeSeed{
+			model: model,
+			snaps: []*seed.Snap{
+				seedSnap("snapd", 1, "latest/stable", snap.TypeSnapd, snapdSnap),
+				seedSnap("pc-kernel", 2, "20", snap.TypeKernel, "/seed/snaps/pc-kernel_2.snap"),
+			},
+		}, nil
+	})
+	defer restore()
+
+	// the only system is picked
+	info, err := image.ReadInfo(prepareDir, "")
+	c.Assert(err, IsNil)
+	c.Check(info, DeepEquals, &image.Info{
+		SystemLabel: "20220203",
+		Model: image.ModelInfo{
+			BrandID: "my-brand",
+			Model:   "my-model",
+			Series:  "16",
+			Grade:   "signed",
+		},
+		ModelAssertion: model,
+		Snaps: []image.SeededSnapInfo{
+			{Name: "snapd", Revision: snap.R(1), Channel: "latest/stable"},
+			{Name: "pc-kernel", Revision: snap.R(2), Channel: "20"},
+		},
+		Preseeded:     true,
+		PreseedDigest: digest,
+		SnapdVersion:  "2.56",
+	})
+}
+
+func (s *imageSuite) TestReadInfoUC20MultipleSystems(c *C) {
+	prepareDir := c.MkDir()
+	for _, label := range []string{"20220203", "20220204"} {
+		c.Assert(os.MkdirAll(filepath.Join(prepareDir, "system-seed/systems", label), 0755), IsNil)
+	}
+
+	_, err := image.ReadInfo(prepareDir, "")
+	c.Check(err, ErrorMatches, "cannot choose between 2 recovery systems in .*/system-seed, a system label is required")
+}
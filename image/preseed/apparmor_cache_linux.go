@@ -0,0 +1,104 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/snapcore/snapd/osutil"
+	apparmor_sandbox "github.com/snapcore/snapd/sandbox/apparmor"
+)
+
+// appArmorCacheFiles are the host files to import the apparmor cache from
+// and export it to. They are opened before changing the root directory to
+// the chroot, the cache itself is handled from inside the chroot.
+type appArmorCacheFiles struct {
+	importFrom *os.File
+	exportTo   *os.File
+}
+
+func openAppArmorCacheFiles(opts *ClassicOptions) (files *appArmorCacheFiles, cleanup func(), err error) {
+	files = &appArmorCacheFiles{}
+	cleanup = func() {
+		if files.importFrom != nil {
+			files.importFrom.Close()
+		}
+		if files.exportTo != nil {
+			files.exportTo.Close()
+		}
+	}
+	if opts.ImportAppArmorCache != "" {
+		f, err := os.Open(opts.ImportAppArmorCache)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("cannot import apparmor cache: %v", err)
+		}
+		files.importFrom = f
+	}
+	if opts.ExportAppArmorCache != "" {
+		f, err := os.Create(opts.ExportAppArmorCache)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("cannot export apparmor cache: %v", err)
+		}
+		files.exportTo = f
+	}
+	return files, cleanup, nil
+}
+
+// importAppArmorCache populates the apparmor cache directory with the
+// contents of the imported tarball, so that snapd does not need to compile
+// the profiles again. It assumes running in the chroot.
+func (files *appArmorCacheFiles) importAppArmorCache() error {
+	if files == nil || files.importFrom == nil {
+		return nil
+	}
+	if err := os.MkdirAll(apparmor_sandbox.CacheDir, 0755); err != nil {
+		return fmt.Errorf("cannot import apparmor cache: %v", err)
+	}
+	cmd := exec.Command("tar", "-xzp", "-C", apparmor_sandbox.CacheDir)
+	cmd.Stdin = files.importFrom
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot import apparmor cache: %v", osutil.OutputErr(out, err))
+	}
+	return nil
+}
+
+// exportAppArmorCache writes the apparmor cache directory, as left by snapd,
+// as a tarball. It assumes running in the chroot.
+func (files *appArmorCacheFiles) exportAppArmorCache() error {
+	if files == nil || files.exportTo == nil {
+		return nil
+	}
+	if err := os.MkdirAll(apparmor_sandbox.CacheDir, 0755); err != nil {
+		return fmt.Errorf("cannot export apparmor cache: %v", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("tar", "-czp", "-C", apparmor_sandbox.CacheDir, ".")
+	cmd.Stdout = files.exportTo
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cannot export apparmor cache: %v", osutil.OutputErr(stderr.Bytes(), err))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	apparmor_sandbox "github.com/snapcore/snapd/sandbox/apparmor"
+	"github.com/snapcore/snapd/strutil"
+)
+
+// targetAppArmorFeaturesFile is where the apparmor features of the kernel
+// the system is meant for are recorded, for pinning the policy of
+// apparmor_parser.
+const targetAppArmorFeaturesFile = "/usr/share/apparmor-features/features"
+
+// parseAppArmorFeatures returns the sorted top-level apparmor features, like
+// []string{"caps", "network"}, from the content of an apparmor features
+// file, in which every feature is a block like "network {...}".
+func parseAppArmorFeatures(content string) ([]string, error) {
+	var features []string
+	var word strings.Builder
+	depth := 0
+	for _, r := range content {
+		switch {
+		case r == '{':
+			if depth == 0 {
+				name := strings.TrimSpace(word.String())
+				if name == "" || strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+					return nil, fmt.Errorf("cannot parse apparmor features: invalid feature name %q", name)
+				}
+				features = append(features, name)
+				word.Reset()
+			}
+			depth++
+		case r == '}':
+			if depth == 0 {
+				return nil, fmt.Errorf("cannot parse apparmor features: unbalanced braces")
+			}
+			depth--
+		case depth == 0:
+			word.WriteRune(r)
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("cannot parse apparmor features: unbalanced braces")
+	}
+	sort.Strings(features)
+	return features, nil
+}
+
+// checkAppArmorFeatures compares the apparmor features of the host kernel
+// with those recorded in the system under preseedChroot, if any, and warns
+// when they differ, as the profiles compiled during preseeding may then be
+// invalid on the target kernel.
+func checkAppArmorFeatures(preseedChroot string) error {
+	path := filepath.Join(preseedChroot, targetAppArmorFeaturesFile)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	targetFeatures, err := parseAppArmorFeatures(string(content))
+	if err != nil {
+		return fmt.Errorf("%v in %s", err, path)
+	}
+	hostFeatures, err := apparmor_sandbox.KernelFeatures()
+	if err != nil {
+		return fmt.Errorf("cannot probe apparmor features of the host kernel: %v", err)
+	}
+
+	var onlyHost, onlyTarget []string
+	for _, f := range hostFeatures {
+		if !strutil.ListContains(targetFeatures, f) {
+			onlyHost = append(onlyHost, f)
+		}
+	}
+	for _, f := range targetFeatures {
+		if !strutil.ListContains(hostFeatures, f) {
+			onlyTarget = append(onlyTarget, f)
+		}
+	}
+	if len(onlyHost) == 0 && len(onlyTarget) == 0 {
+		return nil
+	}
+	fmt.Fprintf(Stderr, "WARNING: apparmor features of the host kernel differ from those recorded in %s, profiles compiled during preseeding may be invalid on the target kernel\n", path)
+	if len(onlyHost) > 0 {
+		fmt.Fprintf(Stderr, "  only on the host: %s\n", strings.Join(onlyHost, ", "))
+	}
+	if len(onlyTarget) > 0 {
+		fmt.Fprintf(Stderr, "  only on the target: %s\n", strings.Join(onlyTarget, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/image/preseed"
+)
+
+func (s *preseedSuite) TestParseAppArmorFeatures(c *C) {
+	features, err := preseed.ParseAppArmorFeatures(`caps {mask {chown dac_override
+}
+}
+network {af_unix {yes
+}
+af_mask {unix inet
+}
+}
+domain {version {1.2
+}
+}
+`)
+	c.Assert(err, IsNil)
+	c.Check(features, DeepEquals, []string{"caps", "domain", "network"})
+
+	features, err = preseed.ParseAppArmorFeatures("")
+	c.Assert(err, IsNil)
+	c.Check(features, HasLen, 0)
+
+	for _, t := range []struct {
+		content, err string
+	}{
+		{"caps {mask {chown}", `cannot parse apparmor features: unbalanced braces`},
+		{"caps {}\n}", `cannot parse apparmor features: unbalanced braces`},
+		{"{mask {chown}}", `cannot parse apparmor features: invalid feature name ""`},
+		{"foo bar {yes}", `cannot parse apparmor features: invalid feature name "foo bar"`},
+	} {
+		_, err := preseed.ParseAppArmorFeatures(t.content)
+		c.Check(err, ErrorMatches, t.err, Commentf("%q", t.content))
+	}
+}
@@ -0,0 +1,101 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/snapcore/snapd/dirs"
+)
+
+// Backend carries out the operations of preseeding that require root
+// privileges: changing the root directory, mounting and running snapd.
+type Backend interface {
+	// Chroot changes the root directory of the process to dir.
+	Chroot(dir string) error
+	// Mount runs mount with the given arguments and returns its combined
+	// output.
+	Mount(args []string) ([]byte, error)
+	// Unmount unmounts the given mountpoint and returns the combined
+	// output of umount.
+	Unmount(mountpoint string) ([]byte, error)
+	// RunSnapd runs the prepared snapd command in preseed mode.
+	RunSnapd(cmd *exec.Cmd) error
+}
+
+// FakeBackend is a Backend that does not chroot, mount or execute
+// anything, but records the requested operations instead. It allows
+// testing code which integrates with preseeding without root privileges,
+// in the same way as the package tests do: paths inside the target are
+// resolved against dirs.GlobalRootDir, which should point at the fake
+// target system.
+type FakeBackend struct {
+	mu sync.Mutex
+
+	Chroots  []string
+	Mounts   [][]string
+	Unmounts []string
+	Snapd    [][]string
+
+	// RunSnapdFunc, if set, is called when snapd is to be run. By
+	// default a minimal snapd state is written, simulating a successful
+	// run of snapd.
+	RunSnapdFunc func(cmd *exec.Cmd) error
+}
+
+func (b *FakeBackend) Chroot(dir string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Chroots = append(b.Chroots, dir)
+	return nil
+}
+
+func (b *FakeBackend) Mount(args []string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Mounts = append(b.Mounts, append([]string(nil), args...))
+	return nil, nil
+}
+
+func (b *FakeBackend) Unmount(mountpoint string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Unmounts = append(b.Unmounts, mountpoint)
+	return nil, nil
+}
+
+func (b *FakeBackend) RunSnapd(cmd *exec.Cmd) error {
+	b.mu.Lock()
+	b.Snapd = append(b.Snapd, append([]string(nil), cmd.Args...))
+	runSnapd := b.RunSnapdFunc
+	b.mu.Unlock()
+
+	if runSnapd != nil {
+		return runSnapd(cmd)
+	}
+	if err := os.MkdirAll(filepath.Dir(dirs.SnapStateFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dirs.SnapStateFile, []byte("{}"), 0644)
+}
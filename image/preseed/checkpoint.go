@@ -0,0 +1,190 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/strutil"
+)
+
+// checkpointStep is a step of preseeding that may be skipped when resuming
+// an interrupted run. Only steps whose results persist in the chroot and
+// can be trusted to be complete once recorded are checkpointed, mounts
+// are always redone.
+type checkpointStep string
+
+const (
+	stepRewriteSeed         checkpointStep = "rewrite-seed"
+	stepImportAppArmorCache checkpointStep = "import-apparmor-cache"
+	stepRunSnapd            checkpointStep = "run-snapd"
+)
+
+// checkpointFile returns the path of the file recording the completed
+// preseeding steps, relative to the root of the preseeded system.
+func checkpointFile() string {
+	return filepath.Join(dirs.SnapdStateDir(dirs.GlobalRootDir), "preseed-checkpoint.json")
+}
+
+// hasCheckpoint returns whether a run of preseeding of the system at
+// preseedChroot was interrupted and left a checkpoint behind.
+func hasCheckpoint(preseedChroot string) bool {
+	return osutil.FileExists(filepath.Join(preseedChroot, checkpointFile()))
+}
+
+// seedProgress returns the names of the snaps of the seed change in the
+// snapd state at stateFile whose tasks were all completed, and of those
+// which still have tasks to run. snapd restarted with the same state
+// continues the seed change instead of creating a new one, so it does not
+// run the completed tasks again and the seeded snaps are skipped.
+func seedProgress(stateFile string) (seeded, pending []string, err error) {
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	type snapSetup struct {
+		SideInfo struct {
+			Name string `json:"name"`
+		} `json:"side-info"`
+	}
+	var st struct {
+		Changes map[string]struct {
+			Kind    string   `json:"kind"`
+			TaskIDs []string `json:"task-ids"`
+		} `json:"changes"`
+		Tasks map[string]struct {
+			Status state.Status `json:"status"`
+			Data   struct {
+				SnapSetup     *snapSetup `json:"snap-setup"`
+				SnapSetupTask string     `json:"snap-setup-task"`
+			} `json:"data"`
+		} `json:"tasks"`
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, nil, fmt.Errorf("cannot read snapd state: %v", err)
+	}
+	// whether all the tasks of each snap of the seed were completed
+	completed := make(map[string]bool)
+	for _, chg := range st.Changes {
+		if chg.Kind != "seed" {
+			continue
+		}
+		for _, id := range chg.TaskIDs {
+			t := st.Tasks[id]
+			snapsup := t.Data.SnapSetup
+			if snapsup == nil {
+				snapsup = st.Tasks[t.Data.SnapSetupTask].Data.SnapSetup
+			}
+			if snapsup == nil || snapsup.SideInfo.Name == "" {
+				// not a task of a snap, e.g. marking the system seeded
+				continue
+			}
+			name := snapsup.SideInfo.Name
+			if done, ok := completed[name]; !ok || done {
+				completed[name] = t.Status == state.DoneStatus
+			}
+		}
+	}
+	for name, done := range completed {
+		if done {
+			seeded = append(seeded, name)
+		} else {
+			pending = append(pending, name)
+		}
+	}
+	sort.Strings(seeded)
+	sort.Strings(pending)
+	return seeded, pending, nil
+}
+
+// checkpoint records the completed preseeding steps in the chroot.
+type checkpoint struct {
+	resume    bool
+	Completed []string `json:"completed"`
+}
+
+// load loads the steps completed by the run being resumed, if resuming,
+// otherwise it discards them. It assumes running in the chroot.
+func (ck *checkpoint) load() error {
+	ck.Completed = nil
+	if !ck.resume {
+		if err := os.Remove(checkpointFile()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove preseed checkpoint: %v", err)
+		}
+		return nil
+	}
+	data, err := ioutil.ReadFile(checkpointFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read preseed checkpoint: %v", err)
+	}
+	if err := json.Unmarshal(data, ck); err != nil {
+		return fmt.Errorf("cannot decode preseed checkpoint: %v", err)
+	}
+	return nil
+}
+
+// skip returns whether step can be skipped, because it was completed by the
+// run being resumed.
+func (ck *checkpoint) skip(step checkpointStep) bool {
+	if !ck.resume || !strutil.ListContains(ck.Completed, string(step)) {
+		return false
+	}
+	fmt.Fprintf(Stdout, "skipping %s, completed by a previous run\n", step)
+	return true
+}
+
+// done records that step was completed.
+func (ck *checkpoint) done(step checkpointStep) error {
+	if strutil.ListContains(ck.Completed, string(step)) {
+		return nil
+	}
+	ck.Completed = append(ck.Completed, string(step))
+	data, err := json.Marshal(ck)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(checkpointFile()), 0755); err != nil {
+		return fmt.Errorf("cannot write preseed checkpoint: %v", err)
+	}
+	if err := osutil.AtomicWriteFile(checkpointFile(), data, 0644, 0); err != nil {
+		return fmt.Errorf("cannot write preseed checkpoint: %v", err)
+	}
+	return nil
+}
+
+// finish removes the checkpoint once preseeding completed, it is not part
+// of the preseeded image.
+func (ck *checkpoint) finish() error {
+	if err := os.Remove(checkpointFile()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove preseed checkpoint: %v", err)
+	}
+	return nil
+}
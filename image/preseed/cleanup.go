@@ -0,0 +1,81 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"sync"
+)
+
+// cleanupStack collects cleanup functions to be run in reverse order. Each
+// function is run at most once, either when preseeding completes or when it
+// is interrupted by a signal.
+type cleanupStack struct {
+	mu    sync.Mutex
+	funcs []func()
+}
+
+func (s *cleanupStack) push(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.funcs = append(s.funcs, f)
+}
+
+func (s *cleanupStack) run() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.funcs) > 0 {
+		f := s.funcs[len(s.funcs)-1]
+		s.funcs = s.funcs[:len(s.funcs)-1]
+		f()
+	}
+}
+
+// chrootTracker records whether the process has entered the chroot of the
+// system being preseeded. Cleanup functions may run either before or after
+// that, also from the signal handler, and use it to undo their mounts at the
+// paths they have in the current root.
+type chrootTracker struct {
+	mu      sync.Mutex
+	entered bool
+}
+
+// enter changes the root directory of the process to dir. Cleanup functions
+// resolving their paths meanwhile wait for it to complete.
+func (t *chrootTracker) enter(backend Backend, dir string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := backend.Chroot(dir); err != nil {
+		return err
+	}
+	t.entered = true
+	return nil
+}
+
+// resolve calls f with inside if the chroot was entered already, or with
+// outside otherwise. The chroot is not entered until f returns.
+func (t *chrootTracker) resolve(outside, inside string, f func(path string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entered {
+		f(inside)
+	} else {
+		f(outside)
+	}
+}
@@ -0,0 +1,154 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/snapcore/snapd/snap"
+)
+
+// Config holds the options of classic preseeding which can be stored in a
+// file, see ClassicOptions for their meaning. Options that take functions,
+// channels or interfaces are not part of it.
+type Config struct {
+	CoreSnapSHA3_384        string            `json:"core-snap-sha3-384,omitempty"`
+	Env                     map[string]string `json:"env,omitempty"`
+	MountPath               string            `json:"mount-path,omitempty"`
+	TempDir                 string            `json:"temp-dir,omitempty"`
+	StateUpperDir           string            `json:"state-upper-dir,omitempty"`
+	SnapdRootDir            string            `json:"snapd-root-dir,omitempty"`
+	SeedDir                 string            `json:"seed-dir,omitempty"`
+	HandleSignals           bool              `json:"handle-signals,omitempty"`
+	ImportAppArmorCache     string            `json:"import-apparmor-cache,omitempty"`
+	ExportAppArmorCache     string            `json:"export-apparmor-cache,omitempty"`
+	ValidateUdevRules       bool              `json:"validate-udev-rules,omitempty"`
+	RequireAppArmorProfiles bool              `json:"require-apparmor-profiles,omitempty"`
+	SnapConfineProfile      bool              `json:"snap-confine-profile,omitempty"`
+	ValidateSeed            bool              `json:"validate-seed,omitempty"`
+	SortSeedSnaps           bool              `json:"sort-seed-snaps,omitempty"`
+	TrustedAssertions       []string          `json:"trusted-assertions,omitempty"`
+	StraceOutput            string            `json:"strace-output,omitempty"`
+	AssertionsOnly          bool              `json:"assertions-only,omitempty"`
+	AppArmorOnly            bool              `json:"apparmor-only,omitempty"`
+	SnapshotDir             string            `json:"snapshot-dir,omitempty"`
+	StoreURL                string            `json:"store-url,omitempty"`
+	Proxy                   string            `json:"proxy,omitempty"`
+	Offline                 bool              `json:"offline,omitempty"`
+	RemountSecurityfs       bool              `json:"remount-securityfs,omitempty"`
+	MakeMountsPrivate       bool              `json:"make-mounts-private,omitempty"`
+	RequireMatchingRelease  bool              `json:"require-matching-release,omitempty"`
+	CPUQuota                string            `json:"cpu-quota,omitempty"`
+	MemoryMax               string            `json:"memory-max,omitempty"`
+	ExpectedStateFormat     int               `json:"expected-state-format,omitempty"`
+	BestEffort              bool              `json:"best-effort,omitempty"`
+	ExtraArtifacts          []string          `json:"extra-artifacts,omitempty"`
+	// SourceDateEpoch is in seconds since the Unix epoch, like the
+	// SOURCE_DATE_EPOCH environment variable of reproducible builds.
+	SourceDateEpoch     int64       `json:"source-date-epoch,omitempty"`
+	UIDMap              []IDMapping `json:"uid-map,omitempty"`
+	GIDMap              []IDMapping `json:"gid-map,omitempty"`
+	AllowActiveSnapd    bool        `json:"allow-active-snapd,omitempty"`
+	InhibitDir          string      `json:"inhibit-dir,omitempty"`
+	ReuseFrom           string      `json:"reuse-from,omitempty"`
+	MountSnapTypes      []snap.Type `json:"mount-snap-types,omitempty"`
+	Resume              bool        `json:"resume,omitempty"`
+	Prune               bool        `json:"prune,omitempty"`
+	AppArmorFeaturesDir string      `json:"apparmor-features-dir,omitempty"`
+	DryRun              bool        `json:"dry-run,omitempty"`
+	QemuUserBinary      string      `json:"qemu-user-binary,omitempty"`
+}
+
+// UnmarshalConfig decodes a preseeding configuration from JSON. Unknown
+// fields are an error.
+func UnmarshalConfig(data []byte) (Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("cannot decode preseed configuration: %v", err)
+	}
+	if dec.More() {
+		return Config{}, fmt.Errorf("cannot decode preseed configuration: spurious content after the configuration")
+	}
+	return cfg, nil
+}
+
+// ClassicOptions returns the options for Classic corresponding to the
+// configuration.
+func (cfg *Config) ClassicOptions() *ClassicOptions {
+	opts := &ClassicOptions{
+		CoreSnapSHA3_384:        cfg.CoreSnapSHA3_384,
+		Env:                     cfg.Env,
+		MountPath:               cfg.MountPath,
+		TempDir:                 cfg.TempDir,
+		StateUpperDir:           cfg.StateUpperDir,
+		SnapdRootDir:            cfg.SnapdRootDir,
+		SeedDir:                 cfg.SeedDir,
+		HandleSignals:           cfg.HandleSignals,
+		ImportAppArmorCache:     cfg.ImportAppArmorCache,
+		ExportAppArmorCache:     cfg.ExportAppArmorCache,
+		ValidateUdevRules:       cfg.ValidateUdevRules,
+		RequireAppArmorProfiles: cfg.RequireAppArmorProfiles,
+		SnapConfineProfile:      cfg.SnapConfineProfile,
+		ValidateSeed:            cfg.ValidateSeed,
+		SortSeedSnaps:           cfg.SortSeedSnaps,
+		TrustedAssertions:       cfg.TrustedAssertions,
+		StraceOutput:            cfg.StraceOutput,
+		AssertionsOnly:          cfg.AssertionsOnly,
+		AppArmorOnly:            cfg.AppArmorOnly,
+		SnapshotDir:             cfg.SnapshotDir,
+		StoreURL:                cfg.StoreURL,
+		Proxy:                   cfg.Proxy,
+		Offline:                 cfg.Offline,
+		RemountSecurityfs:       cfg.RemountSecurityfs,
+		MakeMountsPrivate:       cfg.MakeMountsPrivate,
+		RequireMatchingRelease:  cfg.RequireMatchingRelease,
+		CPUQuota:                cfg.CPUQuota,
+		MemoryMax:               cfg.MemoryMax,
+		ExpectedStateFormat:     cfg.ExpectedStateFormat,
+		BestEffort:              cfg.BestEffort,
+		ExtraArtifacts:          cfg.ExtraArtifacts,
+		AllowActiveSnapd:        cfg.AllowActiveSnapd,
+		InhibitDir:              cfg.InhibitDir,
+		ReuseFrom:               cfg.ReuseFrom,
+		MountSnapTypes:          cfg.MountSnapTypes,
+		Resume:                  cfg.Resume,
+		UIDMap:                  cfg.UIDMap,
+		GIDMap:                  cfg.GIDMap,
+		Prune:                   cfg.Prune,
+		AppArmorFeaturesDir:     cfg.AppArmorFeaturesDir,
+		DryRun:                  cfg.DryRun,
+		QemuUserBinary:          cfg.QemuUserBinary,
+	}
+	if cfg.SourceDateEpoch != 0 {
+		opts.SourceDateEpoch = time.Unix(cfg.SourceDateEpoch, 0).UTC()
+	}
+	return opts
+}
+
+// ClassicWithConfig runs preseeding of the classic system at chrootDir
+// with the given configuration, see Classic.
+func ClassicWithConfig(chrootDir string, cfg Config) error {
+	return Classic(chrootDir, cfg.ClassicOptions())
+}
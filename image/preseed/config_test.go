@@ -0,0 +1,119 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/testutil"
+)
+
+func (s *preseedSuite) TestConfigRoundTrip(c *C) {
+	data := []byte(`{
+	"env": {"SNAPD_DEBUG": "1"},
+	"mount-path": "/srv/snapd-preseed",
+	"seed-dir": "/srv/seed",
+	"validate-udev-rules": true,
+	"extra-artifacts": ["/etc/foo/*"],
+	"source-date-epoch": 1640995200,
+	"mount-snap-types": ["base", "kernel"],
+	"resume": true,
+	"prune": true
+}`)
+	cfg, err := preseed.UnmarshalConfig(data)
+	c.Assert(err, IsNil)
+	c.Check(cfg, DeepEquals, preseed.Config{
+		Env:               map[string]string{"SNAPD_DEBUG": "1"},
+		MountPath:         "/srv/snapd-preseed",
+		SeedDir:           "/srv/seed",
+		ValidateUdevRules: true,
+		ExtraArtifacts:    []string{"/etc/foo/*"},
+		SourceDateEpoch:   1640995200,
+		MountSnapTypes:    []snap.Type{snap.TypeBase, snap.TypeKernel},
+		Resume:            true,
+		Prune:             true,
+	})
+
+	encoded, err := json.Marshal(cfg)
+	c.Assert(err, IsNil)
+	cfg2, err := preseed.UnmarshalConfig(encoded)
+	c.Assert(err, IsNil)
+	c.Check(cfg2, DeepEquals, cfg)
+
+	opts := cfg.ClassicOptions()
+	c.Check(opts.Env, DeepEquals, map[string]string{"SNAPD_DEBUG": "1"})
+	c.Check(opts.MountPath, Equals, "/srv/snapd-preseed")
+	c.Check(opts.SeedDir, Equals, "/srv/seed")
+	c.Check(opts.ValidateUdevRules, Equals, true)
+	c.Check(opts.ExtraArtifacts, DeepEquals, []string{"/etc/foo/*"})
+	c.Check(opts.SourceDateEpoch.Equal(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)), Equals, true)
+	c.Check(opts.MountSnapTypes, DeepEquals, []snap.Type{snap.TypeBase, snap.TypeKernel})
+	c.Check(opts.Resume, Equals, true)
+	c.Check(opts.Prune, Equals, true)
+
+	// the epoch is not set by default
+	c.Check((&preseed.Config{}).ClassicOptions().SourceDateEpoch.IsZero(), Equals, true)
+}
+
+func (s *preseedSuite) TestUnmarshalConfigErrors(c *C) {
+	for _, t := range []struct {
+		data string
+		err  string
+	}{
+		{`{"mount-pth": "/foo"}`, `cannot decode preseed configuration: json: unknown field "mount-pth"`},
+		{`{"mount-snap-types": ["foo"]}`, `cannot decode preseed configuration: invalid snap type: "foo"`},
+		{`{"resume": "yes"}`, `cannot decode preseed configuration: json: cannot unmarshal string .*`},
+		{`{} {}`, `cannot decode preseed configuration: spurious content after the configuration`},
+		{``, `cannot decode preseed configuration: EOF`},
+	} {
+		_, err := preseed.UnmarshalConfig([]byte(t.data))
+		c.Check(err, ErrorMatches, t.err, Commentf("%s", t.data))
+	}
+}
+
+func (s *preseedSuite) TestClassicWithConfig(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	customMountPath := filepath.Join(tmpDir, "larger-fs", "snapd-preseed")
+	customSnapd := testutil.MockCommand(c, filepath.Join(customMountPath, "usr/lib/snapd/snapd"), `
+if [ "$SNAPD_DEBUG" != "1" ]; then
+	exit 1
+fi
+`+mockWriteStateScript())
+	defer customSnapd.Restore()
+	mockVersionFiles(c, customMountPath, "2.44.0", tmpDir, "2.41.0")
+
+	cfg, err := preseed.UnmarshalConfig([]byte(`{"env": {"SNAPD_DEBUG": "1"}, "mount-path": "` + customMountPath + `"}`))
+	c.Assert(err, IsNil)
+	c.Assert(preseed.ClassicWithConfig(tmpDir, cfg), IsNil)
+
+	c.Check(env.mountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(tmpDir, customMountPath)},
+	})
+	c.Check(customSnapd.Calls(), HasLen, 1)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
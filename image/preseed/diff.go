@@ -0,0 +1,230 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// DifferenceKind describes how a preseed artifact differs between two
+// preseeded systems.
+type DifferenceKind string
+
+const (
+	// ArtifactAdded is reported for artifacts present only in the second
+	// system.
+	ArtifactAdded DifferenceKind = "added"
+	// ArtifactRemoved is reported for artifacts present only in the first
+	// system.
+	ArtifactRemoved DifferenceKind = "removed"
+	// ArtifactChanged is reported for artifacts present in both systems
+	// but with different type, content or symlink target.
+	ArtifactChanged DifferenceKind = "changed"
+)
+
+// Difference is a single difference between the preseed artifacts of two
+// systems.
+type Difference struct {
+	// Path of the artifact, relative to the root of the system.
+	Path string
+	Kind DifferenceKind
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s %s", d.Kind, d.Path)
+}
+
+type artifactEntry struct {
+	mode os.FileMode
+	// digest of a regular file, or target of a symlink
+	content []byte
+}
+
+func (a *artifactEntry) equal(b *artifactEntry) bool {
+	return a.mode.Type() == b.mode.Type() && bytes.Equal(a.content, b.content)
+}
+
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// walkArtifacts calls fn for each of the preseed artifacts found under
+// rootDir, and everything inside of them, once. The path passed to fn is
+// relative to rootDir.
+func walkArtifacts(rootDir string, fn func(path, rel string, info os.FileInfo) error) error {
+	seen := make(map[string]bool)
+	for _, gl := range ArtifactPatterns() {
+		matches, err := filepath.Glob(filepath.Join(rootDir, gl))
+		if err != nil {
+			// the only possible error from Glob() is ErrBadPattern
+			return err
+		}
+		for _, match := range matches {
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(rootDir, path)
+				if err != nil {
+					return err
+				}
+				rel = "/" + rel
+				if seen[rel] {
+					// already seen through another pattern
+					return nil
+				}
+				seen[rel] = true
+				return fn(path, rel, info)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// collectArtifacts returns the preseed artifacts found under rootDir, keyed
+// by their path relative to rootDir.
+func collectArtifacts(rootDir string) (map[string]*artifactEntry, error) {
+	artifacts := make(map[string]*artifactEntry)
+	err := walkArtifacts(rootDir, func(path, rel string, info os.FileInfo) error {
+		entry := &artifactEntry{mode: info.Mode()}
+		var err error
+		switch {
+		case info.Mode().IsRegular():
+			entry.content, err = fileDigest(path)
+		case info.Mode()&os.ModeSymlink != 0:
+			var target string
+			target, err = os.Readlink(path)
+			entry.content = []byte(target)
+		}
+		if err != nil {
+			return err
+		}
+		artifacts[rel] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot collect preseed artifacts: %v", err)
+	}
+	return artifacts, nil
+}
+
+// normalizeArtifactTimes sets the access and modification times of all the
+// preseed artifacts found under rootDir to t. Symlinks are left alone.
+func normalizeArtifactTimes(rootDir string, t time.Time) error {
+	err := walkArtifacts(rootDir, func(path, rel string, info os.FileInfo) error {
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chtimes(path, t, t)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot normalize times of preseed artifacts: %v", err)
+	}
+	return nil
+}
+
+// mapID returns the id that id is mapped to by mappings, or id itself if it
+// is not mapped.
+func mapID(mappings []IDMapping, id uint32) uint32 {
+	for _, m := range mappings {
+		if id >= m.ID && id-m.ID < m.Count {
+			return m.TargetID + (id - m.ID)
+		}
+	}
+	return id
+}
+
+var osLchown = os.Lchown
+
+// mapArtifactOwnership changes the owner and group of all the preseed
+// artifacts found under rootDir as described by uidMap and gidMap.
+// Symlinks themselves are changed, not their targets.
+func mapArtifactOwnership(rootDir string, uidMap, gidMap []IDMapping) error {
+	err := walkArtifacts(rootDir, func(path, rel string, info os.FileInfo) error {
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot get the owner of %s", path)
+		}
+		uid, gid := mapID(uidMap, st.Uid), mapID(gidMap, st.Gid)
+		if uid == st.Uid && gid == st.Gid {
+			return nil
+		}
+		return osLchown(path, int(uid), int(gid))
+	})
+	if err != nil {
+		return fmt.Errorf("cannot map ownership of preseed artifacts: %v", err)
+	}
+	return nil
+}
+
+// DiffArtifacts compares the preseed artifacts, as described by
+// ArtifactPatterns, of the systems under dirA and dirB. The differences are
+// returned sorted by path; no differences means the preseeding outputs are
+// identical.
+func DiffArtifacts(dirA, dirB string) ([]Difference, error) {
+	artifactsA, err := collectArtifacts(dirA)
+	if err != nil {
+		return nil, err
+	}
+	artifactsB, err := collectArtifacts(dirB)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []Difference
+	for path, a := range artifactsA {
+		b, ok := artifactsB[path]
+		switch {
+		case !ok:
+			diffs = append(diffs, Difference{Path: path, Kind: ArtifactRemoved})
+		case !a.equal(b):
+			diffs = append(diffs, Difference{Path: path, Kind: ArtifactChanged})
+		}
+	}
+	for path := range artifactsB {
+		if _, ok := artifactsA[path]; !ok {
+			diffs = append(diffs, Difference{Path: path, Kind: ArtifactAdded})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+	return diffs, nil
+}
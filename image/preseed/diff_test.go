@@ -0,0 +1,89 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
+)
+
+func mockPreseedArtifacts(c *C, rootDir string) {
+	files := map[string]string{
+		dirs.SnapStateFile: `{"data":{}}`,
+		filepath.Join(dirs.SnapServicesDir, "snap-foo-1.mount"): "[Mount]\n",
+		filepath.Join(dirs.SnapDataDir, "foo", "1", "data"):     "data",
+		filepath.Join(dirs.SnapSeqDir, "foo.json"):              "{}",
+		// not an artifact
+		"/etc/hostname": "ubuntu",
+	}
+	for path, content := range files {
+		fullPath := filepath.Join(rootDir, path)
+		c.Assert(os.MkdirAll(filepath.Dir(fullPath), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(fullPath, []byte(content), 0644), IsNil)
+	}
+	c.Assert(os.Symlink("1", filepath.Join(rootDir, dirs.SnapDataDir, "foo", "current")), IsNil)
+}
+
+func (s *preseedSuite) TestDiffArtifactsIdentical(c *C) {
+	dirA := c.MkDir()
+	dirB := c.MkDir()
+	mockPreseedArtifacts(c, dirA)
+	mockPreseedArtifacts(c, dirB)
+
+	// files other than preseed artifacts are ignored
+	c.Assert(ioutil.WriteFile(filepath.Join(dirB, "/etc/hostname"), []byte("other"), 0644), IsNil)
+
+	diffs, err := preseed.DiffArtifacts(dirA, dirB)
+	c.Assert(err, IsNil)
+	c.Check(diffs, HasLen, 0)
+}
+
+func (s *preseedSuite) TestDiffArtifacts(c *C) {
+	dirA := c.MkDir()
+	dirB := c.MkDir()
+	mockPreseedArtifacts(c, dirA)
+	mockPreseedArtifacts(c, dirB)
+
+	// extra file in B
+	extra := filepath.Join(dirs.SnapSeqDir, "bar.json")
+	c.Assert(ioutil.WriteFile(filepath.Join(dirB, extra), []byte("{}"), 0644), IsNil)
+	// file missing in B
+	c.Assert(os.Remove(filepath.Join(dirB, dirs.SnapServicesDir, "snap-foo-1.mount")), IsNil)
+	// changed content and symlink target
+	c.Assert(ioutil.WriteFile(filepath.Join(dirB, dirs.SnapStateFile), []byte(`{"data":{"foo":1}}`), 0644), IsNil)
+	current := filepath.Join(dirB, dirs.SnapDataDir, "foo", "current")
+	c.Assert(os.Remove(current), IsNil)
+	c.Assert(os.Symlink("2", current), IsNil)
+
+	diffs, err := preseed.DiffArtifacts(dirA, dirB)
+	c.Assert(err, IsNil)
+	c.Check(diffs, DeepEquals, []preseed.Difference{
+		{Path: filepath.Join(dirs.SnapServicesDir, "snap-foo-1.mount"), Kind: preseed.ArtifactRemoved},
+		{Path: filepath.Join(dirs.SnapSeqDir, "bar.json"), Kind: preseed.ArtifactAdded},
+		{Path: dirs.SnapStateFile, Kind: preseed.ArtifactChanged},
+		{Path: filepath.Join(dirs.SnapDataDir, "foo", "current"), Kind: preseed.ArtifactChanged},
+	})
+}
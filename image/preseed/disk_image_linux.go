@@ -0,0 +1,236 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/osutil"
+)
+
+const (
+	diskImageRaw   = "raw"
+	diskImageQcow2 = "qcow2"
+
+	defaultNBDDevice = "/dev/nbd0"
+
+	// the implicit filesystem labels of the structures with the
+	// system-seed role of UC20+ gadgets and the system-data role of
+	// classic gadgets, see the gadget package
+	systemSeedLabel = "ubuntu-seed"
+	systemDataLabel = "writable"
+)
+
+var (
+	onDiskVolumeFromDevice = gadget.OnDiskVolumeFromDevice
+	core20                 = Core20
+)
+
+// detectDiskImageFormat returns the format of the disk image, based on its
+// header.
+func detectDiskImageFormat(imagePath string) (string, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("cannot read header of %s: %v", imagePath, err)
+	}
+	if bytes.Equal(magic, []byte("QFI\xfb")) {
+		return diskImageQcow2, nil
+	}
+	return diskImageRaw, nil
+}
+
+// attachDiskImage attaches the disk image to a block device, scanning its
+// partitions, and returns the device and a function detaching it.
+func attachDiskImage(imagePath, format, nbdDevice string) (device string, detach func(), err error) {
+	switch format {
+	case diskImageRaw:
+		out, err := exec.Command("losetup", "--find", "--show", "--partscan", imagePath).CombinedOutput()
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot attach %s to a loop device: %v", imagePath, osutil.OutputErr(out, err))
+		}
+		device = strings.TrimSpace(string(out))
+		detach = func() {
+			if out, err := exec.Command("losetup", "--detach", device).CombinedOutput(); err != nil {
+				fmt.Fprintf(Stderr, "cannot detach loop device %s: %v\n", device, osutil.OutputErr(out, err))
+			}
+		}
+	case diskImageQcow2:
+		device = nbdDevice
+		if device == "" {
+			device = defaultNBDDevice
+		}
+		if out, err := exec.Command("qemu-nbd", "--connect", device, imagePath).CombinedOutput(); err != nil {
+			return "", nil, fmt.Errorf("cannot attach %s to %s: %v", imagePath, device, osutil.OutputErr(out, err))
+		}
+		detach = func() {
+			if out, err := exec.Command("qemu-nbd", "--disconnect", device).CombinedOutput(); err != nil {
+				fmt.Fprintf(Stderr, "cannot detach %s: %v\n", device, osutil.OutputErr(out, err))
+			}
+		}
+	default:
+		return "", nil, fmt.Errorf("cannot preseed disk image of unknown format %q", format)
+	}
+
+	// the partitions show up asynchronously
+	if out, err := exec.Command("udevadm", "settle").CombinedOutput(); err != nil {
+		detach()
+		return "", nil, fmt.Errorf("cannot wait for partitions of %s: %v", device, osutil.OutputErr(out, err))
+	}
+	return device, detach, nil
+}
+
+// findStructureByLabel returns the structure of the volume with the given
+// filesystem label, or nil.
+func findStructureByLabel(vol *gadget.OnDiskVolume, label string) *gadget.OnDiskStructure {
+	for i := range vol.Structure {
+		if vol.Structure[i].Label == label {
+			return &vol.Structure[i]
+		}
+	}
+	return nil
+}
+
+// DiskImage runs preseeding of the system stored in the partitioned disk
+// image at imagePath, either raw or qcow2. The image is attached to a loop
+// device or, when in qcow2 format, to a network block device with qemu-nbd.
+// The partitions are located by the filesystem labels of the gadget roles:
+// if there is a system-seed partition, the image is preseeded with Core20,
+// otherwise the system-data partition is mounted and preseeded with
+// Classic. All mounts are undone and the image is detached on return. The
+// opts argument may be nil.
+func DiskImage(imagePath string, opts *DiskImageOptions) error {
+	if opts == nil {
+		opts = &DiskImageOptions{}
+	}
+
+	imagePath, err := filepath.Abs(imagePath)
+	if err != nil {
+		return err
+	}
+
+	format := opts.Format
+	if format == "" {
+		format, err = detectDiskImageFormat(imagePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	cleanups := &cleanupStack{}
+	defer cleanups.run()
+	classicOpts := opts.ClassicOptions
+	if classicOpts != nil && classicOpts.HandleSignals {
+		stop := handleSignals(cleanups)
+		defer stop()
+		// Classic adds its cleanups to ours
+		optsWithCleanups := *classicOpts
+		optsWithCleanups.parentCleanups = cleanups
+		classicOpts = &optsWithCleanups
+	}
+
+	device, detach, err := attachDiskImage(imagePath, format, opts.NBDDevice)
+	if err != nil {
+		return err
+	}
+	cleanups.push(detach)
+
+	vol, err := onDiskVolumeFromDevice(device)
+	if err != nil {
+		return fmt.Errorf("cannot read partitions of %s: %v", imagePath, err)
+	}
+
+	mountDir, err := makeImageMountDir()
+	if err != nil {
+		return fmt.Errorf("cannot create mountpoint for %s: %v", imagePath, err)
+	}
+	removeDir := func(dir string) {
+		// not RemoveAll, the partition may still be mounted there
+		if err := os.Remove(dir); err != nil {
+			fmt.Fprintf(Stderr, "%v\n", err)
+		}
+	}
+	cleanups.push(func() { removeDir(mountDir) })
+
+	mount := func(node, where string) error {
+		if where != mountDir {
+			if err := os.Mkdir(where, 0755); err != nil {
+				return err
+			}
+			cleanups.push(func() { removeDir(where) })
+		}
+		if out, err := exec.Command("mount", node, where).CombinedOutput(); err != nil {
+			return fmt.Errorf("cannot mount %s at %s: %v", node, where, osutil.OutputErr(out, err))
+		}
+		cleanups.push(func() {
+			if out, err := exec.Command("umount", where).CombinedOutput(); err != nil {
+				fmt.Fprintf(Stderr, "cannot unmount %s: %v\n", where, osutil.OutputErr(out, err))
+			}
+		})
+		return nil
+	}
+
+	if seedPart := findStructureByLabel(vol, systemSeedLabel); seedPart != nil {
+		if err := mount(seedPart.Node, filepath.Join(mountDir, "system-seed")); err != nil {
+			return err
+		}
+		return core20(mountDir, opts.CoreOptions)
+	}
+
+	dataPart := findStructureByLabel(vol, systemDataLabel)
+	if dataPart == nil {
+		return fmt.Errorf("cannot find a partition labeled %q or %q in %s", systemSeedLabel, systemDataLabel, imagePath)
+	}
+	if err := mount(dataPart.Node, mountDir); err != nil {
+		return err
+	}
+
+	cleanupMounts, err := PrepareChrootMounts(mountDir)
+	if err != nil {
+		return err
+	}
+	cleanups.push(func() {
+		if err := cleanupMounts(); err != nil {
+			fmt.Fprintf(Stderr, "%v\n", err)
+		}
+	})
+
+	// Classic chroots into the target, the mounts above can only be
+	// cleaned up from the original root.
+	restoreRoot, err := saveRoot()
+	if err != nil {
+		return err
+	}
+	cleanups.push(restoreRoot)
+
+	return classic(mountDir, classicOpts)
+}
@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/testutil"
+)
+
+func mockOnDiskVolume(c *C, expectedDevice string, labels map[string]string) (restore func()) {
+	vol := &gadget.OnDiskVolume{Device: expectedDevice}
+	for node, label := range labels {
+		vol.Structure = append(vol.Structure, gadget.OnDiskStructure{
+			LaidOutStructure: gadget.LaidOutStructure{
+				VolumeStructure: &gadget.VolumeStructure{Label: label},
+			},
+			Node: node,
+		})
+	}
+	return preseed.MockOnDiskVolumeFromDevice(func(device string) (*gadget.OnDiskVolume, error) {
+		c.Check(device, Equals, expectedDevice)
+		return vol, nil
+	})
+}
+
+func (s *preseedSuite) mockDiskImageEnv(c *C) (mountDir string, mountCmd, umountCmd *testutil.MockCmd) {
+	mountDir = filepath.Join(c.MkDir(), "mnt")
+	c.Assert(os.Mkdir(mountDir, 0755), IsNil)
+	s.AddCleanup(preseed.MockMakeImageMountDir(func() (string, error) { return mountDir, nil }))
+	s.AddCleanup(preseed.MockSyscallChroot(func(path string) error { return nil }))
+
+	mountCmd = testutil.MockCommand(c, "mount", "")
+	s.AddCleanup(mountCmd.Restore)
+	// the mountpoints created on the partition go away once it is
+	// unmounted
+	umountCmd = testutil.MockCommand(c, "umount", fmt.Sprintf(`
+if [ "$1" = %q ]; then
+	rm -rf "$1"/*
+fi`, mountDir))
+	s.AddCleanup(umountCmd.Restore)
+	udevadmCmd := testutil.MockCommand(c, "udevadm", "")
+	s.AddCleanup(udevadmCmd.Restore)
+	return mountDir, mountCmd, umountCmd
+}
+
+func (s *preseedSuite) TestDiskImageRawClassic(c *C) {
+	imageFile := filepath.Join(c.MkDir(), "disk.img")
+	c.Assert(ioutil.WriteFile(imageFile, make([]byte, 512), 0644), IsNil)
+
+	mountDir, mountCmd, umountCmd := s.mockDiskImageEnv(c)
+	mockLosetup := testutil.MockCommand(c, "losetup", `
+if [ "$1" = "--find" ]; then
+	echo /dev/loop7
+fi`)
+	defer mockLosetup.Restore()
+	defer mockOnDiskVolume(c, "/dev/loop7", map[string]string{
+		"/dev/loop7p1": "system-boot",
+		"/dev/loop7p2": "writable",
+	})()
+
+	classicOpts := &preseed.ClassicOptions{Resume: true}
+	var called bool
+	restore := preseed.MockClassic(func(chrootDir string, opts *preseed.ClassicOptions) error {
+		c.Check(chrootDir, Equals, mountDir)
+		c.Check(opts, Equals, classicOpts)
+		// the data partition and the virtual filesystems are mounted
+		c.Check(mountCmd.Calls(), DeepEquals, [][]string{
+			{"mount", "/dev/loop7p2", mountDir},
+			{"mount", "--bind", "/proc", filepath.Join(mountDir, "proc")},
+			{"mount", "--bind", "/dev", filepath.Join(mountDir, "dev")},
+			{"mount", "--bind", "/sys/kernel/security", filepath.Join(mountDir, "sys/kernel/security")},
+		})
+		c.Check(umountCmd.Calls(), HasLen, 0)
+		called = true
+		return nil
+	})
+	defer restore()
+
+	c.Assert(preseed.DiskImage(imageFile, &preseed.DiskImageOptions{ClassicOptions: classicOpts}), IsNil)
+	c.Check(called, Equals, true)
+
+	c.Check(mockLosetup.Calls(), DeepEquals, [][]string{
+		{"losetup", "--find", "--show", "--partscan", imageFile},
+		{"losetup", "--detach", "/dev/loop7"},
+	})
+	c.Check(umountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", filepath.Join(mountDir, "sys/kernel/security")},
+		{"umount", filepath.Join(mountDir, "dev")},
+		{"umount", filepath.Join(mountDir, "proc")},
+		{"umount", mountDir},
+	})
+	c.Check(mountDir, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestDiskImageQcow2Core(c *C) {
+	imageFile := filepath.Join(c.MkDir(), "disk.qcow2")
+	c.Assert(ioutil.WriteFile(imageFile, []byte("QFI\xfb\x00\x00\x00\x03"), 0644), IsNil)
+
+	mountDir, mountCmd, umountCmd := s.mockDiskImageEnv(c)
+	mockQemuNBD := testutil.MockCommand(c, "qemu-nbd", "")
+	defer mockQemuNBD.Restore()
+	defer mockOnDiskVolume(c, "/dev/nbd3", map[string]string{
+		"/dev/nbd3p2": "ubuntu-seed",
+		"/dev/nbd3p3": "ubuntu-boot",
+	})()
+
+	coreOpts := &preseed.CoreOptions{SysLabel: "20220203"}
+	var called bool
+	restore := preseed.MockCore20(func(prepareImageDir string, opts *preseed.CoreOptions) error {
+		c.Check(prepareImageDir, Equals, mountDir)
+		c.Check(opts, Equals, coreOpts)
+		c.Check(filepath.Join(mountDir, "system-seed"), testutil.FilePresent)
+		c.Check(mountCmd.Calls(), DeepEquals, [][]string{
+			{"mount", "/dev/nbd3p2", filepath.Join(mountDir, "system-seed")},
+		})
+		called = true
+		return nil
+	})
+	defer restore()
+
+	opts := &preseed.DiskImageOptions{NBDDevice: "/dev/nbd3", CoreOptions: coreOpts}
+	c.Assert(preseed.DiskImage(imageFile, opts), IsNil)
+	c.Check(called, Equals, true)
+
+	c.Check(mockQemuNBD.Calls(), DeepEquals, [][]string{
+		{"qemu-nbd", "--connect", "/dev/nbd3", imageFile},
+		{"qemu-nbd", "--disconnect", "/dev/nbd3"},
+	})
+	c.Check(umountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", filepath.Join(mountDir, "system-seed")},
+	})
+	c.Check(mountDir, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestDiskImageNoSystemPartition(c *C) {
+	imageFile := filepath.Join(c.MkDir(), "disk.img")
+	c.Assert(ioutil.WriteFile(imageFile, nil, 0644), IsNil)
+
+	mountDir, mountCmd, _ := s.mockDiskImageEnv(c)
+	mockLosetup := testutil.MockCommand(c, "losetup", `
+if [ "$1" = "--find" ]; then
+	echo /dev/loop7
+fi`)
+	defer mockLosetup.Restore()
+	defer mockOnDiskVolume(c, "/dev/loop7", map[string]string{
+		"/dev/loop7p1": "data",
+	})()
+
+	restore := preseed.MockClassic(func(chrootDir string, opts *preseed.ClassicOptions) error {
+		c.Fatalf("unexpected call")
+		return nil
+	})
+	defer restore()
+
+	err := preseed.DiskImage(imageFile, nil)
+	c.Check(err, ErrorMatches, fmt.Sprintf(`cannot find a partition labeled "ubuntu-seed" or "writable" in %s`, imageFile))
+	c.Check(mountCmd.Calls(), HasLen, 0)
+	// the image is detached
+	c.Check(mockLosetup.Calls(), DeepEquals, [][]string{
+		{"losetup", "--find", "--show", "--partscan", imageFile},
+		{"losetup", "--detach", "/dev/loop7"},
+	})
+	c.Check(mountDir, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestDiskImageUnknownFormat(c *C) {
+	imageFile := filepath.Join(c.MkDir(), "disk.vmdk")
+	c.Assert(ioutil.WriteFile(imageFile, nil, 0644), IsNil)
+
+	err := preseed.DiskImage(imageFile, &preseed.DiskImageOptions{Format: "vmdk"})
+	c.Check(err, ErrorMatches, `cannot preseed disk image of unknown format "vmdk"`)
+}
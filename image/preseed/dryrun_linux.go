@@ -0,0 +1,154 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/seed"
+)
+
+// dryRunCheck is a named check of the validation performed by a dry run.
+type dryRunCheck struct {
+	name  string
+	check func() error
+}
+
+// dryRun performs the validation of the chroot, mountpoints, snapd version
+// and apparmor done by Classic, without stopping at the first failure, and
+// reports the outcome of every check. Nothing is mounted and snapd is not
+// run. An error is returned if any of the checks failed.
+func dryRun(chrootDir string, opts *ClassicOptions) error {
+	seedDir := dirs.SnapSeedDirUnder(chrootDir)
+	if opts.SeedDir != "" {
+		seedDir = opts.SeedDir
+	}
+
+	checks := []dryRunCheck{
+		{"chroot", func() error {
+			_, err := checkChroot(chrootDir, opts.Resume)
+			return err
+		}},
+		{"mount propagation", func() error {
+			return checkMountPropagation(opts.Backend, chrootDir, false)
+		}},
+		{"securityfs", func() error {
+			readOnly, err := isSecurityfsReadOnly(chrootDir)
+			if err != nil {
+				return err
+			}
+			if readOnly && !opts.RemountSecurityfs {
+				return fmt.Errorf("securityfs is mounted read-only at %s", filepath.Join(chrootDir, "/sys/kernel/security"))
+			}
+			return nil
+		}},
+		{"active snapd", func() error {
+			if opts.AllowActiveSnapd {
+				return nil
+			}
+			return checkActiveSnapd(chrootDir)
+		}},
+		{"inhibit locks", func() error {
+			return checkInhibitLocks(chrootDir, opts.inhibitDir())
+		}},
+		{"mount path", func() error {
+			if opts.MountPath != "" {
+				if err := checkMountPath(chrootDir, opts.MountPath); err != nil {
+					return err
+				}
+			}
+			return checkChrootPathsContained(chrootDir, opts.mountPath())
+		}},
+		{"temporary directory", func() error {
+			if opts.TempDir == "" {
+				return nil
+			}
+			if !filepath.IsAbs(opts.TempDir) {
+				return fmt.Errorf("cannot use %q as temporary directory: must be an absolute path inside the chroot", opts.TempDir)
+			}
+			return checkTempDir(filepath.Join(chrootDir, opts.TempDir))
+		}},
+		{"seed trust", func() error {
+			if len(opts.TrustedAssertions) == 0 {
+				return nil
+			}
+			return verifySeedTrust(seedDir, opts.TrustedAssertions)
+		}},
+		{"snapd version", func() error {
+			return dryRunCheckSnapd(chrootDir, seedDir, opts)
+		}},
+		{"os-release", func() error {
+			return checkOSRelease(chrootDir, opts.RequireMatchingRelease)
+		}},
+		{"apparmor", func() error {
+			if opts.AppArmorFeaturesDir != "" && !osutil.IsDirectory(opts.AppArmorFeaturesDir) {
+				return fmt.Errorf("cannot use apparmor features from %s: not a directory", opts.AppArmorFeaturesDir)
+			}
+			return checkAppArmorFeatures(chrootDir)
+		}},
+	}
+
+	fmt.Fprintf(Stdout, "dry-run of preseeding %s:\n", chrootDir)
+	failed := 0
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			failed++
+			fmt.Fprintf(Stdout, "  FAIL %s: %v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(Stdout, "  PASS %s\n", c.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("dry-run of preseeding %s failed %d of %d checks", chrootDir, failed, len(checks))
+	}
+	return nil
+}
+
+// dryRunCheckSnapd checks that the snapd which would be used for
+// preseeding supports it and understands the format of the seed.
+func dryRunCheckSnapd(chrootDir, seedDir string, opts *ClassicOptions) error {
+	if opts.SnapdRootDir != "" {
+		info, err := snapdFromTree(filepath.Join(chrootDir, opts.SnapdRootDir))
+		if err != nil {
+			return err
+		}
+		return checkSeedFormat(seedDir, info.version)
+	}
+
+	coreSnapPath, _, err := systemSnapFromSeed(seedDir, "")
+	if err != nil {
+		if err == seed.ErrNoAssertions || os.IsNotExist(err) {
+			return &NoSeedError{SeedDir: seedDir}
+		}
+		return err
+	}
+	advice, err := versionAdvice(chrootDir, coreSnapPath)
+	if err != nil {
+		return err
+	}
+	if !advice.Supported {
+		return &UnsupportedSnapdError{Advice: advice}
+	}
+	return checkSeedFormat(seedDir, advice.Version)
+}
@@ -0,0 +1,88 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// EstimateModel is a simple model of the duration of preseeding. The
+// duration grows with the number of snaps in the seed, as security profiles
+// (mostly apparmor) are compiled for each of them, and with their total
+// size, as each snap is mounted and its metadata is read.
+type EstimateModel struct {
+	// Base is the fixed cost of preseeding, i.e. mounting snapd and
+	// starting it up.
+	Base time.Duration
+	// PerSnap is the cost of installing a single snap, dominated by
+	// compiling its apparmor profiles.
+	PerSnap time.Duration
+	// PerMiB is the cost per MiB of the snaps in the seed.
+	PerMiB time.Duration
+}
+
+// DefaultEstimateModel is the model used by EstimateDuration. It is a rough
+// approximation of preseeding on a contemporary build machine and may be
+// replaced to fit a particular setup.
+var DefaultEstimateModel = EstimateModel{
+	Base:    10 * time.Second,
+	PerSnap: 5 * time.Second,
+	PerMiB:  20 * time.Millisecond,
+}
+
+// Estimate returns an estimate of the duration of preseeding the seed at
+// seedDir according to the model. It is not precise, but grows with the
+// number and size of the snaps in the seed.
+func (m EstimateModel) Estimate(seedDir string) (time.Duration, error) {
+	snapsDir := filepath.Join(seedDir, "snaps")
+	if _, err := os.Stat(snapsDir); err != nil {
+		if os.IsNotExist(err) {
+			return 0, &NoSeedError{SeedDir: seedDir}
+		}
+		return 0, err
+	}
+	snaps, err := filepath.Glob(filepath.Join(snapsDir, "*.snap"))
+	if err != nil {
+		return 0, err
+	}
+
+	var totalSize int64
+	for _, sn := range snaps {
+		st, err := os.Stat(sn)
+		if err != nil {
+			return 0, fmt.Errorf("cannot estimate preseeding duration: %v", err)
+		}
+		totalSize += st.Size()
+	}
+
+	estimate := m.Base + time.Duration(len(snaps))*m.PerSnap
+	estimate += time.Duration(float64(totalSize) / (1 << 20) * float64(m.PerMiB))
+	return estimate, nil
+}
+
+// EstimateDuration returns a rough estimate of the duration of preseeding
+// the seed at seedDir, based on the number and size of the snaps in it,
+// using DefaultEstimateModel. It is meant for scheduling preseeding jobs.
+func EstimateDuration(seedDir string) (time.Duration, error) {
+	return DefaultEstimateModel.Estimate(seedDir)
+}
@@ -0,0 +1,82 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/image/preseed"
+)
+
+func mockSeedSnaps(c *C, seedDir string, sizes ...int) {
+	snapsDir := filepath.Join(seedDir, "snaps")
+	c.Assert(os.MkdirAll(snapsDir, 0755), IsNil)
+	for i, size := range sizes {
+		path := filepath.Join(snapsDir, string(rune('a'+i))+"_1.snap")
+		c.Assert(ioutil.WriteFile(path, make([]byte, size), 0644), IsNil)
+	}
+}
+
+func (s *preseedSuite) TestEstimateDuration(c *C) {
+	empty := c.MkDir()
+	mockSeedSnaps(c, empty)
+	small := c.MkDir()
+	mockSeedSnaps(c, small, 1<<20, 1<<20)
+	moreSnaps := c.MkDir()
+	mockSeedSnaps(c, moreSnaps, 1<<20, 1<<20, 1<<20)
+	largerSnaps := c.MkDir()
+	mockSeedSnaps(c, largerSnaps, 1<<20, 1<<20, 4<<20)
+
+	var estimates []time.Duration
+	for _, seedDir := range []string{empty, small, moreSnaps, largerSnaps} {
+		d, err := preseed.EstimateDuration(seedDir)
+		c.Assert(err, IsNil)
+		estimates = append(estimates, d)
+	}
+	c.Check(estimates[0], Equals, preseed.DefaultEstimateModel.Base)
+	for i := 1; i < len(estimates); i++ {
+		c.Check(estimates[i] > estimates[i-1], Equals, true, Commentf("%v", estimates))
+	}
+}
+
+func (s *preseedSuite) TestEstimateModel(c *C) {
+	seedDir := c.MkDir()
+	mockSeedSnaps(c, seedDir, 1<<20, 3<<20)
+
+	model := preseed.EstimateModel{
+		Base:    time.Minute,
+		PerSnap: time.Second,
+		PerMiB:  time.Millisecond,
+	}
+	d, err := model.Estimate(seedDir)
+	c.Assert(err, IsNil)
+	c.Check(d, Equals, time.Minute+2*time.Second+4*time.Millisecond)
+}
+
+func (s *preseedSuite) TestEstimateDurationNoSeed(c *C) {
+	seedDir := filepath.Join(c.MkDir(), "seed")
+	_, err := preseed.EstimateDuration(seedDir)
+	c.Check(err, ErrorMatches, `cannot preseed: no seed found under .*/seed`)
+}
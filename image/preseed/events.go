@@ -0,0 +1,123 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"time"
+)
+
+// Stage identifies a step of the preseeding process.
+type Stage string
+
+const (
+	// StageCheckChroot is the validation of the target chroot.
+	StageCheckChroot Stage = "check-chroot"
+	// StageMountSnapd is the mounting of the core/snapd snap from the seed.
+	StageMountSnapd Stage = "mount-snapd"
+	// StageRunSnapd is the execution of snapd in preseed mode.
+	StageRunSnapd Stage = "run-snapd"
+	// StageWriteArtifacts is the post-processing of the preseed artifacts
+	// once snapd ran, e.g. exporting the apparmor cache.
+	StageWriteArtifacts Stage = "write-artifacts"
+	// StageCleanup is the unmounting and removal of temporary mountpoints.
+	StageCleanup Stage = "cleanup"
+	// StageDone is reported once preseeding finished successfully.
+	StageDone Stage = "done"
+	// StageFailed is reported when preseeding failed, the event detail
+	// carries the error.
+	StageFailed Stage = "failed"
+)
+
+// PreseedEvent describes progress of preseeding.
+type PreseedEvent struct {
+	Stage  Stage
+	Time   time.Time
+	Detail string
+}
+
+var timeNow = time.Now
+
+// emitEvent sends an event for the given stage over the events
+// channel. The send never blocks: if the channel is not ready to receive
+// (e.g. its buffer is full) the event is dropped, so that a slow consumer
+// cannot stall preseeding. The channel is never closed by the preseeder.
+func emitEvent(events chan<- PreseedEvent, stage Stage, detail string) {
+	if events == nil {
+		return
+	}
+	ev := PreseedEvent{
+		Stage:  stage,
+		Time:   timeNow(),
+		Detail: detail,
+	}
+	select {
+	case events <- ev:
+	default:
+	}
+}
+
+// Tracer creates spans for the stages of preseeding. It is deliberately
+// small so that it can be adapted to a tracing library such as
+// OpenTelemetry, where StartSpan would start a child span of the span
+// the adapter was created for.
+type Tracer interface {
+	// StartSpan starts a span with the given name and attributes.
+	StartSpan(name string, attrs map[string]string) Span
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// End ends the span, err is the error preseeding failed with, if any.
+	End(err error)
+}
+
+// stageSpans keeps a span open for the current stage of preseeding,
+// ending it once the next stage is entered.
+type stageSpans struct {
+	tracer Tracer
+	chroot string
+	// snapdVersion is the version of snapd used for preseeding, once
+	// known
+	snapdVersion string
+	current      Span
+}
+
+func (s *stageSpans) enter(stage Stage) {
+	if s == nil {
+		return
+	}
+	s.end(nil)
+	attrs := map[string]string{
+		"preseed.stage":  string(stage),
+		"preseed.chroot": s.chroot,
+	}
+	if s.snapdVersion != "" {
+		attrs["preseed.snapd-version"] = s.snapdVersion
+	}
+	s.current = s.tracer.StartSpan("preseed/"+string(stage), attrs)
+}
+
+func (s *stageSpans) end(err error) {
+	if s == nil || s.current == nil {
+		return
+	}
+	s.current.End(err)
+	s.current = nil
+}
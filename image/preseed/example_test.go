@@ -0,0 +1,82 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/testutil"
+)
+
+// TestMockAllExternalEffects demonstrates how code embedding preseeding can
+// be tested without root privileges, real seeds or snaps, using only the
+// public API of the package.
+func (s *preseedSuite) TestMockAllExternalEffects(c *C) {
+	chrootDir := c.MkDir()
+
+	// paths inside the target are resolved against the root directory,
+	// as nothing is chrooted into
+	dirs.SetRootDir(chrootDir)
+	defer dirs.SetRootDir("")
+
+	// the mountpoints required by preseeding
+	c.Assert(os.MkdirAll(filepath.Join(chrootDir, "/sys/kernel/security/apparmor"), 0755), IsNil)
+	restore := osutil.MockMountInfo(fmt.Sprintf(`912 920 0:57 / %[1]s/proc rw - proc proc rw
+914 913 0:7 / %[1]s/sys/kernel/security rw - securityfs securityfs rw
+915 920 0:58 / %[1]s/dev rw - tmpfs none rw
+`, chrootDir))
+	defer restore()
+
+	// the seed
+	restore = preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		return &Fake16Seed{
+			AssertsModel: mockClassicModel(),
+			Essential:    []*seed.Snap{{Path: "/var/lib/snapd/seed/snaps/core_1.snap", SideInfo: &snap.SideInfo{RealName: "core"}}},
+		}, nil
+	})
+	defer restore()
+
+	// the core snap, as it would be mounted, and snapd from the deb
+	snapdMountDir := filepath.Join(chrootDir, "/tmp/snapd-preseed")
+	restore = preseed.MockSnapdMountPath(snapdMountDir)
+	defer restore()
+	mockVersionFiles(c, snapdMountDir, "2.44.0", chrootDir, "2.41.0")
+
+	// chroot, mount and running snapd
+	backend := &preseed.FakeBackend{}
+
+	c.Assert(preseed.Classic(chrootDir, &preseed.ClassicOptions{Backend: backend}), IsNil)
+
+	c.Check(backend.Chroots, DeepEquals, []string{chrootDir})
+	c.Check(backend.Mounts, DeepEquals, [][]string{
+		{"-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/var/lib/snapd/seed/snaps/core_1.snap", filepath.Join(chrootDir, snapdMountDir)},
+	})
+	c.Check(backend.Snapd, DeepEquals, [][]string{{filepath.Join(snapdMountDir, "usr/lib/snapd/snapd")}})
+	c.Check(dirs.SnapStateFile, testutil.FilePresent)
+}
@@ -20,25 +20,101 @@
 package preseed
 
 import (
-	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/gadget"
 )
 
 var (
+	CheckChroot              = checkChroot
 	SystemSnapFromSeed       = systemSnapFromSeed
 	ChooseTargetSnapdVersion = chooseTargetSnapdVersion
 	CreatePreseedArtifact    = createPreseedArtifact
+	ParseUdevRule            = parseUdevRule
+	ValidateUdevRulesFile    = validateUdevRulesFile
+	SeedConfinedSnaps        = seedConfinedSnaps
+	ParseAppArmorFeatures    = parseAppArmorFeatures
+	SquashfsCompression      = squashfsCompression
 )
 
 type PreseedOpts = preseedOpts
 
-func MockSeedOpen(f func(rootDir, label string) (seed.Seed, error)) (restore func()) {
-	oldSeedOpen := seedOpen
-	seedOpen = f
+func MockResetPreseededChroot(f func(dir string) error) (restore func()) {
+	old := resetPreseededChroot
+	resetPreseededChroot = f
 	return func() {
-		seedOpen = oldSeedOpen
+		resetPreseededChroot = old
+	}
+}
+
+func MockClassic(f func(chrootDir string, opts *ClassicOptions) error) (restore func()) {
+	old := classic
+	classic = f
+	return func() {
+		classic = old
+	}
+}
+
+func MockCore20(f func(prepareImageDir string, opts *CoreOptions) error) (restore func()) {
+	old := core20
+	core20 = f
+	return func() {
+		core20 = old
+	}
+}
+
+func MockOnDiskVolumeFromDevice(f func(device string) (*gadget.OnDiskVolume, error)) (restore func()) {
+	old := onDiskVolumeFromDevice
+	onDiskVolumeFromDevice = f
+	return func() {
+		onDiskVolumeFromDevice = old
+	}
+}
+
+func MockOsExit(f func(code int)) (restore func()) {
+	old := osExit
+	osExit = f
+	return func() {
+		osExit = old
+	}
+}
+
+func MockValidateSeed(f func(seedYamlFile string) error) (restore func()) {
+	old := validateSeed
+	validateSeed = f
+	return func() {
+		validateSeed = old
+	}
+}
+
+func MockProcDir(dir string) (restore func()) {
+	old := procDir
+	procDir = dir
+	return func() {
+		procDir = old
 	}
 }
 
 func SnapdPathAndVersion(targetSnapd *targetSnapdInfo) (string, string) {
 	return targetSnapd.path, targetSnapd.version
 }
+
+func (opts *ClassicOptions) ChrootMountPath() string {
+	return opts.mountPath()
+}
+
+func MockOsLchown(f func(path string, uid, gid int) error) (restore func()) {
+	old := osLchown
+	osLchown = f
+	return func() {
+		osLchown = old
+	}
+}
+
+func MockSeedFormatSnapdVersions(format, since, until string) (restore func()) {
+	old := seedFormatSnapdVersions
+	seedFormatSnapdVersions = map[string]snapdVersionRange{
+		format: {since: since, until: until},
+	}
+	return func() {
+		seedFormatSnapdVersions = old
+	}
+}
@@ -0,0 +1,322 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+var makeImageMountDir = func() (string, error) {
+	return ioutil.TempDir("", "preseed-image-")
+}
+
+// PrepareChrootMounts bind mounts /proc, /dev and /sys/kernel/security of
+// the host under chrootDir, which are required for preseeding with Classic,
+// creating the mountpoints if needed. The returned function unmounts them.
+func PrepareChrootMounts(chrootDir string) (cleanup func() error, err error) {
+	var mounted []string
+	cleanup = func() error {
+		var firstErr error
+		for i := len(mounted) - 1; i >= 0; i-- {
+			mnt := mounted[i]
+			if out, err := exec.Command("umount", mnt).CombinedOutput(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("cannot unmount %s: %v", mnt, osutil.OutputErr(out, err))
+			}
+		}
+		mounted = nil
+		return firstErr
+	}
+
+	for _, dir := range []string{"/proc", "/dev", "/sys/kernel/security"} {
+		where := filepath.Join(chrootDir, dir)
+		if err := os.MkdirAll(where, 0755); err != nil {
+			cleanup()
+			return nil, err
+		}
+		if out, err := exec.Command("mount", "--bind", dir, where).CombinedOutput(); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("cannot bind mount %s under %s: %v", dir, chrootDir, osutil.OutputErr(out, err))
+		}
+		mounted = append(mounted, where)
+	}
+	return cleanup, nil
+}
+
+// saveRoot returns a function that brings the process back to its current
+// root and working directory, after it was chrooted into the target system.
+func saveRoot() (restore func(), err error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.Open("/")
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		defer root.Close()
+		if err := syscall.Fchdir(int(root.Fd())); err != nil {
+			fmt.Fprintf(Stderr, "cannot change to the original root directory: %v\n", err)
+			return
+		}
+		if err := syscallChroot("."); err != nil {
+			fmt.Fprintf(Stderr, "cannot restore the original root directory: %v\n", err)
+			return
+		}
+		if err := os.Chdir(cwd); err != nil {
+			fmt.Fprintf(Stderr, "cannot restore the working directory: %v\n", err)
+		}
+	}, nil
+}
+
+// ClassicImage runs preseeding of a classic ubuntu system stored in the
+// filesystem image imageFile. The image is attached to a loop device and
+// mounted, together with the virtual filesystems needed by preseeding, for
+// the duration of Classic. The loop device is always detached on return.
+func ClassicImage(imageFile string, opts *ClassicOptions) error {
+	var err error
+	imageFile, err = filepath.Abs(imageFile)
+	if err != nil {
+		return err
+	}
+
+	cleanups := &cleanupStack{}
+	defer cleanups.run()
+	if opts != nil && opts.HandleSignals {
+		stop := handleSignals(cleanups)
+		defer stop()
+		// Classic adds its cleanups to ours
+		optsWithCleanups := *opts
+		optsWithCleanups.parentCleanups = cleanups
+		opts = &optsWithCleanups
+	}
+
+	out, err := exec.Command("losetup", "--find", "--show", imageFile).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot attach %s to a loop device: %v", imageFile, osutil.OutputErr(out, err))
+	}
+	loopDev := strings.TrimSpace(string(out))
+	cleanups.push(func() {
+		if out, err := exec.Command("losetup", "--detach", loopDev).CombinedOutput(); err != nil {
+			fmt.Fprintf(Stderr, "cannot detach loop device %s: %v\n", loopDev, osutil.OutputErr(out, err))
+		}
+	})
+
+	mountDir, err := makeImageMountDir()
+	if err != nil {
+		return fmt.Errorf("cannot create mountpoint for %s: %v", imageFile, err)
+	}
+	cleanups.push(func() {
+		if err := os.Remove(mountDir); err != nil {
+			fmt.Fprintf(Stderr, "%v\n", err)
+		}
+	})
+
+	if out, err := exec.Command("mount", loopDev, mountDir).CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot mount %s at %s: %v", loopDev, mountDir, osutil.OutputErr(out, err))
+	}
+	cleanups.push(func() {
+		if out, err := exec.Command("umount", mountDir).CombinedOutput(); err != nil {
+			fmt.Fprintf(Stderr, "cannot unmount %s: %v\n", mountDir, osutil.OutputErr(out, err))
+		}
+	})
+
+	cleanupMounts, err := PrepareChrootMounts(mountDir)
+	if err != nil {
+		return err
+	}
+	cleanups.push(func() {
+		if err := cleanupMounts(); err != nil {
+			fmt.Fprintf(Stderr, "%v\n", err)
+		}
+	})
+
+	// Classic chroots into the target, the mounts above can only be
+	// cleaned up from the original root.
+	restoreRoot, err := saveRoot()
+	if err != nil {
+		return err
+	}
+	cleanups.push(restoreRoot)
+
+	return Classic(mountDir, opts)
+}
+
+var classic = Classic
+
+// ClassicFromTar runs preseeding of a classic ubuntu rootfs stored in the
+// tarball tarPath, e.g. the rootfs of a container image. The rootfs is
+// extracted into the rootfs directory under workDir, which must not exist
+// yet, and the virtual filesystems needed by preseeding are mounted for the
+// duration of Classic. The preseeded rootfs is optionally packed into a new
+// tarball. The extracted rootfs is removed when done, unless KeepRootfs is
+// set.
+func ClassicFromTar(tarPath, workDir string, opts *ClassicFromTarOptions) error {
+	if opts == nil {
+		opts = &ClassicFromTarOptions{}
+	}
+
+	workDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return err
+	}
+	rootfs := filepath.Join(workDir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return fmt.Errorf("cannot create directory for the rootfs: %v", err)
+	}
+	defer func() {
+		if opts.KeepRootfs {
+			return
+		}
+		// removing the rootfs with anything still mounted there would
+		// reach into the filesystems of the host
+		if err := checkNothingMountedUnder(rootfs); err != nil {
+			fmt.Fprintf(Stderr, "not removing %s: %v\n", rootfs, err)
+			return
+		}
+		if err := os.RemoveAll(rootfs); err != nil {
+			fmt.Fprintf(Stderr, "cannot remove %s: %v\n", rootfs, err)
+		}
+	}()
+
+	if out, err := exec.Command("tar", "-xpf", tarPath, "--numeric-owner", "-C", rootfs).CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot extract %s: %v", tarPath, osutil.OutputErr(out, err))
+	}
+
+	if err := preseedRootfs(rootfs, opts.ClassicOptions); err != nil {
+		return err
+	}
+
+	if opts.RepackPath != "" {
+		if err := checkNothingMountedUnder(rootfs); err != nil {
+			return err
+		}
+		if out, err := exec.Command("tar", "-cpf", opts.RepackPath, "--numeric-owner", "-C", rootfs, ".").CombinedOutput(); err != nil {
+			return fmt.Errorf("cannot pack %s: %v", opts.RepackPath, osutil.OutputErr(out, err))
+		}
+	}
+	return nil
+}
+
+// preseedRootfs mounts the virtual filesystems needed by preseeding under
+// rootfs and preseeds it.
+func preseedRootfs(rootfs string, opts *ClassicOptions) error {
+	cleanupMounts, err := PrepareChrootMounts(rootfs)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cleanupMounts(); err != nil {
+			fmt.Fprintf(Stderr, "%v\n", err)
+		}
+	}()
+
+	// Classic chroots into rootfs, the mounts above can only be cleaned up
+	// from the original root
+	restoreRoot, err := saveRoot()
+	if err != nil {
+		return err
+	}
+	defer restoreRoot()
+
+	return classic(rootfs, opts)
+}
+
+// checkNothingMountedUnder returns an error if anything is mounted at dir
+// or below.
+func checkNothingMountedUnder(dir string) error {
+	entries, err := osutil.LoadMountInfo()
+	if err != nil {
+		return fmt.Errorf("cannot parse mount info: %v", err)
+	}
+	for _, ent := range entries {
+		if ent.MountDir == dir || strings.HasPrefix(ent.MountDir, dir+"/") {
+			return fmt.Errorf("%s is still mounted", ent.MountDir)
+		}
+	}
+	return nil
+}
+
+var resetPreseededChroot = ResetPreseededChroot
+
+// SelfTest preseeds the classic system at chrootDir, resets it and verifies
+// that none of the preseed artifacts, as described by ArtifactPatterns,
+// remain. Any leftovers are listed in the returned error. The chroot is
+// left reset.
+func SelfTest(chrootDir string) error {
+	// preseeding chroots into the target, the result is checked and reset
+	// from inside of it
+	restoreRoot, err := saveRoot()
+	if err != nil {
+		return err
+	}
+	defer restoreRoot()
+
+	if err := Classic(chrootDir, nil); err != nil {
+		return err
+	}
+
+	preseeded, err := collectArtifacts("/")
+	if err != nil {
+		return err
+	}
+	if len(preseeded) == 0 {
+		return fmt.Errorf("self-test failed: preseeding of %s produced no artifacts", chrootDir)
+	}
+
+	if err := resetPreseededChroot("/"); err != nil {
+		return fmt.Errorf("self-test failed: cannot reset %s: %v", chrootDir, err)
+	}
+
+	remaining, err := collectArtifacts("/")
+	if err != nil {
+		return err
+	}
+	if len(remaining) > 0 {
+		leftovers := make([]string, 0, len(remaining))
+		for path := range remaining {
+			leftovers = append(leftovers, path)
+		}
+		sort.Strings(leftovers)
+		return fmt.Errorf("self-test failed: reset of %s left %d preseed artifacts behind:\n - %s",
+			chrootDir, len(leftovers), strings.Join(leftovers, "\n - "))
+	}
+	return nil
+}
+
+func MockMakeImageMountDir(f func() (string, error)) (restore func()) {
+	osutil.MustBeTestBinary("mocking can be done only in tests")
+
+	old := makeImageMountDir
+	makeImageMountDir = f
+	return func() {
+		makeImageMountDir = old
+	}
+}
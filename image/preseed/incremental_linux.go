@@ -0,0 +1,117 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/osutil"
+	apparmor_sandbox "github.com/snapcore/snapd/sandbox/apparmor"
+	"github.com/snapcore/snapd/snap"
+)
+
+// seedSnapRevisions returns the revisions of the snaps of the seed at
+// seedDir, keyed by snap name. Snaps without a store revision are left out,
+// as the same local revision does not mean the same snap.
+func seedSnapRevisions(seedDir string) (map[string]snap.Revision, error) {
+	sd, err := loadSeed(seedDir, "")
+	if err != nil {
+		return nil, err
+	}
+	runSnaps, err := sd.ModeSnaps("run")
+	if err != nil {
+		return nil, err
+	}
+	revisions := make(map[string]snap.Revision)
+	for _, sn := range append(sd.EssentialSnaps(), runSnaps...) {
+		if sn.SideInfo == nil || !sn.SideInfo.Revision.Store() {
+			continue
+		}
+		revisions[sn.SnapName()] = sn.SideInfo.Revision
+	}
+	return revisions, nil
+}
+
+// snapSecurityArtifacts returns the glob patterns of the apparmor and
+// seccomp artifacts generated for the given snap, relative to the root of
+// the preseeded system.
+func snapSecurityArtifacts(snapName string) []string {
+	return []string{
+		filepath.Join(dirs.SnapAppArmorDir, fmt.Sprintf("snap.%s.*", snapName)),
+		filepath.Join(dirs.SnapAppArmorDir, fmt.Sprintf("snap-update-ns.%s", snapName)),
+		filepath.Join(apparmor_sandbox.CacheDir, fmt.Sprintf("snap.%s.*", snapName)),
+		filepath.Join(apparmor_sandbox.CacheDir, fmt.Sprintf("snap-update-ns.%s", snapName)),
+		filepath.Join(dirs.SnapSeccompDir, fmt.Sprintf("snap.%s.*", snapName)),
+	}
+}
+
+// reuseSecurityArtifacts copies the apparmor and seccomp artifacts of the
+// snaps whose revision did not change from the preseeded system at prevDir
+// into the system at preseedChroot, before snapd runs. Snapd only
+// regenerates and recompiles profiles whose contents changed, so just the
+// artifacts of the changed snaps are generated again. It returns the names
+// of the snaps whose artifacts were reused.
+func reuseSecurityArtifacts(preseedChroot, seedDir, prevDir string) ([]string, error) {
+	if !IsPreseeded(prevDir) {
+		return nil, fmt.Errorf("cannot reuse artifacts of %s, it is not preseeded", prevDir)
+	}
+	prevRevisions, err := seedSnapRevisions(dirs.SnapSeedDirUnder(prevDir))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the seed of %s: %v", prevDir, err)
+	}
+	revisions, err := seedSnapRevisions(seedDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var reused []string
+	for name, rev := range revisions {
+		if prevRev, ok := prevRevisions[name]; !ok || prevRev != rev {
+			continue
+		}
+		for _, pattern := range snapSecurityArtifacts(name) {
+			matches, err := filepath.Glob(filepath.Join(prevDir, pattern))
+			if err != nil {
+				return nil, err
+			}
+			for _, src := range matches {
+				rel, err := filepath.Rel(prevDir, src)
+				if err != nil {
+					return nil, err
+				}
+				dst := filepath.Join(preseedChroot, rel)
+				if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+					return nil, err
+				}
+				if out, err := exec.Command("cp", "-a", "--reflink=auto", src, dst).CombinedOutput(); err != nil {
+					return nil, fmt.Errorf("cannot reuse %s: %v", src, osutil.OutputErr(out, err))
+				}
+			}
+		}
+		reused = append(reused, name)
+	}
+	sort.Strings(reused)
+	return reused, nil
+}
@@ -0,0 +1,103 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
+	apparmor_sandbox "github.com/snapcore/snapd/sandbox/apparmor"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/testutil"
+)
+
+func (s *preseedSuite) TestRunPreseedReuseFrom(c *C) {
+	tmpDir := c.MkDir()
+	prevDir := c.MkDir()
+	// snapd generates the profiles which are not there yet; note, the
+	// artifacts are reused from the host side, i.e. under tmpDir
+	profilesDir := filepath.Join(tmpDir, dirs.SnapAppArmorDir)
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf(`mkdir -p %[1]s
+for p in foo bar; do
+	[ -e %[1]s/snap.$p.app ] || echo new > %[1]s/snap.$p.app
+done
+`, profilesDir))
+
+	seedSnaps := func(barRev int) *Fake16Seed {
+		return &Fake16Seed{RunModeSnaps: []*seed.Snap{
+			{Path: "/a/foo.snap", SideInfo: &snap.SideInfo{RealName: "foo", Revision: snap.R(1)}},
+			{Path: "/a/bar.snap", SideInfo: &snap.SideInfo{RealName: "bar", Revision: snap.R(barRev)}},
+			{Path: "/a/local.snap", SideInfo: &snap.SideInfo{RealName: "local", Revision: snap.R(-1)}},
+		}}
+	}
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		if strings.HasPrefix(seedDir, prevDir) {
+			return seedSnaps(2), nil
+		}
+		return seedSnaps(3), nil
+	})
+	defer restore()
+
+	// artifacts of the previous run
+	prevFiles := map[string]string{
+		dirs.SnapStateFile: "{}",
+		filepath.Join(dirs.SnapAppArmorDir, "snap.foo.app"):       "old",
+		filepath.Join(dirs.SnapAppArmorDir, "snap.bar.app"):       "old",
+		filepath.Join(dirs.SnapAppArmorDir, "snap.local.app"):     "old",
+		filepath.Join(apparmor_sandbox.CacheDir, "snap.foo.app"):  "old cache",
+		filepath.Join(apparmor_sandbox.CacheDir, "snap.bar.app"):  "old cache",
+		filepath.Join(dirs.SnapSeccompDir, "snap.foo.app.bin"):    "old bpf",
+		filepath.Join(dirs.SnapSeccompDir, "snap.foobar.app.bin"): "other snap",
+	}
+	for path, content := range prevFiles {
+		fullPath := filepath.Join(prevDir, path)
+		c.Assert(os.MkdirAll(filepath.Dir(fullPath), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(fullPath, []byte(content), 0644), IsNil)
+	}
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{ReuseFrom: prevDir}), IsNil)
+
+	// only the unchanged snap is reused
+	c.Check(filepath.Join(profilesDir, "snap.foo.app"), testutil.FileEquals, "old")
+	c.Check(filepath.Join(tmpDir, apparmor_sandbox.CacheDir, "snap.foo.app"), testutil.FileEquals, "old cache")
+	c.Check(filepath.Join(tmpDir, dirs.SnapSeccompDir, "snap.foo.app.bin"), testutil.FileEquals, "old bpf")
+	c.Check(filepath.Join(profilesDir, "snap.bar.app"), testutil.FileEquals, "new\n")
+	c.Check(filepath.Join(tmpDir, apparmor_sandbox.CacheDir, "snap.bar.app"), testutil.FileAbsent)
+	c.Check(filepath.Join(profilesDir, "snap.local.app"), testutil.FileAbsent)
+	c.Check(filepath.Join(tmpDir, dirs.SnapSeccompDir, "snap.foobar.app.bin"), testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestRunPreseedReuseFromNotPreseeded(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	prevDir := c.MkDir()
+
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{ReuseFrom: prevDir})
+	c.Assert(err, ErrorMatches, fmt.Sprintf("cannot reuse artifacts of %s, it is not preseeded", prevDir))
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
@@ -0,0 +1,74 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Manifest records the preseed artifacts, as described by ArtifactPatterns,
+// found in a preseeded system. It allows to check later that a reset of
+// that system reverted exactly that preseeding run.
+type Manifest struct {
+	// Artifacts are the paths of the artifacts, relative to the root of
+	// the system, sorted.
+	Artifacts []string `json:"artifacts"`
+}
+
+// RecordManifest returns the manifest of the preseed artifacts found in the
+// system under dir.
+func RecordManifest(dir string) (Manifest, error) {
+	var manifest Manifest
+	err := walkArtifacts(dir, func(path, rel string, info os.FileInfo) error {
+		manifest.Artifacts = append(manifest.Artifacts, rel)
+		return nil
+	})
+	if err != nil {
+		return Manifest{}, fmt.Errorf("cannot record preseed manifest: %v", err)
+	}
+	sort.Strings(manifest.Artifacts)
+	return manifest, nil
+}
+
+// VerifyResetAgainstManifest checks that none of the artifacts recorded in
+// the manifest remain in the system under dir, i.e. that a reset fully
+// reverted the preseeding run the manifest was recorded for. Any leftovers
+// are listed in the returned error.
+func VerifyResetAgainstManifest(dir string, manifest Manifest) error {
+	var leftovers []string
+	for _, rel := range manifest.Artifacts {
+		_, err := os.Lstat(filepath.Join(dir, rel))
+		switch {
+		case err == nil:
+			leftovers = append(leftovers, rel)
+		case !os.IsNotExist(err):
+			return fmt.Errorf("cannot verify reset of %s: %v", dir, err)
+		}
+	}
+	if len(leftovers) > 0 {
+		return fmt.Errorf("reset of %s left %d artifacts of the manifest behind:\n - %s",
+			dir, len(leftovers), strings.Join(leftovers, "\n - "))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/testutil"
+)
+
+func (s *preseedSuite) TestRecordManifest(c *C) {
+	tmpDir := c.MkDir()
+	mockPreseedArtifacts(c, tmpDir)
+
+	manifest, err := preseed.RecordManifest(tmpDir)
+	c.Assert(err, IsNil)
+	c.Check(manifest.Artifacts, DeepEquals, []string{
+		"/etc/systemd/system/snap-foo-1.mount",
+		"/var/lib/snapd/sequence",
+		"/var/lib/snapd/sequence/foo.json",
+		"/var/lib/snapd/state.json",
+		"/var/snap/foo",
+		"/var/snap/foo/1",
+		"/var/snap/foo/1/data",
+		"/var/snap/foo/current",
+	})
+}
+
+func (s *preseedSuite) TestVerifyResetAgainstManifest(c *C) {
+	tmpDir := c.MkDir()
+	mockPreseedArtifacts(c, tmpDir)
+
+	manifest, err := preseed.RecordManifest(tmpDir)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Artifacts, Not(HasLen), 0)
+
+	// not reset yet
+	c.Check(preseed.VerifyResetAgainstManifest(tmpDir, manifest), ErrorMatches,
+		fmt.Sprintf(`reset of %s left %d artifacts of the manifest behind:\n - .*`, tmpDir, len(manifest.Artifacts)))
+
+	c.Assert(preseed.ResetPreseededChroot(tmpDir), IsNil)
+	c.Check(preseed.VerifyResetAgainstManifest(tmpDir, manifest), IsNil)
+
+	// an artifact leaked by the reset is reported
+	leaked := filepath.Join(dirs.SnapSeqDir, "foo.json")
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, dirs.SnapSeqDir), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, leaked), nil, 0644), IsNil)
+	c.Check(preseed.VerifyResetAgainstManifest(tmpDir, manifest), ErrorMatches,
+		fmt.Sprintf(`reset of %s left 2 artifacts of the manifest behind:\n - %s\n - %s`, tmpDir, dirs.SnapSeqDir, leaked))
+}
+
+func (s *preseedSuite) TestIsResetComplete(c *C) {
+	tmpDir := c.MkDir()
+	mockPreseedArtifacts(c, tmpDir)
+
+	complete, leftovers, err := preseed.IsResetComplete(tmpDir)
+	c.Assert(err, IsNil)
+	c.Check(complete, Equals, false)
+	c.Check(leftovers, testutil.Contains, dirs.SnapStateFile)
+
+	c.Assert(preseed.ResetPreseededChroot(tmpDir), IsNil)
+	complete, leftovers, err = preseed.IsResetComplete(tmpDir)
+	c.Assert(err, IsNil)
+	c.Check(complete, Equals, true)
+	c.Check(leftovers, HasLen, 0)
+	c.Check(preseed.IsPreseeded(tmpDir), Equals, false)
+
+	// a leaked artifact is reported
+	leaked := filepath.Join(dirs.SnapServicesDir, "snap.foo.app.service")
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, leaked), nil, 0644), IsNil)
+	complete, leftovers, err = preseed.IsResetComplete(tmpDir)
+	c.Assert(err, IsNil)
+	c.Check(complete, Equals, false)
+	c.Check(leftovers, DeepEquals, []string{leaked})
+}
@@ -0,0 +1,93 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/release"
+)
+
+// readOSRelease reads the ID and VERSION_ID of the system under rootDir from
+// its os-release file. It returns nil if the system has no os-release file.
+func readOSRelease(rootDir string) (*release.OS, error) {
+	f, err := os.Open(filepath.Join(rootDir, "/etc/os-release"))
+	if os.IsNotExist(err) {
+		// the fallback as per os-release(5)
+		f, err = os.Open(filepath.Join(rootDir, "/usr/lib/os-release"))
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// from os-release(5): if not set, defaults to "ID=linux"
+	osRelease := &release.OS{ID: "linux"}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		v := strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+		switch strings.TrimSpace(kv[0]) {
+		case "ID":
+			osRelease.ID = strings.ToLower(v)
+		case "VERSION_ID":
+			osRelease.VersionID = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return osRelease, nil
+}
+
+// checkOSRelease compares the release of the system under preseedChroot with
+// the one of the host and warns when they differ, as apparmor and seccomp
+// artifacts generated on the host may then be incompatible with the target.
+// With requireMatch the mismatch is an error instead.
+func checkOSRelease(preseedChroot string, requireMatch bool) error {
+	target, err := readOSRelease(preseedChroot)
+	if err != nil {
+		return fmt.Errorf("cannot read os-release of %s: %v", preseedChroot, err)
+	}
+	if target == nil {
+		return nil
+	}
+	host := release.ReleaseInfo
+	if target.ID == host.ID && target.VersionID == host.VersionID {
+		return nil
+	}
+	msg := fmt.Sprintf("preseeding %s %s on a %s %s host, apparmor and seccomp artifacts may be incompatible with the target system",
+		target.ID, target.VersionID, host.ID, host.VersionID)
+	if requireMatch {
+		return fmt.Errorf("cannot preseed: %s", msg)
+	}
+	fmt.Fprintf(Stderr, "WARNING: %s\n", msg)
+	return nil
+}
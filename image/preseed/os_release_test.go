@@ -0,0 +1,80 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/release"
+)
+
+func mockOSRelease(c *C, rootDir, content string) {
+	c.Assert(os.MkdirAll(filepath.Join(rootDir, "/etc"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(rootDir, "/etc/os-release"), []byte(content), 0644), IsNil)
+}
+
+func (s *preseedSuite) TestRunPreseedOSReleaseMismatch(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	mockOSRelease(c, tmpDir, "NAME=\"Ubuntu\"\nID=ubuntu\nVERSION_ID=\"18.04\"\n")
+	s.AddCleanup(release.MockReleaseInfo(&release.OS{ID: "ubuntu", VersionID: "22.04"}))
+
+	var stderr bytes.Buffer
+	oldStderr := preseed.Stderr
+	preseed.Stderr = &stderr
+	defer func() { preseed.Stderr = oldStderr }()
+
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(stderr.String(), Equals, "WARNING: preseeding ubuntu 18.04 on a ubuntu 22.04 host, apparmor and seccomp artifacts may be incompatible with the target system\n")
+}
+
+func (s *preseedSuite) TestRunPreseedOSReleaseMismatchRequired(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	mockOSRelease(c, tmpDir, "ID=debian\nVERSION_ID=\"12\"\n")
+	s.AddCleanup(release.MockReleaseInfo(&release.OS{ID: "ubuntu", VersionID: "22.04"}))
+
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{RequireMatchingRelease: true})
+	c.Assert(err, ErrorMatches, `cannot preseed: preseeding debian 12 on a ubuntu 22.04 host, apparmor and seccomp artifacts may be incompatible with the target system`)
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedOSReleaseMatch(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	// os-release from the fallback location
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "/usr/lib"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, "/usr/lib/os-release"), []byte("ID='Ubuntu'\nVERSION_ID=22.04\n"), 0644), IsNil)
+	s.AddCleanup(release.MockReleaseInfo(&release.OS{ID: "ubuntu", VersionID: "22.04"}))
+
+	var stderr bytes.Buffer
+	oldStderr := preseed.Stderr
+	preseed.Stderr = &stderr
+	defer func() { preseed.Stderr = oldStderr }()
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{RequireMatchingRelease: true}), IsNil)
+	c.Check(stderr.String(), Equals, "")
+}
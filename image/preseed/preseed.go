@@ -25,8 +25,14 @@
 package preseed
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"time"
+
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
 )
 
 var (
@@ -34,11 +40,518 @@ var (
 	Stderr io.Writer = os.Stderr
 )
 
+// DefaultMountPath is the directory, inside the chroot, where the core or
+// snapd snap is mounted while preseeding, unless ClassicOptions.MountPath or
+// TempDir are set. Base snaps are mounted next to it, at
+// DefaultMountPath-<snap file name>. Mounts left there by an aborted run are
+// cleaned up by the next one.
+const DefaultMountPath = "/tmp/snapd-preseed"
+
+// snapdPreseedSupportVer is the minimum version of snapd which supports
+// preseeding.
+const snapdPreseedSupportVer = `2.43.3+`
+
+// ErrNoSeed is matched, with errors.Is, by the error returned when the system
+// to preseed does not contain a seed.
+var ErrNoSeed = errors.New("no seed found")
+
+// NoSeedError is returned when no seed can be found in the system to
+// preseed, typically because prepare-image was not run.
+type NoSeedError struct {
+	SeedDir string
+}
+
+func (e *NoSeedError) Error() string {
+	return fmt.Sprintf("cannot preseed: no seed found under %s", e.SeedDir)
+}
+
+func (e *NoSeedError) Is(target error) bool {
+	return target == ErrNoSeed
+}
+
+// AlreadyPreseededError is returned by AssertReadyForPreseed when the system
+// was preseeded already, see IsPreseeded.
+type AlreadyPreseededError struct {
+	ChrootDir string
+}
+
+func (e *AlreadyPreseededError) Error() string {
+	return fmt.Sprintf("the system at %q appears to be preseeded", e.ChrootDir)
+}
+
+// InvalidChrootError is returned by AssertReadyForPreseed when the chroot
+// is not suitable for preseeding, e.g. because the required virtual
+// filesystems are not mounted there.
+type InvalidChrootError struct {
+	ChrootDir string
+	Err       error
+}
+
+func (e *InvalidChrootError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvalidChrootError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedSnapdError is returned by AssertReadyForPreseed when none of
+// the snapd available to the system supports preseeding. The advice
+// suggests how to remedy that, see VersionAdvice.
+type UnsupportedSnapdError struct {
+	Advice *Advice
+}
+
+func (e *UnsupportedSnapdError) Error() string {
+	return fmt.Sprintf("snapd %s from the %s does not support preseeding, the minimum required version is %s",
+		e.Advice.Version, e.Advice.Source, e.Advice.MinimumVersion)
+}
+
+// CoreOptions holds optional parameters for preseeding of UC20 systems.
+type CoreOptions struct {
+	// SysLabel is the label of the recovery system to preseed. It must be
+	// set if the seed contains more than one system.
+	SysLabel string
+
+	// RewriteSeed, if set, is called with the seed directory before the
+	// seed is loaded, allowing to modify it, e.g. to use a test-signed
+	// model assertion.
+	RewriteSeed func(seedDir string) error
+
+	// ValidateGadget, if set, makes preseeding check that the gadget snap
+	// in the seed matches the gadget name and track of the model before
+	// anything is mounted.
+	ValidateGadget bool
+
+	// MountSnapTypes are the types of the essential snaps from the seed
+	// mounted for preseeding, next to the snapd snap, in addition to the
+	// base of the model, which is the root of the chroot. If not set, the
+	// kernel and gadget snaps are mounted.
+	MountSnapTypes []snap.Type
+
+	// TempDir, if set, is the host directory under which the temporary
+	// chroot and writable directories of preseeding are created, instead
+	// of the default directory for temporary files. It must exist and be
+	// writable.
+	TempDir string
+
+	// AppArmorKernelFeaturesDir, if set, is a host directory describing
+	// the apparmor features of the kernel of the target device, i.e. a
+	// copy of /sys/kernel/security/apparmor/features captured there. It is
+	// bind mounted read-only over the apparmor features of the chroot, so
+	// that the profiles in the preseed artifact are generated for the
+	// target kernel rather than for the kernel of the host.
+	AppArmorKernelFeaturesDir string
+
+	// Events, if set, receives a PreseedEvent as preseeding moves through
+	// its stages, as with ClassicOptions.Events.
+	Events chan<- PreseedEvent
+}
+
+// ClassicOptions holds optional parameters for preseeding of classic systems.
+type ClassicOptions struct {
+	// CoreSnapSHA3_384 is the expected SHA3-384 digest of the core (or
+	// snapd) snap resolved from the seed. If set, the snap is verified
+	// before it gets mounted.
+	CoreSnapSHA3_384 string
+
+	// Events, if set, receives a PreseedEvent as preseeding moves through
+	// its stages. Events are sent without blocking and are dropped if the
+	// channel cannot accept them, so a buffered channel should be used.
+	// The channel is not closed when preseeding finishes.
+	Events chan<- PreseedEvent
+
+	// Tracer, if set, is used to create a span for each stage of
+	// preseeding, with the stage, the chroot and, once known, the version
+	// of snapd as attributes. The span of the last stage ends with the
+	// error preseeding failed with, if any.
+	Tracer Tracer
+
+	// Env holds additional environment variables for snapd running in
+	// preseed mode, e.g. SNAPD_DEBUG or proxy settings. SNAPD_PRESEED is
+	// always set and cannot be overridden.
+	Env map[string]string
+
+	// SnapdStdout and SnapdStderr, if set, receive the output of snapd
+	// running in preseed mode as it is produced, e.g. to log it. By
+	// default it goes to Stdout and Stderr.
+	SnapdStdout io.Writer
+	SnapdStderr io.Writer
+
+	// StraceOutput, if set, is the path, inside the chroot, of a file
+	// where a trace of snapd and its children is written by running it
+	// under strace. It is meant for debugging, e.g. hangs of snapd. If
+	// strace is not available in the chroot, a warning is printed and
+	// snapd runs normally.
+	StraceOutput string
+
+	// CPUQuota and MemoryMax, if set, limit the resources of snapd running
+	// in preseed mode. They take the values of the systemd properties of
+	// the same name, e.g. "50%" and "2G", and are applied by running
+	// snapd with systemd-run in a transient scope, which requires the
+	// systemd of the host to be reachable from the chroot. If systemd-run
+	// is not available, a warning is printed and snapd runs unconstrained.
+	CPUQuota  string
+	MemoryMax string
+
+	// RemountSecurityfs allows to preseed a chroot where securityfs is
+	// mounted read-only, by remounting it read-write for the duration of
+	// preseeding. Without it such a chroot is refused, as snapd would fail
+	// to load apparmor profiles.
+	RemountSecurityfs bool
+
+	// AppArmorFeaturesDir, if set, is a host directory with the apparmor
+	// features captured from the kernel the system is meant for, i.e. a
+	// copy of /sys/kernel/security/apparmor/features. It is bind mounted
+	// read-only over the apparmor features of the chroot for the duration
+	// of preseeding, so that snapd and apparmor_parser compile the
+	// profiles for that kernel rather than for the one of the host.
+	AppArmorFeaturesDir string
+
+	// MakeMountsPrivate changes the propagation of the mounts of the
+	// chroot which use shared propagation to private, so that the snap
+	// mounts done by preseeding cannot leak to the host. The propagation
+	// is not restored afterwards. Without it such mounts are only warned
+	// about.
+	MakeMountsPrivate bool
+
+	// RequireMatchingRelease, if set, makes preseeding fail when the ID or
+	// VERSION_ID of the os-release of the chroot differ from the ones of
+	// the host, instead of only warning about it.
+	RequireMatchingRelease bool
+
+	// AssertionsOnly, if set, only imports the assertions of the seed
+	// into the assertion database of the chroot, without mounting any
+	// snaps or running snapd. It is a fast variant of preseeding for
+	// images which need just the assertions.
+	AssertionsOnly bool
+
+	// AppArmorOnly, if set, keeps only the apparmor profiles and their
+	// cache out of the artifacts of preseeding. The generated profiles are
+	// compiled with apparmor_parser and any compilation errors are
+	// reported. Snapd still runs the whole of preseeding, the rest of its
+	// artifacts, including the snapd state, are removed afterwards. It
+	// cannot be combined with the options checking or processing the rest
+	// of the artifacts.
+	AppArmorOnly bool
+
+	// SnapshotDir, if set, is a host directory, which must not exist or
+	// be empty, where the directories of the chroot modified by preseeding
+	// are saved with Snapshot before preseeding starts. They can be
+	// restored with Rollback.
+	SnapshotDir string
+
+	// StoreURL, if set, is the URL of the store API snapd uses when it
+	// needs to fetch assertions, e.g. of a local store in airgapped
+	// builds.
+	StoreURL string
+
+	// Proxy, if set, is the HTTP(S) proxy snapd uses to reach the store.
+	Proxy string
+
+	// Offline, if set, makes any access of snapd to the network fail,
+	// rather than reach the store. It cannot be combined with StoreURL or
+	// Proxy.
+	Offline bool
+
+	// MountPath is the directory, inside the chroot, where the core/snapd
+	// snap is temporarily mounted; base snaps are mounted next to it. It
+	// is useful when the default location, DefaultMountPath, is on a small
+	// filesystem.
+	MountPath string
+
+	// TempDir, if set, is the directory, inside the chroot, under which
+	// the core/snapd snap and base snaps are temporarily mounted, unless
+	// MountPath is set. It must exist and be writable.
+	TempDir string
+
+	// RewriteSeed, if set, is called with the seed directory, as seen from
+	// inside the chroot, before the seed is loaded and the core snap is
+	// mounted. It allows to modify the seed, e.g. to use a test-signed
+	// model assertion. The seed is validated after the rewrite.
+	RewriteSeed func(seedDir string) error
+
+	// BeforeMount, if set, is called with the path of the core or snapd
+	// snap resolved from the seed, as seen from inside the chroot, right
+	// before it is mounted. It allows to verify or log the snap. An error
+	// aborts preseeding before any snap is mounted.
+	BeforeMount func(coreSnapPath string) error
+
+	// StateUpperDir, if set, is a host directory used as the upper
+	// directory of an overlay mounted over /var/lib/snapd of the chroot,
+	// so that the preseeded snapd state lands there and can be captured
+	// separately, e.g. for layered images. The overlay work directory is
+	// created at <StateUpperDir>.work. Both are left in place.
+	StateUpperDir string
+
+	// SnapdRootDir, if set, is a directory inside the chroot with an
+	// already extracted core or snapd snap. Snapd from that tree is run
+	// as is, instead of mounting the core/snapd snap from the seed and
+	// picking the newer of it and snapd from the deb. The tree can be
+	// extracted with ExtractSnapd.
+	SnapdRootDir string
+
+	// SeedDir, if set, is a host directory with the seed, used instead of
+	// the seed at /var/lib/snapd/seed of the chroot. It is bind mounted
+	// over the latter for the duration of preseeding.
+	SeedDir string
+
+	// HandleSignals, if set, makes preseeding clean up after itself, that
+	// is unmount everything it mounted, and exit the process on SIGINT or
+	// SIGTERM. It is meant for command line tools.
+	HandleSignals bool
+
+	// ImportAppArmorCache, if set, is a host path of a gzipped tarball
+	// with an apparmor cache, as written with ExportAppArmorCache. The
+	// apparmor cache directory of the chroot is populated from it before
+	// snapd runs, so that snapd does not need to compile the profiles
+	// again. It is useful when preseeding many images with the same
+	// kernel.
+	ImportAppArmorCache string
+
+	// ExportAppArmorCache, if set, is a host path where the apparmor
+	// cache generated by preseeding is written as a gzipped tarball. The
+	// file is only valid if preseeding succeeded.
+	ExportAppArmorCache string
+
+	// ValidateUdevRules, if set, makes preseeding check the syntax of the
+	// udev rules generated for the snaps, and fail if any of them is
+	// malformed, rather than having udev ignore them at boot.
+	ValidateUdevRules bool
+
+	// RequireAppArmorProfiles, if set, makes preseeding fail, rather than
+	// only warn, when no apparmor profiles were generated although the
+	// seed has snaps that need them.
+	RequireAppArmorProfiles bool
+
+	// SnapConfineProfile, if set, makes preseeding fail unless snapd
+	// generated the apparmor profile of snap-confine from the core/snapd
+	// snap. The profile is compiled into the apparmor cache if snapd did
+	// not do it already, which saves compiling it on first boot.
+	SnapConfineProfile bool
+
+	// ValidateSeed, if set, validates the seed of the preseeded system,
+	// like snap debug validate-seed does, and fails preseeding if it is
+	// invalid.
+	ValidateSeed bool
+
+	// SortSeedSnaps, if set, sorts the snaps listed in the seed.yaml of
+	// the preseeded system by name before running snapd, which seeds them
+	// in the listed order. This makes the order of the changes in the
+	// snapd state, and of the logs, reproducible. Note that seed.yaml is
+	// rewritten in place, also when the seed comes from SeedDir.
+	SortSeedSnaps bool
+
+	// TrustedAssertions are files with the account and account-key
+	// assertions to trust instead of the default trusted keys. If set,
+	// the assertions of the seed are verified against them before
+	// preseeding, which fails unless all of them are signed by these keys
+	// or keys delegated to by them. Note that snap declarations and
+	// revisions are usually signed by the store.
+	TrustedAssertions []string
+
+	// ExpectedStateFormat, if non-zero, is the format version the snapd
+	// state written by preseeding must have. Preseeding fails on mismatch,
+	// which catches snapd being older or newer than the image expects.
+	ExpectedStateFormat int
+
+	// BestEffort, if set, makes the checks of the result of preseeding,
+	// i.e. ValidateUdevRules, RequireAppArmorProfiles, SnapConfineProfile,
+	// ExpectedStateFormat and ValidateSeed, not abort preseeding.
+	// Preseeding is completed and all the failed checks are reported
+	// together in the returned error.
+	// Failures of mounting, changing root or running snapd still abort.
+	BestEffort bool
+
+	// ExtraArtifacts are additional paths or glob patterns, relative to
+	// the root of the chroot, removed together with the preseeding
+	// artifacts when preseeding resets the chroot, see ResetOptions.
+	ExtraArtifacts []string
+
+	// SourceDateEpoch, if set, is the time the access and modification
+	// times of all the preseed artifacts, e.g. the snapd state, apparmor
+	// cache and seccomp profiles, are set to once snapd ran, so that
+	// preseeding yields reproducible images.
+	SourceDateEpoch time.Time
+
+	// UIDMap and GIDMap, if set, map the owner and group of the preseed
+	// artifacts once snapd ran. They are meant for preseeding in a user
+	// namespace, so that the artifacts are owned by the ids expected in
+	// the final image rather than those seen in the namespace. Ids which
+	// are not mapped are left unchanged.
+	UIDMap []IDMapping
+	GIDMap []IDMapping
+
+	// Prune, if set, removes the intermediate files snapd left behind
+	// with the preseed artifacts once it ran, e.g. temporary files of
+	// interrupted writes of apparmor profiles or of their cache, and
+	// reports the bytes saved. The artifacts snapd needs at boot,
+	// including the compiled apparmor cache, are kept.
+	Prune bool
+
+	// AllowActiveSnapd, if set, disables the check refusing to preseed a
+	// system where snapd is active, i.e. its socket exists or a snapd
+	// process runs with the chroot as its root. It is meant for test
+	// environments only.
+	AllowActiveSnapd bool
+
+	// InhibitDir, if set, is the directory with the run inhibition locks
+	// of snaps, relative to the chroot, for layouts where it is not at the
+	// default location. Preseeding refuses to run while a lock there
+	// indicates that an operation on a snap is in progress.
+	InhibitDir string
+
+	// ReuseFrom, if set, is a host directory with a system preseeded
+	// before from a previous version of the seed. The apparmor and seccomp
+	// artifacts of the snaps whose revision did not change are copied from
+	// there, so that snapd regenerates only those of the changed snaps.
+	// Snaps without a store revision are always regenerated.
+	ReuseFrom string
+
+	// MountSnapTypes are the types of the essential snaps from the seed
+	// mounted for preseeding, next to the core or snapd snap, which is
+	// always mounted. If not set, only the bases are mounted, as the
+	// kernel and gadget snaps are not needed to preseed classic systems.
+	MountSnapTypes []snap.Type
+
+	// Resume, if set, skips the steps of preseeding completed by a
+	// previous, failed run on the same chroot, as recorded in a checkpoint
+	// file in the chroot: rewriting the seed, importing the apparmor
+	// cache and running snapd, the latter only if its state is there.
+	// Mounts are always redone. The checkpoint file is removed when
+	// preseeding succeeds.
+	Resume bool
+
+	// DryRun, if set, only validates the chroot, its mountpoints, the
+	// version of snapd and apparmor, and prints a summary of the checks
+	// that passed and failed. Nothing is mounted and snapd is not run.
+	DryRun bool
+
+	// QemuUserBinary is the qemu-user-static binary of the host snapd is
+	// run with when the architecture of the chroot differs from the one
+	// of the host, e.g. when preseeding an arm64 system on amd64. If not
+	// set, /usr/bin/qemu-<arch>-static is used. The binfmt_misc handler of
+	// the host must be registered for the programs run by snapd.
+	QemuUserBinary string
+
+	// Backend carries out chroot, mount and snapd execution. If not set,
+	// these operations are performed for real.
+	Backend Backend
+
+	// qemuUserPath, if set, is the path of the qemu-user binary inside the
+	// chroot snapd is run with.
+	qemuUserPath string
+	// parentCleanups, if set, are the cleanups of the caller which handles
+	// signals.
+	parentCleanups *cleanupStack
+	// loadedSeed, if set, is the seed of the system loaded by the caller,
+	// see ClassicWithSeed.
+	loadedSeed seed.Seed
+	// spans tracks the spans of preseed stages when Tracer is set.
+	spans *stageSpans
+}
+
+// AdviceAction is a remediation suggested by VersionAdvice.
+type AdviceAction string
+
+const (
+	// AdviceUpgradeDeb suggests upgrading the snapd deb installed in the
+	// target system.
+	AdviceUpgradeDeb AdviceAction = "upgrade-deb"
+	// AdviceRefreshSnap suggests refreshing the core or snapd snap in the
+	// seed of the target system.
+	AdviceRefreshSnap AdviceAction = "refresh-snap"
+)
+
+// Advice describes whether the snapd available to a classic system
+// supports preseeding and, if it does not, how to remedy that.
+type Advice struct {
+	// Supported is true if the system can be preseeded.
+	Supported bool
+	// Source and Version identify the snapd preseeding would use, see
+	// ResolveSnapd.
+	Source  string
+	Version string
+	// MinimumVersion is the minimum version of snapd which supports
+	// preseeding.
+	MinimumVersion string
+	// Actions lists the suggested remediations when preseeding is not
+	// supported, any one of them makes preseeding possible.
+	Actions []AdviceAction
+}
+
+// SeedSnap describes a snap resolved from a seed.
+type SeedSnap struct {
+	Name     string
+	Path     string
+	Revision snap.Revision
+}
+
+// SystemSnaps describes the snaps of a seed which make up the system.
+type SystemSnaps struct {
+	// Snapd is the snapd snap, or the core snap for seeds that do not use
+	// the snapd snap.
+	Snapd SeedSnap
+	// Base is the base of the model, the core snap for models without a
+	// base.
+	Base SeedSnap
+	// Kernel and Gadget are nil for classic seeds without them.
+	Kernel *SeedSnap
+	Gadget *SeedSnap
+}
+
+// IDMapping maps a range of user or group ids, like a line of
+// /proc/<pid>/uid_map does.
+type IDMapping struct {
+	// ID is the first id of the range, as seen while preseeding.
+	ID uint32 `json:"id"`
+	// TargetID is the id that ID is mapped to.
+	TargetID uint32 `json:"target-id"`
+	// Count is the number of ids in the range.
+	Count uint32 `json:"count"`
+}
+
+// ClassicFromTarOptions holds optional parameters for preseeding of a
+// classic ubuntu rootfs stored in a tarball.
+type ClassicFromTarOptions struct {
+	// ClassicOptions are the options of preseeding the extracted rootfs.
+	ClassicOptions *ClassicOptions
+
+	// RepackPath, if set, is the path of a tarball where the preseeded
+	// rootfs is packed.
+	RepackPath string
+
+	// KeepRootfs, if set, leaves the extracted rootfs in place, rather
+	// than removing it when done.
+	KeepRootfs bool
+}
+
+// DiskImageOptions holds optional parameters for preseeding of a system
+// stored in a partitioned disk image.
+type DiskImageOptions struct {
+	// Format is the format of the disk image, "raw" or "qcow2". If not
+	// set, it is detected from the header of the image.
+	Format string
+
+	// NBDDevice is the network block device qcow2 images are attached
+	// to with qemu-nbd. If not set, /dev/nbd0 is used.
+	NBDDevice string
+
+	// ClassicOptions are the options of preseeding a classic system,
+	// whose root filesystem is the system-data partition.
+	ClassicOptions *ClassicOptions
+
+	// CoreOptions are the options of preseeding a UC20+ system, whose
+	// seed is the system-seed partition.
+	CoreOptions *CoreOptions
+}
+
 type preseedOpts struct {
 	PrepareImageDir  string
 	PreseedChrootDir string
 	SystemLabel      string
 	WritableDir      string
+	Events           chan<- PreseedEvent
 }
 
 type targetSnapdInfo struct {
@@ -20,18 +20,31 @@
 package preseed_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	. "gopkg.in/check.v1"
 
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+	"github.com/snapcore/snapd/asserts/sysdb"
 	"github.com/snapcore/snapd/cmd/snaplock/runinhibit"
 	"github.com/snapcore/snapd/dirs"
 	"github.com/snapcore/snapd/image/preseed"
 	"github.com/snapcore/snapd/osutil"
 	apparmor_sandbox "github.com/snapcore/snapd/sandbox/apparmor"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/snaptest"
 	"github.com/snapcore/snapd/testutil"
 )
 
@@ -42,17 +55,59 @@ func mockVersionFiles(c *C, rootDir1, version1, rootDir2, version2 string) {
 		infoFile := filepath.Join(root, dirs.CoreLibExecDir, "info")
 		c.Assert(ioutil.WriteFile(infoFile, []byte(fmt.Sprintf("VERSION=%s", versions[i])), 0644), IsNil)
 	}
+	// the core snap carries snapd, unless mocked already
+	snapd := filepath.Join(rootDir1, dirs.CoreLibExecDir, "snapd")
+	if !osutil.FileExists(snapd) {
+		c.Assert(ioutil.WriteFile(snapd, nil, 0755), IsNil)
+	}
 }
 
 func (s *preseedSuite) TestChrootDoesntExist(c *C) {
-	c.Assert(preseed.Classic("/non-existing-dir"), ErrorMatches, `cannot verify "/non-existing-dir": is not a directory`)
+	c.Assert(preseed.Classic("/non-existing-dir", nil), ErrorMatches, `cannot verify "/non-existing-dir": is not a directory`)
 }
 
 func (s *preseedSuite) TestChrootValidationUnhappy(c *C) {
 	tmpDir := c.MkDir()
 	defer osutil.MockMountInfo("")()
 
-	c.Check(preseed.Classic(tmpDir), ErrorMatches, "cannot preseed without the following mountpoints:\n - .*/dev\n - .*/proc\n - .*/sys/kernel/security")
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, "cannot preseed without the following mountpoints:\n - .*/dev\n - .*/proc\n - .*/sys/kernel/security")
+}
+
+func (s *preseedSuite) TestChrootValidationSatisfiedMounts(c *C) {
+	tmpDir := c.MkDir()
+	defer mockChrootDirs(c, tmpDir, true)()
+
+	mounts, err := preseed.CheckChroot(tmpDir, false)
+	c.Assert(err, IsNil)
+	c.Check(mounts, DeepEquals, []preseed.ChrootMount{
+		{MountDir: filepath.Join(tmpDir, "dev"), Source: "none", FsType: "tmpfs"},
+		{MountDir: filepath.Join(tmpDir, "proc"), Source: "proc", FsType: "proc"},
+		{MountDir: filepath.Join(tmpDir, "sys/kernel/security"), Source: "securityfs", FsType: "securityfs"},
+	})
+}
+
+func (s *preseedSuite) TestChrootValidationResume(c *C) {
+	tmpDir := c.MkDir()
+	defer mockChrootDirs(c, tmpDir, true)()
+
+	stateFile := filepath.Join(tmpDir, dirs.SnapStateFile)
+	c.Assert(os.MkdirAll(filepath.Dir(stateFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(stateFile, nil, 0644), IsNil)
+
+	preseededErr := fmt.Sprintf(`the system at %q appears to be preseeded, pass --reset flag to clean it up`, tmpDir)
+	_, err := preseed.CheckChroot(tmpDir, false)
+	c.Check(err, ErrorMatches, preseededErr)
+	// without a checkpoint, the state was not left by an interrupted run
+	_, err = preseed.CheckChroot(tmpDir, true)
+	c.Check(err, ErrorMatches, preseededErr)
+
+	checkpointFile := filepath.Join(dirs.SnapdStateDir(tmpDir), "preseed-checkpoint.json")
+	c.Assert(ioutil.WriteFile(checkpointFile, []byte(`{"completed":[]}`), 0644), IsNil)
+	_, err = preseed.CheckChroot(tmpDir, false)
+	c.Check(err, ErrorMatches, preseededErr)
+	mounts, err := preseed.CheckChroot(tmpDir, true)
+	c.Assert(err, IsNil)
+	c.Check(mounts, HasLen, 3)
 }
 
 func (s *preseedSuite) TestRunPreseedMountUnhappy(c *C) {
@@ -72,17 +127,67 @@ exit 32
 	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
 	defer restoreMountPath()
 
-	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, string, error) { return "/a/core.snap", "", nil })
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return "/a/core.snap", nil, nil })
+	defer restoreSystemSnapFromSeed()
+
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, `cannot mount .+ at .+ in preseed mode: exit status 32\n'mount -t squashfs -o ro,x-gdu.hide,x-gvfs-hide /a/core.snap .*/target-core-mounted-here' failed with: something went wrong\n`)
+}
+
+func (s *preseedSuite) TestRunPreseedMountedCoreMissingSnapd(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	c.Assert(os.Remove(filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/snapd")), IsNil)
+
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, `mounted core snap /a/core.snap is missing the snapd binary`)
+	c.Check(env.mountCmd.Calls(), HasLen, 1)
+	c.Check(env.umountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", filepath.Join(tmpDir, env.targetSnapdRoot)},
+	})
+}
+
+func (s *preseedSuite) TestRunPreseedMountedCoreMissingInfo(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	c.Assert(os.Remove(filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/info")), IsNil)
+
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, `mounted core snap /a/core.snap is missing the snapd info file`)
+	c.Check(env.umountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", filepath.Join(tmpDir, env.targetSnapdRoot)},
+	})
+}
+
+func (s *preseedSuite) TestRunPreseedCoreSnapDigestMismatch(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+	defer mockChrootDirs(c, tmpDir, true)()
+
+	restoreSyscallChroot := preseed.MockSyscallChroot(func(path string) error { return nil })
+	defer restoreSyscallChroot()
+
+	mockMountCmd := testutil.MockCommand(c, "mount", "")
+	defer mockMountCmd.Restore()
+
+	targetSnapdRoot := filepath.Join(tmpDir, "target-core-mounted-here")
+	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
+	defer restoreMountPath()
+
+	coreSnap := filepath.Join(tmpDir, "core.snap")
+	c.Assert(ioutil.WriteFile(coreSnap, []byte("core snap content"), 0644), IsNil)
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return coreSnap, nil, nil })
 	defer restoreSystemSnapFromSeed()
 
-	c.Check(preseed.Classic(tmpDir), ErrorMatches, `cannot mount .+ at .+ in preseed mode: exit status 32\n'mount -t squashfs -o ro,x-gdu.hide,x-gvfs-hide /a/core.snap .*/target-core-mounted-here' failed with: something went wrong\n`)
+	opts := &preseed.ClassicOptions{CoreSnapSHA3_384: "bad-digest"}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, fmt.Sprintf(`cannot use snap %s: digest mismatch, expected bad-digest but got .+`, coreSnap))
+	c.Check(mockMountCmd.Calls(), HasLen, 0)
 }
 
 func (s *preseedSuite) TestChrootValidationUnhappyNoApparmor(c *C) {
 	tmpDir := c.MkDir()
 	defer mockChrootDirs(c, tmpDir, false)()
 
-	c.Check(preseed.Classic(tmpDir), ErrorMatches, `cannot preseed without access to ".*sys/kernel/security/apparmor"`)
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, `cannot preseed without access to ".*sys/kernel/security/apparmor"`)
 }
 
 func (s *preseedSuite) TestChrootValidationAlreadyPreseeded(c *C) {
@@ -91,7 +196,7 @@ func (s *preseedSuite) TestChrootValidationAlreadyPreseeded(c *C) {
 	c.Assert(os.MkdirAll(filepath.Join(tmpDir, snapdDir), 0755), IsNil)
 	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, dirs.SnapStateFile), nil, os.ModePerm), IsNil)
 
-	c.Check(preseed.Classic(tmpDir), ErrorMatches, fmt.Sprintf("the system at %q appears to be preseeded, pass --reset flag to clean it up", tmpDir))
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, fmt.Sprintf("the system at %q appears to be preseeded, pass --reset flag to clean it up", tmpDir))
 }
 
 func (s *preseedSuite) TestChrootFailure(c *C) {
@@ -103,7 +208,7 @@ func (s *preseedSuite) TestChrootFailure(c *C) {
 	tmpDir := c.MkDir()
 	defer mockChrootDirs(c, tmpDir, true)()
 
-	c.Check(preseed.Classic(tmpDir), ErrorMatches, fmt.Sprintf("cannot chroot into %s: FAIL: %s", tmpDir, tmpDir))
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, fmt.Sprintf("cannot chroot into %s: FAIL: %s", tmpDir, tmpDir))
 }
 
 func (s *preseedSuite) TestRunPreseedHappy(c *C) {
@@ -124,14 +229,14 @@ func (s *preseedSuite) TestRunPreseedHappy(c *C) {
 	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
 	defer restoreMountPath()
 
-	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, string, error) { return "/a/core.snap", "", nil })
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return "/a/core.snap", nil, nil })
 	defer restoreSystemSnapFromSeed()
 
 	mockTargetSnapd := testutil.MockCommand(c, filepath.Join(targetSnapdRoot, "usr/lib/snapd/snapd"), `#!/bin/sh
 	if [ "$SNAPD_PRESEED" != "1" ]; then
 		exit 1
 	fi
-`)
+`+mockWriteStateScript())
 	defer mockTargetSnapd.Restore()
 
 	mockSnapdFromDeb := testutil.MockCommand(c, filepath.Join(tmpDir, "usr/lib/snapd/snapd"), `#!/bin/sh
@@ -142,7 +247,7 @@ func (s *preseedSuite) TestRunPreseedHappy(c *C) {
 	// snapd from the snap is newer than deb
 	mockVersionFiles(c, targetSnapdRoot, "2.44.0", tmpDir, "2.41.0")
 
-	c.Check(preseed.Classic(tmpDir), IsNil)
+	c.Check(preseed.Classic(tmpDir, nil), IsNil)
 
 	c.Assert(mockMountCmd.Calls(), HasLen, 1)
 	// note, tmpDir, targetSnapdRoot are contactenated again cause we're not really chrooting in the test
@@ -162,7 +267,7 @@ func (s *preseedSuite) TestRunPreseedHappy(c *C) {
 		os.Chdir(pwd)
 	}()
 	c.Assert(os.Chdir(tmpDirPath), IsNil)
-	c.Check(preseed.Classic(relativeChroot), IsNil)
+	c.Check(preseed.Classic(relativeChroot, nil), IsNil)
 }
 
 func (s *preseedSuite) TestRunPreseedHappyDebVersionIsNewer(c *C) {
@@ -183,7 +288,7 @@ func (s *preseedSuite) TestRunPreseedHappyDebVersionIsNewer(c *C) {
 	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
 	defer restoreMountPath()
 
-	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, string, error) { return "/a/core.snap", "", nil })
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return "/a/core.snap", nil, nil })
 	defer restoreSystemSnapFromSeed()
 
 	c.Assert(os.MkdirAll(filepath.Join(targetSnapdRoot, "usr/lib/snapd/"), 0755), IsNil)
@@ -196,13 +301,13 @@ func (s *preseedSuite) TestRunPreseedHappyDebVersionIsNewer(c *C) {
 	if [ "$SNAPD_PRESEED" != "1" ]; then
 		exit 1
 	fi
-`)
+`+mockWriteStateScript())
 	defer mockSnapdFromDeb.Restore()
 
 	// snapd from the deb is newer than snap
 	mockVersionFiles(c, targetSnapdRoot, "2.44.0", tmpDir, "2.45.0")
 
-	c.Check(preseed.Classic(tmpDir), IsNil)
+	c.Check(preseed.Classic(tmpDir, nil), IsNil)
 
 	c.Assert(mockMountCmd.Calls(), HasLen, 1)
 	// note, tmpDir, targetSnapdRoot are contactenated again cause we're not really chrooting in the test
@@ -230,7 +335,7 @@ func (s *preseedSuite) TestRunPreseedUnsupportedVersion(c *C) {
 	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
 	defer restoreMountPath()
 
-	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, string, error) { return "/a/core.snap", "", nil })
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return "/a/core.snap", nil, nil })
 	defer restoreSystemSnapFromSeed()
 
 	c.Assert(os.MkdirAll(filepath.Join(targetSnapdRoot, "usr/lib/snapd/"), 0755), IsNil)
@@ -244,8 +349,14 @@ func (s *preseedSuite) TestRunPreseedUnsupportedVersion(c *C) {
 	infoFile = filepath.Join(filepath.Join(tmpDir, dirs.CoreLibExecDir, "info"))
 	c.Assert(ioutil.WriteFile(infoFile, []byte("VERSION=2.41.0"), 0644), IsNil)
 
-	c.Check(preseed.Classic(tmpDir), ErrorMatches,
-		`snapd 2.43.0 from the target system does not support preseeding, the minimum required version is 2.43.3\+`)
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches,
+		`neither the target snapd \(2.43.0\) nor the deb snapd \(2.41.0\) supports preseeding \(min 2.43.3\+\)`)
+
+	// both too old, with the deb being newer
+	c.Assert(ioutil.WriteFile(infoFile, []byte("VERSION=2.43.2"), 0644), IsNil)
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches,
+		`neither the target snapd \(2.43.0\) nor the deb snapd \(2.43.2\) supports preseeding \(min 2.43.3\+\)`)
+	c.Check(mockTargetSnapd.Calls(), HasLen, 0)
 }
 
 func (s *preseedSuite) TestReset(c *C) {
@@ -264,43 +375,35 @@ func (s *preseedSuite) TestReset(c *C) {
 			os.Chdir(parentDir)
 		}
 
-		// mock some preseeding artifacts
-		artifacts := []struct {
+		// mock some preseeding artifacts, one or more for every spec
+		type artifact struct {
 			path string
 			// if symlinkTarget is not empty, then a path -> symlinkTarget symlink
 			// will be created instead of a regular file.
 			symlinkTarget string
-		}{
-			{dirs.SnapStateFile, ""},
-			{dirs.SnapSystemKeyFile, ""},
-			{filepath.Join(dirs.SnapDesktopFilesDir, "foo.desktop"), ""},
-			{filepath.Join(dirs.SnapDesktopIconsDir, "foo.png"), ""},
-			{filepath.Join(dirs.SnapMountPolicyDir, "foo.fstab"), ""},
-			{filepath.Join(dirs.SnapBlobDir, "foo.snap"), ""},
-			{filepath.Join(dirs.SnapUdevRulesDir, "foo-snap.bar.rules"), ""},
-			{filepath.Join(dirs.SnapDBusSystemPolicyDir, "snap.foo.bar.conf"), ""},
-			{filepath.Join(dirs.SnapDBusSessionServicesDir, "org.example.Session.service"), ""},
-			{filepath.Join(dirs.SnapDBusSystemServicesDir, "org.example.System.service"), ""},
-			{filepath.Join(dirs.SnapServicesDir, "snap.foo.service"), ""},
-			{filepath.Join(dirs.SnapServicesDir, "snap.foo.timer"), ""},
-			{filepath.Join(dirs.SnapServicesDir, "snap.foo.socket"), ""},
-			{filepath.Join(dirs.SnapServicesDir, "snap-foo.mount"), ""},
-			{filepath.Join(dirs.SnapServicesDir, "multi-user.target.wants", "snap-foo.mount"), ""},
-			{filepath.Join(dirs.SnapDataDir, "foo", "bar"), ""},
-			{filepath.Join(dirs.SnapCacheDir, "foocache", "bar"), ""},
-			{filepath.Join(apparmor_sandbox.CacheDir, "foo", "bar"), ""},
-			{filepath.Join(dirs.SnapAppArmorDir, "foo"), ""},
-			{filepath.Join(dirs.SnapAssertsDBDir, "foo"), ""},
-			{filepath.Join(dirs.FeaturesDir, "foo"), ""},
-			{filepath.Join(dirs.SnapDeviceDir, "foo-1", "bar"), ""},
-			{filepath.Join(dirs.SnapCookieDir, "foo"), ""},
-			{filepath.Join(dirs.SnapSeqDir, "foo.json"), ""},
-			{filepath.Join(dirs.SnapMountDir, "foo", "bin"), ""},
-			{filepath.Join(dirs.SnapSeccompDir, "foo.bin"), ""},
-			{filepath.Join(runinhibit.InhibitDir, "foo.lock"), ""},
-			// bash-completion symlinks
-			{filepath.Join(dirs.CompletersDir, "foo.bar"), "/a/snapd/complete.sh"},
-			{filepath.Join(dirs.CompletersDir, "foo"), "foo.bar"},
+		}
+		var artifacts []artifact
+		for _, spec := range preseed.Artifacts() {
+			switch spec.Type {
+			case preseed.ArtifactFile:
+				artifacts = append(artifacts, artifact{spec.Path, ""})
+			case preseed.ArtifactGlob:
+				artifacts = append(artifacts, artifact{strings.Replace(spec.Path, "*", "foo", -1), ""})
+				// matching directories are removed with their contents
+				if strings.HasSuffix(spec.Path, "/*") {
+					artifacts = append(artifacts, artifact{filepath.Join(filepath.Dir(spec.Path), "bar", "baz"), ""})
+				}
+			case preseed.ArtifactTree:
+				artifacts = append(artifacts, artifact{filepath.Join(spec.Path, "foo", "bar"), ""})
+			case preseed.ArtifactSymlink:
+				// bash-completion symlinks
+				artifacts = append(artifacts,
+					artifact{filepath.Join(spec.Path, "foo.bar"), "/a/snapd/complete.sh"},
+					artifact{filepath.Join(spec.Path, "foo"), "foo.bar"},
+				)
+			default:
+				c.Fatalf("unexpected artifact type %q", spec.Type)
+			}
 		}
 
 		for _, art := range artifacts {
@@ -333,9 +436,21 @@ func (s *preseedSuite) TestReset(c *C) {
 		c.Assert(os.MkdirAll(filepath.Join(tmpDir, snapdDir), 0755), IsNil)
 		c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, dirs.SnapStateFile), nil, os.ModePerm), IsNil)
 
+		// kernel module configuration not managed by snapd
+		notArtifacts := []string{
+			filepath.Join(dirs.SnapKModModulesDir, "modules.conf"),
+			filepath.Join(dirs.SnapKModModprobeDir, "blacklist.conf"),
+		}
+		for _, path := range notArtifacts {
+			c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, path), nil, 0644), IsNil)
+		}
+
 		c.Assert(preseed.ResetPreseededChroot(resetDirArg), IsNil)
 
 		checkArtifacts(false)
+		for _, path := range notArtifacts {
+			c.Check(filepath.Join(tmpDir, path), testutil.FilePresent)
+		}
 
 		// running reset again is ok
 		c.Assert(preseed.ResetPreseededChroot(resetDirArg), IsNil)
@@ -358,3 +473,2993 @@ func (s *preseedSuite) TestReset(c *C) {
 	}
 
 }
+
+// mockWriteStateScript returns a shell snippet for the mocked snapd that
+// writes the state file, as real snapd does when preseeding.
+func mockWriteStateScript() string {
+	return fmt.Sprintf("mkdir -p %[1]s\necho '{}' > %[2]s\n", filepath.Dir(dirs.SnapStateFile), dirs.SnapStateFile)
+}
+
+type classicPreseedEnv struct {
+	targetSnapdRoot string
+	mountCmd        *testutil.MockCmd
+	umountCmd       *testutil.MockCmd
+	targetSnapd     *testutil.MockCmd
+}
+
+// mockClassicPreseedEnv sets up a chroot under tmpDir that can be preseeded
+// successfully with snapd from the mocked core snap.
+func (s *preseedSuite) mockClassicPreseedEnv(c *C, tmpDir, snapdScript string) *classicPreseedEnv {
+	dirs.SetRootDir(tmpDir)
+	s.AddCleanup(mockChrootDirs(c, tmpDir, true))
+	s.AddCleanup(preseed.MockSyscallChroot(func(path string) error { return nil }))
+
+	env := &classicPreseedEnv{
+		targetSnapdRoot: filepath.Join(tmpDir, "target-core-mounted-here"),
+		mountCmd:        testutil.MockCommand(c, "mount", ""),
+		umountCmd:       testutil.MockCommand(c, "umount", ""),
+	}
+	s.AddCleanup(env.mountCmd.Restore)
+	s.AddCleanup(env.umountCmd.Restore)
+
+	s.AddCleanup(preseed.MockSnapdMountPath(env.targetSnapdRoot))
+	s.AddCleanup(preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return "/a/core.snap", nil, nil }))
+
+	env.targetSnapd = testutil.MockCommand(c, filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/snapd"), mockWriteStateScript()+snapdScript)
+	s.AddCleanup(env.targetSnapd.Restore)
+
+	// snapd from the snap is newer than deb
+	mockVersionFiles(c, env.targetSnapdRoot, "2.44.0", tmpDir, "2.41.0")
+
+	return env
+}
+
+func (s *preseedSuite) TestRunPreseedEvents(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	events := make(chan preseed.PreseedEvent, 10)
+	c.Check(preseed.Classic(tmpDir, &preseed.ClassicOptions{Events: events}), IsNil)
+	close(events)
+
+	var stages []preseed.Stage
+	var details []string
+	for ev := range events {
+		c.Check(ev.Time.IsZero(), Equals, false)
+		stages = append(stages, ev.Stage)
+		details = append(details, ev.Detail)
+	}
+	c.Check(stages, DeepEquals, []preseed.Stage{
+		preseed.StageCheckChroot,
+		preseed.StageMountSnapd,
+		preseed.StageRunSnapd,
+		preseed.StageWriteArtifacts,
+		preseed.StageCleanup,
+		preseed.StageDone,
+	})
+	c.Check(details, DeepEquals, []string{
+		tmpDir,
+		"/a/core.snap",
+		filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/snapd") + " (2.44.0)",
+		"",
+		"",
+		"",
+	})
+}
+
+func (s *preseedSuite) TestSnapdInvocation(c *C) {
+	tmpDir := c.MkDir()
+	outDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf(`echo "$0" > %[1]s/argv
+env > %[1]s/env
+`, outDir))
+	coreSnap := mockCoreSnapDir(c, "2.44.0")
+	restore := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return coreSnap, nil, nil })
+	defer restore()
+
+	os.Setenv("PRESEED_TEST_VAR", "foo")
+	defer os.Unsetenv("PRESEED_TEST_VAR")
+
+	argv, snapdEnv, err := preseed.SnapdInvocation(tmpDir)
+	c.Assert(err, IsNil)
+	c.Check(argv, DeepEquals, []string{filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/snapd")})
+	c.Check(snapdEnv["SNAPD_PRESEED"], Equals, "1")
+	c.Check(snapdEnv["PRESEED_TEST_VAR"], Equals, "foo")
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+
+	// the invocation matches the actual run of snapd
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(filepath.Join(outDir, "argv"), testutil.FileEquals, argv[0]+"\n")
+	data, err := ioutil.ReadFile(filepath.Join(outDir, "env"))
+	c.Assert(err, IsNil)
+	for _, key := range []string{"SNAPD_PRESEED", "PRESEED_TEST_VAR", "PATH"} {
+		c.Check(strings.Split(string(data), "\n"), testutil.Contains, key+"="+snapdEnv[key])
+	}
+}
+
+func (s *preseedSuite) TestSnapdInvocationFromDeb(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	// snapd from the deb is newer than the one from the snap
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, dirs.CoreLibExecDir, "info"), []byte("VERSION=2.45.0"), 0644), IsNil)
+	coreSnap := mockCoreSnapDir(c, "2.44.0")
+	restore := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return coreSnap, nil, nil })
+	defer restore()
+
+	argv, _, err := preseed.SnapdInvocation(tmpDir)
+	c.Assert(err, IsNil)
+	c.Check(argv, DeepEquals, []string{filepath.Join(tmpDir, "usr/lib/snapd/snapd")})
+}
+
+func (s *preseedSuite) TestSnapdInvocationUnsupported(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	coreSnap := mockCoreSnapDir(c, "2.40")
+	restore := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return coreSnap, nil, nil })
+	defer restore()
+
+	_, _, err := preseed.SnapdInvocation(tmpDir)
+	c.Assert(err, ErrorMatches, `snapd 2.41.0 from the deb does not support preseeding, the minimum required version is 2.43.3\+`)
+}
+
+func (s *preseedSuite) TestVersionAdvice(c *C) {
+	for _, tc := range []struct {
+		fromSnap  string
+		fromDeb   string
+		supported bool
+		source    string
+		version   string
+		actions   []preseed.AdviceAction
+	}{
+		// both too old
+		{"2.40", "2.41.0", false, preseed.SnapdSourceDeb, "2.41.0",
+			[]preseed.AdviceAction{preseed.AdviceUpgradeDeb, preseed.AdviceRefreshSnap}},
+		// too old deb, snapd from the snap is used
+		{"2.44.0", "2.41.0", true, preseed.SnapdSourceSnap, "2.44.0", nil},
+		// too old snap, snapd from the deb is used
+		{"2.40", "2.45.0", true, preseed.SnapdSourceDeb, "2.45.0", nil},
+	} {
+		tmpDir := c.MkDir()
+		s.mockClassicPreseedEnv(c, tmpDir, "")
+		c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, dirs.CoreLibExecDir, "info"), []byte("VERSION="+tc.fromDeb), 0644), IsNil)
+		coreSnap := mockCoreSnapDir(c, tc.fromSnap)
+		restore := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return coreSnap, nil, nil })
+
+		advice, err := preseed.VersionAdvice(tmpDir)
+		restore()
+		c.Assert(err, IsNil)
+		c.Check(advice, DeepEquals, &preseed.Advice{
+			Supported:      tc.supported,
+			Source:         tc.source,
+			Version:        tc.version,
+			MinimumVersion: "2.43.3+",
+			Actions:        tc.actions,
+		}, Commentf("snap %s, deb %s", tc.fromSnap, tc.fromDeb))
+	}
+}
+
+func (s *preseedSuite) TestAssertReadyForPreseed(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	coreSnap := mockCoreSnapDir(c, "2.44.0")
+	s.AddCleanup(preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return coreSnap, nil, nil }))
+
+	c.Check(preseed.AssertReadyForPreseed(tmpDir), IsNil)
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestAssertReadyForPreseedAlreadyPreseeded(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, filepath.Dir(dirs.SnapStateFile)), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, dirs.SnapStateFile), nil, 0644), IsNil)
+
+	err := preseed.AssertReadyForPreseed(tmpDir)
+	c.Assert(err, FitsTypeOf, &preseed.AlreadyPreseededError{})
+	c.Check(err, ErrorMatches, fmt.Sprintf("the system at %q appears to be preseeded", tmpDir))
+}
+
+func (s *preseedSuite) TestAssertReadyForPreseedInvalidChroot(c *C) {
+	tmpDir := c.MkDir()
+	defer osutil.MockMountInfo("")()
+
+	err := preseed.AssertReadyForPreseed(tmpDir)
+	c.Assert(err, FitsTypeOf, &preseed.InvalidChrootError{})
+	c.Check(err.(*preseed.InvalidChrootError).ChrootDir, Equals, tmpDir)
+	c.Check(err, ErrorMatches, "cannot preseed without the following mountpoints:\n - .*/dev\n - .*/proc\n - .*/sys/kernel/security")
+}
+
+func (s *preseedSuite) TestAssertReadyForPreseedNoSeed(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	s.AddCleanup(preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) {
+		return "", nil, seed.ErrNoAssertions
+	}))
+
+	err := preseed.AssertReadyForPreseed(tmpDir)
+	c.Assert(err, FitsTypeOf, &preseed.NoSeedError{})
+	c.Check(errors.Is(err, preseed.ErrNoSeed), Equals, true)
+}
+
+func (s *preseedSuite) TestAssertReadyForPreseedUnsupportedSnapd(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	coreSnap := mockCoreSnapDir(c, "2.40")
+	s.AddCleanup(preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return coreSnap, nil, nil }))
+
+	err := preseed.AssertReadyForPreseed(tmpDir)
+	c.Assert(err, FitsTypeOf, &preseed.UnsupportedSnapdError{})
+	c.Check(err, ErrorMatches, `snapd 2.41.0 from the deb does not support preseeding, the minimum required version is 2.43.3\+`)
+	c.Check(err.(*preseed.UnsupportedSnapdError).Advice.Actions, DeepEquals, []preseed.AdviceAction{preseed.AdviceUpgradeDeb, preseed.AdviceRefreshSnap})
+}
+
+func (s *preseedSuite) TestRunPreseedEventsFailure(c *C) {
+	tmpDir := c.MkDir()
+	defer osutil.MockMountInfo("")()
+
+	events := make(chan preseed.PreseedEvent, 10)
+	c.Check(preseed.Classic(tmpDir, &preseed.ClassicOptions{Events: events}), NotNil)
+	close(events)
+
+	var stages []preseed.Stage
+	for ev := range events {
+		stages = append(stages, ev.Stage)
+	}
+	c.Check(stages, DeepEquals, []preseed.Stage{preseed.StageCheckChroot, preseed.StageFailed})
+}
+
+func (s *preseedSuite) TestRunPreseedEventsDoNotBlock(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	// unbuffered channel without a reader, events are dropped
+	events := make(chan preseed.PreseedEvent)
+	c.Check(preseed.Classic(tmpDir, &preseed.ClassicOptions{Events: events}), IsNil)
+}
+
+type fakeSpan struct {
+	name  string
+	attrs map[string]string
+	ended bool
+	err   error
+}
+
+func (sp *fakeSpan) End(err error) {
+	sp.ended = true
+	sp.err = err
+}
+
+type fakeTracer struct {
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) StartSpan(name string, attrs map[string]string) preseed.Span {
+	sp := &fakeSpan{name: name, attrs: attrs}
+	t.spans = append(t.spans, sp)
+	return sp
+}
+
+func (s *preseedSuite) TestRunPreseedTracer(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	tracer := &fakeTracer{}
+	c.Check(preseed.Classic(tmpDir, &preseed.ClassicOptions{Tracer: tracer}), IsNil)
+
+	c.Assert(tracer.spans, HasLen, 5)
+	for i, stage := range []string{"check-chroot", "mount-snapd", "run-snapd", "write-artifacts", "cleanup"} {
+		sp := tracer.spans[i]
+		c.Check(sp.name, Equals, "preseed/"+stage)
+		c.Check(sp.attrs["preseed.stage"], Equals, stage)
+		c.Check(sp.attrs["preseed.chroot"], Equals, tmpDir)
+		c.Check(sp.ended, Equals, true)
+		c.Check(sp.err, IsNil)
+	}
+	// the version of snapd is only known once it was picked
+	c.Check(tracer.spans[1].attrs["preseed.snapd-version"], Equals, "")
+	c.Check(tracer.spans[2].attrs["preseed.snapd-version"], Equals, "2.44.0")
+	c.Check(tracer.spans[3].attrs["preseed.snapd-version"], Equals, "2.44.0")
+	c.Check(tracer.spans[4].attrs["preseed.snapd-version"], Equals, "2.44.0")
+}
+
+func (s *preseedSuite) TestRunPreseedTracerFailure(c *C) {
+	tmpDir := c.MkDir()
+	defer osutil.MockMountInfo("")()
+
+	tracer := &fakeTracer{}
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{Tracer: tracer})
+	c.Assert(err, NotNil)
+
+	c.Assert(tracer.spans, HasLen, 1)
+	c.Check(tracer.spans[0].name, Equals, "preseed/check-chroot")
+	c.Check(tracer.spans[0].ended, Equals, true)
+	c.Check(tracer.spans[0].err, Equals, err)
+}
+
+func (s *preseedSuite) TestRunPreseedMultipleBases(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	restore := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) {
+		return "/a/snapd.snap", []string{"/a/core18.snap", "/a/core20.snap"}, nil
+	})
+	defer restore()
+
+	c.Check(preseed.Classic(tmpDir, nil), IsNil)
+
+	// note, tmpDir, targetSnapdRoot are contactenated again cause we're not really chrooting in the test
+	// and mocking dirs.RootDir
+	c.Check(env.mountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/snapd.snap", filepath.Join(tmpDir, env.targetSnapdRoot)},
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core18.snap", filepath.Join(tmpDir, env.targetSnapdRoot+"-core18")},
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core20.snap", filepath.Join(tmpDir, env.targetSnapdRoot+"-core20")},
+	})
+	c.Check(env.umountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", filepath.Join(tmpDir, env.targetSnapdRoot+"-core20")},
+		{"umount", filepath.Join(tmpDir, env.targetSnapdRoot+"-core18")},
+		{"umount", filepath.Join(tmpDir, env.targetSnapdRoot)},
+	})
+}
+
+func (s *preseedSuite) TestResetPolkitAndDBusPolicy(c *C) {
+	tmpDir := c.MkDir()
+
+	generated := []string{
+		filepath.Join(dirs.SnapPolkitPolicyDir, "snap.foo.interface.bar.policy"),
+		filepath.Join(dirs.SnapDBusSessionPolicyDir, "snapd.session-services.conf"),
+		filepath.Join(dirs.SnapDBusSystemPolicyDir, "snap.foo.bar.conf"),
+	}
+	// policy shipped by the snapd deb and other packages
+	kept := []string{
+		filepath.Join(dirs.SnapPolkitPolicyDir, "io.snapcraft.snapd.policy"),
+		filepath.Join(dirs.SnapPolkitPolicyDir, "org.freedesktop.packagekit.policy"),
+		filepath.Join(dirs.SnapDBusSessionPolicyDir, "other.conf"),
+		"/usr/share/dbus-1/session.d/snapd.session-services.conf",
+	}
+	for _, p := range append(generated, kept...) {
+		fullPath := filepath.Join(tmpDir, p)
+		c.Assert(os.MkdirAll(filepath.Dir(fullPath), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(fullPath, nil, 0644), IsNil)
+	}
+
+	c.Assert(preseed.ResetPreseededChroot(tmpDir), IsNil)
+
+	for _, p := range generated {
+		c.Check(filepath.Join(tmpDir, p), testutil.FileAbsent)
+	}
+	for _, p := range kept {
+		c.Check(filepath.Join(tmpDir, p), testutil.FilePresent)
+	}
+}
+
+func (s *preseedSuite) TestResetHotplugArtifacts(c *C) {
+	tmpDir := c.MkDir()
+
+	// written by snapd for a hotplug slot of the serial-port interface,
+	// the slot itself is kept in the state
+	files := map[string]string{
+		dirs.SnapStateFile: `{"data":{"hotplug-slots":{"ttyacm0":{"name":"ttyacm0","interface":"serial-port","hotplug-key":"0123"}}}}`,
+		filepath.Join(dirs.SnapUdevRulesDir, "70-snap.foo.rules"):     "SUBSYSTEM==\"tty\", KERNEL==\"ttyACM0\", TAG+=\"snap_foo_app\"\n",
+		filepath.Join(dirs.SnapKModModprobeDir, "snap.foo.conf"):      "options cdc_acm foo=bar\n",
+		filepath.Join(dirs.SnapKModModulesDir, "snap.foo.conf"):       "cdc_acm\n",
+		filepath.Join(dirs.SnapUdevRulesDir, "99-local-serial.rules"): "",
+	}
+	for path, content := range files {
+		fullPath := filepath.Join(tmpDir, path)
+		c.Assert(os.MkdirAll(filepath.Dir(fullPath), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(fullPath, []byte(content), 0644), IsNil)
+	}
+
+	c.Assert(preseed.ResetPreseededChroot(tmpDir), IsNil)
+
+	for path := range files {
+		if filepath.Base(path) == "99-local-serial.rules" {
+			// not written by snapd
+			c.Check(filepath.Join(tmpDir, path), testutil.FilePresent)
+			continue
+		}
+		c.Check(filepath.Join(tmpDir, path), testutil.FileAbsent)
+	}
+}
+
+func (s *preseedSuite) TestResetSysctl(c *C) {
+	tmpDir := c.MkDir()
+
+	// written by the core configuration while seeding
+	generated := []string{
+		"/etc/sysctl.d/99-snapd.conf",
+		"/etc/sysctl.d/10-snapd-network.conf",
+	}
+	kept := []string{
+		"/etc/sysctl.d/10-network-security.conf",
+		"/etc/sysctl.conf",
+	}
+	for _, p := range append(generated, kept...) {
+		fullPath := filepath.Join(tmpDir, p)
+		c.Assert(os.MkdirAll(filepath.Dir(fullPath), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(fullPath, nil, 0644), IsNil)
+	}
+
+	opts := &preseed.ResetOptions{Classes: []preseed.ArtifactClass{preseed.ArtifactClassSysctl}}
+	c.Assert(preseed.ResetPreseededChrootWithOptions(tmpDir, opts), IsNil)
+
+	for _, p := range generated {
+		c.Check(filepath.Join(tmpDir, p), testutil.FileAbsent)
+	}
+	for _, p := range kept {
+		c.Check(filepath.Join(tmpDir, p), testutil.FilePresent)
+	}
+}
+
+func (s *preseedSuite) TestResetPreserveData(c *C) {
+	for _, preserve := range []bool{false, true} {
+		tmpDir := c.MkDir()
+
+		state := []string{
+			dirs.SnapStateFile,
+			filepath.Join(dirs.SnapServicesDir, "snap.foo.app.service"),
+			filepath.Join(dirs.SnapAppArmorDir, "snap.foo.app"),
+		}
+		data := []string{
+			filepath.Join(dirs.SnapDataDir, "foo", "common", "data"),
+			filepath.Join(dirs.SnapCacheDir, "foo", "cache"),
+		}
+		for _, path := range append(state, data...) {
+			fullPath := filepath.Join(tmpDir, path)
+			c.Assert(os.MkdirAll(filepath.Dir(fullPath), 0755), IsNil)
+			c.Assert(ioutil.WriteFile(fullPath, nil, 0644), IsNil)
+		}
+
+		opts := &preseed.ResetOptions{PreserveData: preserve}
+		c.Assert(preseed.ResetPreseededChrootWithOptions(tmpDir, opts), IsNil)
+
+		for _, path := range state {
+			c.Check(filepath.Join(tmpDir, path), testutil.FileAbsent)
+		}
+		for _, path := range data {
+			if preserve {
+				c.Check(filepath.Join(tmpDir, path), testutil.FilePresent)
+			} else {
+				c.Check(filepath.Join(tmpDir, path), testutil.FileAbsent)
+			}
+		}
+	}
+}
+
+func (s *preseedSuite) TestResetClasses(c *C) {
+	tmpDir := c.MkDir()
+
+	apparmor := []string{
+		filepath.Join(dirs.SnapAppArmorDir, "snap.foo.app"),
+		filepath.Join(dirs.SnapConfineAppArmorDir, "snap.core.1.foo"),
+	}
+	units := []string{
+		filepath.Join(dirs.SnapServicesDir, "snap.foo.app.service"),
+		filepath.Join(dirs.SnapUserServicesDir, "snap.foo.app.timer"),
+	}
+	others := []string{
+		dirs.SnapStateFile,
+		filepath.Join(dirs.SnapSeccompDir, "snap.foo.app.src"),
+		filepath.Join(dirs.SnapDataDir, "foo", "common", "data"),
+	}
+	for _, path := range append(append(apparmor, units...), others...) {
+		fullPath := filepath.Join(tmpDir, path)
+		c.Assert(os.MkdirAll(filepath.Dir(fullPath), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(fullPath, nil, 0644), IsNil)
+	}
+
+	opts := &preseed.ResetOptions{Classes: []preseed.ArtifactClass{preseed.ArtifactClassAppArmor}}
+	c.Assert(preseed.ResetPreseededChrootWithOptions(tmpDir, opts), IsNil)
+	for _, path := range apparmor {
+		c.Check(filepath.Join(tmpDir, path), testutil.FileAbsent)
+	}
+	for _, path := range append(units, others...) {
+		c.Check(filepath.Join(tmpDir, path), testutil.FilePresent)
+	}
+
+	opts = &preseed.ResetOptions{Classes: []preseed.ArtifactClass{preseed.ArtifactClassSystemdUnits, preseed.ArtifactClassState}}
+	c.Assert(preseed.ResetPreseededChrootWithOptions(tmpDir, opts), IsNil)
+	for _, path := range units {
+		c.Check(filepath.Join(tmpDir, path), testutil.FileAbsent)
+	}
+	c.Check(filepath.Join(tmpDir, dirs.SnapStateFile), testutil.FileAbsent)
+	for _, path := range others[1:] {
+		c.Check(filepath.Join(tmpDir, path), testutil.FilePresent)
+	}
+}
+
+func (s *preseedSuite) TestResetClassesUnknown(c *C) {
+	tmpDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, filepath.Dir(dirs.SnapStateFile)), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, dirs.SnapStateFile), nil, 0644), IsNil)
+
+	opts := &preseed.ResetOptions{Classes: []preseed.ArtifactClass{"foo"}}
+	c.Check(preseed.ResetPreseededChrootWithOptions(tmpDir, opts), ErrorMatches, `cannot reset unknown artifact class "foo"`)
+	c.Check(filepath.Join(tmpDir, dirs.SnapStateFile), testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestArtifactsHaveKnownClasses(c *C) {
+	known := make(map[preseed.ArtifactClass]bool)
+	for _, class := range preseed.ArtifactClasses() {
+		known[class] = true
+	}
+	for _, spec := range preseed.Artifacts() {
+		c.Check(known[spec.Class], Equals, true, Commentf("artifact %s has class %q", spec.Path, spec.Class))
+	}
+}
+
+func (s *preseedSuite) TestResetExtraArtifacts(c *C) {
+	tmpDir := c.MkDir()
+
+	files := []string{
+		dirs.SnapStateFile,
+		"/etc/distro-snapd/policy.conf",
+		"/usr/share/bash-completion/completions/distro-snap-foo",
+		// not an artifact
+		"/usr/share/bash-completion/completions/ls",
+	}
+	for _, path := range files {
+		fullPath := filepath.Join(tmpDir, path)
+		c.Assert(os.MkdirAll(filepath.Dir(fullPath), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(fullPath, nil, 0644), IsNil)
+	}
+
+	opts := &preseed.ResetOptions{
+		ExtraArtifacts: []string{
+			"/etc/distro-snapd",
+			"/usr/share/bash-completion/completions/distro-snap-*",
+		},
+	}
+	c.Assert(preseed.ResetPreseededChrootWithOptions(tmpDir, opts), IsNil)
+
+	c.Check(filepath.Join(tmpDir, dirs.SnapStateFile), testutil.FileAbsent)
+	c.Check(filepath.Join(tmpDir, "/etc/distro-snapd"), testutil.FileAbsent)
+	c.Check(filepath.Join(tmpDir, "/usr/share/bash-completion/completions/distro-snap-foo"), testutil.FileAbsent)
+	c.Check(filepath.Join(tmpDir, "/usr/share/bash-completion/completions/ls"), testutil.FilePresent)
+	c.Check(filepath.Join(tmpDir, "/etc"), testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestResetHooks(c *C) {
+	tmpDir := c.MkDir()
+	stateFile := filepath.Join(tmpDir, dirs.SnapStateFile)
+	c.Assert(os.MkdirAll(filepath.Dir(stateFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(stateFile, nil, 0644), IsNil)
+
+	var calls []string
+	opts := &preseed.ResetOptions{
+		PreReset: func(dir string) error {
+			c.Check(dir, Equals, tmpDir)
+			c.Check(stateFile, testutil.FilePresent)
+			calls = append(calls, "pre")
+			return nil
+		},
+		PostReset: func(dir string) error {
+			c.Check(dir, Equals, tmpDir)
+			c.Check(stateFile, testutil.FileAbsent)
+			calls = append(calls, "post")
+			return nil
+		},
+	}
+	c.Assert(preseed.ResetPreseededChrootWithOptions(tmpDir, opts), IsNil)
+	c.Check(calls, DeepEquals, []string{"pre", "post"})
+}
+
+func (s *preseedSuite) TestResetHooksErrors(c *C) {
+	tmpDir := c.MkDir()
+	stateFile := filepath.Join(tmpDir, dirs.SnapStateFile)
+	c.Assert(os.MkdirAll(filepath.Dir(stateFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(stateFile, nil, 0644), IsNil)
+
+	postCalled := false
+	opts := &preseed.ResetOptions{
+		PreReset: func(string) error { return fmt.Errorf("boom") },
+		PostReset: func(string) error {
+			postCalled = true
+			return nil
+		},
+	}
+	err := preseed.ResetPreseededChrootWithOptions(tmpDir, opts)
+	c.Assert(err, ErrorMatches, `cannot reset ".*": pre-reset hook failed: boom`)
+	// nothing was removed
+	c.Check(stateFile, testutil.FilePresent)
+	c.Check(postCalled, Equals, false)
+
+	opts = &preseed.ResetOptions{
+		PostReset: func(string) error { return fmt.Errorf("bang") },
+	}
+	err = preseed.ResetPreseededChrootWithOptions(tmpDir, opts)
+	c.Assert(err, ErrorMatches, `post-reset hook failed: bang`)
+	c.Check(stateFile, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestResetSeparateDataMounts(c *C) {
+	tmpDir := c.MkDir()
+
+	files := []string{
+		dirs.SnapStateFile,
+		filepath.Join(dirs.SnapDataDir, "foo", "common", "data"),
+		filepath.Join(dirs.SnapAppArmorDir, "profiles", "snap.foo.app"),
+	}
+	for _, path := range files {
+		fullPath := filepath.Join(tmpDir, path)
+		c.Assert(os.MkdirAll(filepath.Dir(fullPath), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(fullPath, nil, 0644), IsNil)
+	}
+
+	// snap data and apparmor profiles are on their own subvolumes
+	restore := osutil.MockMountInfo(fmt.Sprintf(`26 1 0:23 /@snap-data %[1]s%[2]s rw,relatime shared:1 - btrfs /dev/sda2 rw
+27 1 0:23 /@snapd-apparmor %[1]s%[3]s rw,relatime shared:1 - btrfs /dev/sda2 rw
+`, tmpDir, dirs.SnapDataDir, dirs.SnapAppArmorDir))
+	defer restore()
+
+	c.Assert(preseed.ResetPreseededChroot(tmpDir), IsNil)
+
+	for _, path := range files {
+		c.Check(filepath.Join(tmpDir, path), testutil.FileAbsent)
+	}
+	// the mountpoints are kept, but emptied
+	for _, mountpoint := range []string{dirs.SnapDataDir, dirs.SnapAppArmorDir} {
+		entries, err := ioutil.ReadDir(filepath.Join(tmpDir, mountpoint))
+		c.Assert(err, IsNil)
+		c.Check(entries, HasLen, 0)
+	}
+}
+
+func (s *preseedSuite) TestResetUnmountsActiveSnapMounts(c *C) {
+	tmpDir := c.MkDir()
+
+	snapMount := filepath.Join(tmpDir, dirs.SnapMountDir, "core", "123")
+	c.Assert(os.MkdirAll(filepath.Join(snapMount, "bin"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(snapMount, "bin", "sh"), nil, 0755), IsNil)
+
+	restore := osutil.MockMountInfo(fmt.Sprintf(`30 1 7:1 / %s ro,nodev,relatime shared:1 - squashfs /dev/loop1 ro
+`, snapMount))
+	defer restore()
+
+	mockUmountCmd := testutil.MockCommand(c, "umount", "")
+	defer mockUmountCmd.Restore()
+
+	c.Assert(preseed.ResetPreseededChroot(tmpDir), IsNil)
+
+	c.Check(mockUmountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", snapMount},
+	})
+	c.Check(filepath.Join(tmpDir, dirs.SnapMountDir), testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestResetUnmountSnapError(c *C) {
+	tmpDir := c.MkDir()
+
+	snapMount := filepath.Join(tmpDir, dirs.SnapMountDir, "core", "123")
+	c.Assert(os.MkdirAll(snapMount, 0755), IsNil)
+
+	restore := osutil.MockMountInfo(fmt.Sprintf(`30 1 7:1 / %s ro,nodev,relatime shared:1 - squashfs /dev/loop1 ro
+`, snapMount))
+	defer restore()
+
+	mockUmountCmd := testutil.MockCommand(c, "umount", "echo busy; exit 1")
+	defer mockUmountCmd.Restore()
+
+	c.Assert(preseed.ResetPreseededChroot(tmpDir), ErrorMatches, fmt.Sprintf(`cannot unmount %s: busy`, snapMount))
+	c.Check(snapMount, testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestResetIfPreseeded(c *C) {
+	tmpDir := c.MkDir()
+
+	serviceFile := filepath.Join(tmpDir, dirs.SnapServicesDir, "snap.foo.service")
+	c.Assert(os.MkdirAll(filepath.Dir(serviceFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(serviceFile, nil, 0644), IsNil)
+
+	// never preseeded, nothing is touched
+	c.Check(preseed.IsPreseeded(tmpDir), Equals, false)
+	done, err := preseed.ResetIfPreseeded(tmpDir)
+	c.Assert(err, IsNil)
+	c.Check(done, Equals, false)
+	c.Check(serviceFile, testutil.FilePresent)
+
+	stateFile := filepath.Join(tmpDir, dirs.SnapStateFile)
+	c.Assert(os.MkdirAll(filepath.Dir(stateFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(stateFile, nil, 0644), IsNil)
+
+	c.Check(preseed.IsPreseeded(tmpDir), Equals, true)
+	done, err = preseed.ResetIfPreseeded(tmpDir)
+	c.Assert(err, IsNil)
+	c.Check(done, Equals, true)
+	c.Check(serviceFile, testutil.FileAbsent)
+	c.Check(stateFile, testutil.FileAbsent)
+	c.Check(preseed.IsPreseeded(tmpDir), Equals, false)
+}
+
+func (s *preseedSuite) TestRunPreseedClassicImage(c *C) {
+	tmpDir := c.MkDir()
+	imageFile := filepath.Join(tmpDir, "rootfs.img")
+	c.Assert(ioutil.WriteFile(imageFile, nil, 0644), IsNil)
+
+	mountDir := filepath.Join(tmpDir, "mnt")
+	c.Assert(os.MkdirAll(mountDir, 0755), IsNil)
+	restore := preseed.MockMakeImageMountDir(func() (string, error) { return mountDir, nil })
+	defer restore()
+
+	env := s.mockClassicPreseedEnv(c, mountDir, "")
+
+	mockLosetup := testutil.MockCommand(c, "losetup", `
+if [ "$1" = "--find" ]; then
+	echo /dev/loop7
+fi`)
+	defer mockLosetup.Restore()
+
+	c.Check(preseed.ClassicImage(imageFile, nil), IsNil)
+
+	c.Check(mockLosetup.Calls(), DeepEquals, [][]string{
+		{"losetup", "--find", "--show", imageFile},
+		{"losetup", "--detach", "/dev/loop7"},
+	})
+	c.Check(env.mountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "/dev/loop7", mountDir},
+		{"mount", "--bind", "/proc", filepath.Join(mountDir, "proc")},
+		{"mount", "--bind", "/dev", filepath.Join(mountDir, "dev")},
+		{"mount", "--bind", "/sys/kernel/security", filepath.Join(mountDir, "sys/kernel/security")},
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(mountDir, env.targetSnapdRoot)},
+	})
+	c.Check(env.umountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", filepath.Join(mountDir, env.targetSnapdRoot)},
+		{"umount", filepath.Join(mountDir, "sys/kernel/security")},
+		{"umount", filepath.Join(mountDir, "dev")},
+		{"umount", filepath.Join(mountDir, "proc")},
+		{"umount", mountDir},
+	})
+}
+
+func (s *preseedSuite) TestRunPreseedClassicImageMountFailureDetachesLoop(c *C) {
+	tmpDir := c.MkDir()
+	imageFile := filepath.Join(tmpDir, "rootfs.img")
+	c.Assert(ioutil.WriteFile(imageFile, nil, 0644), IsNil)
+
+	mountDir := filepath.Join(tmpDir, "mnt")
+	c.Assert(os.MkdirAll(mountDir, 0755), IsNil)
+	restore := preseed.MockMakeImageMountDir(func() (string, error) { return mountDir, nil })
+	defer restore()
+
+	mockLosetup := testutil.MockCommand(c, "losetup", `
+if [ "$1" = "--find" ]; then
+	echo /dev/loop7
+fi`)
+	defer mockLosetup.Restore()
+
+	mockMountCmd := testutil.MockCommand(c, "mount", `echo "bad superblock"; exit 32`)
+	defer mockMountCmd.Restore()
+
+	c.Check(preseed.ClassicImage(imageFile, nil), ErrorMatches, `cannot mount /dev/loop7 at .*/mnt: bad superblock`)
+	c.Check(mockLosetup.Calls(), DeepEquals, [][]string{
+		{"losetup", "--find", "--show", imageFile},
+		{"losetup", "--detach", "/dev/loop7"},
+	})
+}
+
+func (s *preseedSuite) TestRunPreseedNoStateWritten(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	// snapd exits successfully without writing any state
+	mockSnapd := testutil.MockCommand(c, filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/snapd"), "")
+	defer mockSnapd.Restore()
+
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, "preseeding reported success but no state was written")
+	c.Check(mockSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedFakeBackend(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+	defer mockChrootDirs(c, tmpDir, true)()
+
+	// nothing is mounted for real
+	mockMountCmd := testutil.MockCommand(c, "mount", "exit 1")
+	defer mockMountCmd.Restore()
+
+	targetSnapdRoot := filepath.Join(tmpDir, "target-core-mounted-here")
+	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
+	defer restoreMountPath()
+
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return "/a/core.snap", nil, nil })
+	defer restoreSystemSnapFromSeed()
+
+	mockVersionFiles(c, targetSnapdRoot, "2.44.0", tmpDir, "2.41.0")
+
+	backend := &preseed.FakeBackend{}
+	c.Check(preseed.Classic(tmpDir, &preseed.ClassicOptions{Backend: backend}), IsNil)
+
+	c.Check(backend.Chroots, DeepEquals, []string{tmpDir})
+	c.Check(backend.Mounts, DeepEquals, [][]string{
+		{"-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(tmpDir, targetSnapdRoot)},
+	})
+	c.Check(backend.Unmounts, DeepEquals, []string{filepath.Join(tmpDir, targetSnapdRoot)})
+	c.Check(backend.Snapd, DeepEquals, [][]string{{filepath.Join(targetSnapdRoot, "usr/lib/snapd/snapd")}})
+	c.Check(mockMountCmd.Calls(), HasLen, 0)
+	// the fake backend simulates snapd writing its state
+	c.Check(dirs.SnapStateFile, testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestRunPreseedFakeBackendSnapdFails(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+	defer mockChrootDirs(c, tmpDir, true)()
+
+	targetSnapdRoot := filepath.Join(tmpDir, "target-core-mounted-here")
+	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
+	defer restoreMountPath()
+
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return "/a/core.snap", nil, nil })
+	defer restoreSystemSnapFromSeed()
+
+	mockVersionFiles(c, targetSnapdRoot, "2.44.0", tmpDir, "2.41.0")
+
+	backend := &preseed.FakeBackend{
+		RunSnapdFunc: func(cmd *exec.Cmd) error {
+			c.Check(cmd.Env, testutil.Contains, "SNAPD_PRESEED=1")
+			return fmt.Errorf("boom")
+		},
+	}
+	c.Check(preseed.Classic(tmpDir, &preseed.ClassicOptions{Backend: backend}), ErrorMatches, "error running snapd in preseed mode: boom\n")
+	// cleanup still happened
+	c.Check(backend.Unmounts, DeepEquals, []string{filepath.Join(tmpDir, targetSnapdRoot)})
+}
+
+func (s *preseedSuite) TestRunPreseedCleansUpStaleMount(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	// core snap left mounted by a previous aborted run
+	staleMount := filepath.Join(tmpDir, env.targetSnapdRoot)
+	c.Assert(os.MkdirAll(staleMount, 0755), IsNil)
+	mockMountInfo := `912 920 0:57 / ${rootDir}/proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+914 913 0:7 / ${rootDir}/sys/kernel/security rw,nosuid,nodev,noexec,relatime master:8 - securityfs securityfs rw
+915 920 0:58 / ${rootDir}/dev rw,relatime - tmpfs none rw,size=492k,mode=755,uid=100000,gid=100000
+916 920 7:3 / ${staleMount} ro,relatime - squashfs /dev/loop3 ro
+`
+	mockMountInfo = strings.Replace(mockMountInfo, "${rootDir}", tmpDir, -1)
+	mockMountInfo = strings.Replace(mockMountInfo, "${staleMount}", staleMount, -1)
+	defer osutil.MockMountInfo(mockMountInfo)()
+
+	c.Check(preseed.Classic(tmpDir, nil), IsNil)
+
+	c.Check(env.umountCmd.Calls(), DeepEquals, [][]string{
+		// stale mount cleaned up first
+		{"umount", staleMount},
+		{"umount", filepath.Join(tmpDir, env.targetSnapdRoot)},
+	})
+	c.Assert(env.mountCmd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedCleansUpStaleMountAtDefaultPath(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	// core snap left mounted at the default location by a previous
+	// aborted run, which did not use a custom mount path
+	staleMount := filepath.Join(tmpDir, env.targetSnapdRoot)
+	c.Assert(os.MkdirAll(staleMount, 0755), IsNil)
+	defer osutil.MockMountInfo(fmt.Sprintf(`912 920 0:57 / %[1]s/proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+914 913 0:7 / %[1]s/sys/kernel/security rw,nosuid,nodev,noexec,relatime master:8 - securityfs securityfs rw
+915 920 0:58 / %[1]s/dev rw,relatime - tmpfs none rw,size=492k,mode=755,uid=100000,gid=100000
+916 920 7:3 / %[2]s ro,relatime - squashfs /dev/loop3 ro
+`, tmpDir, staleMount))()
+
+	customMountPath := filepath.Join(tmpDir, "larger-fs", "snapd-preseed")
+	customSnapd := testutil.MockCommand(c, filepath.Join(customMountPath, "usr/lib/snapd/snapd"), mockWriteStateScript())
+	defer customSnapd.Restore()
+	mockVersionFiles(c, customMountPath, "2.44.0", tmpDir, "2.41.0")
+
+	c.Check(preseed.Classic(tmpDir, &preseed.ClassicOptions{MountPath: customMountPath}), IsNil)
+
+	c.Check(env.umountCmd.Calls(), DeepEquals, [][]string{
+		// stale mount cleaned up first
+		{"umount", staleMount},
+		{"umount", filepath.Join(tmpDir, customMountPath)},
+	})
+	c.Check(customSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestDefaultMountPath(c *C) {
+	c.Check(preseed.DefaultMountPath, Equals, "/tmp/snapd-preseed")
+
+	opts := &preseed.ClassicOptions{}
+	c.Check(opts.ChrootMountPath(), Equals, preseed.DefaultMountPath)
+	opts = &preseed.ClassicOptions{TempDir: "/var/tmp"}
+	c.Check(opts.ChrootMountPath(), Equals, "/var/tmp/snapd-preseed")
+	opts = &preseed.ClassicOptions{MountPath: "/mnt/core"}
+	c.Check(opts.ChrootMountPath(), Equals, "/mnt/core")
+}
+
+func (s *preseedSuite) TestRunPreseedCustomEnv(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, `
+if [ "$SNAPD_DEBUG" != "1" ] || [ "$HTTP_PROXY" != "http://proxy:3128" ] || [ "$SNAPD_PRESEED" != "1" ]; then
+	exit 1
+fi
+`)
+
+	opts := &preseed.ClassicOptions{
+		Env: map[string]string{
+			"SNAPD_DEBUG":   "1",
+			"HTTP_PROXY":    "http://proxy:3128",
+			"SNAPD_PRESEED": "0",
+		},
+	}
+	c.Check(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedCustomMountPath(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	customMountPath := filepath.Join(tmpDir, "larger-fs", "snapd-preseed")
+	customSnapd := testutil.MockCommand(c, filepath.Join(customMountPath, "usr/lib/snapd/snapd"), mockWriteStateScript())
+	defer customSnapd.Restore()
+	mockVersionFiles(c, customMountPath, "2.44.0", tmpDir, "2.41.0")
+
+	opts := &preseed.ClassicOptions{MountPath: customMountPath}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+
+	c.Check(env.mountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(tmpDir, customMountPath)},
+	})
+	c.Check(env.umountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", filepath.Join(tmpDir, customMountPath)},
+	})
+	c.Check(customSnapd.Calls(), HasLen, 1)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+	// the mountpoint and its parents created for it are gone
+	c.Check(filepath.Join(tmpDir, customMountPath), testutil.FileAbsent)
+	c.Check(filepath.Join(tmpDir, filepath.Dir(customMountPath)), testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestRunPreseedRemovesMountpoint(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(env.umountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", filepath.Join(tmpDir, env.targetSnapdRoot)},
+	})
+	c.Check(filepath.Join(tmpDir, env.targetSnapdRoot), testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestResetRemovesSnapMountpoints(c *C) {
+	tmpDir := c.MkDir()
+
+	// left behind by an aborted run
+	for _, dir := range []string{"/tmp/snapd-preseed", "/tmp/snapd-preseed-core20_1"} {
+		c.Assert(os.MkdirAll(filepath.Join(tmpDir, dir), 0755), IsNil)
+	}
+	// not empty, not a mountpoint of preseeding
+	unrelated := filepath.Join(tmpDir, "/tmp/snapd-preseed-notes/file")
+	c.Assert(os.MkdirAll(filepath.Dir(unrelated), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(unrelated, nil, 0644), IsNil)
+
+	c.Assert(preseed.ResetPreseededChroot(tmpDir), IsNil)
+
+	c.Check(filepath.Join(tmpDir, preseed.DefaultMountPath), testutil.FileAbsent)
+	c.Check(filepath.Join(tmpDir, "/tmp/snapd-preseed-core20_1"), testutil.FileAbsent)
+	c.Check(unrelated, testutil.FilePresent)
+	c.Check(filepath.Join(tmpDir, "/tmp"), testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestRunPreseedTempDir(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	tempDir := filepath.Join(tmpDir, "larger-fs")
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, tempDir), 0755), IsNil)
+	mountPath := filepath.Join(tempDir, "target-core-mounted-here")
+	customSnapd := testutil.MockCommand(c, filepath.Join(mountPath, "usr/lib/snapd/snapd"), mockWriteStateScript())
+	defer customSnapd.Restore()
+	mockVersionFiles(c, mountPath, "2.44.0", tmpDir, "2.41.0")
+
+	opts := &preseed.ClassicOptions{TempDir: tempDir}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+
+	c.Check(env.mountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(tmpDir, mountPath)},
+	})
+	c.Check(customSnapd.Calls(), HasLen, 1)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedInvalidTempDir(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, "file"), nil, 0644), IsNil)
+
+	for _, tc := range []struct {
+		tempDir string
+		err     string
+	}{
+		{"relative/path", `cannot use "relative/path" as temporary directory: must be an absolute path inside the chroot`},
+		{"/missing", fmt.Sprintf(`cannot use "%s/missing" as temporary directory: it does not exist`, tmpDir)},
+		{"/file", fmt.Sprintf(`cannot use "%s/file" as temporary directory: it is not a directory`, tmpDir)},
+	} {
+		opts := &preseed.ClassicOptions{TempDir: tc.tempDir}
+		c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, tc.err)
+	}
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedInvalidMountPath(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, "file"), nil, 0644), IsNil)
+
+	for _, tc := range []struct {
+		mountPath string
+		err       string
+	}{
+		{"relative/path", `cannot use "relative/path" as mount path: must be an absolute path inside the chroot other than /`},
+		{"/", `cannot use "/" as mount path: must be an absolute path inside the chroot other than /`},
+		{"/file/snapd-preseed", fmt.Sprintf(`cannot use "/file/snapd-preseed" as mount path: %s/file is not a directory`, tmpDir)},
+	} {
+		opts := &preseed.ClassicOptions{MountPath: tc.mountPath}
+		c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, tc.err)
+	}
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedNoSeed(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	s.AddCleanup(preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) {
+		return "", nil, seed.ErrNoAssertions
+	}))
+
+	err := preseed.Classic(tmpDir, nil)
+	c.Check(err, ErrorMatches, fmt.Sprintf("cannot preseed: no seed found under %s/var/lib/snapd/seed", tmpDir))
+	c.Check(errors.Is(err, preseed.ErrNoSeed), Equals, true)
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedRewriteSeed(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	var rewriteCalled bool
+	opts := &preseed.ClassicOptions{
+		RewriteSeed: func(seedDir string) error {
+			rewriteCalled = true
+			c.Check(seedDir, Equals, dirs.SnapSeedDir)
+			// nothing was mounted yet
+			c.Check(env.mountCmd.Calls(), HasLen, 0)
+			c.Assert(os.MkdirAll(filepath.Join(seedDir, "assertions"), 0755), IsNil)
+			return ioutil.WriteFile(filepath.Join(seedDir, "assertions", "model"), []byte("test-signed"), 0644)
+		},
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(rewriteCalled, Equals, true)
+	c.Check(filepath.Join(dirs.SnapSeedDir, "assertions", "model"), testutil.FileEquals, "test-signed")
+	c.Check(env.mountCmd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedRewriteSeedError(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	opts := &preseed.ClassicOptions{
+		RewriteSeed: func(seedDir string) error {
+			return fmt.Errorf("boom")
+		},
+	}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, "cannot rewrite seed: boom")
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedBeforeMount(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	var hookCalls []string
+	opts := &preseed.ClassicOptions{
+		BeforeMount: func(coreSnapPath string) error {
+			hookCalls = append(hookCalls, coreSnapPath)
+			// nothing was mounted yet
+			c.Check(env.mountCmd.Calls(), HasLen, 0)
+			return nil
+		},
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(hookCalls, DeepEquals, []string{"/a/core.snap"})
+	c.Check(env.mountCmd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedBeforeMountError(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	opts := &preseed.ClassicOptions{
+		BeforeMount: func(coreSnapPath string) error {
+			return fmt.Errorf("unexpected blob")
+		},
+	}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, "refusing to mount /a/core.snap: unexpected blob")
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedStateOverlay(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+	defer mockChrootDirs(c, tmpDir, true)()
+
+	targetSnapdRoot := filepath.Join(tmpDir, "target-core-mounted-here")
+	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
+	defer restoreMountPath()
+
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return "/a/core.snap", nil, nil })
+	defer restoreSystemSnapFromSeed()
+
+	mockVersionFiles(c, targetSnapdRoot, "2.44.0", tmpDir, "2.41.0")
+
+	upperDir := filepath.Join(c.MkDir(), "state-layer")
+	backend := &preseed.FakeBackend{
+		RunSnapdFunc: func(cmd *exec.Cmd) error {
+			// simulate the overlay, snapd state lands in the upper dir
+			for _, stateFile := range []string{dirs.SnapStateFile, filepath.Join(upperDir, "state.json")} {
+				c.Assert(os.MkdirAll(filepath.Dir(stateFile), 0755), IsNil)
+				c.Assert(ioutil.WriteFile(stateFile, []byte("{}"), 0644), IsNil)
+			}
+			return nil
+		},
+	}
+	opts := &preseed.ClassicOptions{
+		Backend:       backend,
+		StateUpperDir: upperDir,
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+
+	stateDir := dirs.SnapdStateDir(tmpDir)
+	overlayDir := filepath.Join(tmpDir, stateDir)
+	c.Check(backend.Mounts, DeepEquals, [][]string{
+		{"-t", "overlay", "-o", fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s.work", overlayDir, upperDir, upperDir), "overlay", overlayDir},
+		{"-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(tmpDir, targetSnapdRoot)},
+	})
+	// the overlay is unmounted last
+	c.Check(backend.Unmounts, DeepEquals, []string{filepath.Join(tmpDir, targetSnapdRoot), stateDir})
+	c.Check(filepath.Join(upperDir, "state.json"), testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestRunPreseedNoSpaceLeft(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, `
+echo "cannot write state: write /var/lib/snapd/state.json: no space left on device" >&2
+exit 1
+`)
+
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, "preseeding failed: no space left in chroot")
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+	// cleanup ran
+	c.Check(env.umountCmd.Calls(), DeepEquals, [][]string{{"umount", filepath.Join(tmpDir, env.targetSnapdRoot)}})
+	// partial state written by snapd was removed
+	c.Check(dirs.SnapStateFile, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestRunPreseedNonMergedUsr(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	// snapd from the deb lives in /lib/snapd and is newer than the one
+	// from the snap
+	c.Assert(os.Remove(filepath.Join(tmpDir, "usr/lib/snapd/info")), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "lib/snapd"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, "lib/snapd/info"), []byte("VERSION=2.45.0"), 0644), IsNil)
+	debSnapd := testutil.MockCommand(c, filepath.Join(tmpDir, "lib/snapd/snapd"), mockWriteStateScript())
+	defer debSnapd.Restore()
+
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(debSnapd.Calls(), HasLen, 1)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestChooseTargetSnapdVersionNonMergedUsr(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+
+	targetSnapdRoot := filepath.Join(tmpDir, "target-core-mounted-here")
+	for _, dir := range []string{filepath.Join(tmpDir, "lib/snapd"), filepath.Join(targetSnapdRoot, "lib/snapd")} {
+		c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, "lib/snapd/info"), []byte("VERSION=2.44.0"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(targetSnapdRoot, "lib/snapd/info"), []byte("VERSION=2.45.0"), 0644), IsNil)
+
+	targetSnapd, err := preseed.ChooseTargetSnapdVersion(targetSnapdRoot)
+	c.Assert(err, IsNil)
+	path, version := preseed.SnapdPathAndVersion(targetSnapd)
+	c.Check(path, Equals, filepath.Join(targetSnapdRoot, "lib/snapd/snapd"))
+	c.Check(version, Equals, "2.45.0")
+}
+
+func (s *preseedSuite) TestRunPreseedExtractedSnapdTree(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	mockUnsquashfs := testutil.MockCommand(c, "unsquashfs", "exit 1")
+	defer mockUnsquashfs.Restore()
+
+	extractedDir := filepath.Join(tmpDir, "extracted-core")
+	// older than the deb, but used nonetheless
+	mockVersionFiles(c, extractedDir, "2.43.3", tmpDir, "2.45.0")
+	extractedSnapd := testutil.MockCommand(c, filepath.Join(extractedDir, "usr/lib/snapd/snapd"), mockWriteStateScript())
+	defer extractedSnapd.Restore()
+
+	opts := &preseed.ClassicOptions{SnapdRootDir: extractedDir}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+
+	c.Check(extractedSnapd.Calls(), HasLen, 1)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.umountCmd.Calls(), HasLen, 0)
+	c.Check(mockUnsquashfs.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedExtractedSnapdTreeUnsupported(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	extractedDir := filepath.Join(tmpDir, "extracted-core")
+	mockVersionFiles(c, extractedDir, "2.43.0", tmpDir, "2.45.0")
+
+	opts := &preseed.ClassicOptions{SnapdRootDir: extractedDir}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches,
+		fmt.Sprintf(`snapd 2.43.0 from %s does not support preseeding, the minimum required version is 2.43.3\+`, extractedDir))
+}
+
+func (s *preseedSuite) TestExtractSnapd(c *C) {
+	targetDir := filepath.Join(c.MkDir(), "extracted-core")
+	mockUnsquashfs := testutil.MockCommand(c, "unsquashfs", `mkdir -p "$3/usr/lib/snapd"
+touch "$3/usr/lib/snapd/snapd"
+`)
+	defer mockUnsquashfs.Restore()
+
+	c.Assert(preseed.ExtractSnapd("/a/core.snap", targetDir), IsNil)
+	c.Check(mockUnsquashfs.Calls(), DeepEquals, [][]string{
+		{"unsquashfs", "-n", "-d", targetDir, "/a/core.snap"},
+	})
+	c.Check(filepath.Join(targetDir, "usr/lib/snapd/snapd"), testutil.FilePresent)
+
+	// a complete extraction is reused
+	mockUnsquashfs.ForgetCalls()
+	c.Assert(preseed.ExtractSnapd("/a/core.snap", targetDir), IsNil)
+	c.Check(mockUnsquashfs.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestExtractSnapdPartial(c *C) {
+	targetDir := filepath.Join(c.MkDir(), "extracted-core")
+	// left behind by a crashed extraction
+	c.Assert(os.MkdirAll(filepath.Join(targetDir, "usr/lib"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(targetDir, "usr/lib/partial"), nil, 0644), IsNil)
+
+	mockUnsquashfs := testutil.MockCommand(c, "unsquashfs", `[ ! -e "$3" ] || exit 1
+mkdir -p "$3/usr/lib/snapd"
+touch "$3/usr/lib/snapd/snapd"
+`)
+	defer mockUnsquashfs.Restore()
+
+	c.Assert(preseed.ExtractSnapd("/a/core.snap", targetDir), IsNil)
+	c.Check(mockUnsquashfs.Calls(), HasLen, 1)
+	c.Check(filepath.Join(targetDir, "usr/lib/partial"), testutil.FileAbsent)
+	c.Check(filepath.Join(targetDir, "usr/lib/snapd/snapd"), testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestExtractSnapdError(c *C) {
+	targetDir := filepath.Join(c.MkDir(), "extracted-core")
+	mockUnsquashfs := testutil.MockCommand(c, "unsquashfs", `mkdir -p "$3"
+echo "write failed"
+exit 1
+`)
+	defer mockUnsquashfs.Restore()
+
+	c.Assert(preseed.ExtractSnapd("/a/core.snap", targetDir), ErrorMatches, `cannot extract /a/core.snap: write failed`)
+	// the partial extraction is not trusted
+	c.Check(filepath.Join(targetDir, ".preseed-extracted"), testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestSelfTest(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf("mkdir -p %[1]s\ntouch %[1]s/snap.foo.service\n", dirs.SnapServicesDir))
+
+	c.Assert(preseed.SelfTest(tmpDir), IsNil)
+	c.Check(dirs.SnapStateFile, testutil.FileAbsent)
+	c.Check(filepath.Join(dirs.SnapServicesDir, "snap.foo.service"), testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestSelfTestLeftovers(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	leaked := filepath.Join(dirs.SnapServicesDir, "snap.leaked.service")
+	restore := preseed.MockResetPreseededChroot(func(dir string) error {
+		c.Check(dir, Equals, "/")
+		if err := preseed.ResetPreseededChroot(dir); err != nil {
+			return err
+		}
+		c.Assert(os.MkdirAll(filepath.Dir(leaked), 0755), IsNil)
+		return ioutil.WriteFile(leaked, nil, 0644)
+	})
+	defer restore()
+
+	c.Check(preseed.SelfTest(tmpDir), ErrorMatches, fmt.Sprintf("self-test failed: reset of %s left 1 preseed artifacts behind:\n - %s", tmpDir, leaked))
+}
+
+func (s *preseedSuite) TestRunPreseedRelocatedSeed(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+	defer mockChrootDirs(c, tmpDir, true)()
+
+	targetSnapdRoot := filepath.Join(tmpDir, "target-core-mounted-here")
+	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
+	defer restoreMountPath()
+
+	seedDir := c.MkDir()
+	var backend *preseed.FakeBackend
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(dir, label string) (string, []string, error) {
+		// the relocated seed is mounted at the time of resolution
+		c.Check(dir, Equals, dirs.SnapSeedDir)
+		c.Check(backend.Mounts, DeepEquals, [][]string{
+			{"--bind", seedDir, filepath.Join(tmpDir, dirs.SnapSeedDir)},
+		})
+		return "/a/core.snap", nil, nil
+	})
+	defer restoreSystemSnapFromSeed()
+
+	mockVersionFiles(c, targetSnapdRoot, "2.44.0", tmpDir, "2.41.0")
+
+	backend = &preseed.FakeBackend{}
+	opts := &preseed.ClassicOptions{
+		Backend: backend,
+		SeedDir: seedDir,
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+
+	c.Check(backend.Mounts, HasLen, 2)
+	// the seed is unmounted last
+	c.Check(backend.Unmounts, DeepEquals, []string{filepath.Join(tmpDir, targetSnapdRoot), dirs.SnapSeedDir})
+
+	c.Assert(os.Remove(dirs.SnapStateFile), IsNil)
+	opts.SeedDir = filepath.Join(tmpDir, "missing")
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, `cannot use seed directory ".*/missing": not a directory`)
+}
+
+func (s *preseedSuite) TestRunPreseedHandleSignals(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+	defer mockChrootDirs(c, tmpDir, true)()
+
+	targetSnapdRoot := filepath.Join(tmpDir, "target-core-mounted-here")
+	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
+	defer restoreMountPath()
+
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return "/a/core.snap", nil, nil })
+	defer restoreSystemSnapFromSeed()
+
+	mockVersionFiles(c, targetSnapdRoot, "2.44.0", tmpDir, "2.41.0")
+
+	exited := make(chan int, 1)
+	restoreExit := preseed.MockOsExit(func(code int) { exited <- code })
+	defer restoreExit()
+
+	var backend *preseed.FakeBackend
+	backend = &preseed.FakeBackend{
+		RunSnapdFunc: func(cmd *exec.Cmd) error {
+			// interrupted while snapd runs
+			c.Assert(syscall.Kill(os.Getpid(), syscall.SIGINT), IsNil)
+			select {
+			case code := <-exited:
+				c.Check(code, Equals, 1)
+			case <-time.After(5 * time.Second):
+				c.Fatal("signal was not handled")
+			}
+			// cleanup ran from the signal handler
+			c.Check(backend.Unmounts, DeepEquals, []string{filepath.Join(tmpDir, targetSnapdRoot)})
+			return fmt.Errorf("interrupted")
+		},
+	}
+	opts := &preseed.ClassicOptions{
+		Backend:       backend,
+		HandleSignals: true,
+	}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, "error running snapd in preseed mode: interrupted\n")
+	// the cleanup was not repeated
+	c.Check(backend.Unmounts, DeepEquals, []string{filepath.Join(tmpDir, targetSnapdRoot)})
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorCache(c *C) {
+	tmpDir := c.MkDir()
+	// snapd sees the imported cache and adds to it
+	env := s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf(`
+test -f %[1]s/imported/profile || exit 1
+echo compiled > %[1]s/snap.foo.app
+`, apparmor_sandbox.CacheDir))
+
+	// mock a previously exported cache
+	prevCacheDir := filepath.Join(c.MkDir(), "cache")
+	c.Assert(os.MkdirAll(filepath.Join(prevCacheDir, "imported"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(prevCacheDir, "imported", "profile"), []byte("imported"), 0644), IsNil)
+	importFile := filepath.Join(c.MkDir(), "import.tar.gz")
+	out, err := exec.Command("tar", "-czf", importFile, "-C", prevCacheDir, ".").CombinedOutput()
+	c.Assert(err, IsNil, Commentf("%s", out))
+
+	exportFile := filepath.Join(c.MkDir(), "export.tar.gz")
+	opts := &preseed.ClassicOptions{
+		ImportAppArmorCache: importFile,
+		ExportAppArmorCache: exportFile,
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+
+	c.Check(filepath.Join(apparmor_sandbox.CacheDir, "imported", "profile"), testutil.FileEquals, "imported")
+
+	exportedDir := c.MkDir()
+	out, err = exec.Command("tar", "-xzf", exportFile, "-C", exportedDir).CombinedOutput()
+	c.Assert(err, IsNil, Commentf("%s", out))
+	c.Check(filepath.Join(exportedDir, "imported", "profile"), testutil.FileEquals, "imported")
+	c.Check(filepath.Join(exportedDir, "snap.foo.app"), testutil.FileEquals, "compiled\n")
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorCacheImportMissing(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	opts := &preseed.ClassicOptions{
+		ImportAppArmorCache: filepath.Join(tmpDir, "missing.tar.gz"),
+	}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, `cannot import apparmor cache: open .*/missing.tar.gz: no such file or directory`)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedSnapdDirEscapesChroot(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	hostDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "var/lib"), 0755), IsNil)
+	c.Assert(os.Symlink(hostDir, filepath.Join(tmpDir, "var/lib/snapd")), IsNil)
+
+	err := preseed.Classic(tmpDir, nil)
+	c.Check(err, ErrorMatches, fmt.Sprintf(`cannot preseed: %s/var/lib/snapd resolves to %s outside of the chroot %s, refusing to modify the host`, tmpDir, hostDir, tmpDir))
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+
+	// a symlink which stays inside of the chroot is fine
+	c.Assert(os.Remove(filepath.Join(tmpDir, "var/lib/snapd")), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "data/snapd"), 0755), IsNil)
+	c.Assert(os.Symlink("../../data/snapd", filepath.Join(tmpDir, "var/lib/snapd")), IsNil)
+	c.Check(preseed.Classic(tmpDir, nil), IsNil)
+}
+
+func (s *preseedSuite) TestRunPreseedResume(c *C) {
+	tmpDir := c.MkDir()
+	failMarker := filepath.Join(tmpDir, "failed-once")
+	// snapd fails on the first run
+	env := s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf(`
+if [ ! -e %[1]s ]; then
+	touch %[1]s
+	rm -f %[2]s
+	exit 1
+fi
+`, failMarker, dirs.SnapStateFile))
+
+	checkpointFile := filepath.Join(dirs.SnapdStateDir(dirs.GlobalRootDir), "preseed-checkpoint.json")
+
+	rewrites := 0
+	opts := &preseed.ClassicOptions{
+		RewriteSeed: func(seedDir string) error {
+			rewrites++
+			return nil
+		},
+		Resume: true,
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), ErrorMatches, "error running snapd in preseed mode: exit status 1\n")
+	c.Check(rewrites, Equals, 1)
+	c.Check(checkpointFile, testutil.FileEquals, `{"completed":["rewrite-seed","import-apparmor-cache"]}`)
+
+	// resuming skips rewriting the seed, but the mounts and snapd are redone
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(rewrites, Equals, 1)
+	c.Check(env.targetSnapd.Calls(), HasLen, 2)
+	c.Check(env.mountCmd.Calls(), HasLen, 2)
+	c.Check(checkpointFile, testutil.FileAbsent)
+
+	// without resume, all the steps are run
+	opts.Resume = false
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(rewrites, Equals, 2)
+	c.Check(env.targetSnapd.Calls(), HasLen, 3)
+}
+
+func (s *preseedSuite) TestRunPreseedResumeSnapdCompleted(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	checkpointFile := filepath.Join(dirs.SnapdStateDir(dirs.GlobalRootDir), "preseed-checkpoint.json")
+	c.Assert(os.MkdirAll(filepath.Dir(checkpointFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(checkpointFile, []byte(`{"completed":["run-snapd"]}`), 0644), IsNil)
+
+	// the state of snapd is missing, snapd is run again
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{Resume: true}), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+
+	// snapd state is there, running snapd is skipped
+	c.Assert(ioutil.WriteFile(checkpointFile, []byte(`{"completed":["run-snapd"]}`), 0644), IsNil)
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{Resume: true}), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+	c.Check(checkpointFile, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestRunPreseedResumeInterruptedSeeding(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	// snapd crashed half-way through seeding, leaving its state and the
+	// checkpoint behind
+	for _, p := range []string{dirs.SnapStateFile, filepath.Join(dirs.SnapdStateDir(tmpDir), "preseed-checkpoint.json")} {
+		c.Assert(os.MkdirAll(filepath.Dir(filepath.Join(tmpDir, p)), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, p), []byte("{}"), 0644), IsNil)
+	}
+	checkpointFile := filepath.Join(dirs.SnapdStateDir(dirs.GlobalRootDir), "preseed-checkpoint.json")
+	c.Assert(os.MkdirAll(filepath.Dir(checkpointFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(checkpointFile, []byte(`{"completed":["import-apparmor-cache"]}`), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(dirs.SnapStateFile, []byte(`{
+	"changes": {
+		"1": {"id": "1", "kind": "seed", "task-ids": ["1", "2", "3", "4", "5", "6"]},
+		"2": {"id": "2", "kind": "other", "task-ids": ["7"]}
+	},
+	"tasks": {
+		"1": {"id": "1", "status": 4, "data": {"snap-setup": {"side-info": {"name": "core"}}}},
+		"2": {"id": "2", "status": 4, "data": {"snap-setup-task": "1"}},
+		"3": {"id": "3", "status": 4, "data": {"snap-setup": {"side-info": {"name": "foo"}}}},
+		"4": {"id": "4", "status": 2, "data": {"snap-setup-task": "3"}},
+		"5": {"id": "5", "status": 2, "data": {"snap-setup": {"side-info": {"name": "bar"}}}},
+		"6": {"id": "6", "status": 2},
+		"7": {"id": "7", "status": 4, "data": {"snap-setup": {"side-info": {"name": "baz"}}}}
+	}
+}`), 0644), IsNil)
+
+	// the leftovers of the interrupted run are taken for a preseeded
+	// system, unless resuming
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, `the system at ".*" appears to be preseeded, pass --reset flag to clean it up`)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+
+	var stdout bytes.Buffer
+	oldStdout := preseed.Stdout
+	preseed.Stdout = &stdout
+	defer func() { preseed.Stdout = oldStdout }()
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{Resume: true}), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+	c.Check(stdout.String(), testutil.Contains, `resuming seeding, skipping snaps seeded by a previous run: core
+resuming seeding of snaps: bar, foo
+`)
+}
+
+func (s *preseedSuite) TestRunPreseedValidateUdevRules(c *C) {
+	tmpDir := c.MkDir()
+	rulesFile := filepath.Join(dirs.SnapUdevRulesDir, "70-snap.foo.rules")
+	env := s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf(`
+mkdir -p %[1]s
+cat > %[2]s <<'RULES'
+# This file is automatically generated.
+SUBSYSTEM=="input", KERNEL=="event[0-9]*", TAG+="snap_foo_bar"
+RULES
+`, dirs.SnapUdevRulesDir, rulesFile))
+
+	opts := &preseed.ClassicOptions{ValidateUdevRules: true}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+
+	// snapd generating a malformed rule
+	malformed := testutil.MockCommand(c, filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/snapd"), mockWriteStateScript()+fmt.Sprintf(`
+mkdir -p %[1]s
+cat > %[2]s <<'RULES'
+SUBSYSTEM=="input", KERNEL=="event[0-9]*", TAG+="snap_foo_bar" RUN+="foo"
+RULES
+`, dirs.SnapUdevRulesDir, rulesFile))
+	defer malformed.Restore()
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, fmt.Sprintf(`invalid udev rules generated by preseeding: %s:1: expected a comma before .*`, rulesFile))
+
+	// validation is optional
+	c.Check(preseed.Classic(tmpDir, nil), IsNil)
+}
+
+func (s *preseedSuite) TestRunPreseedReportsSeparateDataMounts(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	restore := osutil.MockMountInfo(fmt.Sprintf(`912 920 0:57 / %[1]s/proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+914 913 0:7 / %[1]s/sys/kernel/security rw,nosuid,nodev,noexec,relatime master:8 - securityfs securityfs rw
+915 920 0:58 / %[1]s/dev rw,relatime - tmpfs none rw,size=492k,mode=755,uid=100000,gid=100000
+916 920 0:23 /@snapd %[1]s/var/lib/snapd rw,relatime shared:1 - btrfs /dev/sda2 rw
+`, tmpDir))
+	defer restore()
+
+	var stdout bytes.Buffer
+	oldStdout := preseed.Stdout
+	preseed.Stdout = &stdout
+	defer func() { preseed.Stdout = oldStdout }()
+
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+	c.Check(stdout.String(), testutil.Contains, fmt.Sprintf("%s/var/lib/snapd is a separate mount: /dev/sda2 (btrfs)\n", tmpDir))
+	c.Check(stdout.String(), testutil.Contains, "ubuntu classic preseeding\n")
+}
+
+func (s *preseedSuite) TestRunPreseedSourceDateEpoch(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf(`
+mkdir -p %[1]s %[2]s
+echo compiled > %[1]s/snap.foo.app
+echo compiled > %[2]s/snap.foo.app.bin
+`, apparmor_sandbox.CacheDir, dirs.SnapSeccompDir))
+
+	tracked := []string{
+		dirs.SnapStateFile,
+		filepath.Join(apparmor_sandbox.CacheDir, "snap.foo.app"),
+		dirs.SnapSeccompDir,
+		filepath.Join(dirs.SnapSeccompDir, "snap.foo.app.bin"),
+	}
+	mtimes := func() []time.Time {
+		var times []time.Time
+		for _, path := range tracked {
+			st, err := os.Stat(path)
+			c.Assert(err, IsNil)
+			times = append(times, st.ModTime())
+		}
+		return times
+	}
+
+	epoch := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	opts := &preseed.ClassicOptions{SourceDateEpoch: epoch}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	first := mtimes()
+	for i, mtime := range first {
+		c.Check(mtime.Equal(epoch), Equals, true, Commentf("%s: %v", tracked[i], mtime))
+	}
+
+	// preseed again
+	c.Assert(os.Remove(dirs.SnapStateFile), IsNil)
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 2)
+	second := mtimes()
+	for i := range first {
+		c.Check(second[i].Equal(first[i]), Equals, true, Commentf("%s: %v != %v", tracked[i], second[i], first[i]))
+	}
+
+	// times are not touched by default
+	c.Assert(os.Remove(dirs.SnapStateFile), IsNil)
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	st, err := os.Stat(dirs.SnapStateFile)
+	c.Assert(err, IsNil)
+	c.Check(st.ModTime().Equal(epoch), Equals, false)
+}
+
+func (s *preseedSuite) TestRunPreseedIDMapping(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf(`
+mkdir -p %[1]s
+echo compiled > %[1]s/snap.foo.app
+`, apparmor_sandbox.CacheDir))
+
+	type chown struct {
+		path     string
+		uid, gid int
+	}
+	var chowns []chown
+	s.AddCleanup(preseed.MockOsLchown(func(path string, uid, gid int) error {
+		chowns = append(chowns, chown{path, uid, gid})
+		return nil
+	}))
+
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	opts := &preseed.ClassicOptions{
+		UIDMap: []preseed.IDMapping{{ID: uid, TargetID: 100000 + uid, Count: 1}},
+		// the group is not mapped
+		GIDMap: []preseed.IDMapping{{ID: gid + 1, TargetID: 0, Count: 10}},
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+
+	c.Check(chowns, testutil.DeepContains, chown{dirs.SnapStateFile, 100000 + int(uid), int(gid)})
+	c.Check(chowns, testutil.DeepContains, chown{filepath.Join(apparmor_sandbox.CacheDir, "snap.foo.app"), 100000 + int(uid), int(gid)})
+}
+
+func (s *preseedSuite) TestRunPreseedPrune(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf(`
+mkdir -p %[1]s/5ade5ed0.0 %[2]s
+echo compiled > %[1]s/5ade5ed0.0/snap.foo.app
+echo partial > %[1]s/5ade5ed0.0/snap.foo.app.BCDFGHJKLMNP~
+echo partial > %[2]s/state.json.bcdfghjklm01~
+# not written by osutil.AtomicWriteFile
+echo backup > %[1]s/5ade5ed0.0/snap.foo.app~
+`, apparmor_sandbox.CacheDir, filepath.Dir(dirs.SnapStateFile)))
+	// not a preseed artifact
+	unrelated := filepath.Join(tmpDir, "etc/foo.BCDFGHJKLMNP~")
+	c.Assert(os.MkdirAll(filepath.Dir(unrelated), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(unrelated, nil, 0644), IsNil)
+
+	var stdout bytes.Buffer
+	oldStdout := preseed.Stdout
+	preseed.Stdout = &stdout
+	defer func() { preseed.Stdout = oldStdout }()
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{Prune: true}), IsNil)
+
+	cacheDir := filepath.Join(apparmor_sandbox.CacheDir, "5ade5ed0.0")
+	c.Check(filepath.Join(cacheDir, "snap.foo.app"), testutil.FileEquals, "compiled\n")
+	c.Check(filepath.Join(cacheDir, "snap.foo.app~"), testutil.FilePresent)
+	c.Check(filepath.Join(cacheDir, "snap.foo.app.BCDFGHJKLMNP~"), testutil.FileAbsent)
+	c.Check(dirs.SnapStateFile, testutil.FilePresent)
+	c.Check(dirs.SnapStateFile+".bcdfghjklm01~", testutil.FileAbsent)
+	c.Check(unrelated, testutil.FilePresent)
+	c.Check(stdout.String(), testutil.Contains, "pruned 2 intermediate files, 16B saved\n")
+}
+
+func (s *preseedSuite) TestRunPreseedIDMappingInvalid(c *C) {
+	opts := &preseed.ClassicOptions{
+		GIDMap: []preseed.IDMapping{{ID: 0, TargetID: 1000, Count: 0}},
+	}
+	c.Check(preseed.Classic(c.MkDir(), opts), ErrorMatches, `cannot use id mapping 0:1000:0, the count must not be 0`)
+}
+func (s *preseedSuite) TestRunPreseedActiveSnapdSocket(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "/run"), 0755), IsNil)
+	l, err := net.Listen("unix", filepath.Join(tmpDir, "/run/snapd.socket"))
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, fmt.Sprintf("refusing to preseed an active snapd system at %s", tmpDir))
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+
+	// the check can be disabled
+	c.Check(preseed.Classic(tmpDir, &preseed.ClassicOptions{AllowActiveSnapd: true}), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedActiveSnapdProcess(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	procDir := c.MkDir()
+	restore := preseed.MockProcDir(procDir)
+	defer restore()
+	mockProcess := func(pid, comm, root string) {
+		c.Assert(os.MkdirAll(filepath.Join(procDir, pid), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(procDir, pid, "comm"), []byte(comm+"\n"), 0644), IsNil)
+		c.Assert(os.Symlink(root, filepath.Join(procDir, pid, "root")), IsNil)
+	}
+	mockProcess("1", "systemd", "/")
+	mockProcess("42", "snapd", "/")
+	mockProcess("100", "bash", tmpDir)
+
+	// snapd is running on the host only
+	c.Check(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+
+	c.Assert(os.Remove(dirs.SnapStateFile), IsNil)
+	mockProcess("200", "snapd", tmpDir)
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, fmt.Sprintf("refusing to preseed an active snapd system at %s", tmpDir))
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedInhibitLocks(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	inhibitDir := filepath.Join(tmpDir, runinhibit.InhibitDir)
+	c.Assert(os.MkdirAll(inhibitDir, 0755), IsNil)
+	// an empty lock means the snap is not inhibited
+	c.Assert(ioutil.WriteFile(filepath.Join(inhibitDir, "bar.lock"), nil, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(inhibitDir, "foo.lock"), []byte("refresh"), 0644), IsNil)
+
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, `refusing to preseed while an operation on snap "foo" is in progress \(refresh\)`)
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedInhibitDir(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	inhibitDir := filepath.Join(tmpDir, "/srv/snapd/inhibit")
+	c.Assert(os.MkdirAll(inhibitDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(inhibitDir, "foo.lock"), []byte("refresh"), 0644), IsNil)
+
+	// the lock is not at the default location
+	c.Check(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+
+	c.Assert(os.Remove(dirs.SnapStateFile), IsNil)
+	opts := &preseed.ClassicOptions{InhibitDir: "/srv/snapd/inhibit"}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, `refusing to preseed while an operation on snap "foo" is in progress \(refresh\)`)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedMountSnapTypes(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		return &Fake16Seed{
+			AssertsModel: mockClassicModel(),
+			Essential: []*seed.Snap{
+				{Path: "/a/core.snap", SideInfo: &snap.SideInfo{RealName: "core"}, EssentialType: snap.TypeOS},
+				{Path: "/a/pc-kernel.snap", SideInfo: &snap.SideInfo{RealName: "pc-kernel"}, EssentialType: snap.TypeKernel},
+				{Path: "/a/pc.snap", SideInfo: &snap.SideInfo{RealName: "pc"}, EssentialType: snap.TypeGadget},
+			},
+		}, nil
+	})
+	defer restore()
+
+	// only core is mounted by default
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(env.mountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(tmpDir, env.targetSnapdRoot)},
+	})
+
+	// the kernel was asked for
+	c.Assert(os.Remove(dirs.SnapStateFile), IsNil)
+	env.mountCmd.ForgetCalls()
+	opts := &preseed.ClassicOptions{MountSnapTypes: []snap.Type{snap.TypeKernel}}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(env.mountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(tmpDir, env.targetSnapdRoot)},
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/pc-kernel.snap", filepath.Join(tmpDir, env.targetSnapdRoot+"-pc-kernel")},
+	})
+}
+
+func (s *preseedSuite) TestRunPreseedWithLoadedSeed(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	// the seed is not loaded again
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		c.Fatalf("unexpected call")
+		return nil, nil
+	})
+	defer restore()
+	restore = preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) {
+		c.Fatalf("unexpected call")
+		return "", nil, nil
+	})
+	defer restore()
+
+	// loaded by the caller from the host
+	seedDir := filepath.Join(tmpDir, "var/lib/snapd/seed")
+	sd := &Fake16Seed{
+		AssertsModel: mockClassicModel(),
+		Essential: []*seed.Snap{
+			{Path: filepath.Join(seedDir, "snaps/core_1.snap"), SideInfo: &snap.SideInfo{RealName: "core"}, EssentialType: snap.TypeOS},
+			{Path: filepath.Join(seedDir, "snaps/pc-kernel_2.snap"), SideInfo: &snap.SideInfo{RealName: "pc-kernel"}, EssentialType: snap.TypeKernel},
+		},
+	}
+	opts := &preseed.ClassicOptions{MountSnapTypes: []snap.Type{snap.TypeKernel}}
+	c.Assert(preseed.ClassicWithSeed(tmpDir, sd, opts), IsNil)
+
+	// the paths are relative to the chroot
+	c.Check(env.mountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/var/lib/snapd/seed/snaps/core_1.snap", filepath.Join(tmpDir, env.targetSnapdRoot)},
+		{"mount", "-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/var/lib/snapd/seed/snaps/pc-kernel_2.snap", filepath.Join(tmpDir, env.targetSnapdRoot+"-pc-kernel_2")},
+	})
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedWithLoadedSeedRewriteSeed(c *C) {
+	opts := &preseed.ClassicOptions{RewriteSeed: func(string) error { return nil }}
+	err := preseed.ClassicWithSeed(c.MkDir(), &Fake16Seed{}, opts)
+	c.Assert(err, ErrorMatches, `cannot rewrite a seed which was already loaded`)
+}
+
+func (s *preseedSuite) TestRunPreseedSeedFormatTooOld(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	seedYaml := filepath.Join(dirs.SnapSeedDirUnder(tmpDir), "seed.yaml")
+	c.Assert(os.MkdirAll(filepath.Dir(seedYaml), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(seedYaml, []byte("snaps:\n"), 0644), IsNil)
+
+	// snapd from the core snap is 2.44.0, pretend it no longer supports
+	// seed.yaml
+	s.AddCleanup(preseed.MockSeedFormatSnapdVersions("seed.yaml", "2.43.3", "2.44"))
+
+	err := preseed.Classic(tmpDir, nil)
+	c.Assert(err, ErrorMatches, `cannot preseed seed of format "seed.yaml" with snapd 2.44.0, the format is not supported since snapd 2.44`)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+	// the core snap was unmounted again
+	c.Check(env.umountCmd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedSeedFormatTooNew(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	systems := filepath.Join(dirs.SnapSeedDirUnder(tmpDir), "systems")
+	c.Assert(os.MkdirAll(systems, 0755), IsNil)
+
+	err := preseed.Classic(tmpDir, nil)
+	c.Assert(err, ErrorMatches, `cannot preseed seed of format "systems" with snapd 2.44.0, the format is supported since snapd 2.56`)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestPrepareChrootMounts(c *C) {
+	tmpDir := c.MkDir()
+
+	mockMountCmd := testutil.MockCommand(c, "mount", "")
+	defer mockMountCmd.Restore()
+	mockUmountCmd := testutil.MockCommand(c, "umount", "")
+	defer mockUmountCmd.Restore()
+
+	cleanup, err := preseed.PrepareChrootMounts(tmpDir)
+	c.Assert(err, IsNil)
+	c.Check(mockMountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "--bind", "/proc", filepath.Join(tmpDir, "/proc")},
+		{"mount", "--bind", "/dev", filepath.Join(tmpDir, "/dev")},
+		{"mount", "--bind", "/sys/kernel/security", filepath.Join(tmpDir, "/sys/kernel/security")},
+	})
+	for _, dir := range []string{"/proc", "/dev", "/sys/kernel/security"} {
+		c.Check(osutil.IsDirectory(filepath.Join(tmpDir, dir)), Equals, true)
+	}
+	c.Check(mockUmountCmd.Calls(), HasLen, 0)
+
+	c.Assert(cleanup(), IsNil)
+	c.Check(mockUmountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", filepath.Join(tmpDir, "/sys/kernel/security")},
+		{"umount", filepath.Join(tmpDir, "/dev")},
+		{"umount", filepath.Join(tmpDir, "/proc")},
+	})
+}
+
+func (s *preseedSuite) TestPrepareChrootMountsError(c *C) {
+	tmpDir := c.MkDir()
+
+	mockMountCmd := testutil.MockCommand(c, "mount", `
+if [ "$2" = "/dev" ]; then
+	echo "mount failed"
+	exit 1
+fi`)
+	defer mockMountCmd.Restore()
+	mockUmountCmd := testutil.MockCommand(c, "umount", "")
+	defer mockUmountCmd.Restore()
+
+	_, err := preseed.PrepareChrootMounts(tmpDir)
+	c.Assert(err, ErrorMatches, fmt.Sprintf(`cannot bind mount /dev under %s: mount failed`, tmpDir))
+	// the mounts done so far are undone
+	c.Check(mockUmountCmd.Calls(), DeepEquals, [][]string{
+		{"umount", filepath.Join(tmpDir, "/proc")},
+	})
+}
+
+func (s *preseedSuite) TestRunPreseedNoAppArmorProfilesWarning(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	restore := preseed.MockSeedConfinedSnaps(func(seedDir string) ([]string, error) {
+		c.Check(seedDir, Equals, dirs.SnapSeedDir)
+		return []string{"foo", "bar"}, nil
+	})
+	defer restore()
+
+	var stderr bytes.Buffer
+	oldStderr := preseed.Stderr
+	preseed.Stderr = &stderr
+	defer func() { preseed.Stderr = oldStderr }()
+
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(stderr.String(), Equals, "WARNING: preseeding generated no apparmor profiles, but the seed has confined snaps: foo, bar\n")
+}
+
+func (s *preseedSuite) TestRunPreseedNoAppArmorProfilesRequired(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	restore := preseed.MockSeedConfinedSnaps(func(string) ([]string, error) {
+		return []string{"foo"}, nil
+	})
+	defer restore()
+
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{RequireAppArmorProfiles: true})
+	c.Assert(err, ErrorMatches, `preseeding generated no apparmor profiles, but the seed has confined snaps: foo`)
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorProfilesGenerated(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf("mkdir -p %[1]s\ntouch %[1]s/snap.foo.app\n", dirs.SnapAppArmorDir))
+
+	restore := preseed.MockSeedConfinedSnaps(func(string) ([]string, error) {
+		c.Fatalf("unexpected call")
+		return nil, nil
+	})
+	defer restore()
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{RequireAppArmorProfiles: true}), IsNil)
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorOnly(c *C) {
+	tmpDir := c.MkDir()
+	profile := filepath.Join(dirs.SnapAppArmorDir, "snap.foo.app")
+	service := filepath.Join(dirs.SnapServicesDir, "snap.foo.app.service")
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf("mkdir -p %[1]s %[2]s\ntouch %[3]s %[4]s\n",
+		dirs.SnapAppArmorDir, dirs.SnapServicesDir, profile, service))
+
+	mockParserCmd := testutil.MockCommand(c, "apparmor_parser", "")
+	defer mockParserCmd.Restore()
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{AppArmorOnly: true}), IsNil)
+
+	c.Check(mockParserCmd.Calls(), DeepEquals, [][]string{
+		{"apparmor_parser", "--skip-kernel-load", "--skip-cache", "--quiet", profile},
+	})
+	// only the apparmor artifacts are left
+	c.Check(profile, testutil.FilePresent)
+	c.Check(service, testutil.FileAbsent)
+	c.Check(dirs.SnapStateFile, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorOnlyCompileError(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf("mkdir -p %[1]s\ntouch %[1]s/snap.foo.app %[1]s/snap.bar.app\n", dirs.SnapAppArmorDir))
+
+	mockParserCmd := testutil.MockCommand(c, "apparmor_parser", `
+case "$5" in
+	*snap.bar.app)
+		echo "syntax error"
+		exit 1
+		;;
+esac
+`)
+	defer mockParserCmd.Restore()
+
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{AppArmorOnly: true})
+	c.Assert(err, ErrorMatches, `cannot compile 1 apparmor profiles:\n - snap.bar.app: syntax error`)
+	c.Check(mockParserCmd.Calls(), HasLen, 2)
+	c.Check(dirs.SnapStateFile, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorOnlyBestEffort(c *C) {
+	tmpDir := c.MkDir()
+	rulesFile := filepath.Join(dirs.SnapUdevRulesDir, "70-snap.foo.rules")
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf(`
+mkdir -p %[1]s %[3]s
+touch %[1]s/snap.bar.app
+cat > %[2]s <<'RULES'
+SUBSYSTEM=="input", KERNEL=="event[0-9]*", TAG+="snap_foo_bar" RUN+="foo"
+RULES
+`, dirs.SnapAppArmorDir, rulesFile, dirs.SnapUdevRulesDir))
+
+	mockParserCmd := testutil.MockCommand(c, "apparmor_parser", `echo "syntax error"; exit 1`)
+	defer mockParserCmd.Restore()
+
+	checkpointFile := filepath.Join(dirs.SnapdStateDir(dirs.GlobalRootDir), "preseed-checkpoint.json")
+
+	opts := &preseed.ClassicOptions{
+		AppArmorOnly:      true,
+		ValidateUdevRules: true,
+		BestEffort:        true,
+		Resume:            true,
+	}
+	err := preseed.Classic(tmpDir, opts)
+	c.Assert(err, ErrorMatches, fmt.Sprintf(`preseeding completed with 2 errors:
+ - invalid udev rules generated by preseeding: %s:1: expected a comma before .*
+ - cannot compile 1 apparmor profiles:
+ - snap.bar.app: syntax error`, rulesFile))
+	c.Check(mockParserCmd.Calls(), HasLen, 1)
+	c.Check(checkpointFile, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestRunPreseedSnapConfineProfile(c *C) {
+	tmpDir := c.MkDir()
+	profile := filepath.Join(dirs.SnapAppArmorDir, "snap-confine.core.123")
+	cached := filepath.Join(apparmor_sandbox.CacheDir, "snap-confine.core.123")
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf("mkdir -p %[1]s %[2]s\ntouch %[3]s %[4]s\n",
+		dirs.SnapAppArmorDir, apparmor_sandbox.CacheDir, profile, cached))
+
+	mockParserCmd := testutil.MockCommand(c, "apparmor_parser", "")
+	defer mockParserCmd.Restore()
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{SnapConfineProfile: true}), IsNil)
+	// already compiled by snapd
+	c.Check(mockParserCmd.Calls(), HasLen, 0)
+	c.Check(profile, testutil.FilePresent)
+	c.Check(cached, testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestRunPreseedSnapConfineProfileCompiled(c *C) {
+	tmpDir := c.MkDir()
+	profile := filepath.Join(dirs.SnapAppArmorDir, "snap-confine.snapd.456")
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf("mkdir -p %[1]s\ntouch %[2]s\n", dirs.SnapAppArmorDir, profile))
+
+	mockParserCmd := testutil.MockCommand(c, "apparmor_parser", `touch "$4/$(basename "$6")"`)
+	defer mockParserCmd.Restore()
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{SnapConfineProfile: true}), IsNil)
+	c.Check(mockParserCmd.Calls(), DeepEquals, [][]string{
+		{"apparmor_parser", "--skip-kernel-load", "--write-cache", "--cache-loc", apparmor_sandbox.CacheDir, "--quiet", profile},
+	})
+	c.Check(filepath.Join(apparmor_sandbox.CacheDir, "snap-confine.snapd.456"), testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestRunPreseedSnapConfineProfileErrors(c *C) {
+	tmpDir := c.MkDir()
+	profile := filepath.Join(dirs.SnapAppArmorDir, "snap-confine.core.123")
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf(`
+if [ -e %[1]s/generate ]; then
+	mkdir -p %[2]s
+	touch %[3]s
+fi
+`, tmpDir, dirs.SnapAppArmorDir, profile))
+
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{SnapConfineProfile: true})
+	c.Check(err, ErrorMatches, `preseeding generated no snap-confine apparmor profile`)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, "generate"), nil, 0644), IsNil)
+	mockParserCmd := testutil.MockCommand(c, "apparmor_parser", "echo 'cannot write cache'; exit 1")
+	defer mockParserCmd.Restore()
+
+	err = preseed.Classic(tmpDir, &preseed.ClassicOptions{SnapConfineProfile: true})
+	c.Check(err, ErrorMatches, `cannot compile snap-confine apparmor profile snap-confine.core.123: cannot write cache`)
+}
+
+func (s *preseedSuite) TestResetRemovesSnapConfinePolicy(c *C) {
+	tmpDir := c.MkDir()
+	snippet := filepath.Join(tmpDir, dirs.SnapConfineAppArmorDir, "nfs-support")
+	c.Assert(os.MkdirAll(filepath.Dir(snippet), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(snippet, nil, 0644), IsNil)
+
+	c.Assert(preseed.ResetPreseededChroot(tmpDir), IsNil)
+	c.Check(filepath.Join(tmpDir, dirs.SnapConfineAppArmorDir), testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorOnlyConflict(c *C) {
+	err := preseed.Classic(c.MkDir(), &preseed.ClassicOptions{AppArmorOnly: true, AssertionsOnly: true})
+	c.Assert(err, ErrorMatches, `cannot preseed only assertions and only apparmor profiles at the same time`)
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorOnlyIgnoredOptions(c *C) {
+	tmpDir := c.MkDir()
+	for _, tc := range []struct {
+		opts *preseed.ClassicOptions
+		err  string
+	}{
+		{&preseed.ClassicOptions{ExpectedStateFormat: 2}, "cannot check the state format when preseeding only apparmor profiles"},
+		{&preseed.ClassicOptions{ValidateSeed: true}, "cannot validate the seed when preseeding only apparmor profiles"},
+		{&preseed.ClassicOptions{ExportAppArmorCache: "/cache"}, "cannot export the apparmor cache when preseeding only apparmor profiles"},
+		{&preseed.ClassicOptions{Prune: true}, "cannot prune intermediate files when preseeding only apparmor profiles"},
+		{&preseed.ClassicOptions{UIDMap: []preseed.IDMapping{{ID: 0, TargetID: 100000, Count: 65536}}}, "cannot map the ownership of the artifacts when preseeding only apparmor profiles"},
+		{&preseed.ClassicOptions{GIDMap: []preseed.IDMapping{{ID: 0, TargetID: 100000, Count: 65536}}}, "cannot map the ownership of the artifacts when preseeding only apparmor profiles"},
+		{&preseed.ClassicOptions{SourceDateEpoch: time.Unix(1, 0)}, "cannot normalize the times of the artifacts when preseeding only apparmor profiles"},
+	} {
+		tc.opts.AppArmorOnly = true
+		c.Check(preseed.Classic(tmpDir, tc.opts), ErrorMatches, tc.err)
+	}
+}
+
+func (s *preseedSuite) TestSeedConfinedSnaps(c *C) {
+	withApps := snaptest.MakeTestSnapWithFiles(c, "name: foo\nversion: 1\napps:\n  app:\n    command: bin/app\n", nil)
+	withHooks := snaptest.MakeTestSnapWithFiles(c, "name: baz\nversion: 1\nhooks:\n  install:\n", nil)
+	contentOnly := snaptest.MakeTestSnapWithFiles(c, "name: data\nversion: 1\n", nil)
+	classic := snaptest.MakeTestSnapWithFiles(c, "name: tool\nversion: 1\nconfinement: classic\napps:\n  tool:\n    command: bin/tool\n", nil)
+
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		return &Fake16Seed{RunModeSnaps: []*seed.Snap{
+			{Path: withApps, SideInfo: &snap.SideInfo{RealName: "foo"}},
+			{Path: contentOnly, SideInfo: &snap.SideInfo{RealName: "data"}},
+			{Path: classic, SideInfo: &snap.SideInfo{RealName: "tool"}, Classic: true},
+			{Path: withHooks, SideInfo: &snap.SideInfo{RealName: "baz"}},
+		}}, nil
+	})
+	defer restore()
+
+	confined, err := preseed.SeedConfinedSnaps("/seed")
+	c.Assert(err, IsNil)
+	c.Check(confined, DeepEquals, []string{"foo", "baz"})
+}
+
+func (s *preseedSuite) TestRunPreseedExpectedStateFormat(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf("echo '{\"format\": 2}' > %s\n", dirs.SnapStateFile))
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{ExpectedStateFormat: 2}), IsNil)
+}
+
+func (s *preseedSuite) TestRunPreseedExpectedStateFormatMismatch(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf("echo '{\"format\": 1}' > %s\n", dirs.SnapStateFile))
+
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{ExpectedStateFormat: 2})
+	c.Assert(err, ErrorMatches, `preseeding wrote snapd state format 1, expected 2`)
+}
+
+func (s *preseedSuite) TestRunPreseedBestEffort(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, fmt.Sprintf("echo '{\"format\": 1}' > %s\n", dirs.SnapStateFile))
+
+	restore := preseed.MockValidateSeed(func(seedYamlFile string) error {
+		return fmt.Errorf("missing snap")
+	})
+	defer restore()
+
+	opts := &preseed.ClassicOptions{
+		ExpectedStateFormat: 2,
+		ValidateSeed:        true,
+	}
+	// the first failure aborts by default
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, `preseeding wrote snapd state format 1, expected 2`)
+
+	c.Assert(os.Remove(dirs.SnapStateFile), IsNil)
+	opts.BestEffort = true
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, `preseeding completed with 2 errors:
+ - preseeding wrote snapd state format 1, expected 2
+ - invalid seed after preseeding: missing snap`)
+	c.Check(env.targetSnapd.Calls(), HasLen, 2)
+	c.Check(dirs.SnapStateFile, testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestRunPreseedBestEffortFatal(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	env.mountCmd.Restore()
+	mockMountCmd := testutil.MockCommand(c, "mount", "exit 1")
+	defer mockMountCmd.Restore()
+
+	opts := &preseed.ClassicOptions{BestEffort: true}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, `cannot mount /a/core.snap at .*`)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedExpectedStateFormatMissing(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{ExpectedStateFormat: 2})
+	c.Assert(err, ErrorMatches, `preseeding wrote snapd state format 0, expected 2`)
+}
+
+func (s *preseedSuite) TestRunPreseedValidateSeed(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	var validated []string
+	restore := preseed.MockValidateSeed(func(seedYamlFile string) error {
+		// validation runs after snapd
+		c.Check(osutil.FileExists(dirs.SnapStateFile), Equals, true)
+		validated = append(validated, seedYamlFile)
+		return nil
+	})
+	defer restore()
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{ValidateSeed: true}), IsNil)
+	c.Check(validated, DeepEquals, []string{filepath.Join(dirs.SnapSeedDir, "seed.yaml")})
+}
+
+func (s *preseedSuite) TestRunPreseedValidateSeedNotRequested(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	restore := preseed.MockValidateSeed(func(string) error {
+		c.Fatalf("unexpected call")
+		return nil
+	})
+	defer restore()
+
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+}
+
+func (s *preseedSuite) TestRunPreseedValidateSeedFails(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	restore := preseed.MockValidateSeed(func(string) error {
+		return fmt.Errorf("cannot use snap \"foo\": boom")
+	})
+	defer restore()
+
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{ValidateSeed: true})
+	c.Assert(err, ErrorMatches, `invalid seed after preseeding: cannot use snap "foo": boom`)
+}
+
+func (s *preseedSuite) TestRunPreseedMountUnmountSamePaths(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	restore := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) {
+		return "/a/snapd.snap", []string{"/a/core18.snap", "/a/core20.snap"}, nil
+	})
+	defer restore()
+
+	backend := &preseed.FakeBackend{}
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{Backend: backend}), IsNil)
+
+	// the global root directory is set and the chroot is not real, the
+	// snaps are mounted and unmounted under the root directory all the same
+	expected := []string{
+		filepath.Join(tmpDir, env.targetSnapdRoot),
+		filepath.Join(tmpDir, env.targetSnapdRoot+"-core18"),
+		filepath.Join(tmpDir, env.targetSnapdRoot+"-core20"),
+	}
+	var mounted []string
+	for _, args := range backend.Mounts {
+		mounted = append(mounted, args[len(args)-1])
+	}
+	c.Check(mounted, DeepEquals, expected)
+	c.Check(backend.Unmounts, DeepEquals, []string{expected[2], expected[1], expected[0]})
+	// and the mountpoints are gone
+	for _, where := range expected {
+		c.Check(where, testutil.FileAbsent)
+	}
+}
+
+func (s *preseedSuite) TestRunPreseedSnapdOutput(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, `
+echo "snapd out 1"
+echo "snapd err" >&2
+echo "snapd out 2"
+`)
+
+	var stdout, stderr, snapdStdout, snapdStderr bytes.Buffer
+	oldStdout, oldStderr := preseed.Stdout, preseed.Stderr
+	preseed.Stdout, preseed.Stderr = &stdout, &stderr
+	defer func() { preseed.Stdout, preseed.Stderr = oldStdout, oldStderr }()
+
+	opts := &preseed.ClassicOptions{
+		SnapdStdout: &snapdStdout,
+		SnapdStderr: &snapdStderr,
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(snapdStdout.String(), Equals, "snapd out 1\nsnapd out 2\n")
+	c.Check(snapdStderr.String(), Equals, "snapd err\n")
+	// the output of snapd did not go to the default writers
+	c.Check(stdout.String(), Not(testutil.Contains), "snapd out")
+	c.Check(stderr.String(), Not(testutil.Contains), "snapd err")
+}
+
+func (s *preseedSuite) TestRunPreseedStrace(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	// strace runs the traced command
+	mockStrace := testutil.MockCommand(c, "strace", `shift 3; exec "$@"`)
+	defer mockStrace.Restore()
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{StraceOutput: "/tmp/snapd.trace"}), IsNil)
+
+	snapdPath := filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/snapd")
+	c.Check(mockStrace.Calls(), DeepEquals, [][]string{
+		{"strace", "-f", "-o", "/tmp/snapd.trace", snapdPath},
+	})
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedNoStraceByDefault(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	mockStrace := testutil.MockCommand(c, "strace", "")
+	defer mockStrace.Restore()
+
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(mockStrace.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedResourceLimits(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, `
+if [ "$SNAPD_PRESEED" != "1" ]; then
+	exit 1
+fi
+`)
+
+	// the command follows --
+	mockSystemdRun := testutil.MockCommand(c, "systemd-run", `while [ "$1" != "--" ]; do shift; done; shift; exec "$@"`)
+	defer mockSystemdRun.Restore()
+
+	snapdPath := filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/snapd")
+	for _, t := range []struct {
+		cpuQuota, memoryMax string
+		args                []string
+	}{
+		{"50%", "2G", []string{"systemd-run", "--scope", "--quiet", "--collect", "-p", "CPUQuota=50%", "-p", "MemoryMax=2G", "--", snapdPath}},
+		{"", "512M", []string{"systemd-run", "--scope", "--quiet", "--collect", "-p", "MemoryMax=512M", "--", snapdPath}},
+		{"200%", "", []string{"systemd-run", "--scope", "--quiet", "--collect", "-p", "CPUQuota=200%", "--", snapdPath}},
+	} {
+		mockSystemdRun.ForgetCalls()
+		env.targetSnapd.ForgetCalls()
+		os.Remove(dirs.SnapStateFile)
+
+		opts := &preseed.ClassicOptions{CPUQuota: t.cpuQuota, MemoryMax: t.memoryMax}
+		c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+		c.Check(mockSystemdRun.Calls(), DeepEquals, [][]string{t.args})
+		c.Check(env.targetSnapd.Calls(), HasLen, 1)
+	}
+
+	// not used without limits
+	mockSystemdRun.ForgetCalls()
+	os.Remove(dirs.SnapStateFile)
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(mockSystemdRun.Calls(), HasLen, 0)
+}
+
+func mockReadOnlySecurityfsMountInfo(tmpDir string) (restore func()) {
+	return osutil.MockMountInfo(fmt.Sprintf(`912 920 0:57 / %[1]s/proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+914 913 0:7 / %[1]s/sys/kernel/security ro,nosuid,nodev,noexec,relatime master:8 - securityfs securityfs rw
+915 920 0:58 / %[1]s/dev rw,relatime - tmpfs none rw,size=492k,mode=755,uid=100000,gid=100000
+`, tmpDir))
+}
+
+func (s *preseedSuite) TestRunPreseedReadOnlySecurityfs(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	defer mockReadOnlySecurityfsMountInfo(tmpDir)()
+
+	err := preseed.Classic(tmpDir, nil)
+	c.Assert(err, ErrorMatches, fmt.Sprintf(`cannot preseed with securityfs mounted read-only at %s/sys/kernel/security, snapd would fail to load apparmor profiles`, tmpDir))
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedReadOnlySecurityfsRemount(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	defer mockReadOnlySecurityfsMountInfo(tmpDir)()
+
+	backend := &preseed.FakeBackend{}
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{Backend: backend, RemountSecurityfs: true}), IsNil)
+
+	securityfs := filepath.Join(tmpDir, "/sys/kernel/security")
+	c.Check(backend.Mounts, DeepEquals, [][]string{
+		{"-o", "remount,rw", securityfs},
+		{"-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(tmpDir, env.targetSnapdRoot)},
+		// made read-only again when done
+		{"-o", "remount,ro", securityfs},
+	})
+}
+
+// failingChrootBackend is a FakeBackend which cannot enter the chroot.
+type failingChrootBackend struct {
+	preseed.FakeBackend
+}
+
+func (b *failingChrootBackend) Chroot(dir string) error {
+	return fmt.Errorf("cannot chroot for testing")
+}
+
+// checkChrootMountpoints checks that all the mount and unmount operations
+// recorded by backend were on paths under preseedChroot.
+func checkChrootMountpoints(c *C, backend *preseed.FakeBackend, preseedChroot string) {
+	for _, args := range backend.Mounts {
+		c.Check(strings.HasPrefix(args[len(args)-1], preseedChroot+"/"), Equals, true, Commentf("mount %v", args))
+	}
+	for _, mnt := range backend.Unmounts {
+		c.Check(strings.HasPrefix(mnt, preseedChroot+"/"), Equals, true, Commentf("unmount %s", mnt))
+	}
+}
+
+func (s *preseedSuite) TestRunPreseedChrootFailedRestoresUnderChroot(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	defer mockReadOnlySecurityfsMountInfo(tmpDir)()
+	// as in real runs, the paths refer to the host until the chroot is
+	// entered
+	dirs.SetRootDir("/")
+
+	upperDir := filepath.Join(c.MkDir(), "state-layer")
+	seedDir := c.MkDir()
+	featuresDir := c.MkDir()
+	backend := &failingChrootBackend{}
+	opts := &preseed.ClassicOptions{
+		Backend:             backend,
+		RemountSecurityfs:   true,
+		StateUpperDir:       upperDir,
+		SeedDir:             seedDir,
+		AppArmorFeaturesDir: featuresDir,
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), ErrorMatches, `cannot chroot into .*: cannot chroot for testing`)
+
+	securityfs := filepath.Join(tmpDir, "/sys/kernel/security")
+	stateDir := filepath.Join(tmpDir, "/var/lib/snapd")
+	chrootSeedDir := filepath.Join(tmpDir, "/var/lib/snapd/seed")
+	features := filepath.Join(tmpDir, "/sys/kernel/security/apparmor/features")
+	c.Check(backend.Mounts, DeepEquals, [][]string{
+		{"-t", "overlay", "-o", fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s.work", stateDir, upperDir, upperDir), "overlay", stateDir},
+		{"--bind", seedDir, chrootSeedDir},
+		{"-o", "remount,rw", securityfs},
+		{"--bind", featuresDir, features},
+		{"-o", "remount,bind,ro", features},
+		// the securityfs of the chroot is made read-only again, not
+		// the one of the host
+		{"-o", "remount,ro", securityfs},
+	})
+	// the features, the seed and the overlay are unmounted from the chroot
+	c.Check(backend.Unmounts, DeepEquals, []string{features, chrootSeedDir, stateDir})
+	checkChrootMountpoints(c, &backend.FakeBackend, tmpDir)
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorFeaturesDir(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	featuresDir := c.MkDir()
+
+	features := filepath.Join(tmpDir, "/sys/kernel/security/apparmor/features")
+	backend := &preseed.FakeBackend{}
+	var mountsWhenRun [][]string
+	var unmountsWhenRun []string
+	backend.RunSnapdFunc = func(cmd *exec.Cmd) error {
+		mountsWhenRun = append([][]string(nil), backend.Mounts...)
+		unmountsWhenRun = append([]string(nil), backend.Unmounts...)
+		c.Assert(os.MkdirAll(filepath.Dir(dirs.SnapStateFile), 0755), IsNil)
+		return ioutil.WriteFile(dirs.SnapStateFile, []byte("{}"), 0644)
+	}
+	opts := &preseed.ClassicOptions{Backend: backend, AppArmorFeaturesDir: featuresDir}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+
+	// snapd runs with the features mounted
+	c.Check(mountsWhenRun, DeepEquals, [][]string{
+		{"--bind", featuresDir, features},
+		{"-o", "remount,bind,ro", features},
+		{"-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(tmpDir, env.targetSnapdRoot)},
+	})
+	c.Check(unmountsWhenRun, HasLen, 0)
+	// and they are unmounted, from inside the chroot, when done
+	c.Check(backend.Unmounts, testutil.Contains, features)
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorFeaturesDirMissing(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	backend := &preseed.FakeBackend{}
+	opts := &preseed.ClassicOptions{Backend: backend, AppArmorFeaturesDir: "/non-existing"}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, "cannot use apparmor features from /non-existing: not a directory")
+	c.Check(backend.Mounts, HasLen, 0)
+	c.Check(backend.Snapd, HasLen, 0)
+}
+
+func mockSharedMountInfo(rootDir string) (restore func()) {
+	return osutil.MockMountInfo(fmt.Sprintf(`912 920 0:57 / %[1]s/proc rw,nosuid,nodev,noexec,relatime shared:5 - proc proc rw
+914 913 0:7 / %[1]s/sys/kernel/security rw,nosuid,nodev,noexec,relatime master:8 - securityfs securityfs rw
+915 920 0:58 / %[1]s/dev rw,relatime shared:9 master:2 - tmpfs none rw,size=492k,mode=755,uid=100000,gid=100000
+916 1 0:23 / /home rw,relatime shared:1 - ext4 /dev/sda3 rw
+`, rootDir))
+}
+
+func (s *preseedSuite) TestRunPreseedWarnsAboutSharedMounts(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	defer mockSharedMountInfo(tmpDir)()
+
+	var stderr bytes.Buffer
+	oldStderr := preseed.Stderr
+	preseed.Stderr = &stderr
+	defer func() { preseed.Stderr = oldStderr }()
+
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+	c.Check(stderr.String(), testutil.Contains, fmt.Sprintf(`WARNING: the following mounts use shared propagation, the snap mounts of preseeding may leak to the host:
+ - %[1]s/dev
+ - %[1]s/proc
+`, tmpDir))
+}
+
+func (s *preseedSuite) TestRunPreseedMakeMountsPrivate(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	defer mockSharedMountInfo(tmpDir)()
+
+	var stderr bytes.Buffer
+	oldStderr := preseed.Stderr
+	preseed.Stderr = &stderr
+	defer func() { preseed.Stderr = oldStderr }()
+
+	backend := &preseed.FakeBackend{}
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{Backend: backend, MakeMountsPrivate: true}), IsNil)
+	c.Check(stderr.String(), Not(testutil.Contains), "shared propagation")
+	c.Check(backend.Mounts, DeepEquals, [][]string{
+		{"--make-private", filepath.Join(tmpDir, "/dev")},
+		{"--make-private", filepath.Join(tmpDir, "/proc")},
+		{"-t", "squashfs", "-o", "ro,x-gdu.hide,x-gvfs-hide", "/a/core.snap", filepath.Join(tmpDir, env.targetSnapdRoot)},
+	})
+}
+
+func (s *preseedSuite) TestClassicFromTar(c *C) {
+	workDir := c.MkDir()
+	rootfs := filepath.Join(workDir, "rootfs")
+	tarPath := filepath.Join(workDir, "rootfs.tar")
+	repackPath := filepath.Join(workDir, "preseeded.tar")
+
+	s.AddCleanup(preseed.MockSyscallChroot(func(path string) error { return nil }))
+	mockMountCmd := testutil.MockCommand(c, "mount", "")
+	defer mockMountCmd.Restore()
+	mockUmountCmd := testutil.MockCommand(c, "umount", "")
+	defer mockUmountCmd.Restore()
+	mockTar := testutil.MockCommand(c, "tar", `
+case "$1" in
+	-xpf) touch "$5/extracted" ;;
+	-cpf) touch "$2" ;;
+esac
+`)
+	defer mockTar.Restore()
+
+	for _, keep := range []bool{false, true} {
+		mockTar.ForgetCalls()
+		mockUmountCmd.ForgetCalls()
+		os.RemoveAll(rootfs)
+
+		classicOpts := &preseed.ClassicOptions{ValidateUdevRules: true}
+		restore := preseed.MockClassic(func(chrootDir string, opts *preseed.ClassicOptions) error {
+			c.Check(chrootDir, Equals, rootfs)
+			c.Check(opts, Equals, classicOpts)
+			c.Check(filepath.Join(rootfs, "extracted"), testutil.FilePresent)
+			// the virtual filesystems are mounted while preseeding
+			c.Check(mockMountCmd.Calls(), HasLen, 3)
+			c.Check(mockUmountCmd.Calls(), HasLen, 0)
+			mockMountCmd.ForgetCalls()
+			return nil
+		})
+		defer restore()
+
+		opts := &preseed.ClassicFromTarOptions{
+			ClassicOptions: classicOpts,
+			RepackPath:     repackPath,
+			KeepRootfs:     keep,
+		}
+		c.Assert(preseed.ClassicFromTar(tarPath, workDir, opts), IsNil)
+
+		c.Check(mockTar.Calls(), DeepEquals, [][]string{
+			{"tar", "-xpf", tarPath, "--numeric-owner", "-C", rootfs},
+			{"tar", "-cpf", repackPath, "--numeric-owner", "-C", rootfs, "."},
+		})
+		c.Check(mockUmountCmd.Calls(), HasLen, 3)
+		c.Check(repackPath, testutil.FilePresent)
+		c.Check(osutil.IsDirectory(rootfs), Equals, keep)
+	}
+}
+
+func (s *preseedSuite) TestClassicFromTarPreseedFails(c *C) {
+	workDir := c.MkDir()
+	rootfs := filepath.Join(workDir, "rootfs")
+	tarPath := filepath.Join(workDir, "rootfs.tar")
+
+	s.AddCleanup(preseed.MockSyscallChroot(func(path string) error { return nil }))
+	mockMountCmd := testutil.MockCommand(c, "mount", "")
+	defer mockMountCmd.Restore()
+	mockUmountCmd := testutil.MockCommand(c, "umount", "")
+	defer mockUmountCmd.Restore()
+	mockTar := testutil.MockCommand(c, "tar", "")
+	defer mockTar.Restore()
+
+	restore := preseed.MockClassic(func(chrootDir string, opts *preseed.ClassicOptions) error {
+		return fmt.Errorf("boom")
+	})
+	defer restore()
+
+	opts := &preseed.ClassicFromTarOptions{RepackPath: filepath.Join(workDir, "preseeded.tar")}
+	c.Assert(preseed.ClassicFromTar(tarPath, workDir, opts), ErrorMatches, "boom")
+	// nothing was packed, the mounts were undone and the rootfs removed
+	c.Check(mockTar.Calls(), HasLen, 1)
+	c.Check(mockUmountCmd.Calls(), HasLen, 3)
+	c.Check(rootfs, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestClassicFromTarExtractFails(c *C) {
+	workDir := c.MkDir()
+	tarPath := filepath.Join(workDir, "rootfs.tar")
+
+	mockTar := testutil.MockCommand(c, "tar", `echo "tar: broken"; exit 1`)
+	defer mockTar.Restore()
+
+	err := preseed.ClassicFromTar(tarPath, workDir, nil)
+	c.Assert(err, ErrorMatches, fmt.Sprintf(`cannot extract %s: tar: broken`, tarPath))
+	c.Check(filepath.Join(workDir, "rootfs"), testutil.FileAbsent)
+
+	// the rootfs directory must not exist
+	c.Assert(os.Mkdir(filepath.Join(workDir, "rootfs"), 0755), IsNil)
+	err = preseed.ClassicFromTar(tarPath, workDir, nil)
+	c.Assert(err, ErrorMatches, `cannot create directory for the rootfs: .* file exists`)
+}
+
+func writeTrustedAssertions(c *C, trusted []asserts.Assertion) string {
+	var buf bytes.Buffer
+	enc := asserts.NewEncoder(&buf)
+	for _, a := range trusted {
+		c.Assert(enc.Encode(a), IsNil)
+	}
+	fn := filepath.Join(c.MkDir(), "trusted.assert")
+	c.Assert(ioutil.WriteFile(fn, buf.Bytes(), 0644), IsNil)
+	return fn
+}
+
+func (s *preseedSuite) TestRunPreseedTrustedAssertions(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	brandStack := assertstest.NewStoreStack("brand", nil)
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		c.Check(seedDir, Equals, filepath.Join(tmpDir, "var/lib/snapd/seed"))
+		return &Fake16Seed{
+			AssertsModel: mockClassicModel(),
+			// signed by the root key of the brand
+			Assertions: []asserts.Assertion{brandStack.StoreAccountKey("")},
+		}, nil
+	})
+	defer restore()
+
+	opts := &preseed.ClassicOptions{
+		TrustedAssertions: []string{writeTrustedAssertions(c, brandStack.Trusted)},
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedTrustedAssertionsUntrustedSeed(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	brandStack := assertstest.NewStoreStack("brand", nil)
+	// trusted by default, but not by the brand
+	storeStack := assertstest.NewStoreStack("canonical", nil)
+	s.AddCleanup(sysdb.InjectTrusted(storeStack.Trusted))
+
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		return &Fake16Seed{
+			AssertsModel: mockClassicModel(),
+			Assertions:   []asserts.Assertion{storeStack.StoreAccountKey("")},
+		}, nil
+	})
+	defer restore()
+
+	opts := &preseed.ClassicOptions{
+		TrustedAssertions: []string{writeTrustedAssertions(c, brandStack.Trusted)},
+	}
+	err := preseed.Classic(tmpDir, opts)
+	c.Assert(err, ErrorMatches, fmt.Sprintf(`cannot preseed: seed at %s/var/lib/snapd/seed is not signed by the trusted keys: .*`, tmpDir))
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedTrustedAssertionsInvalid(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	brandStack := assertstest.NewStoreStack("brand", nil)
+	opts := &preseed.ClassicOptions{
+		TrustedAssertions: []string{writeTrustedAssertions(c, []asserts.Assertion{brandStack.GenericClassicModel})},
+	}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, `cannot trust model assertion from .*/trusted.assert, only account and account-key assertions can be trusted`)
+
+	opts.TrustedAssertions = []string{filepath.Join(tmpDir, "missing")}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, `cannot read trusted assertions: open .*/missing: no such file or directory`)
+
+	opts.TrustedAssertions = []string{writeTrustedAssertions(c, nil)}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, `cannot read trusted assertions: no assertions found`)
+}
+
+func (s *preseedSuite) TestRunPreseedAssertionsOnly(c *C) {
+	tmpDir := c.MkDir()
+
+	storeStack := assertstest.NewStoreStack("canonical", nil)
+	s.AddCleanup(sysdb.InjectTrusted(storeStack.Trusted))
+	storeAccountKey := storeStack.StoreAccountKey("")
+
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		c.Check(seedDir, Equals, filepath.Join(tmpDir, "var/lib/snapd/seed"))
+		return &Fake16Seed{
+			AssertsModel: mockClassicModel(),
+			Assertions:   []asserts.Assertion{storeAccountKey},
+		}, nil
+	})
+	defer restore()
+
+	mockMountCmd := testutil.MockCommand(c, "mount", "")
+	defer mockMountCmd.Restore()
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) {
+		c.Fatalf("unexpected call")
+		return "", nil, nil
+	})
+	defer restoreSystemSnapFromSeed()
+
+	// the chroot does not need the mounts required by snapd
+	defer osutil.MockMountInfo("")()
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{AssertionsOnly: true}), IsNil)
+	c.Check(mockMountCmd.Calls(), HasLen, 0)
+	c.Check(filepath.Join(tmpDir, "var/lib/snapd/state.json"), testutil.FileAbsent)
+
+	db, err := sysdb.OpenAt(filepath.Join(tmpDir, "var/lib/snapd/assertions"))
+	c.Assert(err, IsNil)
+	_, err = db.Find(asserts.AccountKeyType, map[string]string{
+		"public-key-sha3-384": storeAccountKey.PublicKeyID(),
+	})
+	c.Check(err, IsNil)
+}
+
+func (s *preseedSuite) TestRunPreseedAssertionsOnlyError(c *C) {
+	tmpDir := c.MkDir()
+
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		return &Fake16Seed{LoadAssertionsErr: fmt.Errorf("boom")}, nil
+	})
+	defer restore()
+
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{AssertionsOnly: true})
+	c.Assert(err, ErrorMatches, "cannot import seed assertions: boom")
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorFeaturesDiffer(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	featuresFile := filepath.Join(tmpDir, "/usr/share/apparmor-features/features")
+	c.Assert(os.MkdirAll(filepath.Dir(featuresFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(featuresFile, []byte("caps {mask {chown\n}\n}\ndomain {version {1.2\n}\n}\nnetwork {af_unix {yes\n}\n}\n"), 0644), IsNil)
+	defer apparmor_sandbox.MockFeatures([]string{"caps", "network", "policy"}, nil, nil, nil)()
+
+	var stderr bytes.Buffer
+	oldStderr := preseed.Stderr
+	preseed.Stderr = &stderr
+	defer func() { preseed.Stderr = oldStderr }()
+
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+	c.Check(stderr.String(), Equals, fmt.Sprintf(`WARNING: apparmor features of the host kernel differ from those recorded in %s, profiles compiled during preseeding may be invalid on the target kernel
+  only on the host: policy
+  only on the target: domain
+`, featuresFile))
+}
+
+func (s *preseedSuite) TestRunPreseedAppArmorFeaturesMatch(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	featuresFile := filepath.Join(tmpDir, "/usr/share/apparmor-features/features")
+	c.Assert(os.MkdirAll(filepath.Dir(featuresFile), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(featuresFile, []byte("caps {mask {chown\n}\n}\nnetwork {af_unix {yes\n}\n}\n"), 0644), IsNil)
+	defer apparmor_sandbox.MockFeatures([]string{"caps", "network"}, nil, nil, nil)()
+
+	var stderr bytes.Buffer
+	oldStderr := preseed.Stderr
+	preseed.Stderr = &stderr
+	defer func() { preseed.Stderr = oldStderr }()
+
+	c.Assert(preseed.Classic(tmpDir, nil), IsNil)
+	c.Check(stderr.String(), Equals, "")
+}
+
+func (s *preseedSuite) TestRunPreseedSnapshot(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	snapshotDir := filepath.Join(c.MkDir(), "snapshot")
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{SnapshotDir: snapshotDir}), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+	c.Check(filepath.Join(snapshotDir, "snapshot.json"), testutil.FilePresent)
+
+	// a snapshot is not overwritten
+	c.Assert(os.Remove(dirs.SnapStateFile), IsNil)
+	err := preseed.Classic(tmpDir, &preseed.ClassicOptions{SnapshotDir: snapshotDir})
+	c.Assert(err, ErrorMatches, `cannot snapshot into .*: directory is not empty`)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedOffline(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, `
+if [ "$https_proxy" != "http://127.0.0.1:9" ] || [ "$HTTPS_PROXY" != "http://127.0.0.1:9" ] || [ "$http_proxy" != "http://127.0.0.1:9" ] || [ -n "$no_proxy" ]; then
+	exit 1
+fi
+`)
+
+	opts := &preseed.ClassicOptions{
+		Offline: true,
+		// cannot be overridden
+		Env: map[string]string{"HTTPS_PROXY": "http://proxy:3128", "no_proxy": "*"},
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedStoreAndProxy(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, `
+if [ "$SNAPPY_FORCE_API_URL" != "http://store.local/" ] || [ "$https_proxy" != "http://proxy:3128" ] || [ "$HTTP_PROXY" != "http://proxy:3128" ]; then
+	exit 1
+fi
+`)
+
+	opts := &preseed.ClassicOptions{
+		StoreURL: "http://store.local/",
+		Proxy:    "http://proxy:3128",
+	}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+	c.Check(env.targetSnapd.Calls(), HasLen, 1)
+}
+
+func (s *preseedSuite) TestRunPreseedOfflineConflicts(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	for _, opts := range []*preseed.ClassicOptions{
+		{Offline: true, StoreURL: "http://store.local/"},
+		{Offline: true, Proxy: "http://proxy:3128"},
+	} {
+		c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, "cannot use a store or a proxy when preseeding offline")
+	}
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedDryRun(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	coreSnap := mockCoreSnapDir(c, "2.44.0")
+	s.AddCleanup(preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return coreSnap, nil, nil }))
+
+	var stdout bytes.Buffer
+	oldStdout := preseed.Stdout
+	preseed.Stdout = &stdout
+	defer func() { preseed.Stdout = oldStdout }()
+
+	backend := &preseed.FakeBackend{}
+	c.Check(preseed.Classic(tmpDir, &preseed.ClassicOptions{Backend: backend, DryRun: true}), IsNil)
+	c.Check(stdout.String(), Equals, fmt.Sprintf(`dry-run of preseeding %s:
+  PASS chroot
+  PASS mount propagation
+  PASS securityfs
+  PASS active snapd
+  PASS inhibit locks
+  PASS mount path
+  PASS temporary directory
+  PASS seed trust
+  PASS snapd version
+  PASS os-release
+  PASS apparmor
+`, tmpDir))
+
+	// nothing was mounted or run
+	c.Check(backend.Chroots, HasLen, 0)
+	c.Check(backend.Mounts, HasLen, 0)
+	c.Check(backend.Snapd, HasLen, 0)
+	c.Check(env.mountCmd.Calls(), HasLen, 0)
+	c.Check(env.targetSnapd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedDryRunFailures(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	// both snapd from the snap and from the deb are too old
+	coreSnap := mockCoreSnapDir(c, "2.40")
+	s.AddCleanup(preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return coreSnap, nil, nil }))
+
+	var stdout bytes.Buffer
+	oldStdout := preseed.Stdout
+	preseed.Stdout = &stdout
+	defer func() { preseed.Stdout = oldStdout }()
+
+	backend := &preseed.FakeBackend{}
+	opts := &preseed.ClassicOptions{
+		Backend: backend,
+		DryRun:  true,
+		TempDir: "tmp",
+	}
+	err := preseed.Classic(tmpDir, opts)
+	c.Check(err, ErrorMatches, fmt.Sprintf("dry-run of preseeding %s failed 2 of 11 checks", tmpDir))
+	// all the checks are run
+	c.Check(stdout.String(), testutil.Contains, "  FAIL temporary directory: cannot use \"tmp\" as temporary directory: must be an absolute path inside the chroot\n  PASS seed trust\n")
+	c.Check(stdout.String(), testutil.Contains, "  FAIL snapd version: snapd 2.41.0 from the deb does not support preseeding, the minimum required version is 2.43.3+\n  PASS os-release\n  PASS apparmor\n")
+	c.Check(backend.Mounts, HasLen, 0)
+	c.Check(backend.Snapd, HasLen, 0)
+}
@@ -20,8 +20,10 @@
 package preseed
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -30,10 +32,18 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/sysdb"
+	"github.com/snapcore/snapd/cmd/snaplock/runinhibit"
 	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/logger"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/osutil/squashfs"
+	apparmor_sandbox "github.com/snapcore/snapd/sandbox/apparmor"
 	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/channel"
+	"github.com/snapcore/snapd/snap/snapfile"
 	"github.com/snapcore/snapd/snapdtool"
 	"github.com/snapcore/snapd/strutil"
 	"github.com/snapcore/snapd/timings"
@@ -41,26 +51,57 @@ import (
 
 var (
 	// snapdMountPath is where target core/snapd is going to be mounted in the target chroot
-	snapdMountPath = "/tmp/snapd-preseed"
+	snapdMountPath = DefaultMountPath
 	syscallChroot  = syscall.Chroot
 )
 
+// realBackend is the Backend used by default, it performs all the
+// operations for real.
+type realBackend struct{}
+
+func (realBackend) Chroot(dir string) error {
+	return syscallChroot(dir)
+}
+
+func (realBackend) Mount(args []string) ([]byte, error) {
+	return exec.Command("mount", args...).CombinedOutput()
+}
+
+func (realBackend) Unmount(mountpoint string) ([]byte, error) {
+	return exec.Command("umount", mountpoint).CombinedOutput()
+}
+
+func (realBackend) RunSnapd(cmd *exec.Cmd) error {
+	return cmd.Run()
+}
+
+// ChrootMount describes a mountpoint required for preseeding that was found
+// in the target chroot.
+type ChrootMount struct {
+	MountDir string
+	// Source is the backing device or filesystem name
+	Source string
+	FsType string
+}
+
 // checkChroot does a basic validity check of the target chroot environment, e.g. makes
 // sure critical virtual filesystems (such as proc) are mounted. This is not meant to
 // be exhaustive check, but one that prevents running the tool against a wrong directory
 // by an accident, which would lead to hard to understand errors from snapd in preseed
-// mode.
-func checkChroot(preseedChroot string) error {
+// mode. On success, the detected required mountpoints are returned. When
+// resuming, the snapd state left by an interrupted run is not mistaken for
+// a preseeded system.
+func checkChroot(preseedChroot string, resume bool) ([]ChrootMount, error) {
 	exists, isDir, err := osutil.DirExists(preseedChroot)
 	if err != nil {
-		return fmt.Errorf("cannot verify %q: %v", preseedChroot, err)
+		return nil, fmt.Errorf("cannot verify %q: %v", preseedChroot, err)
 	}
 	if !exists || !isDir {
-		return fmt.Errorf("cannot verify %q: is not a directory", preseedChroot)
+		return nil, fmt.Errorf("cannot verify %q: is not a directory", preseedChroot)
 	}
 
-	if osutil.FileExists(filepath.Join(preseedChroot, dirs.SnapStateFile)) {
-		return fmt.Errorf("the system at %q appears to be preseeded, pass --reset flag to clean it up", preseedChroot)
+	if IsPreseeded(preseedChroot) && !(resume && hasCheckpoint(preseedChroot)) {
+		return nil, fmt.Errorf("the system at %q appears to be preseeded, pass --reset flag to clean it up", preseedChroot)
 	}
 
 	// validity checks of the critical mountpoints inside chroot directory.
@@ -71,11 +112,17 @@ func checkChroot(preseedChroot string) error {
 	}
 	entries, err := osutil.LoadMountInfo()
 	if err != nil {
-		return fmt.Errorf("cannot parse mount info: %v", err)
+		return nil, fmt.Errorf("cannot parse mount info: %v", err)
 	}
+	var satisfied []ChrootMount
 	for _, ent := range entries {
 		if _, ok := required[ent.MountDir]; ok {
 			delete(required, ent.MountDir)
+			satisfied = append(satisfied, ChrootMount{
+				MountDir: ent.MountDir,
+				Source:   ent.MountSource,
+				FsType:   ent.FsType,
+			})
 		}
 	}
 	// non empty required indicates missing mountpoint(s)
@@ -86,45 +133,107 @@ func checkChroot(preseedChroot string) error {
 		}
 		sort.Strings(sorted)
 		parts := append([]string{""}, sorted...)
-		return fmt.Errorf("cannot preseed without the following mountpoints:%s", strings.Join(parts, "\n - "))
+		return nil, fmt.Errorf("cannot preseed without the following mountpoints:%s", strings.Join(parts, "\n - "))
 	}
 
 	path := filepath.Join(preseedChroot, "/sys/kernel/security/apparmor")
 	if exists := osutil.FileExists(path); !exists {
-		return fmt.Errorf("cannot preseed without access to %q", path)
+		return nil, fmt.Errorf("cannot preseed without access to %q", path)
 	}
 
-	return nil
+	sort.Slice(satisfied, func(i, j int) bool {
+		return satisfied[i].MountDir < satisfied[j].MountDir
+	})
+	return satisfied, nil
 }
 
 var seedOpen = seed.Open
 
-var systemSnapFromSeed = func(seedDir, sysLabel string) (systemSnap string, baseSnap string, err error) {
-	seed, err := seedOpen(seedDir, sysLabel)
+// loadSeed opens the seed at seedDir and loads its assertions and metadata.
+func loadSeed(seedDir, sysLabel string) (seed.Seed, error) {
+	sd, err := seedOpen(seedDir, sysLabel)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
 	// load assertions into temporary database
-	if err := seed.LoadAssertions(nil, nil); err != nil {
-		return "", "", err
+	if err := sd.LoadAssertions(nil, nil); err != nil {
+		return nil, err
 	}
-	model := seed.Model()
 
 	tm := timings.New(nil)
-	if err := seed.LoadMeta(tm); err != nil {
-		return "", "", err
+	if err := sd.LoadMeta(tm); err != nil {
+		return nil, err
 	}
+	return sd, nil
+}
 
-	if model.Classic() {
-		fmt.Fprintf(Stdout, "ubuntu classic preseeding")
-	} else {
-		if model.Base() == "core20" {
-			fmt.Fprintf(Stdout, "UC20 preseeding")
-		} else {
-			// TODO: support uc20+
-			return "", "", fmt.Errorf("preseeding of ubuntu core with base %s is not supported", model.Base())
+// validateGadget checks that the gadget snap in the seed matches the gadget
+// name and track required by the model.
+func validateGadget(seedDir, sysLabel string) error {
+	sd, err := loadSeed(seedDir, sysLabel)
+	if err != nil {
+		return err
+	}
+	model := sd.Model()
+	gadgetSnap := model.GadgetSnap()
+	if gadgetSnap == nil {
+		return nil
+	}
+
+	var gadget *seed.Snap
+	for _, ess := range sd.EssentialSnaps() {
+		if ess.EssentialType == snap.TypeGadget {
+			gadget = ess
+			break
+		}
+	}
+	if gadget == nil {
+		return fmt.Errorf("gadget mismatch: model requires gadget %q but the seed has none", gadgetSnap.Name)
+	}
+	if gadget.SnapName() != gadgetSnap.Name {
+		return fmt.Errorf("gadget mismatch: model requires gadget %q but the seed has %q", gadgetSnap.Name, gadget.SnapName())
+	}
+
+	expectedTrack := gadgetSnap.PinnedTrack
+	if expectedTrack == "" && gadgetSnap.DefaultChannel != "" {
+		defaultChannel, err := channel.ParseVerbatim(gadgetSnap.DefaultChannel, "-")
+		if err != nil {
+			return err
 		}
+		expectedTrack = defaultChannel.Track
+	}
+	if expectedTrack == "" || gadget.Channel == "" {
+		return nil
+	}
+	seedChannel, err := channel.ParseVerbatim(gadget.Channel, "-")
+	if err != nil {
+		return err
+	}
+	if seedChannel.Track != "" && seedChannel.Track != expectedTrack {
+		return fmt.Errorf("gadget mismatch: model requires track %q of gadget %q but the seed has %q", expectedTrack, gadgetSnap.Name, seedChannel.Track)
+	}
+	return nil
+}
+
+// systemSnapFromSeed returns the path of the system (core or snapd) snap from
+// the seed, along with the paths of all the essential base snaps.
+var systemSnapFromSeed = func(seedDir, sysLabel string) (systemSnap string, baseSnaps []string, err error) {
+	seed, err := loadSeed(seedDir, sysLabel)
+	if err != nil {
+		return "", nil, err
+	}
+	return systemSnapOfSeed(seed)
+}
+
+// systemSnapOfSeed is like systemSnapFromSeed, but for a seed whose
+// assertions and metadata are already loaded.
+func systemSnapOfSeed(seed seed.Seed) (systemSnap string, baseSnaps []string, err error) {
+	model := seed.Model()
+
+	if !model.Classic() && model.Base() != "core20" {
+		// TODO: support uc20+
+		return "", nil, fmt.Errorf("preseeding of ubuntu core with base %s is not supported", model.Base())
 	}
 
 	var required string
@@ -134,34 +243,447 @@ var systemSnapFromSeed = func(seedDir, sysLabel string) (systemSnap string, base
 		required = "core"
 	}
 
-	var systemSnapPath, baseSnapPath string
+	var systemSnapPath string
+	var baseSnapPaths []string
 	for _, ess := range seed.EssentialSnaps() {
 		if ess.SnapName() == required {
 			systemSnapPath = ess.Path
 		}
-		if ess.EssentialType == "base" {
-			baseSnapPath = ess.Path
+		if ess.EssentialType == "base" && !strutil.ListContains(baseSnapPaths, ess.Path) {
+			baseSnapPaths = append(baseSnapPaths, ess.Path)
 		}
 	}
 
 	if systemSnapPath == "" {
-		return "", "", fmt.Errorf("%s snap not found", required)
+		return "", nil, fmt.Errorf("%s snap not found", required)
+	}
+
+	return systemSnapPath, baseSnapPaths, nil
+}
+
+// ResolveSystemSnaps returns the snapd (or core), base, kernel and gadget
+// snaps of the seed at seedDir, together with their revisions. The label
+// is empty for seeds other than UC20 ones. Unlike preseeding, it does not
+// check whether the seed can be preseeded.
+func ResolveSystemSnaps(seedDir, label string) (SystemSnaps, error) {
+	sd, err := loadSeed(seedDir, label)
+	if err != nil {
+		return SystemSnaps{}, err
+	}
+
+	baseName := sd.Model().Base()
+	if baseName == "" {
+		baseName = "core"
+	}
+	systemName := "core"
+	if sd.UsesSnapdSnap() {
+		systemName = "snapd"
+	}
+
+	var res SystemSnaps
+	for _, ess := range sd.EssentialSnaps() {
+		seedSnap := SeedSnap{
+			Name:     ess.SnapName(),
+			Path:     ess.Path,
+			Revision: ess.SideInfo.Revision,
+		}
+		// the core snap is both the system and the base snap
+		if seedSnap.Name == systemName {
+			res.Snapd = seedSnap
+		}
+		if seedSnap.Name == baseName {
+			res.Base = seedSnap
+		}
+		switch ess.EssentialType {
+		case snap.TypeKernel:
+			res.Kernel = &seedSnap
+		case snap.TypeGadget:
+			res.Gadget = &seedSnap
+		}
+	}
+	if res.Snapd.Path == "" {
+		return SystemSnaps{}, fmt.Errorf("%s snap not found", systemName)
+	}
+	if res.Base.Path == "" {
+		return SystemSnaps{}, fmt.Errorf("%s snap not found", baseName)
+	}
+	return res, nil
+}
+
+var (
+	// classicMountSnapTypes are the types of essential snaps mounted by
+	// default for classic preseeding, besides the core or snapd snap
+	classicMountSnapTypes = []snap.Type{snap.TypeBase}
+	// coreMountSnapTypes are the types of essential snaps mounted by
+	// default for UC20 preseeding, besides the snapd snap and the base
+	coreMountSnapTypes = []snap.Type{snap.TypeKernel, snap.TypeGadget}
+)
+
+// mountSnapTypes returns the types of essential snaps to mount, either
+// those requested or the defaults.
+func mountSnapTypes(requested, defaults []snap.Type) []snap.Type {
+	if requested != nil {
+		return requested
+	}
+	return defaults
+}
+
+func hasSnapType(types []snap.Type, typ snap.Type) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// nonBaseSnapTypes returns types without the base type.
+func nonBaseSnapTypes(types []snap.Type) []snap.Type {
+	var nonBase []snap.Type
+	for _, t := range types {
+		if t != snap.TypeBase {
+			nonBase = append(nonBase, t)
+		}
+	}
+	return nonBase
+}
+
+// pathInChroot returns path, which may be a path on the host under
+// preseedChroot, relative to the chroot.
+func pathInChroot(preseedChroot, path string) string {
+	if strings.HasPrefix(path, preseedChroot+"/") {
+		return strings.TrimPrefix(path, preseedChroot)
+	}
+	return path
+}
+
+// essentialSnapsFromSeed returns the paths of the essential snaps of the
+// given types, other than bases, from the seed.
+var essentialSnapsFromSeed = func(seedDir, sysLabel string, types []snap.Type) ([]string, error) {
+	wanted := nonBaseSnapTypes(types)
+	if len(wanted) == 0 {
+		return nil, nil
+	}
+
+	seed, err := loadSeed(seedDir, sysLabel)
+	if err != nil {
+		return nil, err
+	}
+	return essentialSnapsOfSeed(seed, wanted), nil
+}
+
+// essentialSnapsOfSeed returns the paths of the essential snaps of the given
+// types from a seed whose assertions and metadata are already loaded.
+func essentialSnapsOfSeed(seed seed.Seed, types []snap.Type) []string {
+	var snapPaths []string
+	for _, ess := range seed.EssentialSnaps() {
+		if hasSnapType(types, ess.EssentialType) && !strutil.ListContains(snapPaths, ess.Path) {
+			snapPaths = append(snapPaths, ess.Path)
+		}
+	}
+	return snapPaths
+}
+
+// snapdLibExecDirs are the locations of the snapd binary and its info file,
+// relative to the root of a system. Systems without merged /usr only have
+// the latter.
+var snapdLibExecDirs = []string{dirs.CoreLibExecDir, "/lib/snapd"}
+
+// snapdLibExecDir returns the directory with snapd and its info file under
+// rootDir. If none is found, the default location is returned.
+func snapdLibExecDir(rootDir string) string {
+	for _, dir := range snapdLibExecDirs {
+		candidate := filepath.Join(rootDir, dir)
+		if osutil.FileExists(filepath.Join(candidate, "info")) {
+			return candidate
+		}
+	}
+	return filepath.Join(rootDir, dirs.CoreLibExecDir)
+}
+
+// preferSnapdFromSnap returns whether snapd from the core/snapd snap should
+// be used rather than snapd from the deb, that is when it is not older.
+func preferSnapdFromSnap(verFromSnap, verFromDeb string) (bool, error) {
+	res, err := strutil.VersionCompare(verFromSnap, verFromDeb)
+	if err != nil {
+		return false, err
+	}
+	return res >= 0, nil
+}
+
+const (
+	// SnapdSourceSnap indicates snapd from the core or snapd snap.
+	SnapdSourceSnap = "snap"
+	// SnapdSourceDeb indicates snapd installed in the chroot from the deb.
+	SnapdSourceDeb = "deb"
+)
+
+// ResolveSnapd returns which snapd, either from the core/snapd snap at
+// coreSnapPath (SnapdSourceSnap) or from the deb installed in chrootDir
+// (SnapdSourceDeb), preseeding of the classic system at chrootDir would use,
+// and its version. The snap is not mounted and snapd is not run. Whether the
+// version supports preseeding is not checked.
+func ResolveSnapd(chrootDir, coreSnapPath string) (source string, version string, err error) {
+	source, version, _, err = resolveSnapd(chrootDir, coreSnapPath)
+	return source, version, err
+}
+
+// resolveSnapd is like ResolveSnapd, but also returns the directory with the
+// chosen snapd, relative to the root of the snap or of chrootDir.
+func resolveSnapd(chrootDir, coreSnapPath string) (source, version, libExecDir string, err error) {
+	verFromSnap, snapLibExecDir, err := snapdVersionFromSnap(coreSnapPath)
+	if err != nil {
+		return "", "", "", err
+	}
+	debLibExecDir := snapdLibExecDir(chrootDir)
+	verFromDeb, _, err := snapdtool.SnapdVersionFromInfoFile(debLibExecDir)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	useSnap, err := preferSnapdFromSnap(verFromSnap, verFromDeb)
+	if err != nil {
+		return "", "", "", err
+	}
+	if useSnap {
+		return SnapdSourceSnap, verFromSnap, snapLibExecDir, nil
+	}
+	return SnapdSourceDeb, verFromDeb, strings.TrimPrefix(debLibExecDir, chrootDir), nil
+}
+
+// SnapdVersionFromSnap returns the version of snapd carried by the core or
+// snapd snap at snapPath. The snap is not mounted.
+func SnapdVersionFromSnap(snapPath string) (string, error) {
+	version, _, err := snapdVersionFromSnap(snapPath)
+	return version, err
+}
+
+// snapdVersionFromSnap reads the version of snapd from the info file of the
+// given core/snapd snap. It also returns the directory of the info file,
+// relative to the root of the snap.
+func snapdVersionFromSnap(snapPath string) (version, libExecDir string, err error) {
+	container, err := snapfile.Open(snapPath)
+	if err != nil {
+		return "", "", err
+	}
+	var info []byte
+	for _, dir := range snapdLibExecDirs {
+		// paths in the snap are relative to its root
+		infoPath := strings.TrimPrefix(filepath.Join(dir, "info"), "/")
+		info, err = container.ReadFile(infoPath)
+		if err == nil {
+			libExecDir = dir
+			break
+		}
 	}
+	if err != nil {
+		return "", "", fmt.Errorf("cannot read snapd info file from %s: %v", snapPath, err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "preseed-snapd-info-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "info"), info, 0644); err != nil {
+		return "", "", err
+	}
+	version, _, err = snapdtool.SnapdVersionFromInfoFile(tmpDir)
+	return version, libExecDir, err
+}
+
+// SnapdInvocation returns the command line and the environment snapd would
+// be run with by Classic with default options when preseeding the classic
+// system at chrootDir. The path of snapd is as seen from inside the chroot.
+// Nothing is mounted and snapd is not run.
+func SnapdInvocation(chrootDir string) (argv []string, env map[string]string, err error) {
+	chrootDir, err = filepath.Abs(chrootDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	coreSnapPath, _, err := systemSnapFromSeed(dirs.SnapSeedDirUnder(chrootDir), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	source, version, libExecDir, err := resolveSnapd(chrootDir, coreSnapPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := strutil.VersionCompare(version, snapdPreseedSupportVer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res < 0 {
+		return nil, nil, fmt.Errorf("snapd %s from the %s does not support preseeding, the minimum required version is %s",
+			version, source, snapdPreseedSupportVer)
+	}
+
+	opts := &ClassicOptions{}
+	// mirrors chooseTargetSnapdVersion
+	snapdPath := filepath.Join(dirs.GlobalRootDir, libExecDir, "snapd")
+	if source == SnapdSourceSnap {
+		snapdPath = filepath.Join(opts.mountPath(), libExecDir, "snapd")
+	}
+	cmd := snapdCommand(snapdPath, opts)
+
+	env = make(map[string]string, len(cmd.Env))
+	for _, kv := range cmd.Env {
+		// later entries take precedence, like when running the command
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return cmd.Args, env, nil
+}
+
+// VersionAdvice checks whether the snapd available to the classic system
+// at chrootDir, either from the deb or from the core/snapd snap of its
+// seed, supports preseeding. If it does not, the returned advice suggests
+// how to get a recent enough snapd. Nothing is mounted and snapd is not
+// run.
+func VersionAdvice(chrootDir string) (*Advice, error) {
+	chrootDir, err := filepath.Abs(chrootDir)
+	if err != nil {
+		return nil, err
+	}
+	coreSnapPath, _, err := systemSnapFromSeed(dirs.SnapSeedDirUnder(chrootDir), "")
+	if err != nil {
+		return nil, err
+	}
+	return versionAdvice(chrootDir, coreSnapPath)
+}
+
+func versionAdvice(chrootDir, coreSnapPath string) (*Advice, error) {
+	source, version, err := ResolveSnapd(chrootDir, coreSnapPath)
+	if err != nil {
+		return nil, err
+	}
+	advice := &Advice{
+		Source:         source,
+		Version:        version,
+		MinimumVersion: snapdPreseedSupportVer,
+	}
+	res, err := strutil.VersionCompare(version, snapdPreseedSupportVer)
+	if err != nil {
+		return nil, err
+	}
+	if res >= 0 {
+		advice.Supported = true
+		return advice, nil
+	}
+	// the newer of the two versions of snapd is used, so either of them
+	// being upgraded is enough
+	advice.Actions = []AdviceAction{AdviceUpgradeDeb, AdviceRefreshSnap}
+	return advice, nil
+}
+
+// AssertReadyForPreseed checks that the classic system at chrootDir can be
+// preseeded for the first time: it is not preseeded yet, the chroot is
+// suitable for preseeding, it has a seed and the snapd available to it
+// supports preseeding. Failures are reported as AlreadyPreseededError,
+// InvalidChrootError, NoSeedError and UnsupportedSnapdError respectively.
+// Nothing is mounted and snapd is not run.
+func AssertReadyForPreseed(chrootDir string) error {
+	chrootDir, err := filepath.Abs(chrootDir)
+	if err != nil {
+		return err
+	}
+	if IsPreseeded(chrootDir) {
+		return &AlreadyPreseededError{ChrootDir: chrootDir}
+	}
+	if _, err := checkChroot(chrootDir, false); err != nil {
+		return &InvalidChrootError{ChrootDir: chrootDir, Err: err}
+	}
+
+	seedDir := dirs.SnapSeedDirUnder(chrootDir)
+	coreSnapPath, _, err := systemSnapFromSeed(seedDir, "")
+	if err != nil {
+		if err == seed.ErrNoAssertions || os.IsNotExist(err) {
+			return &NoSeedError{SeedDir: seedDir}
+		}
+		return err
+	}
+
+	advice, err := versionAdvice(chrootDir, coreSnapPath)
+	if err != nil {
+		return err
+	}
+	if !advice.Supported {
+		return &UnsupportedSnapdError{Advice: advice}
+	}
+	return nil
+}
+
+// snapdFromTree returns the information about snapd from the extracted
+// core/snapd snap at rootDir. The function must be called after
+// syscall.Chroot(..).
+func snapdFromTree(rootDir string) (*targetSnapdInfo, error) {
+	libExecDir := snapdLibExecDir(rootDir)
+	version, _, err := snapdtool.SnapdVersionFromInfoFile(libExecDir)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := strutil.VersionCompare(version, snapdPreseedSupportVer)
+	if err != nil {
+		return nil, err
+	}
+	if res < 0 {
+		return nil, fmt.Errorf("snapd %s from %s does not support preseeding, the minimum required version is %s",
+			version, rootDir, snapdPreseedSupportVer)
+	}
+
+	return &targetSnapdInfo{path: filepath.Join(libExecDir, "snapd"), version: version}, nil
+}
 
-	return systemSnapPath, baseSnapPath, nil
+// extractedSentinel is written into a snap tree by ExtractSnapd once the
+// extraction completed.
+const extractedSentinel = ".preseed-extracted"
+
+// ExtractSnapd extracts the core or snapd snap at snapPath into targetDir,
+// for use with the SnapdRootDir option of Classic. A tree left behind by a
+// complete extraction of an earlier run is reused, while a partial one,
+// e.g. after a crash, is removed and extracted again.
+func ExtractSnapd(snapPath, targetDir string) error {
+	sentinel := filepath.Join(targetDir, extractedSentinel)
+	if osutil.FileExists(sentinel) {
+		return nil
+	}
+	if osutil.FileExists(targetDir) {
+		fmt.Fprintf(Stdout, "removing partial extraction at %s\n", targetDir)
+		if err := os.RemoveAll(targetDir); err != nil {
+			return fmt.Errorf("cannot remove partial extraction: %v", err)
+		}
+	}
+	if out, err := exec.Command("unsquashfs", "-n", "-d", targetDir, snapPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot extract %s: %v", snapPath, osutil.OutputErr(out, err))
+	}
+	return ioutil.WriteFile(sentinel, nil, 0644)
 }
 
-const snapdPreseedSupportVer = `2.43.3+`
+// checkMountedSnapd verifies that the core/snapd snap from snapPath mounted
+// at mountPath carries snapd and its info file, so that a malformed snap is
+// reported clearly rather than failing to execute.
+func checkMountedSnapd(snapPath, mountPath string) error {
+	libExecDir := snapdLibExecDir(mountPath)
+	if !osutil.FileExists(filepath.Join(libExecDir, "info")) {
+		return fmt.Errorf("mounted core snap %s is missing the snapd info file", snapPath)
+	}
+	if !osutil.FileExists(filepath.Join(libExecDir, "snapd")) {
+		return fmt.Errorf("mounted core snap %s is missing the snapd binary", snapPath)
+	}
+	return nil
+}
 
 // chooseTargetSnapdVersion checks if the version of snapd under chroot env
 // is good enough for preseeding. It checks both the snapd from the deb
-// and from the seeded snap mounted under snapdMountPath and returns the
+// and from the seeded snap mounted under mountPath and returns the
 // information (path, version) about snapd to execute as part of preseeding
 // (it picks the newer version of the two).
 // The function must be called after syscall.Chroot(..).
-func chooseTargetSnapdVersion() (*targetSnapdInfo, error) {
+func chooseTargetSnapdVersion(mountPath string) (*targetSnapdInfo, error) {
 	// read snapd version from the mounted core/snapd snap
-	snapdInfoDir := filepath.Join(snapdMountPath, dirs.CoreLibExecDir)
+	snapdInfoDir := snapdLibExecDir(mountPath)
 	verFromSnap, _, err := snapdtool.SnapdVersionFromInfoFile(snapdInfoDir)
 	if err != nil {
 		return nil, err
@@ -169,41 +691,43 @@ func chooseTargetSnapdVersion() (*targetSnapdInfo, error) {
 
 	// read snapd version from the main fs under chroot (snapd from the deb);
 	// assumes running under chroot already.
-	hostInfoDir := filepath.Join(dirs.GlobalRootDir, dirs.CoreLibExecDir)
+	hostInfoDir := snapdLibExecDir(dirs.GlobalRootDir)
 	verFromDeb, _, err := snapdtool.SnapdVersionFromInfoFile(hostInfoDir)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := strutil.VersionCompare(verFromSnap, verFromDeb)
+	useSnap, err := preferSnapdFromSnap(verFromSnap, verFromDeb)
 	if err != nil {
 		return nil, err
 	}
 
 	var whichVer, snapdPath string
-	if res < 0 {
+	if !useSnap {
 		// snapd from the deb under chroot is the candidate to run
 		whichVer = verFromDeb
-		snapdPath = filepath.Join(dirs.GlobalRootDir, dirs.CoreLibExecDir, "snapd")
+		snapdPath = filepath.Join(hostInfoDir, "snapd")
 	} else {
 		// snapd from the mounted core/snapd snap is the candidate to run
 		whichVer = verFromSnap
-		snapdPath = filepath.Join(snapdMountPath, dirs.CoreLibExecDir, "snapd")
+		snapdPath = filepath.Join(snapdInfoDir, "snapd")
 	}
 
-	res, err = strutil.VersionCompare(whichVer, snapdPreseedSupportVer)
+	// the newer of the two is picked, so if it is too old, neither of them
+	// can be used
+	res, err := strutil.VersionCompare(whichVer, snapdPreseedSupportVer)
 	if err != nil {
 		return nil, err
 	}
 	if res < 0 {
-		return nil, fmt.Errorf("snapd %s from the target system does not support preseeding, the minimum required version is %s",
-			whichVer, snapdPreseedSupportVer)
+		return nil, fmt.Errorf("neither the target snapd (%s) nor the deb snapd (%s) supports preseeding (min %s)",
+			verFromSnap, verFromDeb, snapdPreseedSupportVer)
 	}
 
 	return &targetSnapdInfo{path: snapdPath, version: whichVer}, nil
 }
 
-func prepareCore20Mountpoints(prepareImageDir, tmpPreseedChrootDir, snapdSnapBlob, baseSnapBlob, writable string) (cleanupMounts func(), err error) {
+func prepareCore20Mountpoints(prepareImageDir, tmpPreseedChrootDir, snapdSnapBlob, baseSnapBlob string, extraSnapBlobs []string, writable, appArmorFeaturesDir string) (cleanupMounts func(), err error) {
 	underPreseed := func(path string) string {
 		return filepath.Join(tmpPreseedChrootDir, path)
 	}
@@ -257,6 +781,16 @@ func prepareCore20Mountpoints(prepareImageDir, tmpPreseedChrootDir, snapdSnapBlo
 	mounts := [][]string{
 		{"-o", "loop", baseSnapBlob, tmpPreseedChrootDir},
 		{"-o", "loop", snapdSnapBlob, snapdMountPath},
+	}
+	// other essential snaps are mounted next to snapd
+	for _, blob := range extraSnapBlobs {
+		where := baseMountPath(snapdMountPath, blob)
+		if err := os.MkdirAll(where, 0755); err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, []string{"-o", "loop", blob, where})
+	}
+	mounts = append(mounts, [][]string{
 		{"-t", "tmpfs", "tmpfs", underPreseed("run")},
 		{"-t", "tmpfs", "tmpfs", underPreseed("var/tmp")},
 		{"--bind", underPreseed("var/tmp"), underPreseed("tmp")},
@@ -264,18 +798,35 @@ func prepareCore20Mountpoints(prepareImageDir, tmpPreseedChrootDir, snapdSnapBlo
 		{"-t", "sysfs", "sysfs", underPreseed("sys")},
 		{"-t", "devtmpfs", "udev", underPreseed("dev")},
 		{"-t", "securityfs", "securityfs", underPreseed("sys/kernel/security")},
-		{"--bind", writable, underPreseed("writable")},
-	}
+	}...)
 
-	var out []byte
-	for _, mountArgs := range mounts {
+	mount := func(mountArgs []string) error {
 		cmd := exec.Command("mount", mountArgs...)
-		if out, err = cmd.CombinedOutput(); err != nil {
-			return nil, fmt.Errorf("cannot prepare mountpoint in preseed mode: %v\n'mount %s' failed with: %s", err, strings.Join(mountArgs, " "), out)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("cannot prepare mountpoint in preseed mode: %v\n'mount %s' failed with: %s", err, strings.Join(mountArgs, " "), out)
 		}
 		mounted = append(mounted, mountArgs[len(mountArgs)-1])
+		return nil
+	}
+	for _, mountArgs := range mounts {
+		if err := mount(mountArgs); err != nil {
+			return nil, err
+		}
+	}
+	if appArmorFeaturesDir != "" {
+		// the features of the target kernel replace those of the host
+		where := underPreseed(appArmorFeaturesPath)
+		if err := bindMountReadOnly(realBackend{}, appArmorFeaturesDir, where); err != nil {
+			return nil, fmt.Errorf("cannot prepare mountpoint in preseed mode: %v", err)
+		}
+		mounted = append(mounted, where)
+	}
+	if err := mount([]string{"--bind", writable, underPreseed("writable")}); err != nil {
+		return nil, err
 	}
 
+	var out []byte
+
 	cmd := exec.Command(underPreseed("/usr/lib/core/handle-writable-paths"), tmpPreseedChrootDir)
 	if out, err = cmd.CombinedOutput(); err != nil {
 		return nil, fmt.Errorf("handle-writable-paths failed with: %v\n%s", err, out)
@@ -317,32 +868,69 @@ func prepareCore20Mountpoints(prepareImageDir, tmpPreseedChrootDir, snapdSnapBlo
 	return cleanupMounts, nil
 }
 
-func systemForPreseeding(systemsDir string) (label string, err error) {
+// systemForPreseeding returns the label of the recovery system to preseed.
+// If sysLabel is empty, the seed is expected to contain a single system.
+func systemForPreseeding(systemsDir, sysLabel string) (label string, err error) {
 	systemLabels, err := filepath.Glob(filepath.Join(systemsDir, "systems", "*"))
 	if err != nil && !os.IsNotExist(err) {
 		return "", fmt.Errorf("cannot list available systems: %v", err)
 	}
+	for i := range systemLabels {
+		systemLabels[i] = filepath.Base(systemLabels[i])
+	}
+	if sysLabel != "" {
+		if !strutil.ListContains(systemLabels, sysLabel) {
+			return "", fmt.Errorf("cannot find system %q for preseeding, available systems: %s", sysLabel, strings.Join(systemLabels, ", "))
+		}
+		return sysLabel, nil
+	}
+	if len(systemLabels) > 1 {
+		return "", fmt.Errorf("cannot select the system for preseeding, found multiple systems: %s", strings.Join(systemLabels, ", "))
+	}
 	if len(systemLabels) != 1 {
 		return "", fmt.Errorf("expected a single system for preseeding, found %d", len(systemLabels))
 	}
-	return filepath.Base(systemLabels[0]), nil
+	return systemLabels[0], nil
 }
 
-var makePreseedTempDir = func() (string, error) {
-	return ioutil.TempDir("", "preseed-")
+// makePreseedTempDir and makeWritableTempDir create temporary directories
+// under baseDir, or under the default directory for temporary files if
+// baseDir is empty.
+var makePreseedTempDir = func(baseDir string) (string, error) {
+	return ioutil.TempDir(baseDir, "preseed-")
 }
 
-var makeWritableTempDir = func() (string, error) {
-	return ioutil.TempDir("", "writable-")
+var makeWritableTempDir = func(baseDir string) (string, error) {
+	return ioutil.TempDir(baseDir, "writable-")
 }
 
-func prepareCore20Chroot(prepareImageDir string) (preseed *preseedOpts, cleanup func(), err error) {
+func prepareCore20Chroot(prepareImageDir string, coreOpts *CoreOptions) (preseed *preseedOpts, cleanup func(), err error) {
+	if coreOpts.TempDir != "" {
+		if err := checkTempDir(coreOpts.TempDir); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if coreOpts.AppArmorKernelFeaturesDir != "" && !osutil.IsDirectory(coreOpts.AppArmorKernelFeaturesDir) {
+		return nil, nil, fmt.Errorf("cannot use apparmor features from %s: not a directory", coreOpts.AppArmorKernelFeaturesDir)
+	}
+
 	sysDir := filepath.Join(prepareImageDir, "system-seed")
-	sysLabel, err := systemForPreseeding(sysDir)
+	if coreOpts.RewriteSeed != nil {
+		if err := coreOpts.RewriteSeed(sysDir); err != nil {
+			return nil, nil, fmt.Errorf("cannot rewrite seed: %v", err)
+		}
+	}
+	sysLabel, err := systemForPreseeding(sysDir, coreOpts.SysLabel)
 	if err != nil {
 		return nil, nil, err
 	}
-	snapdSnapPath, baseSnapPath, err := systemSnapFromSeed(sysDir, sysLabel)
+	if coreOpts.ValidateGadget {
+		if err := validateGadget(sysDir, sysLabel); err != nil {
+			return nil, nil, err
+		}
+	}
+	snapdSnapPath, baseSnapPaths, err := systemSnapFromSeed(sysDir, sysLabel)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -350,25 +938,35 @@ func prepareCore20Chroot(prepareImageDir string) (preseed *preseedOpts, cleanup
 	if snapdSnapPath == "" {
 		return nil, nil, fmt.Errorf("snapd snap not found")
 	}
-	if baseSnapPath == "" {
+	if len(baseSnapPaths) == 0 {
 		return nil, nil, fmt.Errorf("base snap not found")
 	}
+	// the base of the model comes first, any other bases are not
+	// needed to set up the UC20 chroot
+	baseSnapPath := baseSnapPaths[0]
+	extraSnapPaths, err := essentialSnapsFromSeed(sysDir, sysLabel, mountSnapTypes(coreOpts.MountSnapTypes, coreMountSnapTypes))
+	if err != nil {
+		return nil, nil, err
+	}
 
-	tmpPreseedChrootDir, err := makePreseedTempDir()
+	tmpPreseedChrootDir, err := makePreseedTempDir(coreOpts.TempDir)
 	if err != nil {
 		return nil, nil, fmt.Errorf("cannot prepare uc20 chroot: %v", err)
 	}
-	writableTmpDir, err := makeWritableTempDir()
+	writableTmpDir, err := makeWritableTempDir(coreOpts.TempDir)
 	if err != nil {
+		os.RemoveAll(tmpPreseedChrootDir)
 		return nil, nil, fmt.Errorf("cannot prepare uc20 chroot: %v", err)
 	}
 
-	cleanupMounts, err := prepareCore20Mountpoints(prepareImageDir, tmpPreseedChrootDir, snapdSnapPath, baseSnapPath, writableTmpDir)
+	emitEvent(coreOpts.Events, StageMountSnapd, snapdSnapPath)
+	cleanupMounts, err := prepareCore20Mountpoints(prepareImageDir, tmpPreseedChrootDir, snapdSnapPath, baseSnapPath, extraSnapPaths, writableTmpDir, coreOpts.AppArmorKernelFeaturesDir)
 	if err != nil {
 		return nil, nil, fmt.Errorf("cannot prepare uc20 mountpoints: %v", err)
 	}
 
 	cleanup = func() {
+		emitEvent(coreOpts.Events, StageCleanup, "")
 		cleanupMounts()
 		if err := os.RemoveAll(tmpPreseedChrootDir); err != nil {
 			fmt.Fprintf(Stdout, "%v", err)
@@ -383,16 +981,388 @@ func prepareCore20Chroot(prepareImageDir string) (preseed *preseedOpts, cleanup
 		PreseedChrootDir: tmpPreseedChrootDir,
 		SystemLabel:      sysLabel,
 		WritableDir:      writableTmpDir,
+		Events:           coreOpts.Events,
 	}
 	return opts, cleanup, nil
 }
 
-func prepareClassicChroot(preseedChroot string) (*targetSnapdInfo, func(), error) {
-	if err := syscallChroot(preseedChroot); err != nil {
-		return nil, nil, fmt.Errorf("cannot chroot into %s: %v", preseedChroot, err)
+// verifySnapDigest checks that the SHA3-384 digest of the given snap matches
+// the expected one.
+func verifySnapDigest(snapPath, expectedDigest string) error {
+	digest, _, err := asserts.SnapFileSHA3_384(snapPath)
+	if err != nil {
+		return err
 	}
-
-	if err := os.Chdir("/"); err != nil {
+	if digest != expectedDigest {
+		return fmt.Errorf("cannot use snap %s: digest mismatch, expected %s but got %s", snapPath, expectedDigest, digest)
+	}
+	return nil
+}
+
+// mountPath returns the directory, inside the chroot, where the core/snapd
+// snap is mounted.
+func (opts *ClassicOptions) mountPath() string {
+	if opts.MountPath != "" {
+		return opts.MountPath
+	}
+	if opts.TempDir != "" {
+		return filepath.Join(opts.TempDir, filepath.Base(snapdMountPath))
+	}
+	return snapdMountPath
+}
+
+// checkTempDir verifies that dir exists and is a writable directory, so that
+// it can be used as the base of temporary directories.
+func checkTempDir(dir string) error {
+	exists, isDir, err := osutil.DirExists(dir)
+	if err != nil {
+		return fmt.Errorf("cannot use %q as temporary directory: %v", dir, err)
+	}
+	if !exists {
+		return fmt.Errorf("cannot use %q as temporary directory: it does not exist", dir)
+	}
+	if !isDir {
+		return fmt.Errorf("cannot use %q as temporary directory: it is not a directory", dir)
+	}
+	probe, err := ioutil.TempFile(dir, ".preseed-temp-dir-")
+	if err != nil {
+		return fmt.Errorf("cannot use %q as temporary directory: it is not writable", dir)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// checkMountPath verifies that mountPath, interpreted inside preseedChroot,
+// can be used as the mountpoint of the core/snapd snap.
+func checkMountPath(preseedChroot, mountPath string) error {
+	if !filepath.IsAbs(mountPath) || filepath.Clean(mountPath) == "/" {
+		return fmt.Errorf("cannot use %q as mount path: must be an absolute path inside the chroot other than /", mountPath)
+	}
+	// the mountpoint and its parents are created as needed, check the
+	// closest existing one
+	dir := filepath.Join(preseedChroot, mountPath)
+	for {
+		exists, isDir, err := osutil.DirExists(dir)
+		if err != nil {
+			return fmt.Errorf("cannot use %q as mount path: %v", mountPath, err)
+		}
+		if exists {
+			if !isDir {
+				return fmt.Errorf("cannot use %q as mount path: %s is not a directory", mountPath, dir)
+			}
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	probe, err := ioutil.TempFile(dir, ".preseed-mount-path-")
+	if err != nil {
+		return fmt.Errorf("cannot use %q as mount path: %s is not writable", mountPath, dir)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+var procDir = "/proc"
+
+// checkActiveSnapd returns an error if snapd appears to be active on the
+// system at preseedChroot, i.e. its socket is there or a snapd process runs
+// with preseedChroot as its root directory, e.g. if pointed at / or at a
+// live system by accident.
+func checkActiveSnapd(preseedChroot string) error {
+	refusal := fmt.Errorf("refusing to preseed an active snapd system at %s", preseedChroot)
+
+	if st, err := os.Stat(filepath.Join(preseedChroot, "/run/snapd.socket")); err == nil && st.Mode()&os.ModeSocket != 0 {
+		return refusal
+	}
+
+	root, err := filepath.EvalSymlinks(preseedChroot)
+	if err != nil {
+		return err
+	}
+	comms, err := filepath.Glob(filepath.Join(procDir, "[0-9]*", "comm"))
+	if err != nil {
+		return err
+	}
+	for _, comm := range comms {
+		// processes may go away at any time, errors are ignored
+		name, err := ioutil.ReadFile(comm)
+		if err != nil || strings.TrimSpace(string(name)) != "snapd" {
+			continue
+		}
+		procRoot, err := os.Readlink(filepath.Join(filepath.Dir(comm), "root"))
+		if err != nil {
+			continue
+		}
+		if procRoot == root {
+			return refusal
+		}
+	}
+	return nil
+}
+
+func (opts *ClassicOptions) inhibitDir() string {
+	if opts.InhibitDir != "" {
+		return opts.InhibitDir
+	}
+	return runinhibit.InhibitDir
+}
+
+// checkInhibitLocks returns an error if any of the run inhibition locks in
+// inhibitDir of the system at preseedChroot holds a hint, i.e. an operation
+// on the snap is in progress.
+func checkInhibitLocks(preseedChroot, inhibitDir string) error {
+	locks, err := filepath.Glob(filepath.Join(preseedChroot, inhibitDir, "*.lock"))
+	if err != nil {
+		return err
+	}
+	for _, lock := range locks {
+		hint, err := ioutil.ReadFile(lock)
+		if err != nil {
+			return fmt.Errorf("cannot read inhibition lock: %v", err)
+		}
+		if len(hint) > 0 {
+			snapName := strings.TrimSuffix(filepath.Base(lock), ".lock")
+			return fmt.Errorf("refusing to preseed while an operation on snap %q is in progress (%s)", snapName, hint)
+		}
+	}
+	return nil
+}
+
+// separateDataMounts returns the snapd data directories of preseedChroot,
+// i.e. /var/lib/snapd and /var/snap, which are mountpoints of their own,
+// e.g. separate subvolumes.
+func separateDataMounts(preseedChroot string) ([]ChrootMount, error) {
+	dataDirs := map[string]bool{
+		dirs.SnapdStateDir(preseedChroot):         true,
+		filepath.Join(preseedChroot, "/var/snap"): true,
+	}
+	entries, err := osutil.LoadMountInfo()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse mount info: %v", err)
+	}
+	var separate []ChrootMount
+	for _, ent := range entries {
+		if dataDirs[ent.MountDir] {
+			separate = append(separate, ChrootMount{
+				MountDir: ent.MountDir,
+				Source:   ent.MountSource,
+				FsType:   ent.FsType,
+			})
+		}
+	}
+	sort.Slice(separate, func(i, j int) bool {
+		return separate[i].MountDir < separate[j].MountDir
+	})
+	return separate, nil
+}
+
+// checkChrootPathsContained verifies that the paths inside preseedChroot
+// which preseeding writes to or mounts over, before or after entering the
+// chroot, do not resolve to a location outside of the chroot, e.g. through
+// symlinks. Otherwise a crafted chroot could make preseeding modify the
+// host.
+func checkChrootPathsContained(preseedChroot, mountPath string) error {
+	root, err := filepath.EvalSymlinks(preseedChroot)
+	if err != nil {
+		return err
+	}
+	paths := []string{
+		dirs.SnapdStateDir(preseedChroot),
+		dirs.SnapSeedDirUnder(preseedChroot),
+		dirs.SnapServicesDirUnder(preseedChroot),
+		filepath.Join(preseedChroot, "var/cache/snapd"),
+		filepath.Join(preseedChroot, "var/cache/apparmor"),
+		filepath.Join(preseedChroot, mountPath),
+	}
+	for _, path := range paths {
+		// the path may not exist yet, check the closest existing parent
+		existing := path
+		for {
+			if _, err := os.Lstat(existing); err == nil {
+				break
+			}
+			existing = filepath.Dir(existing)
+		}
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err != nil {
+			return fmt.Errorf("cannot preseed: cannot resolve %s: %v", existing, err)
+		}
+		if resolved != root && !strings.HasPrefix(resolved, root+"/") {
+			return fmt.Errorf("cannot preseed: %s resolves to %s outside of the chroot %s, refusing to modify the host", existing, resolved, preseedChroot)
+		}
+	}
+	return nil
+}
+
+// preseedAssertions imports the assertions of the seed of the system under
+// preseedChroot into its system assertion database, without mounting any
+// snaps or running snapd.
+func preseedAssertions(preseedChroot string, opts *ClassicOptions) error {
+	seedDir := dirs.SnapSeedDirUnder(preseedChroot)
+	if opts.SeedDir != "" {
+		seedDir = opts.SeedDir
+	}
+	if err := checkChrootPathsContained(preseedChroot, opts.mountPath()); err != nil {
+		return err
+	}
+
+	sd, err := seedOpen(seedDir, "")
+	if err != nil {
+		return err
+	}
+	dbDir := filepath.Join(dirs.SnapdStateDir(preseedChroot), "assertions")
+	db, err := sysdb.OpenAt(dbDir)
+	if err != nil {
+		return fmt.Errorf("cannot open assertion database at %s: %v", dbDir, err)
+	}
+	commitTo := func(b *asserts.Batch) error {
+		return b.CommitTo(db, nil)
+	}
+	fmt.Fprintf(Stdout, "importing assertions of the seed into %s\n", dbDir)
+	if err := sd.LoadAssertions(db, commitTo); err != nil {
+		return fmt.Errorf("cannot import seed assertions: %v", err)
+	}
+	return nil
+}
+
+// isSecurityfsReadOnly returns whether securityfs is mounted read-only at
+// /sys/kernel/security of the system under preseedChroot.
+func isSecurityfsReadOnly(preseedChroot string) (bool, error) {
+	where := filepath.Join(preseedChroot, "/sys/kernel/security")
+	entries, err := osutil.LoadMountInfo()
+	if err != nil {
+		return false, fmt.Errorf("cannot parse mount info: %v", err)
+	}
+	readOnly := false
+	// the last mount at the location is the visible one
+	for _, ent := range entries {
+		if ent.MountDir == where {
+			_, readOnly = ent.MountOptions["ro"]
+		}
+	}
+	return readOnly, nil
+}
+
+// sharedChrootMounts returns the mountpoints at or below preseedChroot
+// which use shared propagation. Mounts made below them by preseeding, like
+// the one of the core snap, are propagated to their peers, possibly in the
+// mount tree of the host.
+func sharedChrootMounts(preseedChroot string) ([]string, error) {
+	entries, err := osutil.LoadMountInfo()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse mount info: %v", err)
+	}
+	var shared []string
+	for _, ent := range entries {
+		if ent.MountDir != preseedChroot && !strings.HasPrefix(ent.MountDir, preseedChroot+"/") {
+			continue
+		}
+		// slave mounts only receive propagation, unless they are
+		// also shared, e.g. "shared:2 master:1"
+		for _, field := range ent.OptionalFields {
+			if strings.HasPrefix(field, "shared:") {
+				shared = append(shared, ent.MountDir)
+				break
+			}
+		}
+	}
+	sort.Strings(shared)
+	return shared, nil
+}
+
+// checkMountPropagation warns about mounts of preseedChroot using shared
+// propagation or, with makePrivate, changes their propagation to private.
+// The propagation is not restored afterwards.
+func checkMountPropagation(backend Backend, preseedChroot string, makePrivate bool) error {
+	shared, err := sharedChrootMounts(preseedChroot)
+	if err != nil {
+		return err
+	}
+	if len(shared) == 0 {
+		return nil
+	}
+	if !makePrivate {
+		fmt.Fprintf(Stderr, "WARNING: the following mounts use shared propagation, the snap mounts of preseeding may leak to the host:\n - %s\n", strings.Join(shared, "\n - "))
+		return nil
+	}
+	for _, mnt := range shared {
+		if out, err := backend.Mount([]string{"--make-private", mnt}); err != nil {
+			return fmt.Errorf("cannot make %s private: %v", mnt, osutil.OutputErr(out, err))
+		}
+	}
+	return nil
+}
+
+// remountSecurityfsWritable remounts the securityfs of the system under
+// preseedChroot read-write. The returned function makes the mount read-only
+// again, either from inside or from outside of the chroot as tracked by
+// chroot.
+func remountSecurityfsWritable(backend Backend, preseedChroot string, chroot *chrootTracker) (restore func(), err error) {
+	where := filepath.Join(preseedChroot, "/sys/kernel/security")
+	if out, err := backend.Mount([]string{"-o", "remount,rw", where}); err != nil {
+		return nil, fmt.Errorf("cannot remount %s read-write: %v", where, osutil.OutputErr(out, err))
+	}
+
+	inChroot := filepath.Join(dirs.GlobalRootDir, "/sys/kernel/security")
+	return func() {
+		chroot.resolve(where, inChroot, func(where string) {
+			if out, err := backend.Mount([]string{"-o", "remount,ro", where}); err != nil {
+				fmt.Fprintf(Stderr, "cannot remount %s read-only: %v\n", where, osutil.OutputErr(out, err))
+			}
+		})
+	}, nil
+}
+
+// appArmorFeaturesPath is where the apparmor features of the kernel are
+// exposed, relative to the root of the system.
+const appArmorFeaturesPath = "/sys/kernel/security/apparmor/features"
+
+// bindMountReadOnly bind mounts src at where and then remounts the bind
+// mount read-only, as passing ro along with bind to a single mount does not
+// reliably make it read-only.
+func bindMountReadOnly(backend Backend, src, where string) error {
+	if out, err := backend.Mount([]string{"--bind", src, where}); err != nil {
+		return fmt.Errorf("cannot bind mount %s at %s: %v", src, where, osutil.OutputErr(out, err))
+	}
+	if out, err := backend.Mount([]string{"-o", "remount,bind,ro", where}); err != nil {
+		if umountOut, umountErr := backend.Unmount(where); umountErr != nil {
+			fmt.Fprintf(Stderr, "cannot unmount %s: %v\n", where, osutil.OutputErr(umountOut, umountErr))
+		}
+		return fmt.Errorf("cannot make %s read-only: %v", where, osutil.OutputErr(out, err))
+	}
+	return nil
+}
+
+// bindAppArmorFeatures bind mounts the apparmor features captured at
+// featuresDir read-only over those of the system under preseedChroot. The
+// returned function unmounts them, either from inside or from outside of the
+// chroot as tracked by chroot.
+func bindAppArmorFeatures(backend Backend, preseedChroot, featuresDir string, chroot *chrootTracker) (restore func(), err error) {
+	if !osutil.IsDirectory(featuresDir) {
+		return nil, fmt.Errorf("cannot use apparmor features from %s: not a directory", featuresDir)
+	}
+	where := filepath.Join(preseedChroot, appArmorFeaturesPath)
+	if err := bindMountReadOnly(backend, featuresDir, where); err != nil {
+		return nil, fmt.Errorf("cannot use apparmor features from %s: %v", featuresDir, err)
+	}
+
+	inChroot := filepath.Join(dirs.GlobalRootDir, appArmorFeaturesPath)
+	return func() {
+		chroot.resolve(where, inChroot, func(where string) {
+			if out, err := backend.Unmount(where); err != nil {
+				fmt.Fprintf(Stderr, "cannot unmount %s: %v\n", where, osutil.OutputErr(out, err))
+			}
+		})
+	}, nil
+}
+
+func prepareClassicChroot(preseedChroot string, opts *ClassicOptions, chroot *chrootTracker, ck *checkpoint) (*targetSnapdInfo, func(), error) {
+	var err error
+	if err := chroot.enter(opts.Backend, preseedChroot); err != nil {
+		return nil, nil, fmt.Errorf("cannot chroot into %s: %v", preseedChroot, err)
+	}
+
+	if err := os.Chdir("/"); err != nil {
 		return nil, nil, fmt.Errorf("cannot chdir to /: %v", err)
 	}
 
@@ -403,132 +1373,776 @@ func prepareClassicChroot(preseedChroot string) (*targetSnapdInfo, func(), error
 		rootDir = "/"
 	}
 
-	coreSnapPath, _, err := systemSnapFromSeed(dirs.SnapSeedDirUnder(rootDir), "")
-	if err != nil {
-		return nil, nil, err
+	if err := ck.load(); err != nil {
+		return nil, nil, err
+	}
+
+	if opts.RewriteSeed != nil && !ck.skip(stepRewriteSeed) {
+		if err := opts.RewriteSeed(dirs.SnapSeedDirUnder(rootDir)); err != nil {
+			return nil, nil, fmt.Errorf("cannot rewrite seed: %v", err)
+		}
+		if err := ck.done(stepRewriteSeed); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// note, the seed and its assertions are validated when it is loaded, so
+	// any changes made by RewriteSeed are validated as well
+	var coreSnapPath string
+	var baseSnapPaths []string
+	if opts.loadedSeed != nil {
+		coreSnapPath, baseSnapPaths, err = systemSnapOfSeed(opts.loadedSeed)
+		coreSnapPath = pathInChroot(preseedChroot, coreSnapPath)
+		for i := range baseSnapPaths {
+			baseSnapPaths[i] = pathInChroot(preseedChroot, baseSnapPaths[i])
+		}
+	} else {
+		coreSnapPath, baseSnapPaths, err = systemSnapFromSeed(dirs.SnapSeedDirUnder(rootDir), "")
+	}
+	if err != nil {
+		if err == seed.ErrNoAssertions || os.IsNotExist(err) {
+			return nil, nil, &NoSeedError{SeedDir: dirs.SnapSeedDirUnder(preseedChroot)}
+		}
+		return nil, nil, err
+	}
+
+	var unmounts []func()
+	cleanup := func() {
+		for i := len(unmounts) - 1; i >= 0; i-- {
+			unmounts[i]()
+		}
+	}
+
+	mountPath := opts.mountPath()
+
+	// snapd from an already extracted tree is used as is
+	if opts.SnapdRootDir == "" {
+		if opts.CoreSnapSHA3_384 != "" {
+			if err := verifySnapDigest(coreSnapPath, opts.CoreSnapSHA3_384); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if opts.BeforeMount != nil {
+			if err := opts.BeforeMount(coreSnapPath); err != nil {
+				return nil, nil, fmt.Errorf("refusing to mount %s: %v", coreSnapPath, err)
+			}
+		}
+
+		emitEvent(opts.Events, StageMountSnapd, coreSnapPath)
+		opts.spans.enter(StageMountSnapd)
+
+		// mount core/snapd
+		unmountCore, err := mountSnapUnderRoot(opts.Backend, rootDir, coreSnapPath, mountPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		unmounts = append(unmounts, unmountCore)
+
+		if err := checkMountedSnapd(coreSnapPath, mountPath); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+
+	// mount the bases required by the seed and any other essential snaps
+	// that were asked for
+	types := mountSnapTypes(opts.MountSnapTypes, classicMountSnapTypes)
+	var otherSnapPaths []string
+	if hasSnapType(types, snap.TypeBase) {
+		otherSnapPaths = append(otherSnapPaths, baseSnapPaths...)
+	}
+	var extraSnapPaths []string
+	if opts.loadedSeed != nil {
+		for _, snapPath := range essentialSnapsOfSeed(opts.loadedSeed, nonBaseSnapTypes(types)) {
+			extraSnapPaths = append(extraSnapPaths, pathInChroot(preseedChroot, snapPath))
+		}
+	} else {
+		extraSnapPaths, err = essentialSnapsFromSeed(dirs.SnapSeedDirUnder(rootDir), "", types)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	otherSnapPaths = append(otherSnapPaths, extraSnapPaths...)
+	for _, snapPath := range otherSnapPaths {
+		unmountSnap, err := mountSnapUnderRoot(opts.Backend, rootDir, snapPath, baseMountPath(mountPath, snapPath))
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		unmounts = append(unmounts, unmountSnap)
+	}
+
+	var targetSnapd *targetSnapdInfo
+	if opts.SnapdRootDir != "" {
+		targetSnapd, err = snapdFromTree(opts.SnapdRootDir)
+	} else {
+		targetSnapd, err = chooseTargetSnapdVersion(mountPath)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	// a format skew would only make snapd fail half-way through seeding
+	if err := checkSeedFormat(dirs.SnapSeedDirUnder(rootDir), targetSnapd.version); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return targetSnapd, cleanup, nil
+}
+
+// cleanupStaleMounts unmounts the core/snapd and base snaps left mounted
+// under preseedChroot by a previously aborted run and removes their
+// mountpoints. Both mountPath and the default mount path are looked at, as
+// the aborted run may have used either.
+func cleanupStaleMounts(preseedChroot, mountPath string, backend Backend) error {
+	entries, err := osutil.LoadMountInfo()
+	if err != nil {
+		return fmt.Errorf("cannot parse mount info: %v", err)
+	}
+
+	staleMountPaths := []string{filepath.Join(preseedChroot, mountPath)}
+	if mountPath != snapdMountPath {
+		staleMountPaths = append(staleMountPaths, filepath.Join(preseedChroot, snapdMountPath))
+	}
+	isStale := func(mnt string) bool {
+		for _, staleMountPath := range staleMountPaths {
+			if mnt == staleMountPath || strings.HasPrefix(mnt, staleMountPath+"-") {
+				return true
+			}
+		}
+		return false
+	}
+	// go in reverse order so that most recent mounts are undone first
+	for i := len(entries) - 1; i >= 0; i-- {
+		mnt := entries[i].MountDir
+		if !isStale(mnt) {
+			continue
+		}
+		fmt.Fprintf(Stdout, "unmounting stale mount: %s\n", mnt)
+		if out, err := backend.Unmount(mnt); err != nil {
+			return fmt.Errorf("cannot unmount stale mount %s: %v", mnt, osutil.OutputErr(out, err))
+		}
+		if err := os.Remove(mnt); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove stale mountpoint %s: %v", mnt, err)
+		}
+	}
+	return nil
+}
+
+// mountStateOverlay mounts an overlay over the snapd state directory of the
+// system under preseedChroot, with upperDir capturing all the changes. The
+// returned function unmounts the overlay, either from inside or from outside
+// of the chroot as tracked by chroot. Both upperDir and the overlay work
+// directory, <upperDir>.work, are left in place as they are not reachable
+// from inside the chroot.
+func mountStateOverlay(backend Backend, preseedChroot, upperDir string, chroot *chrootTracker) (unmount func(), err error) {
+	upperDir, err = filepath.Abs(upperDir)
+	if err != nil {
+		return nil, err
+	}
+	// the work directory must be on the same filesystem as upperdir
+	workDir := upperDir + ".work"
+	for _, dir := range []string{upperDir, workDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("cannot create overlay directory: %v", err)
+		}
+	}
+
+	stateDir := dirs.SnapdStateDir(dirs.GlobalRootDir)
+	where := filepath.Join(preseedChroot, stateDir)
+	mountArgs := []string{"-t", "overlay", "-o",
+		fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", where, upperDir, workDir),
+		"overlay", where}
+	if out, err := backend.Mount(mountArgs); err != nil {
+		return nil, fmt.Errorf("cannot mount overlay over %s: %v", where, osutil.OutputErr(out, err))
+	}
+
+	return func() {
+		chroot.resolve(where, stateDir, func(where string) {
+			fmt.Fprintf(Stdout, "unmounting: %s\n", where)
+			if out, err := backend.Unmount(where); err != nil {
+				fmt.Fprintf(Stderr, "cannot unmount %s: %v\n", where, osutil.OutputErr(out, err))
+			}
+		})
+	}, nil
+}
+
+// bindMountSeed bind mounts seedDir over the seed directory of the system
+// under preseedChroot, so that the seed is found there both when resolving
+// the snaps to mount and by snapd. The returned function unmounts it, either
+// from inside or from outside of the chroot as tracked by chroot.
+func bindMountSeed(backend Backend, preseedChroot, seedDir string, chroot *chrootTracker) (unmount func(), err error) {
+	seedDir, err = filepath.Abs(seedDir)
+	if err != nil {
+		return nil, err
+	}
+	if !osutil.IsDirectory(seedDir) {
+		return nil, fmt.Errorf("cannot use seed directory %q: not a directory", seedDir)
+	}
+
+	where := filepath.Join(preseedChroot, dirs.SnapSeedDir)
+	if err := os.MkdirAll(where, 0755); err != nil {
+		return nil, err
+	}
+	mountArgs := []string{"--bind", seedDir, where}
+	if out, err := backend.Mount(mountArgs); err != nil {
+		return nil, fmt.Errorf("cannot mount seed %s at %s: %v", seedDir, where, osutil.OutputErr(out, err))
+	}
+
+	inChroot := dirs.SnapSeedDir
+	return func() {
+		chroot.resolve(where, inChroot, func(where string) {
+			fmt.Fprintf(Stdout, "unmounting: %s\n", where)
+			if out, err := backend.Unmount(where); err != nil {
+				fmt.Fprintf(Stderr, "cannot unmount %s: %v\n", where, osutil.OutputErr(out, err))
+			}
+		})
+	}, nil
+}
+
+// baseMountPath returns the path where the given base (or other essential)
+// snap is mounted, next to the core/snapd snap mounted at mountPath.
+func baseMountPath(mountPath, baseSnapPath string) string {
+	return mountPath + "-" + strings.TrimSuffix(filepath.Base(baseSnapPath), ".snap")
+}
+
+// mountSnapUnderRoot mounts the given snap at mountPath under rootDir and
+// returns a function that unmounts it and removes the mountpoint.
+func mountSnapUnderRoot(backend Backend, rootDir, snapPath, mountPath string) (unmount func(), err error) {
+	// the mountpoint is computed once and used for mounting, unmounting
+	// and removing it alike; rootDir is "/" when really chrooted, but not
+	// when the global root directory is set, in which case unmounting
+	// mountPath alone would miss the mount and leak it
+	where := filepath.Join(rootDir, mountPath)
+	// the mountpoint and any of its parents created here are removed
+	// again, so that they do not end up in the preseeded image
+	topCreated := where
+	for {
+		parent := filepath.Dir(topCreated)
+		if parent == topCreated || osutil.IsDirectory(parent) {
+			break
+		}
+		topCreated = parent
+	}
+	if err := os.MkdirAll(where, 0755); err != nil {
+		return nil, err
+	}
+
+	removeMountpoint := func() {
+		for dir := where; ; dir = filepath.Dir(dir) {
+			if err := os.Remove(dir); err != nil {
+				fmt.Fprintf(Stderr, "%v", err)
+				return
+			}
+			if dir == topCreated {
+				return
+			}
+		}
+	}
+
+	fstype, fsopts := squashfs.FsType()
+	mountArgs := []string{"-t", fstype, "-o", strings.Join(fsopts, ","), snapPath, where}
+	if out, err := backend.Mount(mountArgs); err != nil {
+		removeMountpoint()
+		// gzip is supported by any kernel with squashfs, other
+		// compressions are optional and a common reason of failures
+		if comp, compErr := squashfsCompression(snapPath); compErr == nil && comp != "gzip" {
+			return nil, fmt.Errorf("cannot mount %s at %s in preseed mode: host kernel cannot mount %s squashfs, load a kernel module supporting it or extract the snap and preseed with SnapdRootDir\n'mount %s' failed with: %s",
+				snapPath, where, comp, strings.Join(mountArgs, " "), out)
+		}
+		return nil, fmt.Errorf("cannot mount %s at %s in preseed mode: %v\n'mount %s' failed with: %s", snapPath, where, err, strings.Join(mountArgs, " "), out)
+	}
+
+	return func() {
+		fmt.Fprintf(Stdout, "unmounting: %s\n", where)
+		if _, err := backend.Unmount(where); err != nil {
+			fmt.Fprintf(Stderr, "%v", err)
+		}
+		removeMountpoint()
+	}, nil
+}
+
+type preseedFilePatterns struct {
+	Exclude []string `json:"exclude"`
+	Include []string `json:"include"`
+}
+
+func createPreseedArtifact(opts *preseedOpts) error {
+	artifactPath := filepath.Join(opts.PrepareImageDir, "system-seed", "systems", opts.SystemLabel, "preseed.tgz")
+	systemData := filepath.Join(opts.WritableDir, "system-data")
+
+	patternsFile := filepath.Join(systemData, "var/lib/snapd/preseed-export.json")
+	pf, err := os.Open(patternsFile)
+	if err != nil {
+		return err
+	}
+
+	var patterns preseedFilePatterns
+	dec := json.NewDecoder(pf)
+	if err := dec.Decode(&patterns); err != nil {
+		return err
+	}
+
+	args := []string{"-czf", artifactPath, "-p", "-C", systemData}
+	for _, excl := range patterns.Exclude {
+		args = append(args, "--exclude", excl)
+	}
+	for _, incl := range patterns.Include {
+		// tar doesn't support globs for files to include, since we are not using shell we need to
+		// handle globs explicitly.
+		matches, err := filepath.Glob(filepath.Join(systemData, incl))
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			relPath, err := filepath.Rel(systemData, m)
+			if err != nil {
+				return err
+			}
+			args = append(args, relPath)
+		}
+	}
+
+	cmd := exec.Command("tar", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v (%s)", err, out)
+	}
+	return nil
+}
+
+// isNoSpaceError returns whether running snapd failed because the chroot ran
+// out of space, based on the error and the output of snapd.
+func isNoSpaceError(err error, output []byte) bool {
+	if errno, ok := err.(syscall.Errno); ok && errno == syscall.ENOSPC {
+		return true
+	}
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOSPC {
+		return true
+	}
+	return bytes.Contains(output, []byte(syscall.ENOSPC.Error()))
+}
+
+// offlineProxy is the address of the proxy used when preseeding offline,
+// nothing listens on the discard port so any network access of snapd
+// fails.
+const offlineProxy = "http://127.0.0.1:9"
+
+// networkEnv returns the environment of snapd in preseed mode controlling
+// its access to the store, which takes precedence over the extra
+// environment of the options.
+func networkEnv(opts *ClassicOptions) []string {
+	var env []string
+	proxy := opts.Proxy
+	if opts.Offline {
+		proxy = offlineProxy
+		env = append(env, "no_proxy=", "NO_PROXY=")
+	}
+	if proxy != "" {
+		for _, name := range []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY"} {
+			env = append(env, fmt.Sprintf("%s=%s", name, proxy))
+		}
+	}
+	if opts.StoreURL != "" {
+		env = append(env, fmt.Sprintf("SNAPPY_FORCE_API_URL=%s", opts.StoreURL))
+	}
+	return env
+}
+
+// straceCommand returns cmd wrapped with strace, tracing it together with
+// its children into output. If strace is not available, cmd is returned as
+// is.
+func straceCommand(cmd *exec.Cmd, output string) *exec.Cmd {
+	stracePath, err := exec.LookPath("strace")
+	if err != nil {
+		fmt.Fprintf(Stderr, "WARNING: cannot trace snapd, strace is not available: %v\n", err)
+		return cmd
+	}
+	args := append([]string{"-f", "-o", output, cmd.Path}, cmd.Args[1:]...)
+	return exec.Command(stracePath, args...)
+}
+
+// limitedCommand returns cmd wrapped with systemd-run, so that it runs in
+// a transient scope with the given CPU quota and memory limit, either of
+// which may be empty. If systemd-run is not available, cmd is returned as
+// is.
+func limitedCommand(cmd *exec.Cmd, cpuQuota, memoryMax string) *exec.Cmd {
+	systemdRunPath, err := exec.LookPath("systemd-run")
+	if err != nil {
+		fmt.Fprintf(Stderr, "WARNING: cannot limit resources of snapd, systemd-run is not available: %v\n", err)
+		return cmd
+	}
+	// a scope runs the command as a child of systemd-run, with its
+	// environment and standard streams
+	args := []string{"--scope", "--quiet", "--collect"}
+	if cpuQuota != "" {
+		args = append(args, "-p", "CPUQuota="+cpuQuota)
+	}
+	if memoryMax != "" {
+		args = append(args, "-p", "MemoryMax="+memoryMax)
+	}
+	args = append(args, "--", cmd.Path)
+	args = append(args, cmd.Args[1:]...)
+	return exec.Command(systemdRunPath, args...)
+}
+
+// snapdCommand returns the command running snapd at snapdPath in preseed
+// mode with the given options.
+func snapdCommand(snapdPath string, opts *ClassicOptions) *exec.Cmd {
+	cmd := exec.Command(snapdPath)
+	if opts.qemuUserPath != "" {
+		cmd = exec.Command(opts.qemuUserPath, snapdPath)
+	}
+	if opts.StraceOutput != "" {
+		cmd = straceCommand(cmd, opts.StraceOutput)
+	}
+	if opts.CPUQuota != "" || opts.MemoryMax != "" {
+		cmd = limitedCommand(cmd, opts.CPUQuota, opts.MemoryMax)
+	}
+	cmd.Env = os.Environ()
+	// extra environment is sorted for predictable ordering
+	envKeys := make([]string, 0, len(opts.Env))
+	for k := range opts.Env {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, opts.Env[k]))
+	}
+	cmd.Env = append(cmd.Env, networkEnv(opts)...)
+	cmd.Env = append(cmd.Env, "SNAPD_PRESEED=1")
+	return cmd
+}
+
+// runPreseedMode runs snapd in a preseed mode. It assumes running in a chroot.
+// The chroot is expected to be set-up and ready to use (critical system directories mounted).
+func runPreseedMode(preseedChroot string, targetSnapd *targetSnapdInfo, opts *ClassicOptions, appArmorCache *appArmorCacheFiles, ck *checkpoint) error {
+	if !ck.skip(stepImportAppArmorCache) {
+		if err := appArmorCache.importAppArmorCache(); err != nil {
+			return err
+		}
+		if err := ck.done(stepImportAppArmorCache); err != nil {
+			return err
+		}
+	}
+
+	// snapd is run again unless its state is there
+	if osutil.FileExists(dirs.SnapStateFile) && ck.skip(stepRunSnapd) {
+		return finishPreseedMode(opts, appArmorCache, ck)
+	}
+
+	if ck.resume && osutil.FileExists(dirs.SnapStateFile) {
+		// snapd picks up the seeding where the interrupted run left it
+		seeded, pending, err := seedProgress(dirs.SnapStateFile)
+		if err != nil {
+			return err
+		}
+		if len(seeded) > 0 {
+			fmt.Fprintf(Stdout, "resuming seeding, skipping snaps seeded by a previous run: %s\n", strings.Join(seeded, ", "))
+		}
+		if len(pending) > 0 {
+			fmt.Fprintf(Stdout, "resuming seeding of snaps: %s\n", strings.Join(pending, ", "))
+		}
+	}
+
+	// run snapd in preseed mode
+	cmd := snapdCommand(targetSnapd.path, opts)
+	// keep the output of snapd to detect some of the failures
+	var output bytes.Buffer
+	snapdStdout, snapdStderr := Stdout, Stderr
+	if opts.SnapdStdout != nil {
+		snapdStdout = opts.SnapdStdout
+	}
+	if opts.SnapdStderr != nil {
+		snapdStderr = opts.SnapdStderr
+	}
+	cmd.Stderr = io.MultiWriter(snapdStderr, &output)
+	cmd.Stdout = io.MultiWriter(snapdStdout, &output)
+
+	// note, snapdPath is relative to preseedChroot
+	fmt.Fprintf(Stdout, "starting to preseed root: %s\nusing snapd binary: %s (%s)\n", preseedChroot, targetSnapd.path, targetSnapd.version)
+
+	if err := opts.Backend.RunSnapd(cmd); err != nil {
+		if isNoSpaceError(err, output.Bytes()) {
+			// snapd leaves partial state behind, make sure the next
+			// attempt starts clean; note, running inside the chroot
+			resetOpts := &ResetOptions{ExtraArtifacts: opts.ExtraArtifacts}
+			if err := ResetPreseededChrootWithOptions("/", resetOpts); err != nil {
+				fmt.Fprintf(Stderr, "cannot reset partially preseeded chroot: %v\n", err)
+			}
+			return fmt.Errorf("preseeding failed: no space left in chroot")
+		}
+		return fmt.Errorf("error running snapd in preseed mode: %v\n", err)
+	}
+
+	// snapd exiting successfully without writing its state would leave
+	// the image unseeded; note, the state file is relative to preseedChroot
+	if st, err := os.Stat(dirs.SnapStateFile); err != nil || st.Size() == 0 {
+		return fmt.Errorf("preseeding reported success but no state was written")
+	}
+
+	// the checks of the result of preseeding are not fatal when preseeding
+	// best-effort, all their failures are reported at the end
+	var failures []string
+	nonFatal := func(err error) error {
+		if err != nil && opts.BestEffort {
+			failures = append(failures, err.Error())
+			return nil
+		}
+		return err
+	}
+	if opts.ValidateUdevRules {
+		if err := nonFatal(validateUdevRules()); err != nil {
+			return err
+		}
+	}
+	if err := nonFatal(checkAppArmorProfiles(opts)); err != nil {
+		return err
+	}
+	if opts.SnapConfineProfile {
+		if err := nonFatal(ensureSnapConfineProfile()); err != nil {
+			return err
+		}
+	}
+	if opts.AppArmorOnly {
+		if err := nonFatal(finishAppArmorOnly(opts)); err != nil {
+			return err
+		}
+		if err := ck.finish(); err != nil {
+			return err
+		}
+		return bestEffortError(failures)
+	}
+	if opts.ExpectedStateFormat != 0 {
+		if err := nonFatal(checkStateFormat(opts.ExpectedStateFormat)); err != nil {
+			return err
+		}
+	}
+	if opts.ValidateSeed {
+		if err := validateSeed(filepath.Join(dirs.SnapSeedDir, "seed.yaml")); err != nil {
+			if err := nonFatal(fmt.Errorf("invalid seed after preseeding: %v", err)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := ck.done(stepRunSnapd); err != nil {
+		return err
+	}
+
+	if err := finishPreseedMode(opts, appArmorCache, ck); err != nil {
+		return err
 	}
+	return bestEffortError(failures)
+}
 
-	// create mountpoint for core/snapd
-	where := filepath.Join(rootDir, snapdMountPath)
-	if err := os.MkdirAll(where, 0755); err != nil {
-		return nil, nil, err
+// bestEffortError returns an error listing the failures collected while
+// preseeding best-effort, or nil if there were none.
+func bestEffortError(failures []string) error {
+	if len(failures) == 0 {
+		return nil
 	}
+	return fmt.Errorf("preseeding completed with %d errors:\n - %s", len(failures), strings.Join(failures, "\n - "))
+}
 
-	removeMountpoint := func() {
-		if err := os.Remove(where); err != nil {
-			fmt.Fprintf(Stderr, "%v", err)
-		}
-	}
+var validateSeed = seed.ValidateFromYaml
 
-	fstype, fsopts := squashfs.FsType()
-	mountArgs := []string{"-t", fstype, "-o", strings.Join(fsopts, ","), coreSnapPath, where}
-	cmd := exec.Command("mount", mountArgs...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		removeMountpoint()
-		return nil, nil, fmt.Errorf("cannot mount %s at %s in preseed mode: %v\n'mount %s' failed with: %s", coreSnapPath, where, err, strings.Join(mountArgs, " "), out)
+// checkStateFormat verifies that the format version of the snapd state
+// written by preseeding matches the expected one. It assumes running in the
+// chroot.
+func checkStateFormat(expected int) error {
+	data, err := ioutil.ReadFile(dirs.SnapStateFile)
+	if err != nil {
+		return err
 	}
-
-	unmount := func() {
-		fmt.Fprintf(Stdout, "unmounting: %s\n", snapdMountPath)
-		cmd := exec.Command("umount", snapdMountPath)
-		if err := cmd.Run(); err != nil {
-			fmt.Fprintf(Stderr, "%v", err)
-		}
+	var st struct {
+		Format int `json:"format"`
 	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("cannot read snapd state format: %v", err)
+	}
+	if st.Format != expected {
+		return fmt.Errorf("preseeding wrote snapd state format %d, expected %d", st.Format, expected)
+	}
+	return nil
+}
 
-	targetSnapd, err := chooseTargetSnapdVersion()
+// seedConfinedSnaps returns the names of the snaps in the seed of the
+// classic system, other than the essential ones, which have apps or hooks
+// and are not using classic confinement, i.e. the snaps that get apparmor
+// profiles.
+var seedConfinedSnaps = func(seedDir string) ([]string, error) {
+	sd, err := loadSeed(seedDir, "")
 	if err != nil {
-		unmount()
-		removeMountpoint()
-		return nil, nil, err
+		return nil, err
 	}
-
-	return targetSnapd, func() {
-		unmount()
-		removeMountpoint()
-	}, nil
+	seedSnaps, err := sd.ModeSnaps("run")
+	if err != nil {
+		return nil, err
+	}
+	var confined []string
+	for _, sn := range seedSnaps {
+		if sn.Classic {
+			continue
+		}
+		snapf, err := snapfile.Open(sn.Path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := snap.ReadInfoFromSnapFile(snapf, sn.SideInfo)
+		if err != nil {
+			return nil, err
+		}
+		if len(info.Apps) > 0 || len(info.Hooks) > 0 {
+			confined = append(confined, sn.SnapName())
+		}
+	}
+	return confined, nil
 }
 
-type preseedFilePatterns struct {
-	Exclude []string `json:"exclude"`
-	Include []string `json:"include"`
+// checkAppArmorProfiles verifies that preseeding generated apparmor
+// profiles, if the seed has snaps that need them. Missing profiles usually
+// mean a misconfiguration of apparmor. It assumes running in the chroot.
+func checkAppArmorProfiles(opts *ClassicOptions) error {
+	profiles, err := filepath.Glob(filepath.Join(dirs.SnapAppArmorDir, "*"))
+	if err != nil {
+		return err
+	}
+	if len(profiles) > 0 {
+		return nil
+	}
+	confined, err := seedConfinedSnaps(dirs.SnapSeedDir)
+	if err != nil {
+		return fmt.Errorf("cannot check apparmor profiles: %v", err)
+	}
+	if len(confined) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("preseeding generated no apparmor profiles, but the seed has confined snaps: %s", strings.Join(confined, ", "))
+	if opts.RequireAppArmorProfiles {
+		return fmt.Errorf("%s", msg)
+	}
+	fmt.Fprintf(Stderr, "WARNING: %s\n", msg)
+	return nil
 }
 
-func createPreseedArtifact(opts *preseedOpts) error {
-	artifactPath := filepath.Join(opts.PrepareImageDir, "system-seed", "systems", opts.SystemLabel, "preseed.tgz")
-	systemData := filepath.Join(opts.WritableDir, "system-data")
-
-	patternsFile := filepath.Join(systemData, "var/lib/snapd/preseed-export.json")
-	pf, err := os.Open(patternsFile)
+// ensureSnapConfineProfile verifies that preseeding generated the apparmor
+// profile of snap-confine from the core/snapd snap and compiles it into the
+// apparmor cache if snapd did not, so that it does not need to be compiled
+// on first boot. It assumes running in the chroot.
+func ensureSnapConfineProfile() error {
+	profiles, err := filepath.Glob(filepath.Join(dirs.SnapAppArmorDir, "snap-confine.*"))
 	if err != nil {
 		return err
 	}
+	if len(profiles) == 0 {
+		return fmt.Errorf("preseeding generated no snap-confine apparmor profile")
+	}
+	for _, profile := range profiles {
+		cached := filepath.Join(apparmor_sandbox.CacheDir, filepath.Base(profile))
+		if osutil.FileExists(cached) {
+			continue
+		}
+		if err := os.MkdirAll(apparmor_sandbox.CacheDir, 0755); err != nil {
+			return err
+		}
+		cmd := exec.Command("apparmor_parser", "--skip-kernel-load", "--write-cache", "--cache-loc", apparmor_sandbox.CacheDir, "--quiet", profile)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("cannot compile snap-confine apparmor profile %s: %v", filepath.Base(profile), osutil.OutputErr(out, err))
+		}
+		if !osutil.FileExists(cached) {
+			return fmt.Errorf("snap-confine apparmor profile %s is missing from the apparmor cache", filepath.Base(profile))
+		}
+	}
+	return nil
+}
 
-	var patterns preseedFilePatterns
-	dec := json.NewDecoder(pf)
-	if err := dec.Decode(&patterns); err != nil {
+// finishAppArmorOnly compiles the apparmor profiles generated by preseeding
+// and removes all the other preseeding artifacts. It assumes running in the
+// chroot.
+func finishAppArmorOnly(opts *ClassicOptions) error {
+	profiles, err := filepath.Glob(filepath.Join(dirs.SnapAppArmorDir, "*"))
+	if err != nil {
 		return err
 	}
+	var failed []string
+	for _, profile := range profiles {
+		out, err := exec.Command("apparmor_parser", "--skip-kernel-load", "--skip-cache", "--quiet", profile).CombinedOutput()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", filepath.Base(profile), osutil.OutputErr(out, err)))
+		}
+	}
 
-	args := []string{"-czf", artifactPath, "-p", "-C", systemData}
-	for _, excl := range patterns.Exclude {
-		args = append(args, "--exclude", excl)
+	mountpoints := activeMountpoints()
+	specs := Artifacts()
+	for _, extra := range opts.ExtraArtifacts {
+		specs = append(specs, ArtifactSpec{Path: extra, Type: ArtifactGlob, Class: ArtifactClassExtra})
 	}
-	for _, incl := range patterns.Include {
-		// tar doesn't support globs for files to include, since we are not using shell we need to
-		// handle globs explicitly.
-		matches, err := filepath.Glob(filepath.Join(systemData, incl))
-		if err != nil {
-			return err
+	for _, spec := range specs {
+		if isAppArmorArtifact(spec) {
+			continue
 		}
-		for _, m := range matches {
-			relPath, err := filepath.Rel(systemData, m)
-			if err != nil {
-				return err
-			}
-			args = append(args, relPath)
+		if err := removeArtifact("/", spec, mountpoints); err != nil {
+			return err
 		}
 	}
 
-	cmd := exec.Command("tar", args...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("%v (%s)", err, out)
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot compile %d apparmor profiles:\n - %s", len(failed), strings.Join(failed, "\n - "))
 	}
 	return nil
 }
 
-// runPreseedMode runs snapd in a preseed mode. It assumes running in a chroot.
-// The chroot is expected to be set-up and ready to use (critical system directories mounted).
-func runPreseedMode(preseedChroot string, targetSnapd *targetSnapdInfo) error {
-	// run snapd in preseed mode
-	cmd := exec.Command(targetSnapd.path)
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "SNAPD_PRESEED=1")
-	cmd.Stderr = Stderr
-	cmd.Stdout = Stdout
-
-	// note, snapdPath is relative to preseedChroot
-	fmt.Fprintf(Stdout, "starting to preseed root: %s\nusing snapd binary: %s (%s)\n", preseedChroot, targetSnapd.path, targetSnapd.version)
+// isAppArmorArtifact returns whether spec describes the apparmor profiles,
+// including the snap-confine policy, or their cache.
+func isAppArmorArtifact(spec ArtifactSpec) bool {
+	return spec.Class == ArtifactClassAppArmor
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("error running snapd in preseed mode: %v\n", err)
+// finishPreseedMode processes the artifacts once snapd ran in preseed mode.
+// It assumes running in the chroot.
+func finishPreseedMode(opts *ClassicOptions, appArmorCache *appArmorCacheFiles, ck *checkpoint) error {
+	emitEvent(opts.Events, StageWriteArtifacts, "")
+	opts.spans.enter(StageWriteArtifacts)
+	if opts.Prune {
+		if err := pruneAndReport("/"); err != nil {
+			return err
+		}
 	}
-
-	return nil
+	if len(opts.UIDMap) > 0 || len(opts.GIDMap) > 0 {
+		if err := mapArtifactOwnership("/", opts.UIDMap, opts.GIDMap); err != nil {
+			return err
+		}
+	}
+	if !opts.SourceDateEpoch.IsZero() {
+		if err := normalizeArtifactTimes("/", opts.SourceDateEpoch); err != nil {
+			return err
+		}
+	}
+	if err := appArmorCache.exportAppArmorCache(); err != nil {
+		return err
+	}
+	return ck.finish()
 }
 
 func runUC20PreseedMode(opts *preseedOpts) error {
 	cmd := exec.Command("chroot", opts.PreseedChrootDir, "/usr/lib/snapd/snapd")
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "SNAPD_PRESEED=1")
+	// the seed may contain more than one system
+	cmd.Env = append(cmd.Env, fmt.Sprintf("SNAPD_PRESEED_SYSTEM_LABEL=%s", opts.SystemLabel))
 	cmd.Stderr = Stderr
 	cmd.Stdout = Stdout
-	fmt.Fprintf(Stdout, "starting to preseed UC20 system: %s", opts.PreseedChrootDir)
+	fmt.Fprintf(Stdout, "starting to preseed UC20 system: %s\n", opts.PreseedChrootDir)
 
+	emitEvent(opts.Events, StageRunSnapd, "/usr/lib/snapd/snapd")
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("error running snapd in preseed mode: %v\n", err)
 	}
 
+	emitEvent(opts.Events, StageWriteArtifacts, "")
 	if err := createPreseedArtifact(opts); err != nil {
 		return fmt.Errorf("cannot create preseed.tgz: %v", err)
 	}
@@ -538,33 +2152,303 @@ func runUC20PreseedMode(opts *preseedOpts) error {
 
 // Core20 runs preseeding of UC20 system prepared by prepare-image in prepareImageDir
 // and stores the resulting preseed preseed.tgz file in system-seed/systems/<systemlabel>/preseed.tgz.
-// Expects single systemlabel under systems directory.
-func Core20(prepareImageDir string) error {
-	var err error
+// Unless a system label is given in opts, expects single systemlabel under
+// systems directory. The opts argument may be nil.
+func Core20(prepareImageDir string, opts *CoreOptions) (err error) {
+	if opts == nil {
+		opts = &CoreOptions{}
+	}
+
+	defer func() {
+		if err != nil {
+			emitEvent(opts.Events, StageFailed, err.Error())
+		} else {
+			emitEvent(opts.Events, StageDone, "")
+		}
+	}()
+
 	prepareImageDir, err = filepath.Abs(prepareImageDir)
 	if err != nil {
 		return err
 	}
+	emitEvent(opts.Events, StageCheckChroot, prepareImageDir)
+	fmt.Fprintf(Stdout, "UC20 preseeding\n")
 
-	popts, cleanup, err := prepareCore20Chroot(prepareImageDir)
+	popts, cleanup, err := prepareCore20Chroot(prepareImageDir, opts)
 	if err != nil {
 		return err
 	}
 	defer cleanup()
+
+	// the preseed assertion is signed separately for the digest of
+	// preseed.tgz, which is regenerated below, an existing one is stale;
+	// it can be verified with VerifyPreseedAssertion once signed again
+	assertPath := preseedAssertionPath(prepareImageDir, popts.SystemLabel)
+	if err := os.Remove(assertPath); err == nil {
+		fmt.Fprintf(Stdout, "removed stale preseed assertion %s\n", assertPath)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove stale preseed assertion: %v", err)
+	}
+
 	return runUC20PreseedMode(popts)
 }
 
+// ClassicWithSeed is like Classic, but uses sd, the seed of the system at
+// chrootDir already opened by the caller, with its assertions and metadata
+// loaded, to find the snaps to mount instead of loading the seed again. The
+// paths of the seed snaps may be relative to the chroot or on the host.
+func ClassicWithSeed(chrootDir string, sd seed.Seed, opts *ClassicOptions) error {
+	if opts == nil {
+		opts = &ClassicOptions{}
+	}
+	if opts.RewriteSeed != nil {
+		return fmt.Errorf("cannot rewrite a seed which was already loaded")
+	}
+	optsWithSeed := *opts
+	optsWithSeed.loadedSeed = sd
+	return Classic(chrootDir, &optsWithSeed)
+}
+
 // Classic runs preseeding of a classic ubuntu system pointed by chrootDir.
-func Classic(chrootDir string) error {
-	var err error
+// The opts argument may be nil, in which case defaults are used.
+func Classic(chrootDir string, opts *ClassicOptions) (err error) {
+	if opts == nil {
+		opts = &ClassicOptions{}
+	}
+	if opts.Backend == nil {
+		optsWithBackend := *opts
+		optsWithBackend.Backend = realBackend{}
+		opts = &optsWithBackend
+	}
+	if opts.Tracer != nil {
+		optsWithSpans := *opts
+		optsWithSpans.spans = &stageSpans{tracer: opts.Tracer, chroot: chrootDir}
+		opts = &optsWithSpans
+	}
+
+	defer func() {
+		opts.spans.end(err)
+		if err != nil {
+			emitEvent(opts.Events, StageFailed, err.Error())
+		} else {
+			emitEvent(opts.Events, StageDone, "")
+		}
+	}()
+
+	cleanups := &cleanupStack{}
+	defer cleanups.run()
+	// the cleanups may run before the chroot is entered
+	chroot := &chrootTracker{}
+	switch {
+	case opts.parentCleanups != nil:
+		// the caller handles signals
+		opts.parentCleanups.push(cleanups.run)
+	case opts.HandleSignals:
+		stop := handleSignals(cleanups)
+		defer stop()
+	}
+
+	if opts.Offline && (opts.StoreURL != "" || opts.Proxy != "") {
+		return fmt.Errorf("cannot use a store or a proxy when preseeding offline")
+	}
+	if opts.AssertionsOnly && opts.AppArmorOnly {
+		return fmt.Errorf("cannot preseed only assertions and only apparmor profiles at the same time")
+	}
+	if opts.AppArmorOnly {
+		// only the apparmor profiles are kept, the options applied to the
+		// rest of the artifacts would have no effect
+		for _, conflict := range []struct {
+			what string
+			set  bool
+		}{
+			{"check the state format", opts.ExpectedStateFormat != 0},
+			{"validate the seed", opts.ValidateSeed},
+			{"export the apparmor cache", opts.ExportAppArmorCache != ""},
+			{"prune intermediate files", opts.Prune},
+			{"map the ownership of the artifacts", len(opts.UIDMap) > 0 || len(opts.GIDMap) > 0},
+			{"normalize the times of the artifacts", !opts.SourceDateEpoch.IsZero()},
+		} {
+			if conflict.set {
+				return fmt.Errorf("cannot %s when preseeding only apparmor profiles", conflict.what)
+			}
+		}
+	}
+	for _, mappings := range [][]IDMapping{opts.UIDMap, opts.GIDMap} {
+		for _, m := range mappings {
+			if m.Count == 0 {
+				return fmt.Errorf("cannot use id mapping %d:%d:%d, the count must not be 0", m.ID, m.TargetID, m.Count)
+			}
+		}
+	}
+
 	chrootDir, err = filepath.Abs(chrootDir)
 	if err != nil {
 		return err
 	}
 
-	if err := checkChroot(chrootDir); err != nil {
+	if opts.DryRun {
+		return dryRun(chrootDir, opts)
+	}
+
+	if opts.AssertionsOnly {
+		return preseedAssertions(chrootDir, opts)
+	}
+
+	emitEvent(opts.Events, StageCheckChroot, chrootDir)
+	if opts.spans != nil {
+		opts.spans.chroot = chrootDir
+	}
+	opts.spans.enter(StageCheckChroot)
+	mounts, err := checkChroot(chrootDir, opts.Resume)
+	if err != nil {
+		return err
+	}
+	for _, mnt := range mounts {
+		logger.Debugf("found required mountpoint %s: %s (%s)", mnt.MountDir, mnt.Source, mnt.FsType)
+	}
+
+	if err := checkMountPropagation(opts.Backend, chrootDir, opts.MakeMountsPrivate); err != nil {
+		return err
+	}
+
+	// snapd cannot load apparmor profiles through a read-only securityfs
+	securityfsReadOnly, err := isSecurityfsReadOnly(chrootDir)
+	if err != nil {
+		return err
+	}
+	if securityfsReadOnly && !opts.RemountSecurityfs {
+		return fmt.Errorf("cannot preseed with securityfs mounted read-only at %s, snapd would fail to load apparmor profiles", filepath.Join(chrootDir, "/sys/kernel/security"))
+	}
+
+	if !opts.AllowActiveSnapd {
+		if err := checkActiveSnapd(chrootDir); err != nil {
+			return err
+		}
+	}
+	if err := checkInhibitLocks(chrootDir, opts.inhibitDir()); err != nil {
+		return err
+	}
+
+	// the state is written to and reset on the separate filesystems,
+	// report them
+	dataMounts, err := separateDataMounts(chrootDir)
+	if err != nil {
+		return err
+	}
+	for _, mnt := range dataMounts {
+		fmt.Fprintf(Stdout, "%s is a separate mount: %s (%s)\n", mnt.MountDir, mnt.Source, mnt.FsType)
+	}
+
+	if opts.MountPath != "" {
+		if err := checkMountPath(chrootDir, opts.MountPath); err != nil {
+			return err
+		}
+	}
+	if opts.TempDir != "" {
+		if !filepath.IsAbs(opts.TempDir) {
+			return fmt.Errorf("cannot use %q as temporary directory: must be an absolute path inside the chroot", opts.TempDir)
+		}
+		if err := checkTempDir(filepath.Join(chrootDir, opts.TempDir)); err != nil {
+			return err
+		}
+	}
+
+	if err := checkChrootPathsContained(chrootDir, opts.mountPath()); err != nil {
+		return err
+	}
+
+	if err := cleanupStaleMounts(chrootDir, opts.mountPath(), opts.Backend); err != nil {
+		return err
+	}
+
+	if opts.SnapshotDir != "" {
+		if err := Snapshot(chrootDir, opts.SnapshotDir); err != nil {
+			return err
+		}
+	}
+
+	if opts.StateUpperDir != "" {
+		unmountOverlay, err := mountStateOverlay(opts.Backend, chrootDir, opts.StateUpperDir, chroot)
+		if err != nil {
+			return err
+		}
+		// runs last, after the chroot was set up and the mounts done
+		// by prepareClassicChroot were cleaned up
+		cleanups.push(unmountOverlay)
+	}
+
+	if opts.SeedDir != "" {
+		unmountSeed, err := bindMountSeed(opts.Backend, chrootDir, opts.SeedDir, chroot)
+		if err != nil {
+			return err
+		}
+		cleanups.push(unmountSeed)
+	}
+
+	if len(opts.TrustedAssertions) > 0 {
+		if err := verifySeedTrust(dirs.SnapSeedDirUnder(chrootDir), opts.TrustedAssertions); err != nil {
+			return err
+		}
+	}
+
+	if opts.SortSeedSnaps {
+		if err := sortSeedSnaps(filepath.Join(dirs.SnapSeedDirUnder(chrootDir), "seed.yaml")); err != nil {
+			return err
+		}
+	}
+
+	if err := checkOSRelease(chrootDir, opts.RequireMatchingRelease); err != nil {
+		return err
+	}
+	if err := checkAppArmorFeatures(chrootDir); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(Stdout, "ubuntu classic preseeding\n")
+
+	if opts.ReuseFrom != "" {
+		reused, err := reuseSecurityArtifacts(chrootDir, dirs.SnapSeedDirUnder(chrootDir), opts.ReuseFrom)
+		if err != nil {
+			return err
+		}
+		if len(reused) > 0 {
+			fmt.Fprintf(Stdout, "reusing artifacts of unchanged snaps: %s\n", strings.Join(reused, ", "))
+		}
+	}
+
+	// the files are on the host, open them before entering the chroot
+	appArmorCache, closeAppArmorCache, err := openAppArmorCacheFiles(opts)
+	if err != nil {
+		return err
+	}
+	cleanups.push(closeAppArmorCache)
+
+	if securityfsReadOnly {
+		restoreSecurityfs, err := remountSecurityfsWritable(opts.Backend, chrootDir, chroot)
+		if err != nil {
+			return err
+		}
+		cleanups.push(restoreSecurityfs)
+	}
+
+	if opts.AppArmorFeaturesDir != "" {
+		restoreFeatures, err := bindAppArmorFeatures(opts.Backend, chrootDir, opts.AppArmorFeaturesDir, chroot)
+		if err != nil {
+			return err
+		}
+		cleanups.push(restoreFeatures)
+	}
+
+	qemuUserPath, restoreEmulation, err := setupEmulation(opts.Backend, chrootDir, opts.QemuUserBinary, chroot)
+	if err != nil {
 		return err
 	}
+	cleanups.push(restoreEmulation)
+	if qemuUserPath != "" {
+		optsWithQemu := *opts
+		optsWithQemu.qemuUserPath = qemuUserPath
+		opts = &optsWithQemu
+	}
 
 	var targetSnapd *targetSnapdInfo
 
@@ -573,14 +2457,24 @@ func Classic(chrootDir string) error {
 	// beginning of prepareClassicChroot), then we could have a single
 	// runPreseedMode/runUC20PreseedMode function that handles both classic
 	// and core20.
-	targetSnapd, cleanup, err := prepareClassicChroot(chrootDir)
+	ck := &checkpoint{resume: opts.Resume}
+	targetSnapd, cleanup, err := prepareClassicChroot(chrootDir, opts, chroot, ck)
 	if err != nil {
 		return err
 	}
-	defer cleanup()
+	cleanups.push(func() {
+		emitEvent(opts.Events, StageCleanup, "")
+		opts.spans.enter(StageCleanup)
+		cleanup()
+	})
 
 	// executing inside the chroot
-	return runPreseedMode(chrootDir, targetSnapd)
+	emitEvent(opts.Events, StageRunSnapd, fmt.Sprintf("%s (%s)", targetSnapd.path, targetSnapd.version))
+	if opts.spans != nil {
+		opts.spans.snapdVersion = targetSnapd.version
+	}
+	opts.spans.enter(StageRunSnapd)
+	return runPreseedMode(chrootDir, targetSnapd, opts, appArmorCache, ck)
 }
 
 func MockSyscallChroot(f func(string) error) (restore func()) {
@@ -599,7 +2493,19 @@ func MockSnapdMountPath(path string) (restore func()) {
 	return func() { snapdMountPath = oldMountPath }
 }
 
-func MockSystemSnapFromSeed(f func(rootDir, sysLabel string) (string, string, error)) (restore func()) {
+// MockSeed replaces opening of the seed used by preseeding, so that code
+// integrating preseeding can be tested without real seeds, together with
+// FakeBackend. The function receives the seed directory, as seen from inside
+// the chroot, and the system label, if any.
+func MockSeed(f func(seedDir, label string) (seed.Seed, error)) (restore func()) {
+	osutil.MustBeTestBinary("mocking can be done only in tests")
+
+	oldSeedOpen := seedOpen
+	seedOpen = f
+	return func() { seedOpen = oldSeedOpen }
+}
+
+func MockSystemSnapFromSeed(f func(rootDir, sysLabel string) (string, []string, error)) (restore func()) {
 	osutil.MustBeTestBinary("mocking can be done only in tests")
 
 	oldSystemSnapFromSeed := systemSnapFromSeed
@@ -607,7 +2513,23 @@ func MockSystemSnapFromSeed(f func(rootDir, sysLabel string) (string, string, er
 	return func() { systemSnapFromSeed = oldSystemSnapFromSeed }
 }
 
-func MockMakePreseedTempDir(f func() (string, error)) (restore func()) {
+func MockSeedConfinedSnaps(f func(seedDir string) ([]string, error)) (restore func()) {
+	osutil.MustBeTestBinary("mocking can be done only in tests")
+
+	old := seedConfinedSnaps
+	seedConfinedSnaps = f
+	return func() { seedConfinedSnaps = old }
+}
+
+func MockEssentialSnapsFromSeed(f func(seedDir, sysLabel string, types []snap.Type) ([]string, error)) (restore func()) {
+	osutil.MustBeTestBinary("mocking can be done only in tests")
+
+	old := essentialSnapsFromSeed
+	essentialSnapsFromSeed = f
+	return func() { essentialSnapsFromSeed = old }
+}
+
+func MockMakePreseedTempDir(f func(baseDir string) (string, error)) (restore func()) {
 	osutil.MustBeTestBinary("mocking can be done only in tests")
 
 	old := makePreseedTempDir
@@ -617,7 +2539,7 @@ func MockMakePreseedTempDir(f func() (string, error)) (restore func()) {
 	}
 }
 
-func MockMakeWritableTempDir(f func() (string, error)) (restore func()) {
+func MockMakeWritableTempDir(f func(baseDir string) (string, error)) (restore func()) {
 	osutil.MustBeTestBinary("mocking can be done only in tests")
 
 	old := makeWritableTempDir
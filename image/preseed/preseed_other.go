@@ -23,14 +23,72 @@ package preseed
 
 import (
 	"errors"
+
+	"github.com/snapcore/snapd/seed"
 )
 
 var preseedNotAvailableError = errors.New("preseed mode not available for systems other than linux")
 
-func Classic(chrootDir string) error {
+func Classic(chrootDir string, opts *ClassicOptions) error {
+	return preseedNotAvailableError
+}
+
+func ClassicWithSeed(chrootDir string, sd seed.Seed, opts *ClassicOptions) error {
+	return preseedNotAvailableError
+}
+
+func ClassicImage(imageFile string, opts *ClassicOptions) error {
+	return preseedNotAvailableError
+}
+
+func ClassicFromTar(tarPath, workDir string, opts *ClassicFromTarOptions) error {
+	return preseedNotAvailableError
+}
+
+func DiskImage(imagePath string, opts *DiskImageOptions) error {
+	return preseedNotAvailableError
+}
+
+func ResolveSystemSnaps(seedDir, label string) (SystemSnaps, error) {
+	return SystemSnaps{}, preseedNotAvailableError
+}
+
+func ResolveSnapd(chrootDir, coreSnapPath string) (source string, version string, err error) {
+	return "", "", preseedNotAvailableError
+}
+
+func SnapdVersionFromSnap(snapPath string) (string, error) {
+	return "", preseedNotAvailableError
+}
+
+func SnapdInvocation(chrootDir string) (argv []string, env map[string]string, err error) {
+	return nil, nil, preseedNotAvailableError
+}
+
+func VersionAdvice(chrootDir string) (*Advice, error) {
+	return nil, preseedNotAvailableError
+}
+
+func AssertReadyForPreseed(chrootDir string) error {
+	return preseedNotAvailableError
+}
+
+func ExtractSnapd(snapPath, targetDir string) error {
+	return preseedNotAvailableError
+}
+
+func PrepareChrootMounts(chrootDir string) (cleanup func() error, err error) {
+	return nil, preseedNotAvailableError
+}
+
+func SelfTest(chrootDir string) error {
+	return preseedNotAvailableError
+}
+
+func VerifyPreseedAssertion(prepareImageDir, sysLabel string) error {
 	return preseedNotAvailableError
 }
 
-func Core20(chrootDir string) error {
+func Core20(chrootDir string, opts *CoreOptions) error {
 	return preseedNotAvailableError
 }
@@ -20,6 +20,7 @@
 package preseed_test
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -53,6 +54,9 @@ func (s *preseedSuite) SetUpTest(c *C) {
 	s.BaseTest.SetUpTest(c)
 	restore := squashfs.MockNeedsFuse(false)
 	s.BaseTest.AddCleanup(restore)
+	// most tests have no seed and their mocked snapd writes no profiles
+	restore = preseed.MockSeedConfinedSnaps(func(string) ([]string, error) { return nil, nil })
+	s.BaseTest.AddCleanup(restore)
 }
 
 func (s *preseedSuite) TearDownTest(c *C) {
@@ -66,6 +70,8 @@ type Fake16Seed struct {
 	LoadMetaErr       error
 	LoadAssertionsErr error
 	UsesSnapd         bool
+	RunModeSnaps      []*seed.Snap
+	Assertions        []asserts.Assertion
 }
 
 func mockChrootDirs(c *C, rootDir string, apparmorDir bool) func() {
@@ -95,7 +101,19 @@ func mockClassicModel() *asserts.Model {
 }
 
 func (fs *Fake16Seed) LoadAssertions(db asserts.RODatabase, commitTo func(*asserts.Batch) error) error {
-	return fs.LoadAssertionsErr
+	if fs.LoadAssertionsErr != nil {
+		return fs.LoadAssertionsErr
+	}
+	if commitTo == nil || len(fs.Assertions) == 0 {
+		return nil
+	}
+	b := asserts.NewBatch(nil)
+	for _, a := range fs.Assertions {
+		if err := b.Add(a); err != nil {
+			return err
+		}
+	}
+	return commitTo(b)
 }
 
 func (fs *Fake16Seed) Model() *asserts.Model {
@@ -130,7 +148,7 @@ func (fs *Fake16Seed) EssentialSnaps() []*seed.Snap {
 }
 
 func (fs *Fake16Seed) ModeSnaps(mode string) ([]*seed.Snap, error) {
-	return nil, nil
+	return fs.RunModeSnaps, nil
 }
 
 func (fs *Fake16Seed) NumSnaps() int {
@@ -144,7 +162,7 @@ func (fs *Fake16Seed) Iter(f func(sn *seed.Snap) error) error {
 func (s *preseedSuite) TestSystemSnapFromSeed(c *C) {
 	tmpDir := c.MkDir()
 
-	restore := preseed.MockSeedOpen(func(rootDir, label string) (seed.Seed, error) {
+	restore := preseed.MockSeed(func(rootDir, label string) (seed.Seed, error) {
 		return &Fake16Seed{
 			AssertsModel: mockClassicModel(),
 			Essential:    []*seed.Snap{{Path: "/some/path/core", SideInfo: &snap.SideInfo{RealName: "core"}}},
@@ -152,15 +170,23 @@ func (s *preseedSuite) TestSystemSnapFromSeed(c *C) {
 	})
 	defer restore()
 
+	var stdout bytes.Buffer
+	oldStdout := preseed.Stdout
+	preseed.Stdout = &stdout
+	defer func() { preseed.Stdout = oldStdout }()
+
 	path, _, err := preseed.SystemSnapFromSeed(tmpDir, "")
 	c.Assert(err, IsNil)
 	c.Check(path, Equals, "/some/path/core")
+	// looking up the system snap is silent, it is also used without
+	// preseeding
+	c.Check(stdout.String(), Equals, "")
 }
 
 func (s *preseedSuite) TestSystemSnapFromSnapdSeed(c *C) {
 	tmpDir := c.MkDir()
 
-	restore := preseed.MockSeedOpen(func(rootDir, label string) (seed.Seed, error) {
+	restore := preseed.MockSeed(func(rootDir, label string) (seed.Seed, error) {
 		return &Fake16Seed{
 			AssertsModel: mockClassicModel(),
 			Essential:    []*seed.Snap{{Path: "/some/path/snapd.snap", SideInfo: &snap.SideInfo{RealName: "snapd"}}},
@@ -174,10 +200,33 @@ func (s *preseedSuite) TestSystemSnapFromSnapdSeed(c *C) {
 	c.Check(path, Equals, "/some/path/snapd.snap")
 }
 
+func (s *preseedSuite) TestSystemSnapFromSeedMultipleBases(c *C) {
+	tmpDir := c.MkDir()
+
+	restore := preseed.MockSeed(func(rootDir, label string) (seed.Seed, error) {
+		return &Fake16Seed{
+			AssertsModel: mockClassicModel(),
+			Essential: []*seed.Snap{
+				{Path: "/some/path/snapd.snap", SideInfo: &snap.SideInfo{RealName: "snapd"}},
+				{Path: "/some/path/core18.snap", SideInfo: &snap.SideInfo{RealName: "core18"}, EssentialType: "base"},
+				{Path: "/some/path/core20.snap", SideInfo: &snap.SideInfo{RealName: "core20"}, EssentialType: "base"},
+				{Path: "/some/path/core18.snap", SideInfo: &snap.SideInfo{RealName: "core18"}, EssentialType: "base"},
+			},
+			UsesSnapd: true,
+		}, nil
+	})
+	defer restore()
+
+	path, bases, err := preseed.SystemSnapFromSeed(tmpDir, "")
+	c.Assert(err, IsNil)
+	c.Check(path, Equals, "/some/path/snapd.snap")
+	c.Check(bases, DeepEquals, []string{"/some/path/core18.snap", "/some/path/core20.snap"})
+}
+
 func (s *preseedSuite) TestSystemSnapFromSeedOpenError(c *C) {
 	tmpDir := c.MkDir()
 
-	restore := preseed.MockSeedOpen(func(rootDir, label string) (seed.Seed, error) { return nil, fmt.Errorf("fail") })
+	restore := preseed.MockSeed(func(rootDir, label string) (seed.Seed, error) { return nil, fmt.Errorf("fail") })
 	defer restore()
 
 	_, _, err := preseed.SystemSnapFromSeed(tmpDir, "")
@@ -190,7 +239,7 @@ func (s *preseedSuite) TestSystemSnapFromSeedErrors(c *C) {
 	fakeSeed := &Fake16Seed{}
 	fakeSeed.AssertsModel = mockClassicModel()
 
-	restore := preseed.MockSeedOpen(func(rootDir, label string) (seed.Seed, error) { return fakeSeed, nil })
+	restore := preseed.MockSeed(func(rootDir, label string) (seed.Seed, error) { return fakeSeed, nil })
 	defer restore()
 
 	fakeSeed.Essential = []*seed.Snap{{Path: "", SideInfo: &snap.SideInfo{RealName: "core"}}}
@@ -211,6 +260,73 @@ func (s *preseedSuite) TestSystemSnapFromSeedErrors(c *C) {
 	c.Assert(err, ErrorMatches, "load assertions failed")
 }
 
+func (s *preseedSuite) TestResolveSystemSnapsClassic(c *C) {
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		c.Check(seedDir, Equals, "/seed")
+		c.Check(label, Equals, "")
+		return &Fake16Seed{
+			AssertsModel: mockClassicModel(),
+			Essential: []*seed.Snap{
+				{Path: "/seed/snaps/core_10.snap", SideInfo: &snap.SideInfo{RealName: "core", Revision: snap.R(10)}, EssentialType: snap.TypeOS},
+			},
+		}, nil
+	})
+	defer restore()
+
+	systemSnaps, err := preseed.ResolveSystemSnaps("/seed", "")
+	c.Assert(err, IsNil)
+	core := preseed.SeedSnap{Name: "core", Path: "/seed/snaps/core_10.snap", Revision: snap.R(10)}
+	c.Check(systemSnaps, DeepEquals, preseed.SystemSnaps{
+		Snapd: core,
+		Base:  core,
+	})
+}
+
+func (s *preseedSuite) TestResolveSystemSnapsCore(c *C) {
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		c.Check(label, Equals, "20220401")
+		return &Fake16Seed{
+			AssertsModel: mockUC20Model(),
+			Essential: []*seed.Snap{
+				{Path: "/seed/snaps/snapd_1.snap", SideInfo: &snap.SideInfo{RealName: "snapd", Revision: snap.R(1)}, EssentialType: snap.TypeSnapd},
+				{Path: "/seed/snaps/pc-kernel_2.snap", SideInfo: &snap.SideInfo{RealName: "pc-kernel", Revision: snap.R(2)}, EssentialType: snap.TypeKernel},
+				{Path: "/seed/snaps/core20_3.snap", SideInfo: &snap.SideInfo{RealName: "core20", Revision: snap.R(3)}, EssentialType: snap.TypeBase},
+				{Path: "/seed/snaps/pc_4.snap", SideInfo: &snap.SideInfo{RealName: "pc", Revision: snap.R(4)}, EssentialType: snap.TypeGadget},
+			},
+			UsesSnapd: true,
+		}, nil
+	})
+	defer restore()
+
+	systemSnaps, err := preseed.ResolveSystemSnaps("/seed", "20220401")
+	c.Assert(err, IsNil)
+	c.Check(systemSnaps, DeepEquals, preseed.SystemSnaps{
+		Snapd:  preseed.SeedSnap{Name: "snapd", Path: "/seed/snaps/snapd_1.snap", Revision: snap.R(1)},
+		Base:   preseed.SeedSnap{Name: "core20", Path: "/seed/snaps/core20_3.snap", Revision: snap.R(3)},
+		Kernel: &preseed.SeedSnap{Name: "pc-kernel", Path: "/seed/snaps/pc-kernel_2.snap", Revision: snap.R(2)},
+		Gadget: &preseed.SeedSnap{Name: "pc", Path: "/seed/snaps/pc_4.snap", Revision: snap.R(4)},
+	})
+}
+
+func (s *preseedSuite) TestResolveSystemSnapsErrors(c *C) {
+	fakeSeed := &Fake16Seed{AssertsModel: mockUC20Model(), UsesSnapd: true}
+	restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) { return fakeSeed, nil })
+	defer restore()
+
+	_, err := preseed.ResolveSystemSnaps("/seed", "20220401")
+	c.Check(err, ErrorMatches, "snapd snap not found")
+
+	fakeSeed.Essential = []*seed.Snap{
+		{Path: "/seed/snaps/snapd_1.snap", SideInfo: &snap.SideInfo{RealName: "snapd", Revision: snap.R(1)}, EssentialType: snap.TypeSnapd},
+	}
+	_, err = preseed.ResolveSystemSnaps("/seed", "20220401")
+	c.Check(err, ErrorMatches, "core20 snap not found")
+
+	fakeSeed.LoadMetaErr = fmt.Errorf("load meta failed")
+	_, err = preseed.ResolveSystemSnaps("/seed", "20220401")
+	c.Check(err, ErrorMatches, "load meta failed")
+}
+
 func (s *preseedSuite) TestChooseTargetSnapdVersion(c *C) {
 	tmpDir := c.MkDir()
 	dirs.SetRootDir(tmpDir)
@@ -278,7 +394,7 @@ func (s *preseedSuite) TestChooseTargetSnapdVersion(c *C) {
 			c.Assert(ioutil.WriteFile(infoFile, []byte(fmt.Sprintf("VERSION=%s", test.fromSnap)), 0644), IsNil)
 		}
 
-		targetSnapd, err := preseed.ChooseTargetSnapdVersion()
+		targetSnapd, err := preseed.ChooseTargetSnapdVersion(targetSnapdRoot)
 		if test.expectedErr != "" {
 			c.Assert(err, ErrorMatches, test.expectedErr)
 		} else {
@@ -328,3 +444,49 @@ func (s *preseedSuite) TestCreatePreseedArtifact(c *C) {
 			filepath.Join(writableDir, "system-data"), "--exclude", "/etc/bar/x*", "etc/bar/a", "baz/b"},
 	})
 }
+
+func mockCoreSnapDir(c *C, snapdVersion string) string {
+	snapDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(snapDir, "meta"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(snapDir, "meta/snap.yaml"), []byte("name: core\nversion: 1\ntype: os\n"), 0644), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(snapDir, "usr/lib/snapd"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(snapDir, "usr/lib/snapd/info"), []byte("VERSION="+snapdVersion), 0644), IsNil)
+	return snapDir
+}
+
+func (s *preseedSuite) TestResolveSnapd(c *C) {
+	for _, tc := range []struct {
+		fromSnap        string
+		fromDeb         string
+		expectedSource  string
+		expectedVersion string
+	}{
+		// snap newer
+		{"2.45.3", "2.44.0", preseed.SnapdSourceSnap, "2.45.3"},
+		// deb newer
+		{"2.44.0", "2.45.2+20.04", preseed.SnapdSourceDeb, "2.45.2+20.04"},
+		// tie, snap wins
+		{"2.45.1", "2.45.1", preseed.SnapdSourceSnap, "2.45.1"},
+	} {
+		chrootDir := c.MkDir()
+		c.Assert(os.MkdirAll(filepath.Join(chrootDir, "usr/lib/snapd"), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(chrootDir, "usr/lib/snapd/info"), []byte("VERSION="+tc.fromDeb), 0644), IsNil)
+		coreSnap := mockCoreSnapDir(c, tc.fromSnap)
+
+		source, version, err := preseed.ResolveSnapd(chrootDir, coreSnap)
+		c.Assert(err, IsNil)
+		c.Check(source, Equals, tc.expectedSource)
+		c.Check(version, Equals, tc.expectedVersion)
+	}
+}
+
+func (s *preseedSuite) TestResolveSnapdErrors(c *C) {
+	chrootDir := c.MkDir()
+	coreSnap := mockCoreSnapDir(c, "2.45.1")
+
+	_, _, err := preseed.ResolveSnapd(chrootDir, coreSnap)
+	c.Check(err, ErrorMatches, `cannot open snapd info file ".*/usr/lib/snapd/info".*`)
+
+	_, _, err = preseed.ResolveSnapd(chrootDir, filepath.Join(chrootDir, "missing.snap"))
+	c.Check(err, ErrorMatches, `".*/missing.snap" is not a snap or snapdir`)
+}
@@ -27,9 +27,13 @@ import (
 
 	. "gopkg.in/check.v1"
 
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
 	"github.com/snapcore/snapd/dirs"
 	"github.com/snapcore/snapd/image/preseed"
 	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
 	"github.com/snapcore/snapd/testutil"
 )
 
@@ -48,13 +52,13 @@ func (s *preseedSuite) TestRunPreseedUC20Happy(c *C) {
 	defer mockUmountCmd.Restore()
 
 	preseedTmpDir := filepath.Join(tmpDir, "preseed-tmp")
-	restoreMakePreseedTmpDir := preseed.MockMakePreseedTempDir(func() (string, error) {
+	restoreMakePreseedTmpDir := preseed.MockMakePreseedTempDir(func(string) (string, error) {
 		return preseedTmpDir, nil
 	})
 	defer restoreMakePreseedTmpDir()
 
 	writableTmpDir := filepath.Join(tmpDir, "writable-tmp")
-	restoreMakeWritableTempDir := preseed.MockMakeWritableTempDir(func() (string, error) {
+	restoreMakeWritableTempDir := preseed.MockMakeWritableTempDir(func(string) (string, error) {
 		return writableTmpDir, nil
 	})
 	defer restoreMakeWritableTempDir()
@@ -85,18 +89,46 @@ func (s *preseedSuite) TestRunPreseedUC20Happy(c *C) {
 	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
 	defer restoreMountPath()
 
-	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, string, error) { return "/a/snapd.snap", "/a/base.snap", nil })
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return "/a/snapd.snap", []string{"/a/base.snap"}, nil })
 	defer restoreSystemSnapFromSeed()
 
+	restoreEssentialSnaps := preseed.MockEssentialSnapsFromSeed(func(seedDir, sysLabel string, types []snap.Type) ([]string, error) {
+		c.Check(types, DeepEquals, []snap.Type{snap.TypeKernel, snap.TypeGadget})
+		return []string{"/a/pc-kernel.snap", "/a/pc.snap"}, nil
+	})
+	defer restoreEssentialSnaps()
+
 	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+	// the assertion of a previous run does not match the new preseed.tgz
+	staleAssertion := filepath.Join(tmpDir, "system-seed/systems/20220203/preseed")
+	c.Assert(ioutil.WriteFile(staleAssertion, []byte("stale"), 0644), IsNil)
+
+	events := make(chan preseed.PreseedEvent, 10)
+	c.Assert(preseed.Core20(tmpDir, &preseed.CoreOptions{Events: events}), IsNil)
+	close(events)
 
-	c.Assert(preseed.Core20(tmpDir), IsNil)
+	c.Check(staleAssertion, testutil.FileAbsent)
 
 	c.Check(mockChootCmd.Calls()[0], DeepEquals, []string{"chroot", preseedTmpDir, "/usr/lib/snapd/snapd"})
 
+	var stages []preseed.Stage
+	for ev := range events {
+		stages = append(stages, ev.Stage)
+	}
+	c.Check(stages, DeepEquals, []preseed.Stage{
+		preseed.StageCheckChroot,
+		preseed.StageMountSnapd,
+		preseed.StageRunSnapd,
+		preseed.StageWriteArtifacts,
+		preseed.StageCleanup,
+		preseed.StageDone,
+	})
+
 	c.Check(mockMountCmd.Calls(), DeepEquals, [][]string{
 		{"mount", "-o", "loop", "/a/base.snap", preseedTmpDir},
 		{"mount", "-o", "loop", "/a/snapd.snap", targetSnapdRoot},
+		{"mount", "-o", "loop", "/a/pc-kernel.snap", targetSnapdRoot + "-pc-kernel"},
+		{"mount", "-o", "loop", "/a/pc.snap", targetSnapdRoot + "-pc"},
 		{"mount", "-t", "tmpfs", "tmpfs", filepath.Join(preseedTmpDir, "run")},
 		{"mount", "-t", "tmpfs", "tmpfs", filepath.Join(preseedTmpDir, "var/tmp")},
 		{"mount", "--bind", filepath.Join(preseedTmpDir, "/var/tmp"), filepath.Join(preseedTmpDir, "tmp")},
@@ -141,6 +173,8 @@ func (s *preseedSuite) TestRunPreseedUC20Happy(c *C) {
 		{"umount", filepath.Join(preseedTmpDir, "tmp")},
 		{"umount", filepath.Join(preseedTmpDir, "var/tmp")},
 		{"umount", filepath.Join(preseedTmpDir, "run")},
+		{"umount", filepath.Join(tmpDir, "target-core-mounted-here-pc")},
+		{"umount", filepath.Join(tmpDir, "target-core-mounted-here-pc-kernel")},
 		{"umount", filepath.Join(tmpDir, "target-core-mounted-here")},
 		{"umount", preseedTmpDir},
 		// from handle-writable-paths
@@ -150,3 +184,220 @@ func (s *preseedSuite) TestRunPreseedUC20Happy(c *C) {
 	// validity check; -1 to account for handle-writable-paths mock which doesn’t trigger mount in the test
 	c.Check(len(mockMountCmd.Calls()), Equals, len(mockUmountCmd.Calls())-1)
 }
+
+func (s *preseedSuite) TestRunPreseedUC20MultipleSystems(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+
+	mockMountCmd := testutil.MockCommand(c, "mount", "")
+	defer mockMountCmd.Restore()
+
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220401"), 0755), IsNil)
+
+	c.Check(preseed.Core20(tmpDir, nil), ErrorMatches, `cannot select the system for preseeding, found multiple systems: 20220203, 20220401`)
+	c.Check(preseed.Core20(tmpDir, &preseed.CoreOptions{SysLabel: "20220501"}), ErrorMatches,
+		`cannot find system "20220501" for preseeding, available systems: 20220203, 20220401`)
+
+	c.Check(mockMountCmd.Calls(), HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedUC20SystemLabel(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220401"), 0755), IsNil)
+
+	var seedLabel string
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(seedDir, sysLabel string) (string, []string, error) {
+		c.Check(seedDir, Equals, filepath.Join(tmpDir, "system-seed"))
+		seedLabel = sysLabel
+		return "", nil, fmt.Errorf("stop here")
+	})
+	defer restoreSystemSnapFromSeed()
+
+	c.Check(preseed.Core20(tmpDir, &preseed.CoreOptions{SysLabel: "20220401"}), ErrorMatches, "stop here")
+	c.Check(seedLabel, Equals, "20220401")
+}
+
+func (s *preseedSuite) TestRunPreseedUC20TempDir(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(seedDir, sysLabel string) (string, []string, error) {
+		return "/a/snapd.snap", []string{"/a/core20.snap"}, nil
+	})
+	defer restoreSystemSnapFromSeed()
+	restoreEssentialSnaps := preseed.MockEssentialSnapsFromSeed(func(seedDir, sysLabel string, types []snap.Type) ([]string, error) {
+		return nil, nil
+	})
+	defer restoreEssentialSnaps()
+
+	tempDir := c.MkDir()
+	var preseedTmpDir string
+	restoreMakePreseedTmpDir := preseed.MockMakePreseedTempDir(func(baseDir string) (string, error) {
+		c.Check(baseDir, Equals, tempDir)
+		var err error
+		preseedTmpDir, err = ioutil.TempDir(baseDir, "preseed-")
+		return preseedTmpDir, err
+	})
+	defer restoreMakePreseedTmpDir()
+	restoreMakeWritableTempDir := preseed.MockMakeWritableTempDir(func(baseDir string) (string, error) {
+		c.Check(baseDir, Equals, tempDir)
+		return "", fmt.Errorf("stop here")
+	})
+	defer restoreMakeWritableTempDir()
+
+	err := preseed.Core20(tmpDir, &preseed.CoreOptions{TempDir: tempDir})
+	c.Check(err, ErrorMatches, "cannot prepare uc20 chroot: stop here")
+	c.Check(filepath.Dir(preseedTmpDir), Equals, tempDir)
+	// the temporary directories are removed on errors
+	c.Check(preseedTmpDir, testutil.FileAbsent)
+
+	err = preseed.Core20(tmpDir, &preseed.CoreOptions{TempDir: filepath.Join(tempDir, "missing")})
+	c.Check(err, ErrorMatches, `cannot use ".*/missing" as temporary directory: it does not exist`)
+}
+
+func (s *preseedSuite) TestRunPreseedUC20AppArmorKernelFeaturesDir(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+
+	// stop once the writable directory is to be mounted
+	mockMountCmd := testutil.MockCommand(c, "mount", `
+case "$*" in
+    *"/writable") exit 1;;
+esac`)
+	defer mockMountCmd.Restore()
+	mockUmountCmd := testutil.MockCommand(c, "umount", "")
+	defer mockUmountCmd.Restore()
+	defer osutil.MockMountInfo("")()
+
+	preseedTmpDir := filepath.Join(tmpDir, "preseed-tmp")
+	defer preseed.MockMakePreseedTempDir(func(string) (string, error) {
+		return preseedTmpDir, os.MkdirAll(preseedTmpDir, 0755)
+	})()
+	writableTmpDir := filepath.Join(tmpDir, "writable-tmp")
+	defer preseed.MockMakeWritableTempDir(func(string) (string, error) {
+		return writableTmpDir, os.MkdirAll(writableTmpDir, 0755)
+	})()
+	targetSnapdRoot := filepath.Join(tmpDir, "target-core-mounted-here")
+	defer preseed.MockSnapdMountPath(targetSnapdRoot)()
+	defer preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) {
+		return "/a/snapd.snap", []string{"/a/base.snap"}, nil
+	})()
+	defer preseed.MockEssentialSnapsFromSeed(func(string, string, []snap.Type) ([]string, error) {
+		return nil, nil
+	})()
+
+	featuresDir := c.MkDir()
+	err := preseed.Core20(tmpDir, &preseed.CoreOptions{AppArmorKernelFeaturesDir: featuresDir})
+	c.Assert(err, ErrorMatches, "cannot prepare uc20 mountpoints: cannot prepare mountpoint in preseed mode: .*")
+
+	features := filepath.Join(preseedTmpDir, "sys/kernel/security/apparmor/features")
+	calls := mockMountCmd.Calls()
+	c.Assert(len(calls) >= 4, Equals, true)
+	c.Check(calls[len(calls)-4], DeepEquals, []string{"mount", "-t", "securityfs", "securityfs", filepath.Join(preseedTmpDir, "sys/kernel/security")})
+	// bind mounted and then made read-only, as done for classic
+	c.Check(calls[len(calls)-3], DeepEquals, []string{"mount", "--bind", featuresDir, features})
+	c.Check(calls[len(calls)-2], DeepEquals, []string{"mount", "-o", "remount,bind,ro", features})
+	c.Check(calls[len(calls)-1], DeepEquals, []string{"mount", "--bind", writableTmpDir, filepath.Join(preseedTmpDir, "writable")})
+	// the features are unmounted before securityfs
+	umounts := mockUmountCmd.Calls()
+	c.Assert(len(umounts) >= 2, Equals, true)
+	c.Check(umounts[0], DeepEquals, []string{"umount", features})
+	c.Check(umounts[1], DeepEquals, []string{"umount", filepath.Join(preseedTmpDir, "sys/kernel/security")})
+}
+
+func (s *preseedSuite) TestRunPreseedUC20AppArmorKernelFeaturesDirMissing(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+	mockMountCmd := testutil.MockCommand(c, "mount", "")
+	defer mockMountCmd.Restore()
+
+	err := preseed.Core20(tmpDir, &preseed.CoreOptions{AppArmorKernelFeaturesDir: "/non-existing"})
+	c.Check(err, ErrorMatches, "cannot use apparmor features from /non-existing: not a directory")
+	c.Check(mockMountCmd.Calls(), HasLen, 0)
+}
+
+func mockUC20Model() *asserts.Model {
+	headers := map[string]interface{}{
+		"type":         "model",
+		"authority-id": "brand",
+		"series":       "16",
+		"brand-id":     "brand",
+		"model":        "baz-3000",
+		"architecture": "amd64",
+		"base":         "core20",
+		"grade":        "dangerous",
+		"timestamp":    "2018-01-01T08:00:00+00:00",
+		"snaps": []interface{}{
+			map[string]interface{}{
+				"name":            "pc-kernel",
+				"id":              "pckernelidididididididididididid",
+				"type":            "kernel",
+				"default-channel": "20",
+			},
+			map[string]interface{}{
+				"name":            "pc",
+				"id":              "pcididididididididididididididid",
+				"type":            "gadget",
+				"default-channel": "20",
+			},
+		},
+	}
+	return assertstest.FakeAssertion(headers).(*asserts.Model)
+}
+
+func (s *preseedSuite) TestRunPreseedUC20GadgetMismatch(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+
+	mockMountCmd := testutil.MockCommand(c, "mount", "")
+	defer mockMountCmd.Restore()
+
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+
+	for _, tc := range []struct {
+		gadget  *seed.Snap
+		snapErr string
+	}{
+		{
+			gadget:  &seed.Snap{Path: "/a/other-gadget.snap", SideInfo: &snap.SideInfo{RealName: "other-gadget"}, EssentialType: snap.TypeGadget, Channel: "20"},
+			snapErr: `gadget mismatch: model requires gadget "pc" but the seed has "other-gadget"`,
+		},
+		{
+			gadget:  &seed.Snap{Path: "/a/pc.snap", SideInfo: &snap.SideInfo{RealName: "pc"}, EssentialType: snap.TypeGadget, Channel: "22/stable"},
+			snapErr: `gadget mismatch: model requires track "20" of gadget "pc" but the seed has "22"`,
+		},
+		{
+			gadget:  nil,
+			snapErr: `gadget mismatch: model requires gadget "pc" but the seed has none`,
+		},
+	} {
+		essential := []*seed.Snap{
+			{Path: "/a/snapd.snap", SideInfo: &snap.SideInfo{RealName: "snapd"}, EssentialType: snap.TypeSnapd},
+		}
+		if tc.gadget != nil {
+			essential = append(essential, tc.gadget)
+		}
+		restore := preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+			c.Check(seedDir, Equals, filepath.Join(tmpDir, "system-seed"))
+			c.Check(label, Equals, "20220203")
+			return &Fake16Seed{
+				AssertsModel: mockUC20Model(),
+				Essential:    essential,
+				UsesSnapd:    true,
+			}, nil
+		})
+
+		c.Check(preseed.Core20(tmpDir, &preseed.CoreOptions{ValidateGadget: true}), ErrorMatches, tc.snapErr)
+		restore()
+	}
+
+	// the guard fired before anything got mounted
+	c.Check(mockMountCmd.Calls(), HasLen, 0)
+}
@@ -0,0 +1,97 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/snapcore/snapd/strutil"
+)
+
+// atomicWriteLeftover matches the names of the temporary files
+// osutil.AtomicWriteFile writes before renaming them into place. They are
+// left behind when snapd is interrupted while writing e.g. its state, an
+// apparmor profile or its compiled cache, and are never read.
+var atomicWriteLeftover = regexp.MustCompile(`^.+\.[BCDFGHJKLMNPQRSTVWXYbcdfghjklmnpqrstvwxy0-9]{12}~$`)
+
+// pruneArtifacts removes the intermediate files snapd left behind next to
+// or inside of the preseed artifacts under rootDir, which are not needed at
+// runtime. The artifacts themselves, including the compiled apparmor
+// cache, are kept. It returns the removed files, relative to rootDir, and
+// the number of bytes saved.
+func pruneArtifacts(rootDir string) (pruned []string, saved int64, err error) {
+	candidates := make(map[string]bool)
+	for _, pattern := range ArtifactPatterns() {
+		matches, err := filepath.Glob(filepath.Join(rootDir, filepath.Dir(pattern), "*~"))
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, match := range matches {
+			candidates[match] = true
+		}
+	}
+	err = walkArtifacts(rootDir, func(path, rel string, info os.FileInfo) error {
+		candidates[path] = true
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot prune preseed artifacts: %v", err)
+	}
+
+	paths := make([]string, 0, len(candidates))
+	for path := range candidates {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot prune preseed artifacts: %v", err)
+		}
+		if !info.Mode().IsRegular() || !atomicWriteLeftover.MatchString(info.Name()) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, 0, fmt.Errorf("cannot prune preseed artifacts: %v", err)
+		}
+		rel, err := filepath.Rel(rootDir, path)
+		if err != nil {
+			return nil, 0, err
+		}
+		pruned = append(pruned, "/"+rel)
+		saved += info.Size()
+	}
+	return pruned, saved, nil
+}
+
+// pruneAndReport prunes the preseed artifacts under rootDir and reports the
+// bytes saved.
+func pruneAndReport(rootDir string) error {
+	pruned, saved, err := pruneArtifacts(rootDir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(Stdout, "pruned %d intermediate files, %s saved\n", len(pruned), strutil.SizeToStr(saved))
+	return nil
+}
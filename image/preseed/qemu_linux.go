@@ -0,0 +1,143 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/snapcore/snapd/arch"
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/osutil"
+)
+
+// archProbeBinary is a binary which is present in every classic system,
+// its architecture is the one of the system.
+const archProbeBinary = "/usr/bin/true"
+
+// elfMachineArchs maps the ELF machine types to the dpkg architectures.
+var elfMachineArchs = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_386:     "i386",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_ARM:     "armhf",
+	elf.EM_PPC64:   "ppc64el",
+	elf.EM_S390:    "s390x",
+	elf.EM_RISCV:   "riscv64",
+}
+
+// qemuArchs maps the dpkg architectures to the names qemu uses for them.
+var qemuArchs = map[string]string{
+	"amd64":   "x86_64",
+	"i386":    "i386",
+	"arm64":   "aarch64",
+	"armhf":   "arm",
+	"ppc64el": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+// chrootArchitecture returns the dpkg architecture of the system at
+// preseedChroot, based on the ELF header of one of its binaries.
+func chrootArchitecture(preseedChroot string) (string, error) {
+	f, err := elf.Open(filepath.Join(preseedChroot, archProbeBinary))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	dpkgArch, ok := elfMachineArchs[f.Machine]
+	if !ok {
+		return "", fmt.Errorf("unsupported machine type %s of %s", f.Machine, archProbeBinary)
+	}
+	return dpkgArch, nil
+}
+
+// setupEmulation prepares running snapd of a chroot of an architecture
+// other than the one of the host through the qemu-user binary qemuBinary,
+// or /usr/bin/qemu-<arch>-static if not set. The binary is bind mounted at
+// the same path inside the chroot, unless it is there already, so that the
+// binfmt_misc handler of the host also runs the programs executed by snapd.
+// It returns the path of the binary inside the chroot, which is empty if
+// no emulation is needed, and a function which undoes the setup, either from
+// inside or from outside of the chroot as tracked by chroot.
+func setupEmulation(backend Backend, preseedChroot, qemuBinary string, chroot *chrootTracker) (qemuPath string, restore func(), err error) {
+	targetArch, err := chrootArchitecture(preseedChroot)
+	if err != nil {
+		// chroots without the probed binary are assumed to match
+		logger.Debugf("cannot determine the architecture of %s: %v", preseedChroot, err)
+		return "", func() {}, nil
+	}
+	hostArch := arch.DpkgArchitecture()
+	if targetArch == hostArch {
+		return "", func() {}, nil
+	}
+
+	if qemuBinary == "" {
+		qemuArch, ok := qemuArchs[targetArch]
+		if !ok {
+			return "", nil, fmt.Errorf("cannot preseed %s system on %s host: no qemu-user emulation is known for it", targetArch, hostArch)
+		}
+		qemuBinary = fmt.Sprintf("/usr/bin/qemu-%s-static", qemuArch)
+	}
+	if !filepath.IsAbs(qemuBinary) {
+		return "", nil, fmt.Errorf("cannot use %q as qemu-user binary: must be an absolute path", qemuBinary)
+	}
+
+	where := filepath.Join(preseedChroot, qemuBinary)
+	if osutil.FileExists(where) {
+		// e.g. qemu-user-static is installed in the chroot
+		fmt.Fprintf(Stdout, "preseeding %s system on %s host with %s of the chroot\n", targetArch, hostArch, qemuBinary)
+		return qemuBinary, func() {}, nil
+	}
+	if !osutil.FileExists(qemuBinary) {
+		return "", nil, fmt.Errorf("cannot preseed %s system on %s host: %s does not exist, install qemu-user-static", targetArch, hostArch, qemuBinary)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(where), 0755); err != nil {
+		return "", nil, err
+	}
+	// the mountpoint of the bind mount
+	if err := ioutil.WriteFile(where, nil, 0755); err != nil {
+		return "", nil, err
+	}
+	if out, err := backend.Mount([]string{"--bind", qemuBinary, where}); err != nil {
+		os.Remove(where)
+		return "", nil, fmt.Errorf("cannot bind mount %s into the chroot: %v", qemuBinary, osutil.OutputErr(out, err))
+	}
+	fmt.Fprintf(Stdout, "preseeding %s system on %s host with %s\n", targetArch, hostArch, qemuBinary)
+
+	inChroot := filepath.Join(dirs.GlobalRootDir, qemuBinary)
+	return qemuBinary, func() {
+		chroot.resolve(where, inChroot, func(where string) {
+			if out, err := backend.Unmount(where); err != nil {
+				fmt.Fprintf(Stderr, "cannot unmount %s: %v\n", where, osutil.OutputErr(out, err))
+				return
+			}
+			if err := os.Remove(where); err != nil {
+				fmt.Fprintf(Stderr, "cannot remove %s: %v\n", where, err)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,139 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/arch"
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/testutil"
+)
+
+// mockArchBinary writes a minimal ELF file of the given machine type as
+// /usr/bin/true of the chroot.
+func mockArchBinary(c *C, chrootDir string, machine elf.Machine) {
+	hdr := elf.Header64{
+		Type:    uint16(elf.ET_EXEC),
+		Machine: uint16(machine),
+		Version: uint32(elf.EV_CURRENT),
+		Ehsize:  64,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	c.Assert(binary.Write(&buf, binary.LittleEndian, &hdr), IsNil)
+	path := filepath.Join(chrootDir, "usr/bin/true")
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, buf.Bytes(), 0755), IsNil)
+}
+
+func (s *preseedSuite) TestRunPreseedForeignArchitecture(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	defer arch.SetArchitecture(arch.ArchitectureType(arch.DpkgArchitecture()))
+	arch.SetArchitecture("amd64")
+	mockArchBinary(c, tmpDir, elf.EM_AARCH64)
+
+	qemuBinary := filepath.Join(c.MkDir(), "qemu-aarch64-static")
+	c.Assert(ioutil.WriteFile(qemuBinary, nil, 0755), IsNil)
+	inChroot := filepath.Join(tmpDir, qemuBinary)
+
+	var stdout bytes.Buffer
+	oldStdout := preseed.Stdout
+	preseed.Stdout = &stdout
+	defer func() { preseed.Stdout = oldStdout }()
+
+	backend := &preseed.FakeBackend{}
+	opts := &preseed.ClassicOptions{Backend: backend, QemuUserBinary: qemuBinary}
+	c.Assert(preseed.Classic(tmpDir, opts), IsNil)
+
+	c.Check(backend.Mounts, testutil.DeepContains, []string{"--bind", qemuBinary, inChroot})
+	c.Check(backend.Unmounts, testutil.Contains, inChroot)
+	// snapd is run through qemu
+	c.Assert(backend.Snapd, HasLen, 1)
+	c.Check(backend.Snapd[0], DeepEquals, []string{qemuBinary, filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/snapd")})
+	c.Check(stdout.String(), testutil.Contains, "preseeding arm64 system on amd64 host with "+qemuBinary+"\n")
+	// the mountpoint was removed
+	c.Check(inChroot, testutil.FileAbsent)
+}
+
+func (s *preseedSuite) TestRunPreseedForeignArchitectureChrootFailed(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	defer arch.SetArchitecture(arch.ArchitectureType(arch.DpkgArchitecture()))
+	arch.SetArchitecture("amd64")
+	mockArchBinary(c, tmpDir, elf.EM_AARCH64)
+	// as in real runs, the paths refer to the host until the chroot is
+	// entered
+	dirs.SetRootDir("/")
+
+	qemuBinary := filepath.Join(c.MkDir(), "qemu-aarch64-static")
+	c.Assert(ioutil.WriteFile(qemuBinary, nil, 0755), IsNil)
+	inChroot := filepath.Join(tmpDir, qemuBinary)
+
+	backend := &failingChrootBackend{}
+	opts := &preseed.ClassicOptions{Backend: backend, QemuUserBinary: qemuBinary}
+	c.Assert(preseed.Classic(tmpDir, opts), ErrorMatches, `cannot chroot into .*: cannot chroot for testing`)
+
+	c.Check(backend.Mounts, DeepEquals, [][]string{{"--bind", qemuBinary, inChroot}})
+	// the bind mount in the chroot is undone
+	c.Check(backend.Unmounts, DeepEquals, []string{inChroot})
+	c.Check(inChroot, testutil.FileAbsent)
+	// and the binary of the host is left alone
+	c.Check(qemuBinary, testutil.FilePresent)
+}
+
+func (s *preseedSuite) TestRunPreseedForeignArchitectureNoQemu(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+	defer arch.SetArchitecture(arch.ArchitectureType(arch.DpkgArchitecture()))
+	arch.SetArchitecture("amd64")
+	mockArchBinary(c, tmpDir, elf.EM_AARCH64)
+
+	backend := &preseed.FakeBackend{}
+	opts := &preseed.ClassicOptions{Backend: backend, QemuUserBinary: "/does/not/exist/qemu-aarch64-static"}
+	c.Check(preseed.Classic(tmpDir, opts), ErrorMatches, "cannot preseed arm64 system on amd64 host: /does/not/exist/qemu-aarch64-static does not exist, install qemu-user-static")
+	c.Check(backend.Snapd, HasLen, 0)
+}
+
+func (s *preseedSuite) TestRunPreseedSameArchitecture(c *C) {
+	tmpDir := c.MkDir()
+	env := s.mockClassicPreseedEnv(c, tmpDir, "")
+	defer arch.SetArchitecture(arch.ArchitectureType(arch.DpkgArchitecture()))
+	arch.SetArchitecture("arm64")
+	mockArchBinary(c, tmpDir, elf.EM_AARCH64)
+
+	backend := &preseed.FakeBackend{}
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{Backend: backend}), IsNil)
+	c.Assert(backend.Snapd, HasLen, 1)
+	c.Check(backend.Snapd[0], DeepEquals, []string{filepath.Join(env.targetSnapdRoot, "usr/lib/snapd/snapd")})
+}
@@ -23,7 +23,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/snapcore/snapd/cmd/snaplock/runinhibit"
 	"github.com/snapcore/snapd/dirs"
@@ -31,9 +34,251 @@ import (
 	apparmor_sandbox "github.com/snapcore/snapd/sandbox/apparmor"
 )
 
+// ArtifactType describes how a preseeding artifact is matched and removed.
+type ArtifactType string
+
+const (
+	// ArtifactFile is a single file.
+	ArtifactFile ArtifactType = "file"
+	// ArtifactGlob is a glob pattern, all matching files and directories
+	// are artifacts, including the contents of the directories.
+	ArtifactGlob ArtifactType = "glob"
+	// ArtifactTree is a directory created entirely by preseeding.
+	ArtifactTree ArtifactType = "tree"
+	// ArtifactSymlink is a directory with bash completion symlinks, the
+	// symlinks pointing at the snapd completer and symlinks pointing at
+	// those are artifacts.
+	ArtifactSymlink ArtifactType = "symlink"
+)
+
+// ArtifactClass groups the preseeding artifacts by what they are used for,
+// allowing to reset some of them only.
+type ArtifactClass string
+
+const (
+	// ArtifactClassState is the snapd state and the files tracking it.
+	ArtifactClassState ArtifactClass = "state"
+	// ArtifactClassAssertions is the assertions database.
+	ArtifactClassAssertions ArtifactClass = "assertions"
+	// ArtifactClassSnaps are the snap files, their mountpoints, run
+	// inhibition locks and bash completion symlinks.
+	ArtifactClassSnaps ArtifactClass = "snaps"
+	// ArtifactClassSystemdUnits are the systemd services, timers, sockets
+	// and mount units of the snaps.
+	ArtifactClassSystemdUnits ArtifactClass = "systemd-units"
+	// ArtifactClassAppArmor are the apparmor profiles and their cache.
+	ArtifactClassAppArmor ArtifactClass = "apparmor"
+	// ArtifactClassSeccomp are the seccomp profiles.
+	ArtifactClassSeccomp ArtifactClass = "seccomp"
+	// ArtifactClassMountPolicy are the mount profiles of snap-update-ns.
+	ArtifactClassMountPolicy ArtifactClass = "mount-policy"
+	// ArtifactClassUdev are the udev rules and the device cgroup setup.
+	ArtifactClassUdev ArtifactClass = "udev"
+	// ArtifactClassDBus are the D-Bus policies and services.
+	ArtifactClassDBus ArtifactClass = "dbus"
+	// ArtifactClassPolkit are the polkit policies.
+	ArtifactClassPolkit ArtifactClass = "polkit"
+	// ArtifactClassKMod are the kernel module configuration files.
+	ArtifactClassKMod ArtifactClass = "kmod"
+	// ArtifactClassSysctl are the kernel parameters written for the core
+	// configuration.
+	ArtifactClassSysctl ArtifactClass = "sysctl"
+	// ArtifactClassDesktop are the desktop files and icons.
+	ArtifactClassDesktop ArtifactClass = "desktop"
+	// ArtifactClassData are the data and cache directories of the snaps.
+	ArtifactClassData ArtifactClass = "data"
+	// ArtifactClassExtra are the artifacts passed with
+	// ResetOptions.ExtraArtifacts.
+	ArtifactClassExtra ArtifactClass = "extra"
+)
+
+// ArtifactClasses returns all the classes of preseeding artifacts.
+func ArtifactClasses() []ArtifactClass {
+	return []ArtifactClass{
+		ArtifactClassState,
+		ArtifactClassAssertions,
+		ArtifactClassSnaps,
+		ArtifactClassSystemdUnits,
+		ArtifactClassAppArmor,
+		ArtifactClassSeccomp,
+		ArtifactClassMountPolicy,
+		ArtifactClassUdev,
+		ArtifactClassDBus,
+		ArtifactClassPolkit,
+		ArtifactClassKMod,
+		ArtifactClassSysctl,
+		ArtifactClassDesktop,
+		ArtifactClassData,
+		ArtifactClassExtra,
+	}
+}
+
+// ArtifactSpec describes artifacts created by preseeding.
+type ArtifactSpec struct {
+	// Path is relative to the root of the preseeded system.
+	Path  string
+	Type  ArtifactType
+	Class ArtifactClass
+}
+
+// Artifacts returns the specification of all the artifacts created by
+// preseeding. Both ResetPreseededChroot and ArtifactPatterns are derived
+// from it, new artifacts need to be added only here.
+func Artifacts() []ArtifactSpec {
+	return []ArtifactSpec{
+		// the state also carries the hotplug slots and their bindings
+		{dirs.SnapStateFile, ArtifactFile, ArtifactClassState},
+		{dirs.SnapSystemKeyFile, ArtifactFile, ArtifactClassState},
+		{checkpointFile(), ArtifactFile, ArtifactClassState},
+		{filepath.Join(dirs.SnapBlobDir, "*.snap"), ArtifactGlob, ArtifactClassSnaps},
+		// udev tagging rules, also those of hotplug slots
+		{filepath.Join(dirs.SnapUdevRulesDir, "*-snap.*.rules"), ArtifactGlob, ArtifactClassUdev},
+		{filepath.Join(dirs.SnapDBusSystemPolicyDir, "snap.*.*.conf"), ArtifactGlob, ArtifactClassDBus},
+		// session bus policy of snapd, written from the snapd snap; the
+		// files shipped by the snapd deb live elsewhere
+		{filepath.Join(dirs.SnapDBusSessionPolicyDir, "snapd.*.conf"), ArtifactGlob, ArtifactClassDBus},
+		{filepath.Join(dirs.SnapPolkitPolicyDir, "snap.*.interface.*.policy"), ArtifactGlob, ArtifactClassPolkit},
+		{filepath.Join(dirs.SnapServicesDir, "snap.*.service"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(dirs.SnapServicesDir, "snap.*.timer"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(dirs.SnapServicesDir, "snap.*.socket"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(dirs.SnapServicesDir, "snap-*.mount"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(dirs.SnapServicesDir, "*.target.wants", "snap-*.mount"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(dirs.SnapUserServicesDir, "snap.*.service"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(dirs.SnapUserServicesDir, "snap.*.socket"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(dirs.SnapUserServicesDir, "snap.*.timer"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(dirs.SnapUserServicesDir, "*.target.wants", "snap.*.service"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(dirs.SnapUserServicesDir, "*.target.wants", "snap.*.socket"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(dirs.SnapUserServicesDir, "*.target.wants", "snap.*.timer"), ArtifactGlob, ArtifactClassSystemdUnits},
+		{filepath.Join(runinhibit.InhibitDir, "*.lock"), ArtifactGlob, ArtifactClassSnaps},
+		// kernel modules loaded, or blacklisted, for snaps
+		{filepath.Join(dirs.SnapKModModulesDir, "snap.*.conf"), ArtifactGlob, ArtifactClassKMod},
+		{filepath.Join(dirs.SnapKModModprobeDir, "snap.*.conf"), ArtifactGlob, ArtifactClassKMod},
+		// kernel parameters of the core configuration, of
+		// system.kernel.printk.console-loglevel and network.disable-ipv6
+		{"/etc/sysctl.d/99-snapd.conf", ArtifactFile, ArtifactClassSysctl},
+		{"/etc/sysctl.d/10-snapd-network.conf", ArtifactFile, ArtifactClassSysctl},
+		// directories whose contents are created by preseeding (but not
+		// the directories themselves)
+		{filepath.Join(dirs.SnapDataDir, "*"), ArtifactGlob, ArtifactClassData},
+		{filepath.Join(dirs.SnapCacheDir, "*"), ArtifactGlob, ArtifactClassData},
+		{filepath.Join(apparmor_sandbox.CacheDir, "*"), ArtifactGlob, ArtifactClassAppArmor},
+		{filepath.Join(dirs.SnapDesktopFilesDir, "*"), ArtifactGlob, ArtifactClassDesktop},
+		{filepath.Join(dirs.SnapDBusSessionServicesDir, "*"), ArtifactGlob, ArtifactClassDBus},
+		{filepath.Join(dirs.SnapDBusSystemServicesDir, "*"), ArtifactGlob, ArtifactClassDBus},
+		{dirs.SnapAssertsDBDir, ArtifactTree, ArtifactClassAssertions},
+		{dirs.FeaturesDir, ArtifactTree, ArtifactClassState},
+		{dirs.SnapDesktopIconsDir, ArtifactTree, ArtifactClassDesktop},
+		{dirs.SnapDeviceDir, ArtifactTree, ArtifactClassUdev},
+		{dirs.SnapCookieDir, ArtifactTree, ArtifactClassState},
+		{dirs.SnapMountPolicyDir, ArtifactTree, ArtifactClassMountPolicy},
+		{dirs.SnapAppArmorDir, ArtifactTree, ArtifactClassAppArmor},
+		// snippets of the snap-confine profile, the profile itself is
+		// in SnapAppArmorDir and its cache in the apparmor cache dir
+		{dirs.SnapConfineAppArmorDir, ArtifactTree, ArtifactClassAppArmor},
+		{dirs.SnapSeqDir, ArtifactTree, ArtifactClassState},
+		{dirs.SnapMountDir, ArtifactTree, ArtifactClassSnaps},
+		{dirs.SnapSeccompBase, ArtifactTree, ArtifactClassSeccomp},
+		{dirs.CompletersDir, ArtifactSymlink, ArtifactClassSnaps},
+	}
+}
+
+// ArtifactPatterns returns the glob patterns, relative to the root of the
+// preseeded system, of all files and directories created by preseeding.
+// Matching directories are artifacts including all of their contents.
+// Bash completion symlinks are not included.
+func ArtifactPatterns() []string {
+	var patterns []string
+	for _, spec := range Artifacts() {
+		if spec.Type == ArtifactSymlink {
+			continue
+		}
+		patterns = append(patterns, spec.Path)
+	}
+	return patterns
+}
+
+// IsPreseeded returns whether the system at the given chroot directory
+// appears to be preseeded, i.e. snapd state was written there.
+func IsPreseeded(chrootDir string) bool {
+	return osutil.FileExists(filepath.Join(chrootDir, dirs.SnapStateFile))
+}
+
+// ResetIfPreseeded resets the chroot with ResetPreseededChroot only if it
+// appears to be preseeded. It returns whether a reset was performed.
+func ResetIfPreseeded(preseedChroot string) (bool, error) {
+	if !IsPreseeded(preseedChroot) {
+		return false, nil
+	}
+	if err := ResetPreseededChroot(preseedChroot); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// IsResetComplete returns whether the system at dir is free of preseed
+// artifacts, as described by ArtifactPatterns, so that it can be preseeded
+// again. Any leftover artifacts are returned sorted. A system that is still
+// preseeded is never complete, as the snapd state is an artifact.
+func IsResetComplete(dir string) (complete bool, leftovers []string, err error) {
+	artifacts, err := collectArtifacts(dir)
+	if err != nil {
+		return false, nil, err
+	}
+	for path := range artifacts {
+		leftovers = append(leftovers, path)
+	}
+	sort.Strings(leftovers)
+	return len(leftovers) == 0, leftovers, nil
+}
+
+// ResetOptions carries options for resetting a preseeded chroot.
+type ResetOptions struct {
+	// ExtraArtifacts are additional paths or glob patterns, relative to
+	// the root of the preseeded system, that are removed together with
+	// the artifacts created by snapd. Matching directories are removed
+	// with their contents. It allows integrators to clean up their own
+	// snapd related additions.
+	ExtraArtifacts []string
+
+	// PreserveData, if set, keeps the data and cache directories of the
+	// snaps, i.e. the contents of SnapDataDir and SnapCacheDir, while all
+	// the other artifacts, like the snapd state, security profiles and
+	// services, are removed.
+	PreserveData bool
+
+	// Classes, if set, restricts the reset to the artifacts of the given
+	// classes, e.g. only the apparmor profiles, so that they can be
+	// regenerated without redoing the whole preseeding. The system is
+	// not consistent until it is preseeded again.
+	Classes []ArtifactClass
+
+	// PreReset, if set, is called with the chroot directory before any
+	// artifacts are removed. An error aborts the reset.
+	PreReset func(preseedChroot string) error
+	// PostReset, if set, is called with the chroot directory after the
+	// artifacts were removed, also when removing them failed. Its error is
+	// reported together with the one of the removal, if any.
+	PostReset func(preseedChroot string) error
+}
+
 // ResetPreseededChroot removes all preseeding artifacts from preseedChroot
 // (classic Ubuntu only).
 func ResetPreseededChroot(preseedChroot string) error {
+	return ResetPreseededChrootWithOptions(preseedChroot, nil)
+}
+
+// ResetPreseededChrootWithOptions is like ResetPreseededChroot, but also
+// takes options. The opts argument may be nil.
+func ResetPreseededChrootWithOptions(preseedChroot string, opts *ResetOptions) error {
+	if opts == nil {
+		opts = &ResetOptions{}
+	}
+	for _, class := range opts.Classes {
+		if !isKnownArtifactClass(class) {
+			return fmt.Errorf("cannot reset unknown artifact class %q", class)
+		}
+	}
+
 	var err error
 	preseedChroot, err = filepath.Abs(preseedChroot)
 	if err != nil {
@@ -51,93 +296,213 @@ func ResetPreseededChroot(preseedChroot string) error {
 		return fmt.Errorf("cannot reset %q, it is not a directory", preseedChroot)
 	}
 
-	// globs that yield individual files
-	globs := []string{
-		dirs.SnapStateFile,
-		dirs.SnapSystemKeyFile,
-		filepath.Join(dirs.SnapBlobDir, "*.snap"),
-		filepath.Join(dirs.SnapUdevRulesDir, "*-snap.*.rules"),
-		filepath.Join(dirs.SnapDBusSystemPolicyDir, "snap.*.*.conf"),
-		filepath.Join(dirs.SnapServicesDir, "snap.*.service"),
-		filepath.Join(dirs.SnapServicesDir, "snap.*.timer"),
-		filepath.Join(dirs.SnapServicesDir, "snap.*.socket"),
-		filepath.Join(dirs.SnapServicesDir, "snap-*.mount"),
-		filepath.Join(dirs.SnapServicesDir, "multi-user.target.wants", "snap-*.mount"),
-		filepath.Join(dirs.SnapUserServicesDir, "snap.*.service"),
-		filepath.Join(dirs.SnapUserServicesDir, "snap.*.socket"),
-		filepath.Join(dirs.SnapUserServicesDir, "snap.*.timer"),
-		filepath.Join(dirs.SnapUserServicesDir, "default.target.wants", "snap.*.service"),
-		filepath.Join(dirs.SnapUserServicesDir, "sockets.target.wants", "snap.*.socket"),
-		filepath.Join(dirs.SnapUserServicesDir, "timers.target.wants", "snap.*.timer"),
-		filepath.Join(runinhibit.InhibitDir, "*.lock"),
-	}
-
-	for _, gl := range globs {
-		matches, err := filepath.Glob(filepath.Join(preseedChroot, gl))
-		if err != nil {
-			// the only possible error from Glob() is ErrBadPattern
-			return err
+	if opts.PreReset != nil {
+		if err := opts.PreReset(preseedChroot); err != nil {
+			return fmt.Errorf("cannot reset %q: pre-reset hook failed: %v", preseedChroot, err)
 		}
-		for _, path := range matches {
-			if err := os.Remove(path); err != nil {
-				return fmt.Errorf("error removing %s: %v", path, err)
+	}
+
+	resetErr := removeArtifacts(preseedChroot, opts)
+	if opts.PostReset != nil {
+		if err := opts.PostReset(preseedChroot); err != nil {
+			if resetErr != nil {
+				return fmt.Errorf("%v\npost-reset hook failed: %v", resetErr, err)
 			}
+			return fmt.Errorf("post-reset hook failed: %v", err)
+		}
+	}
+	return resetErr
+}
+
+// removeArtifacts removes the preseeding artifacts from preseedChroot as
+// requested by opts.
+func removeArtifacts(preseedChroot string, opts *ResetOptions) error {
+	// artifacts which are mountpoints, e.g. when snapd data lives on a
+	// separate subvolume, are emptied but kept
+	mountpoints := activeMountpoints()
+
+	resetSnaps := opts.resetsClass(ArtifactClassSnaps)
+
+	// snaps which are still mounted cannot be removed, they are unmounted
+	// first and their mountpoints removed with the rest of SnapMountDir
+	if resetSnaps {
+		if err := unmountSnaps(filepath.Join(preseedChroot, dirs.SnapMountDir), mountpoints); err != nil {
+			return err
+		}
+	}
+
+	specs := Artifacts()
+	for _, extra := range opts.ExtraArtifacts {
+		specs = append(specs, ArtifactSpec{Path: extra, Type: ArtifactGlob, Class: ArtifactClassExtra})
+	}
+	for _, spec := range specs {
+		if !opts.resetsClass(spec.Class) {
+			continue
+		}
+		if opts.PreserveData && isDataArtifact(spec) {
+			continue
+		}
+		if err := removeArtifact(preseedChroot, spec, mountpoints); err != nil {
+			return err
 		}
 	}
 
-	// directories that need to be removed recursively (but
-	// leaving parent directory intact).
-	globs = []string{
-		filepath.Join(dirs.SnapDataDir, "*"),
-		filepath.Join(dirs.SnapCacheDir, "*"),
-		filepath.Join(apparmor_sandbox.CacheDir, "*"),
-		filepath.Join(dirs.SnapDesktopFilesDir, "*"),
-		filepath.Join(dirs.SnapDBusSessionServicesDir, "*"),
-		filepath.Join(dirs.SnapDBusSystemServicesDir, "*"),
+	if !resetSnaps {
+		return nil
 	}
+	return removeSnapMountpoints(preseedChroot, mountpoints)
+}
 
-	for _, gl := range globs {
-		matches, err := filepath.Glob(filepath.Join(preseedChroot, gl))
+// resetsClass returns whether the artifacts of the given class are removed
+// by the reset.
+func (opts *ResetOptions) resetsClass(class ArtifactClass) bool {
+	if len(opts.Classes) == 0 {
+		return true
+	}
+	for _, c := range opts.Classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// isKnownArtifactClass returns whether class is one of ArtifactClasses.
+func isKnownArtifactClass(class ArtifactClass) bool {
+	for _, c := range ArtifactClasses() {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSnapMountpoints removes the mountpoints of the core/snapd and base
+// snaps at the default mount path, which a preseeding run that was aborted
+// may have left behind. Mountpoints that are still mounted or not empty are
+// left alone.
+func removeSnapMountpoints(preseedChroot string, mountpoints map[string]bool) error {
+	where := filepath.Join(preseedChroot, DefaultMountPath)
+	bases, err := filepath.Glob(where + "-*")
+	if err != nil {
+		return err
+	}
+	for _, mnt := range append([]string{where}, bases...) {
+		if mountpoints[mnt] {
+			continue
+		}
+		entries, err := ioutil.ReadDir(mnt)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+		if err := os.Remove(mnt); err != nil {
+			return fmt.Errorf("error removing %s: %v", mnt, err)
+		}
+	}
+	return nil
+}
+
+// isDataArtifact returns whether spec describes the data or cache
+// directories of the snaps.
+func isDataArtifact(spec ArtifactSpec) bool {
+	return spec.Class == ArtifactClassData
+}
+
+// activeMountpoints returns the set of current mountpoints, or an empty set
+// if the mount table cannot be read.
+func activeMountpoints() map[string]bool {
+	mountpoints := make(map[string]bool)
+	if entries, err := osutil.LoadMountInfo(); err == nil {
+		for _, ent := range entries {
+			mountpoints[ent.MountDir] = true
+		}
+	}
+	return mountpoints
+}
+
+// unmountSnaps unmounts everything mounted below snapMountDir, deepest
+// mountpoints first, and drops them from mountpoints.
+func unmountSnaps(snapMountDir string, mountpoints map[string]bool) error {
+	var active []string
+	for mnt := range mountpoints {
+		if strings.HasPrefix(mnt, snapMountDir+"/") {
+			active = append(active, mnt)
+		}
+	}
+	// nested mounts sort after their parents
+	sort.Sort(sort.Reverse(sort.StringSlice(active)))
+	for _, mnt := range active {
+		if out, err := exec.Command("umount", mnt).CombinedOutput(); err != nil {
+			return fmt.Errorf("cannot unmount %s: %v", mnt, osutil.OutputErr(out, err))
+		}
+		delete(mountpoints, mnt)
+	}
+	return nil
+}
+
+// removeArtifact removes the artifacts described by spec from the system
+// under rootDir. Directories which are mountpoints are emptied instead.
+func removeArtifact(rootDir string, spec ArtifactSpec, mountpoints map[string]bool) error {
+	switch spec.Type {
+	case ArtifactFile:
+		path := filepath.Join(rootDir, spec.Path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing %s: %v", path, err)
+		}
+	case ArtifactGlob:
+		matches, err := filepath.Glob(filepath.Join(rootDir, spec.Path))
 		if err != nil {
 			// the only possible error from Glob() is ErrBadPattern
 			return err
 		}
 		for _, path := range matches {
-			if err := os.RemoveAll(path); err != nil {
+			if err := removeAllOrEmpty(path, mountpoints); err != nil {
 				return fmt.Errorf("error removing %s: %v", path, err)
 			}
 		}
+	case ArtifactTree:
+		if err := removeAllOrEmpty(filepath.Join(rootDir, spec.Path), mountpoints); err != nil {
+			return fmt.Errorf("error removing %s: %v", spec.Path, err)
+		}
+	case ArtifactSymlink:
+		return removeCompleterSymlinks(filepath.Join(rootDir, spec.Path))
+	default:
+		return fmt.Errorf("internal error: unknown artifact type %q of %s", spec.Type, spec.Path)
 	}
+	return nil
+}
 
-	// directories removed entirely
-	paths := []string{
-		dirs.SnapAssertsDBDir,
-		dirs.FeaturesDir,
-		dirs.SnapDesktopIconsDir,
-		dirs.SnapDeviceDir,
-		dirs.SnapCookieDir,
-		dirs.SnapMountPolicyDir,
-		dirs.SnapAppArmorDir,
-		dirs.SnapSeqDir,
-		dirs.SnapMountDir,
-		dirs.SnapSeccompBase,
+// removeAllOrEmpty removes path with all its contents, unless it is a
+// mountpoint, which is only emptied.
+func removeAllOrEmpty(path string, mountpoints map[string]bool) error {
+	if !mountpoints[path] {
+		return os.RemoveAll(path)
 	}
-
-	for _, path := range paths {
-		if err := os.RemoveAll(filepath.Join(preseedChroot, path)); err != nil {
-			// report the error and carry on
-			return fmt.Errorf("error removing %s: %v", path, err)
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		if err := os.RemoveAll(filepath.Join(path, ent.Name())); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// bash-completion symlinks; note there are symlinks that point at
-	// completer, and symlinks that point at the completer symlinks.
-	// e.g.
-	// lxd.lxc -> /snap/core/current/usr/lib/snapd/complete.sh
-	// lxc -> lxd.lxc
-	files, err := ioutil.ReadDir(filepath.Join(preseedChroot, dirs.CompletersDir))
+// removeCompleterSymlinks removes the bash-completion symlinks in dir; note
+// there are symlinks that point at completer, and symlinks that point at the
+// completer symlinks.
+// e.g.
+// lxd.lxc -> /snap/core/current/usr/lib/snapd/complete.sh
+// lxc -> lxd.lxc
+func removeCompleterSymlinks(dir string) error {
+	files, err := ioutil.ReadDir(dir)
 	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("error reading %s: %v", dirs.CompletersDir, err)
+		return fmt.Errorf("error reading %s: %v", dir, err)
 	}
 	completeShSymlinks := make(map[string]string)
 	var otherSymlinks []string
@@ -147,7 +512,7 @@ func ResetPreseededChroot(preseedChroot string) error {
 		if fileInfo.Mode()&os.ModeSymlink == 0 {
 			continue
 		}
-		fullPath := filepath.Join(preseedChroot, dirs.CompletersDir, fileInfo.Name())
+		fullPath := filepath.Join(dir, fileInfo.Name())
 		if dirs.IsCompleteShSymlink(fullPath) {
 			if err := os.Remove(fullPath); err != nil {
 				return fmt.Errorf("error removing symlink %s: %v", fullPath, err)
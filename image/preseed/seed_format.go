@@ -0,0 +1,94 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/strutil"
+)
+
+const (
+	// seedFormat16 is the format of seeds described by seed.yaml
+	seedFormat16 = "seed.yaml"
+	// seedFormat20 is the format of seeds with recovery systems
+	seedFormat20 = "systems"
+)
+
+// snapdVersionRange is a range of snapd versions, an empty bound is
+// unlimited. Until is exclusive.
+type snapdVersionRange struct {
+	since string
+	until string
+}
+
+// seedFormatSnapdVersions are the snapd versions which can preseed the
+// seeds of a given format.
+var seedFormatSnapdVersions = map[string]snapdVersionRange{
+	seedFormat16: {since: snapdPreseedSupportVer},
+	// classic systems with modes
+	seedFormat20: {since: "2.56"},
+}
+
+// detectSeedFormat returns the format of the seed at seedDir, or an empty
+// string if there is no seed.
+func detectSeedFormat(seedDir string) string {
+	if osutil.FileExists(filepath.Join(seedDir, "seed.yaml")) {
+		return seedFormat16
+	}
+	if osutil.IsDirectory(filepath.Join(seedDir, "systems")) {
+		return seedFormat20
+	}
+	return ""
+}
+
+// checkSeedFormat verifies that snapd of the given version understands the
+// format of the seed at seedDir.
+func checkSeedFormat(seedDir, snapdVersion string) error {
+	format := detectSeedFormat(seedDir)
+	if format == "" {
+		return nil
+	}
+	versions, ok := seedFormatSnapdVersions[format]
+	if !ok {
+		return nil
+	}
+	if versions.since != "" {
+		res, err := strutil.VersionCompare(snapdVersion, versions.since)
+		if err != nil {
+			return err
+		}
+		if res < 0 {
+			return fmt.Errorf("cannot preseed seed of format %q with snapd %s, the format is supported since snapd %s", format, snapdVersion, versions.since)
+		}
+	}
+	if versions.until != "" {
+		res, err := strutil.VersionCompare(snapdVersion, versions.until)
+		if err != nil {
+			return err
+		}
+		if res >= 0 {
+			return fmt.Errorf("cannot preseed seed of format %q with snapd %s, the format is not supported since snapd %s", format, snapdVersion, versions.until)
+		}
+	}
+	return nil
+}
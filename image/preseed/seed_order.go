@@ -0,0 +1,74 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+// sortSeedSnaps sorts the snaps listed in the seed.yaml at seedYaml by
+// name, keeping all the fields of the entries. snapd seeds the snaps in the
+// order they are listed, this way the order no longer depends on how the
+// seed was put together.
+func sortSeedSnaps(seedYaml string) error {
+	data, err := ioutil.ReadFile(seedYaml)
+	if err != nil {
+		return fmt.Errorf("cannot sort seed snaps: %v", err)
+	}
+
+	// yaml.MapSlice preserves the fields and their order
+	var seed struct {
+		Snaps []yaml.MapSlice `yaml:"snaps"`
+	}
+	if err := yaml.Unmarshal(data, &seed); err != nil {
+		return fmt.Errorf("cannot sort seed snaps: cannot unmarshal %s: %v", seedYaml, err)
+	}
+
+	name := func(snap yaml.MapSlice) string {
+		for _, item := range snap {
+			if item.Key == "name" {
+				return fmt.Sprint(item.Value)
+			}
+		}
+		return ""
+	}
+	sorted := sort.SliceIsSorted(seed.Snaps, func(i, j int) bool {
+		return name(seed.Snaps[i]) < name(seed.Snaps[j])
+	})
+	if sorted {
+		// nothing to do, keep the file as is
+		return nil
+	}
+	sort.SliceStable(seed.Snaps, func(i, j int) bool {
+		return name(seed.Snaps[i]) < name(seed.Snaps[j])
+	})
+
+	data, err = yaml.Marshal(&seed)
+	if err != nil {
+		return fmt.Errorf("cannot sort seed snaps: %v", err)
+	}
+	return osutil.AtomicWriteFile(seedYaml, data, 0644, 0)
+}
@@ -0,0 +1,102 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
+)
+
+const sortedSeedYaml = `snaps:
+- name: core20
+  channel: stable
+  file: core20_1.snap
+- name: lxd
+  snap-id: lxdidididididididididididididid
+  channel: 4.0/stable/ubuntu-20.04
+  file: lxd_2.snap
+- name: snapd
+  file: snapd_3.snap
+`
+
+func (s *preseedSuite) TestRunPreseedSortSeedSnaps(c *C) {
+	var results [][]byte
+	for _, seedYaml := range []string{`snaps:
+  - name: snapd
+    file: snapd_3.snap
+  - name: lxd
+    snap-id: lxdidididididididididididididid
+    channel: 4.0/stable/ubuntu-20.04
+    file: lxd_2.snap
+  - name: core20
+    channel: stable
+    file: core20_1.snap
+`, `snaps:
+  - name: lxd
+    snap-id: lxdidididididididididididididid
+    channel: 4.0/stable/ubuntu-20.04
+    file: lxd_2.snap
+  - name: core20
+    channel: stable
+    file: core20_1.snap
+  - name: snapd
+    file: snapd_3.snap
+`} {
+		tmpDir := c.MkDir()
+		s.mockClassicPreseedEnv(c, tmpDir, "")
+
+		seedYamlPath := filepath.Join(dirs.SnapSeedDirUnder(tmpDir), "seed.yaml")
+		c.Assert(os.MkdirAll(filepath.Dir(seedYamlPath), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(seedYamlPath, []byte(seedYaml), 0644), IsNil)
+
+		c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{SortSeedSnaps: true}), IsNil)
+
+		data, err := ioutil.ReadFile(seedYamlPath)
+		c.Assert(err, IsNil)
+		results = append(results, data)
+	}
+
+	// the same order, regardless of the original one
+	c.Check(string(results[0]), Equals, sortedSeedYaml)
+	c.Check(string(results[1]), Equals, sortedSeedYaml)
+}
+
+func (s *preseedSuite) TestRunPreseedSortSeedSnapsAlreadySorted(c *C) {
+	tmpDir := c.MkDir()
+	s.mockClassicPreseedEnv(c, tmpDir, "")
+
+	// already sorted, the file is not rewritten
+	seedYaml := "# comments are kept\n" + sortedSeedYaml
+	seedYamlPath := filepath.Join(dirs.SnapSeedDirUnder(tmpDir), "seed.yaml")
+	c.Assert(os.MkdirAll(filepath.Dir(seedYamlPath), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(seedYamlPath, []byte(seedYaml), 0644), IsNil)
+
+	c.Assert(preseed.Classic(tmpDir, &preseed.ClassicOptions{SortSeedSnaps: true}), IsNil)
+
+	data, err := ioutil.ReadFile(seedYamlPath)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, seedYaml)
+}
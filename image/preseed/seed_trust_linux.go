@@ -0,0 +1,92 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/snapcore/snapd/asserts"
+)
+
+// readTrustedAssertions reads the account and account-key assertions from
+// the given files.
+func readTrustedAssertions(files []string) ([]asserts.Assertion, error) {
+	var trusted []asserts.Assertion
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read trusted assertions: %v", err)
+		}
+		dec := asserts.NewDecoder(f)
+		for {
+			a, err := dec.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("cannot read trusted assertions from %s: %v", fn, err)
+			}
+			switch a.Type() {
+			case asserts.AccountType, asserts.AccountKeyType:
+				trusted = append(trusted, a)
+			default:
+				f.Close()
+				return nil, fmt.Errorf("cannot trust %s assertion from %s, only account and account-key assertions can be trusted", a.Type().Name, fn)
+			}
+		}
+		f.Close()
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("cannot read trusted assertions: no assertions found")
+	}
+	return trusted, nil
+}
+
+// verifySeedTrust verifies that all the assertions of the seed at seedDir
+// are signed by the keys from the assertions in trustedFiles, or by keys
+// those delegate to, instead of the default trusted keys.
+func verifySeedTrust(seedDir string, trustedFiles []string) error {
+	trusted, err := readTrustedAssertions(trustedFiles)
+	if err != nil {
+		return err
+	}
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: asserts.NewMemoryBackstore(),
+		Trusted:   trusted,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot use trusted assertions: %v", err)
+	}
+	commitTo := func(b *asserts.Batch) error {
+		return b.CommitTo(db, nil)
+	}
+
+	sd, err := seedOpen(seedDir, "")
+	if err != nil {
+		return err
+	}
+	if err := sd.LoadAssertions(db, commitTo); err != nil {
+		return fmt.Errorf("cannot preseed: seed at %s is not signed by the trusted keys: %v", seedDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+const snapshotManifestFile = "snapshot.json"
+
+type snapshotEntry struct {
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+}
+
+type snapshotManifest struct {
+	Entries []snapshotEntry `json:"entries"`
+}
+
+// snapshotRoots returns the directories, relative to the root of the
+// system, which contain all the preseed artifacts, without any nested
+// ones.
+func snapshotRoots() []string {
+	var candidates []string
+	for _, spec := range Artifacts() {
+		root := spec.Path
+		switch spec.Type {
+		case ArtifactFile:
+			root = filepath.Dir(root)
+		case ArtifactGlob:
+			// the longest directory prefix without glob patterns
+			for strings.ContainsAny(root, "*?[") {
+				root = filepath.Dir(root)
+			}
+		}
+		candidates = append(candidates, root)
+	}
+	sort.Strings(candidates)
+
+	var roots []string
+	for _, root := range candidates {
+		if len(roots) > 0 {
+			last := roots[len(roots)-1]
+			if root == last || strings.HasPrefix(root, last+"/") {
+				continue
+			}
+		}
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+// copyTree copies the contents of directory src into directory dst, which
+// is created if needed, preserving all attributes. Reflinks are used where
+// the filesystem supports them, making the copy cheap.
+func copyTree(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	if out, err := exec.Command("cp", "-a", "--reflink=auto", src+"/.", dst).CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot copy %s to %s: %v", src, dst, osutil.OutputErr(out, err))
+	}
+	return nil
+}
+
+// Snapshot saves the directories of the classic system at chrootDir which
+// preseeding modifies into snapshotDir, which must not exist or be empty,
+// so that Rollback can restore them.
+func Snapshot(chrootDir, snapshotDir string) error {
+	if entries, err := ioutil.ReadDir(snapshotDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("cannot snapshot into %s: directory is not empty", snapshotDir)
+	}
+
+	var manifest snapshotManifest
+	for _, root := range snapshotRoots() {
+		entry := snapshotEntry{Path: root}
+		src := filepath.Join(chrootDir, root)
+		if osutil.IsDirectory(src) {
+			entry.Exists = true
+			if err := copyTree(src, filepath.Join(snapshotDir, "rootfs", root)); err != nil {
+				return fmt.Errorf("cannot snapshot %s: %v", chrootDir, err)
+			}
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	data, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		return err
+	}
+	return osutil.AtomicWriteFile(filepath.Join(snapshotDir, snapshotManifestFile), data, 0644, 0)
+}
+
+// Rollback restores the directories of the classic system at chrootDir
+// saved by Snapshot into snapshotDir, reverting any changes made since,
+// including by preseeding. Unlike ResetPreseededChroot it does not rely on
+// knowing the artifacts, changes to the saved directories of any origin are
+// reverted.
+func Rollback(snapshotDir, chrootDir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(snapshotDir, snapshotManifestFile))
+	if err != nil {
+		return fmt.Errorf("cannot read snapshot: %v", err)
+	}
+	var manifest snapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("cannot read snapshot: %v", err)
+	}
+
+	// directories which are mountpoints are emptied but kept
+	mountpoints := make(map[string]bool)
+	if entries, err := osutil.LoadMountInfo(); err == nil {
+		for _, ent := range entries {
+			mountpoints[ent.MountDir] = true
+		}
+	}
+
+	for _, entry := range manifest.Entries {
+		dst := filepath.Join(chrootDir, entry.Path)
+		if err := removeAllOrEmpty(dst, mountpoints); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot roll back %s: %v", dst, err)
+		}
+		if !entry.Exists {
+			continue
+		}
+		if err := copyTree(filepath.Join(snapshotDir, "rootfs", entry.Path), dst); err != nil {
+			return fmt.Errorf("cannot roll back %s: %v", dst, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/testutil"
+)
+
+func (s *preseedSuite) TestSnapshotRollback(c *C) {
+	chrootDir := c.MkDir()
+	snapshotDir := filepath.Join(c.MkDir(), "snapshot")
+
+	// state of the system before preseeding
+	seedYaml := filepath.Join(chrootDir, dirs.SnapSeedDir, "seed.yaml")
+	debUnit := filepath.Join(chrootDir, dirs.SnapServicesDir, "snapd.service")
+	for _, path := range []string{seedYaml, debUnit} {
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte("orig"), 0644), IsNil)
+	}
+
+	c.Assert(preseed.Snapshot(chrootDir, snapshotDir), IsNil)
+	c.Check(filepath.Join(snapshotDir, "snapshot.json"), testutil.FilePresent)
+	c.Check(filepath.Join(snapshotDir, "rootfs", dirs.SnapSeedDir, "seed.yaml"), testutil.FileEquals, "orig")
+
+	// preseeding makes changes
+	mockPreseedArtifacts(c, chrootDir)
+	c.Assert(ioutil.WriteFile(debUnit, []byte("changed"), 0644), IsNil)
+	c.Assert(os.Remove(seedYaml), IsNil)
+
+	c.Assert(preseed.Rollback(snapshotDir, chrootDir), IsNil)
+
+	c.Check(seedYaml, testutil.FileEquals, "orig")
+	c.Check(debUnit, testutil.FileEquals, "orig")
+	c.Check(filepath.Join(chrootDir, dirs.SnapStateFile), testutil.FileAbsent)
+	c.Check(filepath.Join(chrootDir, dirs.SnapServicesDir, "snap-foo-1.mount"), testutil.FileAbsent)
+	// directories which did not exist are removed
+	c.Check(filepath.Join(chrootDir, dirs.SnapDataDir), testutil.FileAbsent)
+	// files other than in the snapshotted directories are kept
+	c.Check(filepath.Join(chrootDir, "/etc/hostname"), testutil.FilePresent)
+
+	// the snapshot can be used again
+	c.Assert(preseed.Rollback(snapshotDir, chrootDir), IsNil)
+	c.Check(seedYaml, testutil.FileEquals, "orig")
+}
+
+func (s *preseedSuite) TestSnapshotErrors(c *C) {
+	chrootDir := c.MkDir()
+	snapshotDir := c.MkDir()
+
+	c.Assert(ioutil.WriteFile(filepath.Join(snapshotDir, "foo"), nil, 0644), IsNil)
+	c.Check(preseed.Snapshot(chrootDir, snapshotDir), ErrorMatches, `cannot snapshot into .*: directory is not empty`)
+
+	c.Check(preseed.Rollback(c.MkDir(), chrootDir), ErrorMatches, `cannot read snapshot: open .*/snapshot.json: no such file or directory`)
+}
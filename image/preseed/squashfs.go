@@ -0,0 +1,68 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// squashfsMagic are the first bytes of a squashfs superblock.
+var squashfsMagic = []byte("hsqs")
+
+// squashfsCompressions maps the compression ids of the squashfs superblock
+// to their names.
+var squashfsCompressions = map[uint16]string{
+	1: "gzip",
+	2: "lzma",
+	3: "lzo",
+	4: "xz",
+	5: "lz4",
+	6: "zstd",
+}
+
+// squashfsCompression returns the name of the compression used by the
+// squashfs image at path, as read from its superblock.
+func squashfsCompression(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// the superblock starts with the magic, the compression id is a
+	// little endian 16 bit integer at offset 20
+	superblock := make([]byte, 22)
+	if _, err := io.ReadFull(f, superblock); err != nil {
+		return "", fmt.Errorf("cannot read squashfs superblock of %s: %v", path, err)
+	}
+	if !bytes.Equal(superblock[:4], squashfsMagic) {
+		return "", fmt.Errorf("%s is not a squashfs image", path)
+	}
+	id := binary.LittleEndian.Uint16(superblock[20:22])
+	name, ok := squashfsCompressions[id]
+	if !ok {
+		return "", fmt.Errorf("unknown squashfs compression %d of %s", id, path)
+	}
+	return name, nil
+}
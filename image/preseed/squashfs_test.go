@@ -0,0 +1,91 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/testutil"
+)
+
+// mockSquashfs writes the beginning of a squashfs superblock with the given
+// compression id.
+func mockSquashfs(c *C, compression byte) string {
+	superblock := make([]byte, 96)
+	copy(superblock, "hsqs")
+	superblock[20] = compression
+	path := filepath.Join(c.MkDir(), "core.snap")
+	c.Assert(ioutil.WriteFile(path, superblock, 0644), IsNil)
+	return path
+}
+
+func (s *preseedSuite) TestSquashfsCompression(c *C) {
+	for id, name := range map[byte]string{1: "gzip", 3: "lzo", 4: "xz", 5: "lz4", 6: "zstd"} {
+		comp, err := preseed.SquashfsCompression(mockSquashfs(c, id))
+		c.Assert(err, IsNil)
+		c.Check(comp, Equals, name)
+	}
+}
+
+func (s *preseedSuite) TestSquashfsCompressionErrors(c *C) {
+	path := mockSquashfs(c, 42)
+	_, err := preseed.SquashfsCompression(path)
+	c.Check(err, ErrorMatches, fmt.Sprintf(`unknown squashfs compression 42 of %s`, path))
+
+	notSquashfs := filepath.Join(c.MkDir(), "file")
+	c.Assert(ioutil.WriteFile(notSquashfs, make([]byte, 96), 0644), IsNil)
+	_, err = preseed.SquashfsCompression(notSquashfs)
+	c.Check(err, ErrorMatches, fmt.Sprintf(`%s is not a squashfs image`, notSquashfs))
+
+	short := filepath.Join(c.MkDir(), "short")
+	c.Assert(ioutil.WriteFile(short, []byte("hsqs"), 0644), IsNil)
+	_, err = preseed.SquashfsCompression(short)
+	c.Check(err, ErrorMatches, fmt.Sprintf(`cannot read squashfs superblock of %s: unexpected EOF`, short))
+}
+
+func (s *preseedSuite) TestRunPreseedUnsupportedSquashfsCompression(c *C) {
+	tmpDir := c.MkDir()
+	dirs.SetRootDir(tmpDir)
+	defer mockChrootDirs(c, tmpDir, true)()
+
+	restoreSyscallChroot := preseed.MockSyscallChroot(func(path string) error { return nil })
+	defer restoreSyscallChroot()
+
+	mockMountCmd := testutil.MockCommand(c, "mount", `echo "wrong fs type, bad option, bad superblock"
+exit 32
+`)
+	defer mockMountCmd.Restore()
+
+	targetSnapdRoot := filepath.Join(tmpDir, "target-core-mounted-here")
+	restoreMountPath := preseed.MockSnapdMountPath(targetSnapdRoot)
+	defer restoreMountPath()
+
+	coreSnap := mockSquashfs(c, 6)
+	restoreSystemSnapFromSeed := preseed.MockSystemSnapFromSeed(func(string, string) (string, []string, error) { return coreSnap, nil, nil })
+	defer restoreSystemSnapFromSeed()
+
+	c.Check(preseed.Classic(tmpDir, nil), ErrorMatches, `cannot mount .+ at .+ in preseed mode: host kernel cannot mount zstd squashfs, load a kernel module supporting it or extract the snap and preseed with SnapdRootDir\n'mount -t squashfs .*' failed with: wrong fs type, bad option, bad superblock\n`)
+}
@@ -0,0 +1,162 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/dirs"
+)
+
+var udevRuleOperators = []string{"==", "!=", "+=", "-=", ":=", "="}
+
+// parseUdevRule checks the syntax of a single udev rule, that is a comma
+// separated list of KEY[{attr}]<op>"value" pairs.
+func parseUdevRule(rule string) error {
+	rest := strings.TrimSpace(rule)
+	for n := 0; ; n++ {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			if n == 0 {
+				return fmt.Errorf("empty rule")
+			}
+			return nil
+		}
+		if n > 0 {
+			if rest[0] != ',' {
+				return fmt.Errorf("expected a comma before %q", rest)
+			}
+			rest = strings.TrimLeft(rest[1:], " \t")
+			if rest == "" {
+				// udev tolerates a trailing comma
+				return nil
+			}
+		}
+
+		// the key, optionally with an attribute
+		i := 0
+		for i < len(rest) && (rest[i] >= 'A' && rest[i] <= 'Z' || rest[i] == '_') {
+			i++
+		}
+		if i == 0 {
+			return fmt.Errorf("expected a key at %q", rest)
+		}
+		if i < len(rest) && rest[i] == '{' {
+			end := strings.IndexByte(rest[i:], '}')
+			if end <= 1 {
+				return fmt.Errorf("invalid attribute of key %q", rest[:i])
+			}
+			i += end + 1
+		}
+		key := rest[:i]
+		rest = strings.TrimLeft(rest[i:], " \t")
+
+		op := ""
+		for _, candidate := range udevRuleOperators {
+			if strings.HasPrefix(rest, candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return fmt.Errorf("expected an operator after key %q", key)
+		}
+		rest = strings.TrimLeft(rest[len(op):], " \t")
+
+		// the value, in double quotes
+		if !strings.HasPrefix(rest, `"`) {
+			return fmt.Errorf("expected a quoted value for key %q", key)
+		}
+		end := -1
+		for j := 1; j < len(rest); j++ {
+			if rest[j] == '\\' {
+				j++
+				continue
+			}
+			if rest[j] == '"' {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			return fmt.Errorf("unterminated value of key %q", key)
+		}
+		rest = rest[end+1:]
+	}
+}
+
+// validateUdevRulesFile checks the syntax of all the rules in the given
+// udev rules file. Comments, empty lines and line continuations are
+// handled like udev does.
+func validateUdevRulesFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rule string
+	ruleLine := 0
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if rule == "" {
+			ruleLine = lineNo
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+		}
+		if strings.HasSuffix(line, `\`) {
+			rule += strings.TrimSuffix(line, `\`)
+			continue
+		}
+		rule += line
+		if err := parseUdevRule(rule); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, ruleLine, err)
+		}
+		rule = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if rule != "" {
+		return fmt.Errorf("%s:%d: unterminated line continuation", path, ruleLine)
+	}
+	return nil
+}
+
+// validateUdevRules checks the syntax of the udev rules generated for
+// snaps by preseeding. It assumes running in the chroot.
+func validateUdevRules() error {
+	files, err := filepath.Glob(filepath.Join(dirs.SnapUdevRulesDir, "*-snap.*.rules"))
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if err := validateUdevRulesFile(path); err != nil {
+			return fmt.Errorf("invalid udev rules generated by preseeding: %v", err)
+		}
+	}
+	return nil
+}
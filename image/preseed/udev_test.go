@@ -0,0 +1,77 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/image/preseed"
+)
+
+func (s *preseedSuite) TestParseUdevRule(c *C) {
+	for _, t := range []struct {
+		rule string
+		err  string
+	}{
+		{`SUBSYSTEM=="input", KERNEL=="event[0-9]*", TAG+="snap_foo_bar"`, ""},
+		{`TAG=="snap_foo_bar", RUN+="/usr/lib/snapd/snap-device-helper $env{ACTION} snap_foo_bar $devpath $major:$minor"`, ""},
+		{`SUBSYSTEM=="usb", ATTRS{idVendor}=="0525", ATTRS{idProduct}=="a4a7", TAG+="snap_foo_bar",`, ""},
+		{`KERNEL=="foo\"bar"`, ""},
+		{``, "empty rule"},
+		{`subsystem=="input"`, `expected a key at "subsystem==\\"input\\""`},
+		{`SUBSYSTEM "input"`, `expected an operator after key "SUBSYSTEM"`},
+		{`SUBSYSTEM==input`, `expected a quoted value for key "SUBSYSTEM"`},
+		{`SUBSYSTEM=="input`, `unterminated value of key "SUBSYSTEM"`},
+		{`SUBSYSTEM=="input" TAG+="snap_foo_bar"`, `expected a comma before "TAG\+=\\"snap_foo_bar\\""`},
+		{`ATTRS{}=="foo"`, `invalid attribute of key "ATTRS"`},
+	} {
+		err := preseed.ParseUdevRule(t.rule)
+		if t.err == "" {
+			c.Check(err, IsNil, Commentf("%s", t.rule))
+		} else {
+			c.Check(err, ErrorMatches, t.err, Commentf("%s", t.rule))
+		}
+	}
+}
+
+func (s *preseedSuite) TestValidateUdevRulesFile(c *C) {
+	path := filepath.Join(c.MkDir(), "70-snap.foo.rules")
+	c.Assert(ioutil.WriteFile(path, []byte(`# This file is automatically generated.
+SUBSYSTEM=="input", \
+  KERNEL=="event[0-9]*", TAG+="snap_foo_bar"
+
+#SUBSYSTEM=="input" commented out
+TAG=="snap_foo_bar", RUN+="/usr/lib/snapd/snap-device-helper"
+`), 0644), IsNil)
+	c.Check(preseed.ValidateUdevRulesFile(path), IsNil)
+
+	c.Assert(ioutil.WriteFile(path, []byte(`# This file is automatically generated.
+SUBSYSTEM=="input", KERNEL=="event[0-9]*" TAG+="snap_foo_bar"
+`), 0644), IsNil)
+	c.Check(preseed.ValidateUdevRulesFile(path), ErrorMatches, fmt.Sprintf(`%s:2: expected a comma before .*`, path))
+
+	c.Assert(ioutil.WriteFile(path, []byte(`SUBSYSTEM=="input", \
+`), 0644), IsNil)
+	c.Check(preseed.ValidateUdevRulesFile(path), ErrorMatches, fmt.Sprintf(`%s:1: unterminated line continuation`, path))
+}
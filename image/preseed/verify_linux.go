@@ -0,0 +1,134 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/seed"
+)
+
+// preseedAssertionPath returns the path of the preseed assertion of the
+// given system of the UC20+ image prepared in prepareImageDir.
+func preseedAssertionPath(prepareImageDir, sysLabel string) string {
+	return filepath.Join(prepareImageDir, "system-seed", "systems", sysLabel, "preseed")
+}
+
+// VerifyPreseedAssertion cross-checks the preseed assertion of the given
+// system of the UC20+ image prepared in prepareImageDir against the system:
+// the digest of the preseed artifact is recomputed and the model and the
+// snaps of the assertion are compared with the seed, whose snaps are
+// checked against the model when it is loaded. It allows failing the build
+// early if the signing step produced an assertion which does not match.
+// All the mismatches are reported in the returned error. If sysLabel is
+// empty, the image is expected to contain a single system.
+func VerifyPreseedAssertion(prepareImageDir, sysLabel string) error {
+	sysLabel, err := systemForPreseeding(filepath.Join(prepareImageDir, "system-seed"), sysLabel)
+	if err != nil {
+		return err
+	}
+	assertionPath := preseedAssertionPath(prepareImageDir, sysLabel)
+	data, err := ioutil.ReadFile(assertionPath)
+	if err != nil {
+		return fmt.Errorf("cannot read preseed assertion: %v", err)
+	}
+	a, err := asserts.Decode(data)
+	if err != nil {
+		return fmt.Errorf("cannot decode preseed assertion %s: %v", assertionPath, err)
+	}
+	preseedAs, ok := a.(*asserts.Preseed)
+	if !ok {
+		return fmt.Errorf("cannot use %s as preseed assertion: unexpected assertion type %q", assertionPath, a.Type().Name)
+	}
+
+	var mismatches []string
+	mismatch := func(format string, args ...interface{}) {
+		mismatches = append(mismatches, fmt.Sprintf(format, args...))
+	}
+
+	if preseedAs.SystemLabel() != sysLabel {
+		mismatch("system label %q, expected %q", preseedAs.SystemLabel(), sysLabel)
+	}
+
+	artifactPath := filepath.Join(filepath.Dir(assertionPath), "preseed.tgz")
+	dgst, _, err := osutil.FileDigest(artifactPath, crypto.SHA3_384)
+	if err != nil {
+		return fmt.Errorf("cannot compute digest of the preseed artifact: %v", err)
+	}
+	artifactDigest, err := asserts.EncodeDigest(crypto.SHA3_384, dgst)
+	if err != nil {
+		return err
+	}
+	if preseedAs.ArtifactSHA3_384() != artifactDigest {
+		mismatch("artifact digest %s, computed %s", preseedAs.ArtifactSHA3_384(), artifactDigest)
+	}
+
+	sd, err := loadSeed(filepath.Join(prepareImageDir, "system-seed"), sysLabel)
+	if err != nil {
+		return err
+	}
+	model := sd.Model()
+	if preseedAs.Series() != model.Series() || preseedAs.BrandID() != model.BrandID() || preseedAs.Model() != model.Model() {
+		mismatch("model %s/%s/%s, expected %s/%s/%s", preseedAs.Series(), preseedAs.BrandID(), preseedAs.Model(),
+			model.Series(), model.BrandID(), model.Model())
+	}
+
+	runSnaps, err := sd.ModeSnaps("run")
+	if err != nil {
+		return err
+	}
+	allSnaps := append(sd.EssentialSnaps(), runSnaps...)
+	seedSnaps := make(map[string]*seed.Snap, len(allSnaps))
+	for _, sn := range allSnaps {
+		seedSnaps[sn.SnapName()] = sn
+	}
+	asserted := make(map[string]bool)
+	for _, psn := range preseedAs.Snaps() {
+		asserted[psn.Name] = true
+		sn, ok := seedSnaps[psn.Name]
+		if !ok {
+			mismatch("snap %q is not in the seed", psn.Name)
+			continue
+		}
+		if psn.SnapID != sn.ID() {
+			mismatch("snap %q has id %q, the seed has %q", psn.Name, psn.SnapID, sn.ID())
+		}
+		// the revisions of unasserted snaps are local
+		if sn.ID() != "" && psn.Revision != sn.SideInfo.Revision.N {
+			mismatch("snap %q has revision %d, the seed has %s", psn.Name, psn.Revision, sn.SideInfo.Revision)
+		}
+	}
+	for _, sn := range allSnaps {
+		if !asserted[sn.SnapName()] {
+			mismatch("snap %q of the seed is missing", sn.SnapName())
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("preseed assertion of system %s does not match:\n - %s", sysLabel, strings.Join(mismatches, "\n - "))
+	}
+	return nil
+}
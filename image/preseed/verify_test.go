@@ -0,0 +1,132 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preseed_test
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+	"github.com/snapcore/snapd/image/preseed"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+)
+
+func (s *preseedSuite) mockPreseedArtifact(c *C, prepareImageDir string, snaps []interface{}, overrides map[string]interface{}) {
+	sysDir := filepath.Join(prepareImageDir, "system-seed/systems/20220203")
+	c.Assert(os.MkdirAll(sysDir, 0755), IsNil)
+	artifactPath := filepath.Join(sysDir, "preseed.tgz")
+	c.Assert(ioutil.WriteFile(artifactPath, []byte("artifact"), 0644), IsNil)
+
+	dgst, _, err := osutil.FileDigest(artifactPath, crypto.SHA3_384)
+	c.Assert(err, IsNil)
+	artifactDigest, err := asserts.EncodeDigest(crypto.SHA3_384, dgst)
+	c.Assert(err, IsNil)
+
+	headers := map[string]interface{}{
+		"type":              "preseed",
+		"authority-id":      "brand",
+		"series":            "16",
+		"brand-id":          "brand",
+		"model":             "baz-3000",
+		"system-label":      "20220203",
+		"artifact-sha3-384": artifactDigest,
+		"snaps":             snaps,
+		"timestamp":         time.Now().UTC().Format(time.RFC3339),
+	}
+	for k, v := range overrides {
+		headers[k] = v
+	}
+	brandStack := assertstest.NewStoreStack("brand", nil)
+	a, err := brandStack.RootSigning.Sign(asserts.PreseedType, headers, nil, "")
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(sysDir, "preseed"), asserts.Encode(a), 0644), IsNil)
+}
+
+func mockVerifySeed(c *C) (restore func()) {
+	return preseed.MockSeed(func(seedDir, label string) (seed.Seed, error) {
+		c.Check(label, Equals, "20220203")
+		return &Fake16Seed{
+			AssertsModel: mockUC20Model(),
+			Essential: []*seed.Snap{
+				{SideInfo: &snap.SideInfo{RealName: "pc-kernel", SnapID: "pckernelidididididididididididid", Revision: snap.R(1)}},
+				{SideInfo: &snap.SideInfo{RealName: "pc", SnapID: "pcididididididididididididididid", Revision: snap.R(2)}},
+			},
+			RunModeSnaps: []*seed.Snap{
+				{SideInfo: &snap.SideInfo{RealName: "local", Revision: snap.R(-1)}},
+			},
+		}, nil
+	})
+}
+
+func (s *preseedSuite) TestVerifyPreseedAssertionHappy(c *C) {
+	tmpDir := c.MkDir()
+	defer mockVerifySeed(c)()
+
+	s.mockPreseedArtifact(c, tmpDir, []interface{}{
+		map[string]interface{}{"name": "pc-kernel", "id": "pckernelidididididididididididid", "revision": "1"},
+		map[string]interface{}{"name": "pc", "id": "pcididididididididididididididid", "revision": "2"},
+		map[string]interface{}{"name": "local"},
+	}, nil)
+
+	c.Assert(preseed.VerifyPreseedAssertion(tmpDir, "20220203"), IsNil)
+	// the single system of the image is verified by default
+	c.Assert(preseed.VerifyPreseedAssertion(tmpDir, ""), IsNil)
+
+	c.Check(preseed.VerifyPreseedAssertion(tmpDir, "20220501"), ErrorMatches,
+		`cannot find system "20220501" for preseeding, available systems: 20220203`)
+}
+
+func (s *preseedSuite) TestVerifyPreseedAssertionMismatch(c *C) {
+	tmpDir := c.MkDir()
+	defer mockVerifySeed(c)()
+
+	s.mockPreseedArtifact(c, tmpDir, []interface{}{
+		map[string]interface{}{"name": "pc-kernel", "id": "pckernelidididididididididididid", "revision": "3"},
+		map[string]interface{}{"name": "other", "id": "otherididididididididididididida", "revision": "1"},
+		map[string]interface{}{"name": "local"},
+	}, map[string]interface{}{
+		"model":             "other-model",
+		"artifact-sha3-384": "KPIl7M4vQ9d4AUjkoU41TGAwtOMLc_bWUCeW8AvdRWD4_xcP60Oo4ABs1No7BtXj",
+	})
+
+	err := preseed.VerifyPreseedAssertion(tmpDir, "20220203")
+	c.Assert(err, ErrorMatches, `(?s)preseed assertion of system 20220203 does not match:
+ - artifact digest KPIl7M4vQ9d4AUjkoU41TGAwtOMLc_bWUCeW8AvdRWD4_xcP60Oo4ABs1No7BtXj, computed .*
+ - model 16/brand/other-model, expected 16/brand/baz-3000
+ - snap "pc-kernel" has revision 3, the seed has 1
+ - snap "other" is not in the seed
+ - snap "pc" of the seed is missing`)
+}
+
+func (s *preseedSuite) TestVerifyPreseedAssertionMissing(c *C) {
+	tmpDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(tmpDir, "system-seed/systems/20220203"), 0755), IsNil)
+
+	err := preseed.VerifyPreseedAssertion(tmpDir, "20220203")
+	c.Assert(err, ErrorMatches, `cannot read preseed assertion: open .*/system-seed/systems/20220203/preseed: no such file or directory`)
+}
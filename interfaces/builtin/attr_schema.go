@@ -0,0 +1,143 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package builtin
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/strutil"
+)
+
+// attrType is the type of the value of an interface attribute.
+type attrType int
+
+const (
+	attrString attrType = iota
+	attrBool
+	attrInt
+	attrStringList
+)
+
+func (t attrType) String() string {
+	switch t {
+	case attrString:
+		return "a string"
+	case attrBool:
+		return "a boolean"
+	case attrInt:
+		return "an int"
+	case attrStringList:
+		return "a list of strings"
+	}
+	return fmt.Sprintf("of unknown type %d", int(t))
+}
+
+// attrSpec describes the constraints on a single attribute of a plug or a
+// slot.
+type attrSpec struct {
+	typ      attrType
+	required bool
+	// enum lists the accepted values of a string attribute, or of each
+	// element of a list of strings
+	enum []string
+	// regexp must be matched by a string attribute, or by each element
+	// of a list of strings
+	regexp *regexp.Regexp
+}
+
+// attrSchema describes the attributes of the plugs or of the slots of an
+// interface, by attribute name. Attributes not in the schema are left
+// alone as they may be used by the policy or by the interface itself.
+type attrSchema map[string]attrSpec
+
+// validate checks the attributes of a plug or slot (side) of the named
+// interface against the schema. The checks are done in the order of the
+// attribute names so that the reported error is stable.
+func (schema attrSchema) validate(ifaceName, side string, attrs interfaces.Attrer) error {
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec := schema[name]
+		value, ok := attrs.Lookup(name)
+		if !ok {
+			if spec.required {
+				return fmt.Errorf("%s %s must have a %s attribute", ifaceName, side, name)
+			}
+			continue
+		}
+		if err := spec.validate(value); err != nil {
+			return fmt.Errorf("%s %s %s %v", ifaceName, side, name, err)
+		}
+	}
+	return nil
+}
+
+func (spec *attrSpec) validate(value interface{}) error {
+	switch spec.typ {
+	case attrString:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("attribute must be %s", spec.typ)
+		}
+		return spec.validateString(s)
+	case attrBool:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("attribute must be %s", spec.typ)
+		}
+	case attrInt:
+		if _, ok := value.(int64); !ok {
+			return fmt.Errorf("attribute must be %s", spec.typ)
+		}
+	case attrStringList:
+		l, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("attribute must be %s", spec.typ)
+		}
+		for _, v := range l {
+			s, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("attribute must be %s", spec.typ)
+			}
+			if err := spec.validateString(s); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("internal error: unknown attribute type %d", int(spec.typ))
+	}
+	return nil
+}
+
+func (spec *attrSpec) validateString(s string) error {
+	if len(spec.enum) > 0 && !strutil.ListContains(spec.enum, s) {
+		return fmt.Errorf("%q is invalid, must be one of %s", s, strutil.Quoted(spec.enum))
+	}
+	if spec.regexp != nil && !spec.regexp.MatchString(s) {
+		return fmt.Errorf("%q is invalid", s)
+	}
+	return nil
+}
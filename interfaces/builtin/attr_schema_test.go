@@ -0,0 +1,127 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package builtin
+
+import (
+	"regexp"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/interfaces"
+)
+
+type attrSchemaSuite struct{}
+
+var _ = Suite(&attrSchemaSuite{})
+
+var testAttrSchema = attrSchema{
+	"name":    {typ: attrString, required: true, regexp: regexp.MustCompile(`^[a-z]+$`)},
+	"mode":    {typ: attrString, enum: []string{"ro", "rw"}},
+	"enabled": {typ: attrBool},
+	"count":   {typ: attrInt},
+	"paths":   {typ: attrStringList, regexp: regexp.MustCompile(`^/dev/`)},
+}
+
+func (s *attrSchemaSuite) TestValidateHappy(c *C) {
+	plug := MockPlug(c, `name: consumer
+version: 0
+plugs:
+  schema:
+    name: foo
+    mode: rw
+    enabled: true
+    count: 2
+    paths: [/dev/foo, /dev/bar]
+    other: [1, 2]
+`, nil, "schema")
+	c.Check(testAttrSchema.validate("schema", "plug", plug), IsNil)
+
+	// only required attributes
+	plug = MockPlug(c, `name: consumer
+version: 0
+plugs:
+  schema:
+    name: foo
+`, nil, "schema")
+	c.Check(testAttrSchema.validate("schema", "plug", plug), IsNil)
+}
+
+func (s *attrSchemaSuite) TestValidateErrors(c *C) {
+	for _, tc := range []struct {
+		attrs string
+		err   string
+	}{
+		{"mode: ro", `schema plug must have a name attribute`},
+		{"name: 1", `schema plug name attribute must be a string`},
+		{"name: Foo", `schema plug name "Foo" is invalid`},
+		{"name: foo\n    mode: wo", `schema plug mode "wo" is invalid, must be one of "ro", "rw"`},
+		{"name: foo\n    enabled: yes-please", `schema plug enabled attribute must be a boolean`},
+		{"name: foo\n    count: lots", `schema plug count attribute must be an int`},
+		{"name: foo\n    paths: /dev/foo", `schema plug paths attribute must be a list of strings`},
+		{"name: foo\n    paths: [/dev/foo, 1]", `schema plug paths attribute must be a list of strings`},
+		{"name: foo\n    paths: [/dev/foo, /sys/foo]", `schema plug paths "/sys/foo" is invalid`},
+		// errors are reported in the order of the attribute names
+		{"name: 1\n    count: lots", `schema plug count attribute must be an int`},
+	} {
+		plug := MockPlug(c, `name: consumer
+version: 0
+plugs:
+  schema:
+    `+tc.attrs+`
+`, nil, "schema")
+		err := testAttrSchema.validate("schema", "plug", plug)
+		c.Check(err, ErrorMatches, tc.err, Commentf("attrs: %s", tc.attrs))
+	}
+}
+
+func (s *attrSchemaSuite) TestCommonInterfaceSchema(c *C) {
+	iface := &commonInterface{
+		name:      "schema",
+		plugAttrs: attrSchema{"mode": {typ: attrString, enum: []string{"ro", "rw"}}},
+		slotAttrs: attrSchema{"name": {typ: attrString, required: true}},
+	}
+	plug, plugInfo := MockConnectedPlug(c, `name: consumer
+version: 0
+plugs:
+  schema:
+    mode: ro
+`, nil, "schema")
+	slot, slotInfo := MockConnectedSlot(c, `name: producer
+version: 0
+slots:
+  schema:
+`, nil, "schema")
+
+	c.Check(interfaces.BeforePreparePlug(iface, plugInfo), IsNil)
+	c.Check(interfaces.BeforePrepareSlot(iface, slotInfo), ErrorMatches, `schema slot must have a name attribute`)
+	c.Check(interfaces.BeforeConnectPlug(iface, plug), IsNil)
+	c.Check(iface.BeforeConnectSlot(slot), ErrorMatches, `schema slot must have a name attribute`)
+
+	// dynamic attributes are checked when connecting
+	plug = interfaces.NewConnectedPlug(plugInfo, nil, map[string]interface{}{"mode": "wo"})
+	c.Check(interfaces.BeforeConnectPlug(iface, plug), ErrorMatches, `schema plug mode "wo" is invalid, must be one of "ro", "rw"`)
+	slot = interfaces.NewConnectedSlot(slotInfo, nil, map[string]interface{}{"name": "foo"})
+	c.Check(iface.BeforeConnectSlot(slot), IsNil)
+
+	// interfaces without a schema accept any attribute
+	iface = &commonInterface{name: "schema"}
+	c.Check(interfaces.BeforePrepareSlot(iface, slotInfo), IsNil)
+	c.Check(interfaces.BeforeConnectPlug(iface, plug), IsNil)
+}
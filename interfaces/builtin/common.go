@@ -54,6 +54,11 @@ type commonInterface struct {
 	baseDeclarationPlugs string
 	baseDeclarationSlots string
 
+	// plugAttrs and slotAttrs are the schemas of the attributes of the
+	// plugs and slots, checked when preparing and before connecting
+	plugAttrs attrSchema
+	slotAttrs attrSchema
+
 	connectedPlugAppArmor  string
 	connectedPlugSecComp   string
 	connectedPlugUDev      []string
@@ -97,6 +102,28 @@ func (iface *commonInterface) StaticInfo() interfaces.StaticInfo {
 	}
 }
 
+// BeforePreparePlug checks the plug attributes against the plug schema.
+func (iface *commonInterface) BeforePreparePlug(plug *snap.PlugInfo) error {
+	return iface.plugAttrs.validate(iface.name, "plug", plug)
+}
+
+// BeforePrepareSlot checks the slot attributes against the slot schema.
+func (iface *commonInterface) BeforePrepareSlot(slot *snap.SlotInfo) error {
+	return iface.slotAttrs.validate(iface.name, "slot", slot)
+}
+
+// BeforeConnectPlug checks the plug attributes, including the dynamic ones,
+// against the plug schema.
+func (iface *commonInterface) BeforeConnectPlug(plug *interfaces.ConnectedPlug) error {
+	return iface.plugAttrs.validate(iface.name, "plug", plug)
+}
+
+// BeforeConnectSlot checks the slot attributes, including the dynamic ones,
+// against the slot schema.
+func (iface *commonInterface) BeforeConnectSlot(slot *interfaces.ConnectedSlot) error {
+	return iface.slotAttrs.validate(iface.name, "slot", slot)
+}
+
 func (iface *commonInterface) ServicePermanentPlug(plug *snap.PlugInfo) []string {
 	return iface.serviceSnippets
 }
@@ -63,47 +63,21 @@ capability net_admin,
 //   as described above
 var familyNameRegexp = regexp.MustCompile(`^[a-z]+[a-z0-9-]*[^\-]$`)
 
-// BeforePrepareSlot checks the slot definition is valid
-func (iface *netlinkDriverInterface) BeforePrepareSlot(slot *snap.SlotInfo) error {
-	// Must have a protocol number identified as family
-	number, ok := slot.Attrs["family"]
-	if !ok {
-		return fmt.Errorf("netlink-driver slot must have a family number attribute")
-	}
-
-	// Valid values of number
-	if _, ok := number.(int64); !ok {
-		return fmt.Errorf("netlink-driver slot family number attribute must be an int")
-	}
-
-	// must also have a family-name, used for identifying plug <-> slot
-	return validateFamilyNameAttr(slot, "slot")
+var netlinkDriverFamilyNameAttr = attrSpec{
+	typ:      attrString,
+	required: true,
+	regexp:   familyNameRegexp,
 }
 
-func validateFamilyNameAttr(a interfaces.Attrer, side string) error {
-	name, ok := a.Lookup("family-name")
-	if !ok {
-		return fmt.Errorf("netlink-driver %s must have a family-name attribute", side)
-	}
-
-	nameStr, ok := name.(string)
-	if !ok {
-		return fmt.Errorf("netlink-driver %s family-name attribute must be a string", side)
-	}
-
-	// ensure it matches the regex
-	if !familyNameRegexp.MatchString(nameStr) {
-		return fmt.Errorf("netlink-driver %s family-name %q is invalid", side, nameStr)
-	}
-
-	// attribute is good
-	return nil
-
+// the slot must have a protocol number identified as family and a
+// family-name, used for identifying plug <-> slot
+var netlinkDriverSlotAttrs = attrSchema{
+	"family":      {typ: attrInt, required: true},
+	"family-name": netlinkDriverFamilyNameAttr,
 }
 
-// BeforePreparePlug checks the plug definition is valid
-func (iface *netlinkDriverInterface) BeforePreparePlug(plug *snap.PlugInfo) error {
-	return validateFamilyNameAttr(plug, "plug")
+var netlinkDriverPlugAttrs = attrSchema{
+	"family-name": netlinkDriverFamilyNameAttr,
 }
 
 func (iface *netlinkDriverInterface) SecCompConnectedPlug(spec *seccomp.Specification, plug *interfaces.ConnectedPlug, slot *interfaces.ConnectedSlot) error {
@@ -147,6 +121,8 @@ func init() {
 			summary:               netlinkDriverSummary,
 			baseDeclarationSlots:  netlinkDriverBaseDeclarationSlots,
 			connectedPlugAppArmor: netlinkDriverConnectedPlugApparmor,
+			plugAttrs:             netlinkDriverPlugAttrs,
+			slotAttrs:             netlinkDriverSlotAttrs,
 		},
 	})
 }
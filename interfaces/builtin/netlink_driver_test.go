@@ -204,11 +204,11 @@ func (s *NetlinkDriverInterfaceSuite) TestSanitizeSlotGadgetSnap(c *C) {
 
 	// slots without number attribute are rejected
 	c.Assert(interfaces.BeforePrepareSlot(s.iface, s.gadgetMissingNumberSlotInfo), ErrorMatches,
-		"netlink-driver slot must have a family number attribute")
+		"netlink-driver slot must have a family attribute")
 
 	// slots with number attribute that isnt a number
 	c.Assert(interfaces.BeforePrepareSlot(s.iface, s.gadgetBadNumberSlotInfo), ErrorMatches,
-		"netlink-driver slot family number attribute must be an int")
+		"netlink-driver slot family attribute must be an int")
 
 	// slots without family-name
 	c.Assert(interfaces.BeforePrepareSlot(s.iface, s.gadgetMissingNameSlotInfo), ErrorMatches,
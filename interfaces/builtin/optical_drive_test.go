@@ -104,6 +104,19 @@ func (s *OpticalDriveInterfaceSuite) TestSanitizePlug(c *C) {
 	c.Assert(interfaces.BeforePreparePlug(s.iface, s.testPlugWritableInfo), IsNil)
 }
 
+func (s *OpticalDriveInterfaceSuite) TestSanitizePlugWriteNotBool(c *C) {
+	const mockSnapYaml = `name: consumer
+version: 0
+plugs:
+ optical-drive:
+  write: "yes"
+`
+	info := snaptest.MockInfo(c, mockSnapYaml, nil)
+	plug := info.Plugs["optical-drive"]
+	c.Assert(interfaces.BeforePreparePlug(s.iface, plug), ErrorMatches,
+		`optical-drive plug write attribute must be a boolean`)
+}
+
 func (s *OpticalDriveInterfaceSuite) TestAppArmorSpec(c *C) {
 	type options struct {
 		appName         string
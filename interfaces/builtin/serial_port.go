@@ -223,15 +223,112 @@ func (iface *serialPortInterface) HotplugDeviceDetected(di *hotplug.HotplugDevic
 			"path": di.DeviceName(),
 		},
 	}
-	if vendor, ok := di.Attribute("ID_VENDOR_ID"); ok {
+	vendor, ok := di.Attribute("ID_VENDOR_ID")
+	if ok {
 		slot.Attrs["usb-vendor"] = vendor
 	}
-	if product, ok := di.Attribute("ID_MODEL_ID"); ok {
+	product, ok := di.Attribute("ID_MODEL_ID")
+	if ok {
 		slot.Attrs["usb-product"] = product
 	}
+	if chip := usbSerialChip(vendor, product); chip != "" {
+		slot.NameVars = usbSerialNameVars(di, chip)
+		slot.Name = usbSerialSlotName(slot.NameVars)
+	}
 	return &slot, nil
 }
 
+// usbSerialChips maps the vendor and product ids of common USB serial
+// adapters to the family of their chip. FTDI adapters are identified by
+// the vendor id alone.
+var usbSerialChips = map[string]string{
+	"0403":      "ftdi",
+	"10c4:ea60": "cp210x",
+	"10c4:ea61": "cp210x",
+	"10c4:ea70": "cp210x",
+	"10c4:ea71": "cp210x",
+	"1a86:5523": "ch340",
+	"1a86:7522": "ch340",
+	"1a86:7523": "ch340",
+}
+
+func usbSerialChip(vendor, product string) string {
+	vendor = strings.ToLower(vendor)
+	if chip, ok := usbSerialChips[vendor]; ok {
+		return chip
+	}
+	return usbSerialChips[vendor+":"+strings.ToLower(product)]
+}
+
+// usbPortPathPattern matches the USB part of the ID_PATH of a device, eg.
+// pci-0000:00:14.0-usb-0:1.4:1.0, capturing the port topology (1.4).
+var usbPortPathPattern = regexp.MustCompile(`-usb-[0-9]+:([0-9.]+):[0-9]+\.[0-9]+$`)
+
+// slotNamePart turns s into a string usable as part of a slot name.
+func slotNamePart(s string) string {
+	var out []rune
+	dash := true
+	for _, c := range strings.ToLower(s) {
+		switch {
+		case c >= 'a' && c <= 'z' || c >= '0' && c <= '9':
+			out = append(out, c)
+			dash = false
+		case !dash:
+			out = append(out, '-')
+			dash = true
+		}
+	}
+	return strings.TrimRight(string(out), "-")
+}
+
+// usbSerialNameVars returns the values of the slot name template variables
+// of a USB serial adapter, derived from properties which are stable across
+// reboots: the serial number of the adapter and the port it is plugged in.
+func usbSerialNameVars(di *hotplug.HotplugDeviceInfo, chip string) map[string]string {
+	vars := map[string]string{
+		hotplug.NameVarChip: chip,
+	}
+	if serial, ok := di.Attribute("ID_SERIAL_SHORT"); ok {
+		if serial := slotNamePart(serial); serial != "" {
+			vars[hotplug.NameVarSerial] = serial
+		}
+	}
+	if path, ok := di.Attribute("ID_PATH"); ok {
+		if m := usbPortPathPattern.FindStringSubmatch(path); m != nil {
+			vars[hotplug.NameVarPort] = strings.Replace(m[1], ".", "-", -1)
+		}
+	}
+	if ifaceNum, ok := di.Attribute("ID_USB_INTERFACE_NUM"); ok {
+		if n, err := strconv.ParseInt(ifaceNum, 16, 64); err == nil {
+			vars[hotplug.NameVarInterface] = strconv.FormatInt(n, 10)
+		}
+	}
+	return vars
+}
+
+// usbSerialSlotName returns the default slot name of a USB serial adapter,
+// eg. ftdi-a1b2c3d4, or ch340-port-1-4 for adapters without a serial number.
+// The USB interface is added for the ports of multi-port adapters other
+// than the first one, eg. ftdi-a1b2c3d4-if1.
+func usbSerialSlotName(vars map[string]string) string {
+	var name string
+	switch {
+	case vars[hotplug.NameVarSerial] != "":
+		name = vars[hotplug.NameVarChip] + "-" + vars[hotplug.NameVarSerial]
+	case vars[hotplug.NameVarPort] != "":
+		name = vars[hotplug.NameVarChip] + "-port-" + vars[hotplug.NameVarPort]
+	default:
+		return ""
+	}
+	if ifaceNum := vars[hotplug.NameVarInterface]; ifaceNum != "" && ifaceNum != "0" {
+		name += "-if" + ifaceNum
+	}
+	if err := snap.ValidateSlotName(name); err != nil {
+		return ""
+	}
+	return name
+}
+
 func slotDeviceAttrEqual(di *hotplug.HotplugDeviceInfo, devinfoAttribute string, slotAttributeValue int64) bool {
 	var attr string
 	var ok bool
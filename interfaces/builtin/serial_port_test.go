@@ -636,6 +636,53 @@ func (s *SerialPortInterfaceSuite) TestHotplugDeviceDetected(c *C) {
 	c.Assert(proposedSlot, DeepEquals, &hotplug.ProposedSlot{Attrs: map[string]interface{}{"path": "/dev/ttyUSB0", "usb-vendor": "1234", "usb-product": "5678"}})
 }
 
+func (s *SerialPortInterfaceSuite) TestHotplugDeviceDetectedUSBSerialAdapters(c *C) {
+	hotplugIface := s.iface.(hotplug.Definer)
+	for _, tc := range []struct {
+		env      map[string]string
+		name     string
+		nameVars map[string]string
+	}{{
+		// FTDI adapter with a serial number
+		env:      map[string]string{"ID_VENDOR_ID": "0403", "ID_MODEL_ID": "6001", "ID_SERIAL_SHORT": "A10KZP4Q", "ID_PATH": "pci-0000:00:14.0-usb-0:1.4:1.0", "ID_USB_INTERFACE_NUM": "00"},
+		name:     "ftdi-a10kzp4q",
+		nameVars: map[string]string{"chip": "ftdi", "serial": "a10kzp4q", "port": "1-4", "interface": "0"},
+	}, {
+		// second port of a multi-port FTDI adapter
+		env:      map[string]string{"ID_VENDOR_ID": "0403", "ID_MODEL_ID": "6011", "ID_SERIAL_SHORT": "FT4232_01", "ID_PATH": "platform-3f980000.usb-usb-0:1.2:1.1", "ID_USB_INTERFACE_NUM": "01"},
+		name:     "ftdi-ft4232-01-if1",
+		nameVars: map[string]string{"chip": "ftdi", "serial": "ft4232-01", "port": "1-2", "interface": "1"},
+	}, {
+		// CP210x adapter
+		env:      map[string]string{"ID_VENDOR_ID": "10C4", "ID_MODEL_ID": "EA60", "ID_SERIAL_SHORT": "0001", "ID_PATH": "pci-0000:00:14.0-usb-0:2:1.0", "ID_USB_INTERFACE_NUM": "00"},
+		name:     "cp210x-0001",
+		nameVars: map[string]string{"chip": "cp210x", "serial": "0001", "port": "2", "interface": "0"},
+	}, {
+		// CH340 adapters do not have a serial number, the port is used
+		env:      map[string]string{"ID_VENDOR_ID": "1a86", "ID_MODEL_ID": "7523", "ID_PATH": "pci-0000:00:14.0-usb-0:1.3.2:1.0", "ID_USB_INTERFACE_NUM": "00"},
+		name:     "ch340-port-1-3-2",
+		nameVars: map[string]string{"chip": "ch340", "port": "1-3-2", "interface": "0"},
+	}, {
+		// nothing stable to derive the name from
+		env:      map[string]string{"ID_VENDOR_ID": "1a86", "ID_MODEL_ID": "7523"},
+		nameVars: map[string]string{"chip": "ch340"},
+	}} {
+		env := map[string]string{"DEVPATH": "/sys/foo/bar", "DEVNAME": "/dev/ttyUSB0", "ACTION": "add", "SUBSYSTEM": "tty", "ID_BUS": "usb"}
+		for k, v := range tc.env {
+			env[k] = v
+		}
+		di, err := hotplug.NewHotplugDeviceInfo(env)
+		c.Assert(err, IsNil)
+		proposedSlot, err := hotplugIface.HotplugDeviceDetected(di)
+		c.Assert(err, IsNil)
+		c.Check(proposedSlot, DeepEquals, &hotplug.ProposedSlot{
+			Name:     tc.name,
+			Attrs:    map[string]interface{}{"path": "/dev/ttyUSB0", "usb-vendor": tc.env["ID_VENDOR_ID"], "usb-product": tc.env["ID_MODEL_ID"]},
+			NameVars: tc.nameVars,
+		}, Commentf("env: %v", tc.env))
+	}
+}
+
 func (s *SerialPortInterfaceSuite) TestHotplugDeviceDetectedNotSerialPort(c *C) {
 	hotplugIface := s.iface.(hotplug.Definer)
 	di, err := hotplug.NewHotplugDeviceInfo(map[string]string{"DEVPATH": "/sys/foo/bar", "DEVNAME": "/dev/other", "ID_VENDOR_ID": "1234", "ID_MODEL_ID": "5678", "ACTION": "add", "SUBSYSTEM": "tty", "ID_BUS": "usb"})
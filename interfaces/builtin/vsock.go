@@ -0,0 +1,61 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package builtin
+
+// https://man7.org/linux/man-pages/man7/vsock.7.html
+const vsockSummary = `allows access to virtio-vsock sockets for host/guest communication`
+
+const vsockBaseDeclarationSlots = `
+  vsock:
+    allow-installation:
+      slot-snap-type:
+        - core
+    deny-auto-connection: true
+`
+
+const vsockConnectedPlugAppArmor = `
+# Description: Can use AF_VSOCK sockets to communicate between a virtual
+# machine and its host, eg. for guest agents.
+network vsock,
+`
+
+const vsockConnectedPlugSecComp = `
+# Description: Can use AF_VSOCK sockets to communicate between a virtual
+# machine and its host, eg. for guest agents.
+bind
+listen
+accept
+accept4
+
+# We allow AF_VSOCK in the default template since it is mediated via the AppArmor rule
+#socket AF_VSOCK
+`
+
+func init() {
+	registerIface(&commonInterface{
+		name:                  "vsock",
+		summary:               vsockSummary,
+		implicitOnCore:        true,
+		implicitOnClassic:     true,
+		baseDeclarationSlots:  vsockBaseDeclarationSlots,
+		connectedPlugAppArmor: vsockConnectedPlugAppArmor,
+		connectedPlugSecComp:  vsockConnectedPlugSecComp,
+	})
+}
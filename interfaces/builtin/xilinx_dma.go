@@ -52,8 +52,10 @@ const xilinxDmaConnectedPlugAppArmor = `
 `
 
 // The xdma subsystem alone should serve as a unique identifier for all relevant devices
+const xilinxDmaUDevRule = `SUBSYSTEM=="xdma"`
+
 var xilinxDmaConnectedPlugUDev = []string{
-	`SUBSYSTEM=="xdma"`,
+	xilinxDmaUDevRule,
 }
 
 func init() {
@@ -0,0 +1,82 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package builtin
+
+// https://xilinx.github.io/XRT/master/html/mgmt-ioctl.main.html
+// https://github.com/Xilinx/XRT/tree/master/src/runtime_src/core/pcie/driver/linux
+const xilinxFpgaSummary = `allows programming and using Xilinx/AMD FPGA accelerator cards`
+
+const xilinxFpgaBaseDeclarationPlugs = `
+  xilinx-fpga:
+    allow-installation: false
+    deny-auto-connection: true
+`
+
+const xilinxFpgaBaseDeclarationSlots = `
+  xilinx-fpga:
+    allow-installation:
+      slot-snap-type:
+        - core
+    deny-auto-connection: true
+`
+
+// Accelerator cards expose a DMA engine handled by the xdma driver, whose
+// rules are shared with xilinx-dma, and a management physical function
+// handled by the xclmgmt driver, the latter is used to load bitstreams and
+// to monitor the card.
+const xilinxFpgaConnectedPlugAppArmor = xilinxDmaConnectedPlugAppArmor + `
+# Access to the management function of the card, used to program it
+/dev/xclmgmt[0-9]* rw,
+
+# View xclmgmt driver module parameters
+/sys/module/xclmgmt/parameters/* r,
+
+# Enumerate the cards and read their management information (sensors,
+# firmware and bitstream status, flash)
+/sys/bus/pci/drivers/{xdma,xclmgmt}/ r,
+/sys/class/{xdma,xrt_mgmt}/ r,
+/sys/devices/pci[0-9a-f]*/**/{icap,xmc,mailbox,sysmon,firewall,rom,flash,clock,mgmt_pf}.*/** r,
+
+# Settings of the management subdevices changed by the management tools
+/sys/devices/pci[0-9a-f]*/**/{icap,xmc}.*/cache_expire_secs w,
+/sys/devices/pci[0-9a-f]*/**/icap.*/sec_level w,
+/sys/devices/pci[0-9a-f]*/**/xmc.*/scaling_enabled w,
+/sys/devices/pci[0-9a-f]*/**/xmc.*/scaling_threshold_{power,temp}_override w,
+/sys/devices/pci[0-9a-f]*/**/firewall.*/clear w,
+`
+
+// The management devices are identified by their kernel name
+var xilinxFpgaConnectedPlugUDev = []string{
+	xilinxDmaUDevRule,
+	`KERNEL=="xclmgmt[0-9]*"`,
+}
+
+func init() {
+	registerIface(&commonInterface{
+		name:                  "xilinx-fpga",
+		summary:               xilinxFpgaSummary,
+		implicitOnCore:        true,
+		implicitOnClassic:     true,
+		baseDeclarationPlugs:  xilinxFpgaBaseDeclarationPlugs,
+		baseDeclarationSlots:  xilinxFpgaBaseDeclarationSlots,
+		connectedPlugAppArmor: xilinxFpgaConnectedPlugAppArmor,
+		connectedPlugUDev:     xilinxFpgaConnectedPlugUDev,
+	})
+}
@@ -0,0 +1,117 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package hotplug
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/strutil"
+)
+
+// Variables provided by interfaces proposing slots for USB serial adapters,
+// which can be used in slot name templates.
+const (
+	// NameVarChip is the family of the adapter chip, eg. ftdi
+	NameVarChip = "chip"
+	// NameVarSerial is the serial number of the adapter, if it has one
+	NameVarSerial = "serial"
+	// NameVarPort is the USB port topology of the adapter, eg. 1-4
+	NameVarPort = "port"
+	// NameVarInterface is the number of the USB interface of the
+	// serial port, for adapters with multiple ports
+	NameVarInterface = "interface"
+)
+
+// USBSerialNameVars lists the variables of slot name templates for USB
+// serial adapters.
+var USBSerialNameVars = []string{NameVarChip, NameVarSerial, NameVarPort, NameVarInterface}
+
+// parseNameTemplate splits a slot name template into literal parts and
+// {variable} references, calling the given functions in order.
+func parseNameTemplate(template string, literal func(string), variable func(string) error) error {
+	for template != "" {
+		start := strings.IndexAny(template, "{}")
+		if start < 0 {
+			literal(template)
+			break
+		}
+		if template[start] == '}' {
+			return fmt.Errorf("unexpected '}' in slot name template")
+		}
+		literal(template[:start])
+		end := strings.IndexAny(template[start+1:], "{}")
+		if end < 0 || template[start+1+end] != '}' {
+			return fmt.Errorf("unclosed '{' in slot name template")
+		}
+		if err := variable(template[start+1 : start+1+end]); err != nil {
+			return err
+		}
+		template = template[start+1+end+1:]
+	}
+	return nil
+}
+
+// ValidateNameTemplate checks that the slot name template only references
+// the given variables and that it can produce a valid slot name.
+func ValidateNameTemplate(template string, vars []string) error {
+	var sample strings.Builder
+	err := parseNameTemplate(template, func(s string) {
+		sample.WriteString(s)
+	}, func(name string) error {
+		if !strutil.ListContains(vars, name) {
+			return fmt.Errorf("unknown variable %q in slot name template, expected one of %s", name, strutil.Quoted(vars))
+		}
+		sample.WriteString("x")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := snap.ValidateSlotName(sample.String()); err != nil {
+		return fmt.Errorf("slot name template %q cannot produce valid slot names", template)
+	}
+	return nil
+}
+
+// ExpandNameTemplate expands the {variable} references of a slot name
+// template with the given values. It is an error if a referenced variable
+// has no value or if the result is not a valid slot name.
+func ExpandNameTemplate(template string, values map[string]string) (string, error) {
+	var name strings.Builder
+	err := parseNameTemplate(template, func(s string) {
+		name.WriteString(s)
+	}, func(v string) error {
+		value := values[v]
+		if value == "" {
+			return fmt.Errorf("no value for variable %q of slot name template %q", v, template)
+		}
+		name.WriteString(value)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := snap.ValidateSlotName(name.String()); err != nil {
+		return "", err
+	}
+	return name.String(), nil
+}
@@ -0,0 +1,77 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package hotplug
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type nameTemplateSuite struct{}
+
+var _ = Suite(&nameTemplateSuite{})
+
+func (s *nameTemplateSuite) TestValidateNameTemplate(c *C) {
+	for _, template := range []string{
+		"rs485",
+		"{port}",
+		"rs485-{port}",
+		"{chip}-{serial}-if{interface}",
+	} {
+		c.Check(ValidateNameTemplate(template, USBSerialNameVars), IsNil, Commentf("template: %s", template))
+	}
+
+	for _, tc := range []struct {
+		template string
+		err      string
+	}{
+		{"rs485-{foo}", `unknown variable "foo" in slot name template, expected one of "chip", "serial", "port", "interface"`},
+		{"rs485-{port", `unclosed '{' in slot name template`},
+		{"rs485-{po{rt}", `unclosed '{' in slot name template`},
+		{"rs485-port}", `unexpected '}' in slot name template`},
+		{"RS485-{port}", `slot name template "RS485-{port}" cannot produce valid slot names`},
+		{"{port}--{serial}", `slot name template "{port}--{serial}" cannot produce valid slot names`},
+		{"", `slot name template "" cannot produce valid slot names`},
+	} {
+		c.Check(ValidateNameTemplate(tc.template, USBSerialNameVars), ErrorMatches, tc.err, Commentf("template: %s", tc.template))
+	}
+}
+
+func (s *nameTemplateSuite) TestExpandNameTemplate(c *C) {
+	values := map[string]string{
+		NameVarChip:      "ftdi",
+		NameVarPort:      "1-4",
+		NameVarInterface: "2",
+	}
+
+	name, err := ExpandNameTemplate("rs485-{port}-{interface}", values)
+	c.Assert(err, IsNil)
+	c.Check(name, Equals, "rs485-1-4-2")
+
+	name, err = ExpandNameTemplate("{chip}", values)
+	c.Assert(err, IsNil)
+	c.Check(name, Equals, "ftdi")
+
+	_, err = ExpandNameTemplate("{chip}-{serial}", values)
+	c.Check(err, ErrorMatches, `no value for variable "serial" of slot name template "{chip}-{serial}"`)
+
+	// the name must be valid
+	_, err = ExpandNameTemplate("{port}", values)
+	c.Check(err, ErrorMatches, `invalid slot name: "1-4"`)
+}
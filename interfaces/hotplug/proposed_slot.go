@@ -49,6 +49,10 @@ type ProposedSlot struct {
 	Name  string                 `json:"name"`
 	Label string                 `json:"label"`
 	Attrs map[string]interface{} `json:"attrs,omitempty"`
+	// NameVars are the values of the variables which can be used in a
+	// slot name template configured for the interface. When a template
+	// is configured, it takes precedence over Name.
+	NameVars map[string]string `json:"name-vars,omitempty"`
 }
 
 // Clean returns a copy of the input slot with normalized attributes and validated slot name (unless its empty).
@@ -65,9 +69,18 @@ func (slot *ProposedSlot) Clean() (*ProposedSlot, error) {
 		attrs = make(map[string]interface{})
 	}
 
+	var nameVars map[string]string
+	if len(slot.NameVars) > 0 {
+		nameVars = make(map[string]string, len(slot.NameVars))
+		for k, v := range slot.NameVars {
+			nameVars[k] = v
+		}
+	}
+
 	return &ProposedSlot{
-		Name:  slot.Name,
-		Label: slot.Label,
-		Attrs: utils.NormalizeInterfaceAttributes(attrs).(map[string]interface{}),
+		Name:     slot.Name,
+		Label:    slot.Label,
+		Attrs:    utils.NormalizeInterfaceAttributes(attrs).(map[string]interface{}),
+		NameVars: nameVars,
 	}, nil
 }
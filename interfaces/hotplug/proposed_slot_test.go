@@ -78,3 +78,12 @@ func (s *proposedSlotSuite) TestInvalidName(c *C) {
 	c.Assert(err, ErrorMatches, `invalid slot name: "slot!"`)
 	c.Assert(slot, IsNil)
 }
+
+func (s *proposedSlotSuite) TestCleanNameVars(c *C) {
+	nameVars := map[string]string{"port": "1-4"}
+	slot := &ProposedSlot{Name: "slot1", NameVars: nameVars}
+	slot, err := slot.Clean()
+	c.Assert(err, IsNil)
+	nameVars["port"] = "modified"
+	c.Assert(slot, DeepEquals, &ProposedSlot{Name: "slot1", Attrs: map[string]interface{}{}, NameVars: map[string]string{"port": "1-4"}})
+}
@@ -909,6 +909,7 @@ func (s *baseDeclSuite) TestPlugInstallation(c *C) {
 		"uinput":                true,
 		"unity8":                true,
 		"xilinx-dma":            true,
+		"xilinx-fpga":           true,
 	}
 
 	for _, iface := range all {
@@ -1160,6 +1161,7 @@ func (s *baseDeclSuite) TestValidity(c *C) {
 		"unity8":                true,
 		"wayland":               true,
 		"xilinx-dma":            true,
+		"xilinx-fpga":           true,
 	}
 
 	for _, iface := range all {
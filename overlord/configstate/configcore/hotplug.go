@@ -0,0 +1,50 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+//go:build !nomanagers
+// +build !nomanagers
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package configcore
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/interfaces/hotplug"
+	"github.com/snapcore/snapd/overlord/configstate/config"
+)
+
+func init() {
+	// add supported configuration of this module
+	supportedConfigurations["core.hotplug.serial-port.name-template"] = true
+}
+
+// validateHotplugSettings checks the slot name template for the hotplug
+// slots of USB serial adapters, it is used when the slots are created.
+func validateHotplugSettings(tr config.Conf) error {
+	template, err := coreCfg(tr, "hotplug.serial-port.name-template")
+	if err != nil {
+		return err
+	}
+	if template == "" {
+		return nil
+	}
+	if err := hotplug.ValidateNameTemplate(template, hotplug.USBSerialNameVars); err != nil {
+		return fmt.Errorf("hotplug.serial-port.name-template is not valid: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2022 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package configcore_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/configstate/configcore"
+)
+
+type hotplugSuite struct {
+	configcoreSuite
+}
+
+var _ = Suite(&hotplugSuite{})
+
+func (s *hotplugSuite) TestConfigureSerialPortNameTemplateHappy(c *C) {
+	err := configcore.Run(classicDev, &mockConf{
+		state: s.state,
+		conf: map[string]interface{}{
+			"hotplug.serial-port.name-template": "rs485-{port}-if{interface}",
+		},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *hotplugSuite) TestConfigureSerialPortNameTemplateInvalid(c *C) {
+	for _, tc := range []struct {
+		template string
+		err      string
+	}{
+		{"rs485-{slot}", `hotplug.serial-port.name-template is not valid: unknown variable "slot" in slot name template, expected one of "chip", "serial", "port", "interface"`},
+		{"rs485-{port", `hotplug.serial-port.name-template is not valid: unclosed '{' in slot name template`},
+		{"RS485", `hotplug.serial-port.name-template is not valid: slot name template "RS485" cannot produce valid slot names`},
+	} {
+		err := configcore.Run(classicDev, &mockConf{
+			state: s.state,
+			conf: map[string]interface{}{
+				"hotplug.serial-port.name-template": tc.template,
+			},
+		})
+		c.Check(err, ErrorMatches, tc.err, Commentf("template: %s", tc.template))
+	}
+}
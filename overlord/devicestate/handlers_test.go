@@ -794,4 +794,14 @@ func (s *preseedingUC20Suite) TestSystemForPreseeding(c *C) {
 	c.Assert(os.MkdirAll(filepath.Join(dirs.SnapSeedDir, "systems", "20210201"), 0755), IsNil)
 	_, err = devicestate.SystemForPreseeding()
 	c.Assert(err, ErrorMatches, `expected a single system for preseeding, found 2`)
+
+	os.Setenv("SNAPD_PRESEED_SYSTEM_LABEL", "20210201")
+	defer os.Unsetenv("SNAPD_PRESEED_SYSTEM_LABEL")
+	systemLabel, err = devicestate.SystemForPreseeding()
+	c.Assert(err, IsNil)
+	c.Check(systemLabel, Equals, "20210201")
+
+	os.Setenv("SNAPD_PRESEED_SYSTEM_LABEL", "20200101")
+	_, err = devicestate.SystemForPreseeding()
+	c.Assert(err, ErrorMatches, `cannot find system "20200101" to preseed`)
 }
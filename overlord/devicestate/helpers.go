@@ -27,6 +27,7 @@ import (
 	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/dirs"
 	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/overlord/auth"
 	"github.com/snapcore/snapd/overlord/devicestate/internal"
 	"github.com/snapcore/snapd/overlord/state"
@@ -52,6 +53,15 @@ func gadgetDataFromInfo(info *snap.Info, model *asserts.Model) (*gadget.GadgetDa
 }
 
 var systemForPreseeding = func() (label string, err error) {
+	// the system may be selected by snap-preseed if the seed has more
+	// than one
+	if label := os.Getenv("SNAPD_PRESEED_SYSTEM_LABEL"); label != "" {
+		if !osutil.IsDirectory(filepath.Join(dirs.SnapSeedDir, "systems", label)) {
+			return "", fmt.Errorf("cannot find system %q to preseed", label)
+		}
+		return label, nil
+	}
+
 	systemLabels, err := filepath.Glob(filepath.Join(dirs.SnapSeedDir, "systems", "*"))
 	if err != nil && !os.IsNotExist(err) {
 		return "", fmt.Errorf("cannot list available systems: %v", err)
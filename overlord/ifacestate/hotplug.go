@@ -185,6 +185,20 @@ InterfacesLoop:
 			continue
 		}
 
+		if len(proposedSlot.NameVars) > 0 {
+			template, err := hotplugNameTemplate(st, iface.Name())
+			if err != nil {
+				logger.Noticef("internal error: cannot get slot name template of interface %q: %v", iface.Name(), err)
+			} else if template != "" {
+				name, err := hotplug.ExpandNameTemplate(template, proposedSlot.NameVars)
+				if err != nil {
+					logger.Noticef("cannot use slot name template of interface %q for device %s: %v", iface.Name(), devinfo, err)
+				} else {
+					proposedSlot.Name = name
+				}
+			}
+		}
+
 		proposedSlot, err = proposedSlot.Clean()
 		if err != nil {
 			logger.Noticef("cannot validate hotplug slot proposed by interface %q for device %s: %v", iface.Name(), devinfo, err.Error())
@@ -333,6 +347,18 @@ func (m *InterfaceManager) hotplugEnabled() (bool, error) {
 	return features.Flag(tr, features.Hotplug)
 }
 
+// hotplugNameTemplate returns the slot name template configured for the
+// hotplug slots of the given interface with the
+// hotplug.<interface>.name-template option, if any.
+func hotplugNameTemplate(st *state.State, ifaceName string) (string, error) {
+	tr := config.NewTransaction(st)
+	var template string
+	if err := tr.Get("core", fmt.Sprintf("hotplug.%s.name-template", ifaceName), &template); err != nil && !config.IsNoOption(err) {
+		return "", err
+	}
+	return template, nil
+}
+
 // ensureUniqueName modifies proposedName so that it's unique according to isUnique predicate.
 // Uniqueness is achieved by appending a numeric suffix.
 func ensureUniqueName(proposedName string, isUnique func(string) bool) string {
@@ -33,6 +33,7 @@ import (
 	"github.com/snapcore/snapd/interfaces/builtin"
 	"github.com/snapcore/snapd/interfaces/hotplug"
 	"github.com/snapcore/snapd/interfaces/ifacetest"
+	"github.com/snapcore/snapd/logger"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/overlord"
 	"github.com/snapcore/snapd/overlord/configstate/config"
@@ -209,12 +210,16 @@ func (s *hotplugSuite) SetUpTest(c *C) {
 			return "key-1", nil
 		},
 		HotplugDeviceDetectedCallback: func(deviceInfo *hotplug.HotplugDeviceInfo) (*hotplug.ProposedSlot, error) {
-			return &hotplug.ProposedSlot{
+			slot := &hotplug.ProposedSlot{
 				Name: "hotplugslot-a",
 				Attrs: map[string]interface{}{
 					"slot-a-attr1": "a",
 					"path":         deviceInfo.DevicePath(),
-				}}, nil
+				}}
+			if port, ok := deviceInfo.Attribute("PORT"); ok {
+				slot.NameVars = map[string]string{"port": port}
+			}
+			return slot, nil
 		},
 	}
 	testIface2 := &ifacetest.TestHotplugInterface{
@@ -332,6 +337,66 @@ func (s *hotplugSuite) TestHotplugAddBasic(c *C) {
 	c.Check(s.handledByGadgetCalled, Equals, 0)
 }
 
+func (s *hotplugSuite) TestHotplugAddWithNameTemplate(c *C) {
+	s.MockModel(c, nil)
+
+	s.state.Lock()
+	tr := config.NewTransaction(s.state)
+	tr.Set("core", "hotplug.test-a.name-template", "port-{port}")
+	tr.Set("core", "hotplug.test-b.name-template", "port-{port}")
+	tr.Commit()
+	s.state.Unlock()
+
+	di, err := hotplug.NewHotplugDeviceInfo(map[string]string{"DEVPATH": "a/path", "ACTION": "add", "SUBSYSTEM": "foo", "PORT": "1-4"})
+	c.Assert(err, IsNil)
+	s.udevMon.AddDevice(di)
+
+	c.Assert(s.o.Settle(5*time.Second), IsNil)
+
+	st := s.state
+	st.Lock()
+	defer st.Unlock()
+
+	// the template is used for the interface which provides name variables
+	repo := s.mgr.Repository()
+	slots := repo.AllSlots("test-a")
+	c.Assert(slots, HasLen, 1)
+	c.Check(slots[0].Name, Equals, "port-1-4")
+	slots = repo.AllSlots("test-b")
+	c.Assert(slots, HasLen, 1)
+	c.Check(slots[0].Name, Equals, "hotplugslot-b")
+}
+
+func (s *hotplugSuite) TestHotplugAddWithNameTemplateError(c *C) {
+	s.MockModel(c, nil)
+
+	s.state.Lock()
+	tr := config.NewTransaction(s.state)
+	tr.Set("core", "hotplug.test-a.name-template", "serial-{serial}")
+	tr.Commit()
+	s.state.Unlock()
+
+	logbuf, restore := logger.MockLogger()
+	defer restore()
+
+	di, err := hotplug.NewHotplugDeviceInfo(map[string]string{"DEVPATH": "a/path", "ACTION": "add", "SUBSYSTEM": "foo", "PORT": "1-4"})
+	c.Assert(err, IsNil)
+	s.udevMon.AddDevice(di)
+
+	c.Assert(s.o.Settle(5*time.Second), IsNil)
+
+	st := s.state
+	st.Lock()
+	defer st.Unlock()
+
+	// the name proposed by the interface is used
+	slots := s.mgr.Repository().AllSlots("test-a")
+	c.Assert(slots, HasLen, 1)
+	c.Check(slots[0].Name, Equals, "hotplugslot-a")
+	c.Check(logbuf.String(), testutil.Contains, `cannot use slot name template of interface "test-a" for device `)
+	c.Check(logbuf.String(), testutil.Contains, `: no value for variable "serial" of slot name template "serial-{serial}"`)
+}
+
 func (s *hotplugSuite) TestHotplugConnectWithGadgetSlot(c *C) {
 	s.MockModel(c, map[string]interface{}{
 		"gadget": "the-gadget",